@@ -73,10 +73,86 @@ addFlag "$TREATMENT_INFO" "treatmentInfo"
 addFlag "$CLUSTER_GRANULARITIES" "clusterGranularities"
 addFlag "$NUMBER_OF_THREADS" "nrOfThreads"
 addFlag "$RR" "RR"
+addFlag "$WASHOUT" "washout"
+addFlag "$EOI_CODES" "eoiCodes"
+addFlag "$EOI_FILE" "eoiFile"
+addFlag "$BURST_WINDOW" "burstWindow"
+addFlag "$MIN_OBSERVATION" "minObservation"
+addFlag "$EXPORT_BUNDLE" "exportBundle"
+addFlag "$MIN_CELL_SIZE" "minCellSize"
+addFlag "$ANCHOR" "anchor"
+addFlag "$EXTRA_CODES" "extraCodes"
+addFlag "$WINDOW_SIZE" "windowSize"
+addFlag "$WINDOW_STEP" "windowStep"
+addFlag "$TUMOR_SITES" "tumorSites"
+addFlag "$CCSR_MODE" "ccsrMode"
+addFlag "$FAIL_ON_UNMAPPED" "failOnUnmapped"
+addFlag "$CENSOR_AFTER_DEATH" "censorAfterDeath"
+addFlag "$BEFORE_YOB" "beforeYOB"
+addFlag "$STRATIFY_BY" "stratifyBy"
+addFlag "$RANK_TRAJECTORIES" "rankTrajectories"
+addFlag "$AGE_GROUP_BOUNDS" "ageGroupBounds"
+addFlag "$COHORT_MODE" "cohortMode"
+addFlag "$STABLE_PIDS" "stablePIDs"
+addFlag "$MIN_MEAN_RR" "minMeanRR"
+addFlag "$ICD_FLAVOR" "icdFlavor"
+addFlag "$PROCEDURE_INFO" "procedureInfo"
+addFlag "$PROCEDURE_CODES" "procedureCodes"
+addFlag "$SEX_STRATIFY" "sexStratify"
+addFlag "$MIN_DIAGNOSES_PER_PATIENT" "minDiagnosesPerPatient"
+addFlag "$CONFIG_FILE" "config"
+addFlag "$DELIMITER" "delimiter"
+addFlag "$LAZY_QUOTES" "lazyQuotes"
+addFlag "$PROGRESS" "progress"
+addFlag "$CHECKPOINT" "checkpoint"
+addFlag "$INCLUDE_DEATH_NODE" "includeDeathNode"
+addFlag "$IVT_EVENTS" "ivtEvents"
+addFlag "$MAX_PARSE_WARNINGS" "maxParseWarnings"
+addFlag "$AUTO_AGE_GROUPS" "autoAgeGroups"
+addFlag "$DATE_RANGE" "dateRange"
+addFlag "$DRY_RUN" "dryRun"
+addFlag "$ADAPTIVE_ITER" "adaptiveIter"
+addFlag "$CONVERGENCE_TOL" "convergenceTol"
+addFlag "$ICD_EXCLUDE_CONFIG" "icdExcludeConfig"
+addFlag "$EOI" "eoi"
+addFlag "$PERMUTATION_TEST" "permutationTest"
+addFlag "$ALPHA" "alpha"
+addFlag "$NOF_RACE_GROUPS" "nofRaceGroups"
+addFlag "$STAGE_AT_EOI" "stageAtEOI"
+addFlag "$STAGE_TOLERANCE" "stageTolerance"
+addFlag "$SAVE_PAR" "savePAR"
+addFlag "$SNOMED_TO_ICD10_FILE" "SNOMEDToICD10File"
+addFlag "$LAB_INFO" "labInfo"
+addFlag "$LOINC_MAP" "loincMap"
+addFlag "$MEDICATION_INFO" "medicationInfo"
+addFlag "$RXNORM_MAP" "rxNormMap"
+addFlag "$MAX_TRAJECTORY_SPAN" "maxTrajectorySpan"
+addFlag "$MMAP_RR" "mmapRR"
+addFlag "$COMPUTE_OR" "computeOR"
+addFlag "$SEED" "seed"
+addFlag "$CLUSTER_METHOD" "clusterMethod"
+addFlag "$CLUSTER_LINKAGE" "clusterLinkage"
+addFlag "$CLUSTER_THRESHOLD" "clusterThreshold"
+addFlag "$CLUSTER_K" "k"
+addFlag "$P_CORRECTION" "pCorrection"
+addFlag "$SAVE_MARKOV" "saveMarkov"
+addFlag "$EFFECT_MEASURE" "effectMeasure"
 
 # Trim the flags
 FLAGS=$(echo "$FLAGS" | sed 's/ *$//g')
 FLAGS=$(echo "$FLAGS" | sed 's/--cluster 1/--cluster/g') # "--cluster" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--rankTrajectories 1/--rankTrajectories/g') # "--rankTrajectories" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--stablePIDs 1/--stablePIDs/g') # "--stablePIDs" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--sexStratify 1/--sexStratify/g') # "--sexStratify" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--lazyQuotes 1/--lazyQuotes/g') # "--lazyQuotes" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--progress 1/--progress/g') # "--progress" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--includeDeathNode 1/--includeDeathNode/g') # "--includeDeathNode" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--ivtEvents 1/--ivtEvents/g') # "--ivtEvents" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--dryRun 1/--dryRun/g') # "--dryRun" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--stageAtEOI 1/--stageAtEOI/g') # "--stageAtEOI" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--computeOR 1/--computeOR/g') # "--computeOR" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--computeOR 0/--computeOR=false/g') # to disable "--computeOR", set it to "0"
+FLAGS=$(echo "$FLAGS" | sed 's/--censorAfterDeath \([^ ]*\)/--censorAfterDeath=\1/g') # boolean flags with a value need "="
 echo "*$FLAGS*"
 cd ..
 
@@ -0,0 +1,434 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"fmt"
+	"ptra/trajectory"
+	"strconv"
+	"strings"
+)
+
+// Built-in filters of --pfilters and --tfilters, cf. RegisterPatientFilter and RegisterTrajectoryFilter.
+
+func init() {
+	registerPatientFilters()
+	registerTrajectoryFilters()
+}
+
+// checkNoFilterArgs returns an error if a filter that takes no arguments is given arguments, e.g. male:x.
+func checkNoFilterArgs(name, args string) error {
+	if args != "" {
+		return fmt.Errorf("invalid filter %q, %s takes no arguments", name+":"+args, name)
+	}
+	return nil
+}
+
+// registerPatientFilters registers the built-in patient filters of --pfilters.
+func registerPatientFilters() {
+	register := func(name string, needs FilterData, filter func(ctx FilterContext) trajectory.PatientFilter) {
+		RegisterPatientFilter(PatientFilterSpec{Name: name, Needs: needs,
+			New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+				if err := checkNoFilterArgs(name, args); err != nil {
+					return nil, err
+				}
+				return filter(ctx), nil
+			}})
+	}
+	// truncatable registers a filter that trims the diagnoses of the remaining patients if it is given :truncate
+	truncatable := func(name string, needs FilterData, filter func(ctx FilterContext,
+		truncate bool) trajectory.PatientFilter) {
+		RegisterPatientFilter(PatientFilterSpec{Name: name, Usage: name + "|" + name + ":truncate", Needs: needs,
+			New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+				if args != "" && args != "truncate" {
+					return nil, fmt.Errorf("invalid filter %q, expected %s or %s:truncate", name+":"+args, name, name)
+				}
+				return filter(ctx, args == "truncate"), nil
+			}})
+	}
+	register("id", 0, func(FilterContext) trajectory.PatientFilter {
+		return func(p *trajectory.Patient) bool { return true }
+	})
+	register("male", 0, func(FilterContext) trajectory.PatientFilter {
+		return trajectory.FemaleFilter() // keep the male patients, i.e. remove the female patients
+	})
+	register("female", 0, func(FilterContext) trajectory.PatientFilter {
+		return trajectory.MaleFilter() // keep the female patients, i.e. remove the male patients
+	})
+	RegisterPatientFilter(PatientFilterSpec{Name: "age", Usage: "ageN+|ageN-|ageN-M", Prefix: true,
+		New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+			return parseAgeFilter("age" + args)
+		}})
+	for _, stage := range []struct {
+		name       string
+		aggregator func(map[string][]*TumorInfo, StageSelection) trajectory.PatientFilter
+	}{
+		{"Ta", TaStageAggregator}, {"Tis", TisStageAggregator}, {"T1", T1StageAggregator},
+		{"T2", T2StageAggregator}, {"T3", T3StageAggregator}, {"T4", T4StageAggregator},
+		{"N0", N0StageAggregator}, {"N1", N1StageAggregator}, {"N2", N2StageAggregator},
+		{"N3", N3StageAggregator}, {"M0", M0StageAggregator}, {"M1", M1StageAggregator},
+		{"NMIBC", NMIBCAggregator}, {"MIBC", MIBCAggregator},
+	} {
+		aggregator := stage.aggregator
+		register(stage.name, 0, func(ctx FilterContext) trajectory.PatientFilter {
+			return aggregator(ctx.TumorInfo, ctx.StageSelection)
+		})
+	}
+	truncatable("NMIBCtoMIBC", 0, func(ctx FilterContext, truncate bool) trajectory.PatientFilter {
+		return ProgressionAggregator(ctx.TumorInfo, truncate)
+	})
+	register("mUC", 0, func(ctx FilterContext) trajectory.PatientFilter {
+		return MUCAggregator(ctx.TumorInfo, ctx.StageSelection)
+	})
+	for _, treatment := range []struct{ name, code string }{{"rc", RadicalCystectomyCode}, {"mvac", MVACCode},
+		{"ivt", IntravesicalTherapyCode}} {
+		code := treatment.code
+		truncatable(treatment.name, TreatmentData, func(ctx FilterContext, truncate bool) trajectory.PatientFilter {
+			return TreatmentFilter(ctx.TreatmentInfo, code, truncate)
+		})
+	}
+	register("noRC", TreatmentData, func(ctx FilterContext) trajectory.PatientFilter {
+		return NoTreatmentFilter(ctx.TreatmentInfo, RadicalCystectomyCode)
+	})
+	RegisterPatientFilter(PatientFilterSpec{Name: "region", Usage: "region:name", Needs: RegionData,
+		New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+			return parseRegionFilter("region:"+args, ctx.RegionIDs)
+		}})
+	register("EOI+", 0, func(FilterContext) trajectory.PatientFilter { return trajectory.EOIBeforeFilter() })
+	register("EOI-", 0, func(FilterContext) trajectory.PatientFilter { return trajectory.EOIAfterFilter() })
+	RegisterPatientFilter(PatientFilterSpec{Name: "EOI", Usage: "EOIn:m", Prefix: true,
+		New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+			n, m, err := parseEOIWindow("EOI" + args)
+			if err != nil {
+				return nil, err
+			}
+			return trajectory.EOIWindowFilter(n, m), nil
+		}})
+	RegisterPatientFilter(PatientFilterSpec{Name: "EOIwindow", Usage: "EOIwindow:before:after",
+		New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+			yearsBefore, yearsAfter, err := parseEOIPeriod("EOIwindow:" + args)
+			if err != nil {
+				return nil, err
+			}
+			return trajectory.EOIPeriodFilter(yearsBefore, yearsAfter), nil
+		}})
+	for _, survival := range []struct{ name, usage string }{{"diedWithin", "diedWithin:years"},
+		{"survived", "survived:years|survived:years:observed"}} {
+		name := survival.name
+		RegisterPatientFilter(PatientFilterSpec{Name: name, Usage: survival.usage,
+			New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+				return parseSurvivalFilter(name + ":" + args)
+			}})
+	}
+	for _, name := range []string{"hasCode", "noCode"} {
+		name := name
+		RegisterPatientFilter(PatientFilterSpec{Name: name, Usage: name + ":ICD10Code",
+			New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+				return parseCodeFilter(name+":"+args, ctx.AnalysisMaps)
+			}})
+	}
+	for _, name := range []string{"cohortFile", "excludeCohortFile"} {
+		exclude := name == "excludeCohortFile"
+		RegisterPatientFilter(PatientFilterSpec{Name: name, Usage: name + ":file",
+			New: func(args string, ctx FilterContext) (trajectory.PatientFilter, error) {
+				cohortList := ParseCohortFile(args, exclude)
+				if ctx.CohortLists != nil {
+					*ctx.CohortLists = append(*ctx.CohortLists, cohortList)
+				}
+				return cohortList.Filter(), nil
+			}})
+	}
+}
+
+// registerTrajectoryFilters registers the built-in trajectory filters of --tfilters.
+func registerTrajectoryFilters() {
+	register := func(name string, filter func(ctx FilterContext) trajectory.TrajectoryFilter) {
+		RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: name,
+			Check: func(args string) error { return checkNoFilterArgs(name, args) },
+			New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+				return filter(ctx), nil
+			}})
+	}
+	register("id", func(FilterContext) trajectory.TrajectoryFilter {
+		return func(t *trajectory.Trajectory) bool { return true }
+	})
+	register("neoplasm", func(ctx FilterContext) trajectory.TrajectoryFilter {
+		return CancerTrajectoryFilter(ctx.Experiment)
+	})
+	register("bc", func(ctx FilterContext) trajectory.TrajectoryFilter {
+		return BladderCancerTrajectoryFilter(ctx.Experiment)
+	})
+	for _, codes := range []struct {
+		name   string
+		filter func(*trajectory.Experiment, []string, AnalysisMaps) (trajectory.TrajectoryFilter, error)
+	}{
+		{"required", ContainsCodeTrajectoryFilter}, {"contains", ContainsCodeTrajectoryFilter},
+		{"excludes", ExcludesCodeTrajectoryFilter},
+	} {
+		filter := codes.filter
+		RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: codes.name, Usage: codes.name + ":codes", ListArgs: true,
+			New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+				return filter(ctx.Experiment, strings.Split(args, ","), ctx.AnalysisMaps)
+			}})
+	}
+	RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: "ccsr", Usage: "ccsr:name",
+		New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+			return CCSRCategoryTrajectoryFilter(args, ctx.Experiment)
+		}})
+	for _, codes := range []struct {
+		name   string
+		filter func(*trajectory.Experiment, []string, AnalysisMaps) (trajectory.TrajectoryFilter, error)
+	}{
+		{"startswith", StartsWithCodeFilter}, {"endswith", EndsWithCodeFilter},
+	} {
+		filter := codes.filter
+		RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: codes.name, Usage: codes.name + ":codes", ListArgs: true,
+			New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+				return filter(ctx.Experiment, strings.Split(args, ","), ctx.AnalysisMaps)
+			}})
+	}
+	for _, count := range []struct {
+		name   string
+		filter func(n int) trajectory.TrajectoryFilter
+	}{
+		{"minFinal", trajectory.MinFinalPatientsFilter}, {"minUnique", trajectory.MinTotalUniquePatientsFilter},
+	} {
+		name, filter := count.name, count.filter
+		RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: name, Usage: name + ":n",
+			Check: func(args string) error {
+				_, err := parseTrajectoryFilterCount(name + ":" + args)
+				return err
+			},
+			New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+				n, err := parseTrajectoryFilterCount(name + ":" + args)
+				if err != nil {
+					return nil, err
+				}
+				return filter(n), nil
+			}})
+	}
+	RegisterTrajectoryFilter(TrajectoryFilterSpec{Name: "minRR", Usage: "minRR:rr",
+		Check: func(args string) error {
+			_, err := parseTrajectoryFilterRR("minRR:" + args)
+			return err
+		},
+		New: func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error) {
+			rr, err := parseTrajectoryFilterRR("minRR:" + args)
+			if err != nil {
+				return nil, err
+			}
+			return trajectory.MinTransitionRRFilter(ctx.Experiment, rr), nil
+		}})
+}
+
+// parseAgeFilter parses an age filter of the form ageN+ for the patients above age N, ageN- for the patients below age
+// N, or ageN-M for the diagnoses recorded between ages N and M, e.g. age80+, age55-, or age40-60.
+func parseAgeFilter(s string) (trajectory.PatientFilter, error) {
+	invalid := fmt.Errorf("invalid age filter %q, expected ageN+, ageN-, or ageN-M with ages N < M, "+
+		"e.g. age80+, age55-, or age40-60", s)
+	parseAge := func(age string) (int, bool) {
+		n, err := strconv.Atoi(age)
+		return n, err == nil && n >= 0 && !strings.HasPrefix(age, "+")
+	}
+	bounds := strings.TrimPrefix(s, "age")
+	if strings.HasSuffix(bounds, "+") {
+		if n, ok := parseAge(strings.TrimSuffix(bounds, "+")); ok {
+			return trajectory.AboveAgeAggregator(n), nil
+		}
+		return nil, invalid
+	}
+	if strings.HasSuffix(bounds, "-") {
+		if n, ok := parseAge(strings.TrimSuffix(bounds, "-")); ok {
+			return trajectory.LessThanAgeAggregator(n), nil
+		}
+		return nil, invalid
+	}
+	band := strings.Split(bounds, "-")
+	if len(band) != 2 {
+		return nil, invalid
+	}
+	n, ok1 := parseAge(band[0])
+	m, ok2 := parseAge(band[1])
+	if !ok1 || !ok2 || n >= m {
+		return nil, invalid
+	}
+	return trajectory.AgeBandAggregator(n, m), nil
+}
+
+// parseEOIWindow parses an event of interest window filter of the form EOIn:m, e.g. EOI1:2 for the diagnoses between
+// the first and second event of interest. n or m may be omitted, e.g. EOI2: for the diagnoses from the second event of
+// interest on.
+func parseEOIWindow(s string) (int, int, error) {
+	invalid := fmt.Errorf("invalid EOI window %q, expected EOIn:m with event of interest numbers >= 1, "+
+		"e.g. EOI1:2 or EOI2:", s)
+	bounds := strings.Split(strings.TrimPrefix(s, "EOI"), ":")
+	if len(bounds) != 2 {
+		return 0, 0, invalid
+	}
+	result := []int{0, 0}
+	for i, bound := range bounds {
+		if bound == "" {
+			continue
+		}
+		b, err := strconv.Atoi(bound)
+		if err != nil || b < 1 {
+			return 0, 0, invalid
+		}
+		result[i] = b
+	}
+	return result[0], result[1], nil
+}
+
+// parseEOIPeriod parses a filter of the form EOIwindow:yearsBefore:yearsAfter for the diagnoses from yearsBefore years
+// before through yearsAfter years after the event of interest, e.g. EOIwindow:5:2.
+func parseEOIPeriod(s string) (float64, float64, error) {
+	bounds := strings.Split(strings.TrimPrefix(s, "EOIwindow:"), ":")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid EOI window, expected EOIwindow:yearsBefore:yearsAfter: %s", s)
+	}
+	years := []float64{0, 0}
+	for i, bound := range bounds {
+		y, err := strconv.ParseFloat(bound, 64)
+		if err != nil || y < 0 {
+			return 0, 0, fmt.Errorf("invalid EOI window, expected non-negative years: %s", s)
+		}
+		years[i] = y
+	}
+	return years[0], years[1], nil
+}
+
+// parseSurvivalFilter parses a filter of the form diedWithin:years for the patients who died within a number of years
+// of the event of interest, or survived:years for the patients who survived at least that long. The patients without a
+// date of death are survivors, unless the filter has the form survived:years:observed, which requires them to have a
+// diagnosis at least that long after the event of interest.
+func parseSurvivalFilter(s string) (trajectory.PatientFilter, error) {
+	args := strings.Split(s, ":")
+	observed := len(args) == 3 && args[0] == "survived" && args[2] == "observed"
+	if len(args) != 2 && !observed {
+		return nil, fmt.Errorf("invalid survival filter, expected diedWithin:years, survived:years or "+
+			"survived:years:observed: %s", s)
+	}
+	years, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || years < 0 {
+		return nil, fmt.Errorf("invalid survival filter, expected non-negative years: %s", s)
+	}
+	switch {
+	case args[0] == "diedWithin":
+		return trajectory.DiedWithinYearsOfEOI(years), nil
+	case observed:
+		return trajectory.ObservedSurvivalAfterEOI(years), nil
+	default:
+		return trajectory.SurvivedAtLeastYearsAfterEOI(years), nil
+	}
+}
+
+// parseCodeFilter parses a filter of the form hasCode:ICD10Code for the patients diagnosed with an ICD10 code, or
+// noCode:ICD10Code for the patients never diagnosed with it, e.g. hasCode:E11. The code is resolved with the analysis
+// maps, cf. HasCodeFilter.
+func parseCodeFilter(s string, analysisMaps AnalysisMaps) (trajectory.PatientFilter, error) {
+	args := strings.Split(s, ":")
+	if len(args) != 2 || args[1] == "" {
+		return nil, fmt.Errorf("invalid code filter, expected hasCode:ICD10Code or noCode:ICD10Code: %s", s)
+	}
+	if analysisMaps == nil || len(analysisMaps.GetDIDs(args[1])) == 0 {
+		return nil, fmt.Errorf("unknown ICD10 code in code filter: %s", s)
+	}
+	if args[0] == "noCode" {
+		return HasNoCodeFilter(analysisMaps, args[1]), nil
+	}
+	return HasCodeFilter(analysisMaps, args[1]), nil
+}
+
+// parseRegionFilter parses a region filter of the form region:name, e.g. region:Northeast. It returns an error if the
+// region does not occur in the patient file, cf. ParseTriNetXRegions.
+func parseRegionFilter(s string, regionIDs map[string]int) (trajectory.PatientFilter, error) {
+	regionName := strings.TrimPrefix(s, "region:")
+	if _, ok := regionIDs[regionName]; !ok {
+		return nil, fmt.Errorf("unknown region %q in patient filter %q, the patients are of the regions: %s",
+			regionName, s, strings.Join(RegionNames(regionIDs), ", "))
+	}
+	return RegionNameFilter(regionName, regionIDs), nil
+}
+
+// RegionNames returns the names of the regions, ordered by region ID.
+func RegionNames(regionIDs map[string]int) []string {
+	names := make([]string, len(regionIDs))
+	for name, id := range regionIDs {
+		names[id] = name
+	}
+	return names
+}
+
+// parseTrajectoryFilterCount parses the number of patients of a trajectory filter of the form minFinal:n or
+// minUnique:n.
+func parseTrajectoryFilterCount(s string) (int, error) {
+	n, err := strconv.Atoi(s[strings.Index(s, ":")+1:])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid trajectory filter %q, expected a number of patients >= 0, e.g. minFinal:200", s)
+	}
+	return n, nil
+}
+
+// parseTrajectoryFilterRR parses the RR score of a trajectory filter of the form minRR:rr.
+func parseTrajectoryFilterRR(s string) (float64, error) {
+	rr, err := strconv.ParseFloat(strings.TrimPrefix(s, "minRR:"), 64)
+	if err != nil || rr < 0 {
+		return 0, fmt.Errorf("invalid trajectory filter %q, expected an RR score >= 0, e.g. minRR:2.0", s)
+	}
+	return rr, nil
+}
+
+// ParseCohortFileFilters splits the cohort file filters cohortFile:file and excludeCohortFile:file off the top-level
+// comma-separated list of a patient filter expression, so that they can be applied before the other filters. It
+// returns the parsed cohort lists and the remaining patient filter expression. Cohort file filters that are combined
+// with AND, OR, or NOT, or occur between parentheses, remain part of the expression.
+func ParseCohortFileFilters(f string) ([]*CohortList, string) {
+	cohortLists := []*CohortList{}
+	rest := []string{}
+	depth, start := 0, 0
+	for i := 0; i <= len(f); i++ {
+		if i < len(f) {
+			switch f[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if f[i] != ',' || depth > 0 {
+				continue
+			}
+		}
+		item := strings.TrimSpace(f[start:i])
+		start = i + 1
+		switch {
+		case strings.ContainsAny(item, " \t()"):
+			rest = append(rest, item)
+		case strings.HasPrefix(item, "cohortFile:"):
+			cohortLists = append(cohortLists, ParseCohortFile(strings.TrimPrefix(item, "cohortFile:"), false))
+		case strings.HasPrefix(item, "excludeCohortFile:"):
+			cohortLists = append(cohortLists, ParseCohortFile(strings.TrimPrefix(item, "excludeCohortFile:"), true))
+		default:
+			rest = append(rest, item)
+		}
+	}
+	if len(rest) == 0 {
+		rest = append(rest, "id")
+	}
+	return cohortLists, strings.Join(rest, ",")
+}
@@ -0,0 +1,309 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Reproducibility bundles.
+//A bundle is a tar.gz file with everything needed to reproduce the figures of a run, which can be deposited with a
+//publication. To make the bundle shareable, it never contains patient identifiers: all files are aggregated at the
+//level of diagnoses, pairs, trajectories, or clusters. Patient counts below the minimum cell size are suppressed and
+//reported as -1.
+
+// BundleIndexFile is the name of the index file in a bundle. Each line of the index lists a file in the bundle, its
+// size in bytes, and its sha256 checksum, separated by tabs.
+const BundleIndexFile = "index.tsv"
+
+// bundleFiles are the files that make up a bundle, in the order in which they are written.
+var bundleFiles = []string{
+	"manifest.txt",
+	"dictionary.tab",
+	"pairs.tab",
+	"trajectories.json",
+	"clusters.csv",
+	"cluster-metrics.tab",
+	"RR.tab",
+}
+
+// suppressCount returns the count, or -1 if the count is below the minimum cell size.
+func suppressCount(count, minCellSize int) int {
+	if count < minCellSize {
+		return -1
+	}
+	return count
+}
+
+// createBundleFile creates a file in the bundle directory and passes it to the write function.
+func createBundleFile(dir, name string, write func(w io.Writer) error) error {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeBundleManifest writes the command line and version that produced the run.
+func writeBundleManifest(w io.Writer, exp *trajectory.Experiment, command, version string, minCellSize int) error {
+	_, err := fmt.Fprintf(w, "Name:\t%s\nVersion:\t%s\nCreated:\t%s\nCommand:\t%s\nMinimum cell size:\t%d\n"+
+		"Patient funnel:\tnot available, ptra does not report patient attrition\n",
+		exp.Name, version, time.Now().UTC().Format(time.RFC3339), command, minCellSize)
+	return err
+}
+
+// writeBundleDictionary writes the analysis DIDs with their original diagnostic ID and medical name.
+func writeBundleDictionary(w io.Writer, exp *trajectory.Experiment) error {
+	dids := []int{}
+	for did := range exp.NameMap {
+		dids = append(dids, did)
+	}
+	sort.Ints(dids)
+	fmt.Fprintf(w, "DID\tCode\tName\n")
+	for _, did := range dids {
+		if _, err := fmt.Fprintf(w, "%d\t%s\t%s\n", did, exp.IdMap[did], exp.NameMap[did]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBundlePairs writes the selected diagnosis pairs with their RR, or OR, cf. trajectory.EffectMeasureOR, RD, and
+// number of patients.
+func writeBundlePairs(w io.Writer, exp *trajectory.Experiment, minCellSize int) error {
+	fmt.Fprintf(w, "D1\tD2\t%s\tRD\tPatients\n", trajectory.EffectMeasureName(exp))
+	for _, pair := range exp.Pairs {
+		n := suppressCount(len(exp.DxDPatients[pair.First][pair.Second]), minCellSize)
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", exp.NameMap[pair.First], exp.NameMap[pair.Second],
+			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64),
+			strconv.FormatFloat(trajectory.RiskDifference(exp, pair.First, pair.Second), 'E', -1, 64), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleTrajectory is the JSON representation of a trajectory in a bundle.
+type bundleTrajectory struct {
+	ID              int
+	Cluster         int
+	Diagnoses       []string
+	PatientNumbers  []int
+	TransitionTimes []*trajectory.TransitionTimeStats `json:",omitempty"` // nil for suppressed transitions
+}
+
+// writeBundleTrajectories writes the trajectories as JSON.
+func writeBundleTrajectories(w io.Writer, exp *trajectory.Experiment, minCellSize int) error {
+	trajectories := []bundleTrajectory{}
+	for _, t := range exp.Trajectories {
+		bt := bundleTrajectory{ID: t.ID, Cluster: t.Cluster}
+		for _, d := range t.Diagnoses {
+			bt.Diagnoses = append(bt.Diagnoses, exp.NameMap[d])
+		}
+		for _, n := range t.PatientNumbers {
+			bt.PatientNumbers = append(bt.PatientNumbers, suppressCount(n, minCellSize))
+		}
+		for i := range t.TransitionTimes {
+			if i < len(t.PatientNumbers) && suppressCount(t.PatientNumbers[i], minCellSize) != -1 {
+				bt.TransitionTimes = append(bt.TransitionTimes, &t.TransitionTimes[i])
+			} else {
+				bt.TransitionTimes = append(bt.TransitionTimes, nil)
+			}
+		}
+		trajectories = append(trajectories, bt)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(trajectories)
+}
+
+// writeBundleClusters writes the cluster assignment of each trajectory.
+func writeBundleClusters(w io.Writer, exp *trajectory.Experiment) error {
+	fmt.Fprintf(w, "TID,CID\n")
+	for _, t := range exp.Trajectories {
+		if _, err := fmt.Fprintf(w, "%d,%d\n", t.ID, t.Cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBundleClusterMetrics writes the metrics of each cluster, cf. MetricsFromTrajectories.
+func writeBundleClusterMetrics(w io.Writer, exp *trajectory.Experiment, minCellSize int) error {
+	clusters := map[int][]*trajectory.Trajectory{}
+	cids := []int{}
+	for _, t := range exp.Trajectories {
+		if _, ok := clusters[t.Cluster]; !ok {
+			cids = append(cids, t.Cluster)
+		}
+		clusters[t.Cluster] = append(clusters[t.Cluster], t)
+	}
+	sort.Ints(cids)
+	fmt.Fprintf(w, "CID\tTrajectories\tMean Age\tStdev\tMean Age EOI\tStdev\tMales\tFemales\tMedian Age\tIQR\t"+
+		"Median Age EOI\tIQR\n")
+	for _, cid := range cids {
+		ageMean, stdev, ageEOIMean, stdev2, mCtr, fCtr, ageMedian, iqr, ageEOIMedian, iqr2 :=
+			trajectory.MetricsFromTrajectories(clusters[cid])
+		if _, err := fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", cid, len(clusters[cid]),
+			strconv.FormatFloat(ageMean, 'f', 2, 64), strconv.FormatFloat(stdev, 'f', 2, 64),
+			strconv.FormatFloat(ageEOIMean, 'f', 2, 64), strconv.FormatFloat(stdev2, 'f', 2, 64),
+			suppressCount(mCtr, minCellSize), suppressCount(fCtr, minCellSize),
+			strconv.FormatFloat(ageMedian, 'f', 2, 64), strconv.FormatFloat(iqr, 'f', 2, 64),
+			strconv.FormatFloat(ageEOIMedian, 'f', 2, 64), strconv.FormatFloat(iqr2, 'f', 2, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBundleRR writes the non-zero entries of the RR matrix.
+func writeBundleRR(w io.Writer, exp *trajectory.Experiment) error {
+	for i, js := range exp.DxDRR {
+		for j, RR := range js {
+			if RR == 0 {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", exp.NameMap[i], exp.NameMap[j],
+				strconv.FormatFloat(RR, 'E', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumFile computes the sha256 checksum of a file.
+func checksumFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addFileToTar adds a file from the given directory to a tar archive.
+func addFileToTar(tw *tar.Writer, dir, name string) error {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// ExportBundle writes a reproducibility bundle for an experiment to a tar.gz file. The command and version are
+// recorded in the manifest of the bundle. Patient counts below minCellSize are suppressed. The bundle contains an index
+// file that lists the size and checksum of every other file in the bundle.
+func ExportBundle(exp *trajectory.Experiment, bundleFile, command, version string, minCellSize int) error {
+	dir, err := ioutil.TempDir("", "ptra-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	writers := map[string]func(w io.Writer) error{
+		"manifest.txt": func(w io.Writer) error {
+			return writeBundleManifest(w, exp, command, version, minCellSize)
+		},
+		"dictionary.tab":      func(w io.Writer) error { return writeBundleDictionary(w, exp) },
+		"pairs.tab":           func(w io.Writer) error { return writeBundlePairs(w, exp, minCellSize) },
+		"trajectories.json":   func(w io.Writer) error { return writeBundleTrajectories(w, exp, minCellSize) },
+		"clusters.csv":        func(w io.Writer) error { return writeBundleClusters(w, exp) },
+		"cluster-metrics.tab": func(w io.Writer) error { return writeBundleClusterMetrics(w, exp, minCellSize) },
+		"RR.tab":              func(w io.Writer) error { return writeBundleRR(w, exp) },
+	}
+	for _, name := range bundleFiles {
+		if err := createBundleFile(dir, name, writers[name]); err != nil {
+			return fmt.Errorf("writing %s to bundle failed: %w", name, err)
+		}
+	}
+	// verify the files and checksum them into the index
+	err = createBundleFile(dir, BundleIndexFile, func(w io.Writer) error {
+		for _, name := range bundleFiles {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("bundle file %s is missing: %w", name, err)
+			}
+			checksum, err := checksumFile(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%d\t%s\n", name, info.Size(), checksum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+	for _, name := range append([]string{BundleIndexFile}, bundleFiles...) {
+		if err := addFileToTar(tw, dir, name); err != nil {
+			return fmt.Errorf("adding %s to bundle failed: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,217 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"ptra/trajectory"
+	"strings"
+)
+
+//Coded events.
+//Events from the TriNetX tables with coded events, e.g. lab results coded in LOINC from the lab_result table, or drug
+//exposures coded in RxNorm from the medication tables, can be added to the analysis as trajectory events. A mapping
+//file maps the codes onto pseudo ICD10 codes, which are registered in the analysis maps as extra codes.
+
+// CodedEventTable describes a TriNetX table with coded events: the code systems of the events that are added, and the
+// columns of the code system, the code, and the date of the events.
+type CodedEventTable struct {
+	Name             string   // name of the events, e.g. lab result
+	MapHeader        string   // first field of the optional header line of the mapping files, e.g. loinc
+	CodeSystems      []string // accepted code systems, matched as prefixes, e.g. LOINC
+	CodeSystemColumn int
+	CodeColumn       int
+	DateColumn       int
+}
+
+// LabResultTable is the TriNetX lab_result table with lab results coded in LOINC. The header is omitted from the
+// TriNetX file, but it should be: patient_id, encounter_id, code_system, code, date, lab_result_num_val,
+// lab_result_text_val, units_of_measure, derived_by_TriNetX, source_id
+var LabResultTable = CodedEventTable{Name: "lab result", MapHeader: "loinc", CodeSystems: []string{"LOINC"},
+	CodeSystemColumn: 2, CodeColumn: 3, DateColumn: 4}
+
+// MedicationTable is the TriNetX medication_ingredient or medication_drug table with drug exposures coded in RxNorm.
+// The header is omitted from the TriNetX file, but it should be: patient_id, encounter_id, unique_id, code_system,
+// code, start_date, ..., derived_by_TriNetX, source_id
+var MedicationTable = CodedEventTable{Name: "medication", MapHeader: "rxnorm", CodeSystems: []string{"RXNORM"},
+	CodeSystemColumn: 3, CodeColumn: 4, DateColumn: 5}
+
+// isCodeSystem checks if a TriNetX code system is one of the code systems of a table with coded events.
+func (table CodedEventTable) isCodeSystem(codeSystem string) bool {
+	codeSystem = strings.ToUpper(codeSystem)
+	for _, cs := range table.CodeSystems {
+		if strings.HasPrefix(codeSystem, cs) {
+			return true
+		}
+	}
+	return false
+}
+
+// CodeMapping maps a code of a table with coded events, e.g. a LOINC or RxNorm code, onto a pseudo ICD10 code.
+type CodeMapping struct {
+	Source      string // code in the table, e.g. 4548-4 for hemoglobin A1c
+	Code        string // pseudo ICD10 code, e.g. LAB01
+	Description string // medical name
+}
+
+// ParseCodeMapFile parses a csv file that maps the codes of a table with coded events onto pseudo ICD10 codes. Each
+// line has the form: code, pseudo code, description. Several lines may map onto the same pseudo code, e.g. to group
+// the LOINC codes of the same lab test. An optional header line starting with the MapHeader of the table is skipped.
+// It returns an error for lines with fewer than 3 fields.
+func (table CodedEventTable) ParseCodeMapFile(config *ParseConfig, fileName string) ([]CodeMapping, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := config.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	mappings := []CodeMapping{}
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], table.MapHeader) {
+			continue // skip header
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s line %d: expected %s code, code, description, got %q", fileName, i+1,
+				table.MapHeader, strings.Join(record, ","))
+		}
+		mappings = append(mappings, CodeMapping{Source: strings.TrimSpace(record[0]), Code: record[1],
+			Description: record[2]})
+	}
+	return mappings, nil
+}
+
+// CodeMappingExtraCodes returns the pseudo ICD10 codes of code mappings as extra codes, so that they can be registered
+// in the analysis maps. Each pseudo code occurs once, with the description of its first mapping.
+func CodeMappingExtraCodes(mappings []CodeMapping) []ExtraCode {
+	extraCodes := []ExtraCode{}
+	seen := map[string]bool{}
+	for _, m := range mappings {
+		if !seen[m.Code] {
+			seen[m.Code] = true
+			extraCodes = append(extraCodes, ExtraCode{Code: m.Code, Description: m.Description, Column: -1})
+		}
+	}
+	return extraCodes
+}
+
+// CodeMappingAnalysisMap maps the source codes of code mappings onto the analysis DIDs of their pseudo ICD10 codes.
+// The pseudo codes must be registered in the analysis maps, cf. CodeMappingExtraCodes. Source codes whose pseudo code
+// is not registered are left out.
+func CodeMappingAnalysisMap(mappings []CodeMapping, analysisMaps AnalysisMaps) map[string]int {
+	codeToAnalysisMap := map[string]int{}
+	for _, m := range mappings {
+		if dids := analysisMaps.GetDIDs(m.Code); len(dids) > 0 {
+			codeToAnalysisMap[m.Source] = dids[0]
+		}
+	}
+	return codeToAnalysisMap
+}
+
+// ParseTriNetXData adds the events of a TriNetX file of a table with coded events to the patients as diagnoses. The
+// codes are mapped onto analysis DIDs with the codeToAnalysisMap, cf. CodeMappingAnalysisMap. Events with another code
+// system, unmapped codes, invalid dates, or unknown patients are skipped, and an event of the same code observed
+// several times on the same date is added once. It returns the number of added diagnoses. The diagnoses are appended,
+// so the patients' diagnoses must be sorted afterwards, cf. trajectory.SortDiagnoses.
+func (table CodedEventTable) ParseTriNetXData(config *ParseConfig, fileName string, codeToAnalysisMap map[string]int,
+	patients *trajectory.PatientMap) int {
+	file, err := os.Open(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	type event struct {
+		PID, DID int
+		Date     trajectory.DiagnosisDate
+	}
+	added := map[event]bool{}
+	reader := config.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		if len(record) <= table.CodeSystemColumn || len(record) <= table.CodeColumn ||
+			len(record) <= table.DateColumn || !table.isCodeSystem(record[table.CodeSystemColumn]) ||
+			len(record[table.DateColumn]) != 10 {
+			continue
+		}
+		did, ok := codeToAnalysisMap[strings.TrimSpace(record[table.CodeColumn])]
+		if !ok {
+			continue
+		}
+		patient, ok := trajectory.GetPatient(record[0], patients)
+		if !ok {
+			continue
+		}
+		e := event{PID: patient.PID, DID: did, Date: parseTriNetXDiagnosisDate(record[table.DateColumn])}
+		if added[e] {
+			continue
+		}
+		added[e] = true
+		trajectory.AddDiagnosis(patient, &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: e.Date})
+	}
+	return len(added)
+}
+
+// CodedEventInjector is a diagnosis processor that adds the events of patients from a TriNetX file of a table with
+// coded events as diagnoses, using the pseudo ICD10 codes the codes are mapped onto.
+type CodedEventInjector struct {
+	Config            *ParseConfig
+	Table             CodedEventTable
+	File              string
+	CodeToAnalysisMap map[string]int
+	Ctr               int // the nr of events added
+}
+
+// NewCodedEventInjector creates a diagnosis processor that adds the events from a TriNetX file of a table with coded
+// events as diagnoses. The pseudo codes of the code mappings must be registered in the analysis maps, cf.
+// CodeMappingExtraCodes.
+func NewCodedEventInjector(config *ParseConfig, table CodedEventTable, mappings []CodeMapping, file string,
+	analysisMaps AnalysisMaps) *CodedEventInjector {
+	return &CodedEventInjector{Config: config, Table: table, File: file,
+		CodeToAnalysisMap: CodeMappingAnalysisMap(mappings, analysisMaps)}
+}
+
+func (ci *CodedEventInjector) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string,
+	date trajectory.DiagnosisDate) {
+}
+
+func (ci *CodedEventInjector) Finish(patients *trajectory.PatientMap) {
+	ci.Ctr = ci.Table.ParseTriNetXData(ci.Config, ci.File, ci.CodeToAnalysisMap, patients)
+	fmt.Println("Added ", ci.Ctr, " ", ci.Table.Name, " events.")
+}
@@ -0,0 +1,240 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Extra codes.
+//Events that are not ICD10 diagnoses, such as treatments, can be added to the analysis as extra codes. Each extra code
+//is a pseudo ICD10 code with a medical name, that is registered in the analysis maps like any other ICD10 code. The
+//dates of the events come from a column of the TriNetX treatment file, or from a separate event csv file.
+
+// ExtraCode defines a pseudo ICD10 code for events that are not ICD10 diagnoses, e.g. treatments, so that they can be
+// used as diagnoses to build trajectories.
+type ExtraCode struct {
+	Code        string `json:"code"`        // pseudo ICD10 code, e.g. C98
+	Description string `json:"description"` // medical name
+	Column      int    `json:"column"`      // column with the event dates in the treatment file, or -1
+	EventFile   string `json:"eventFile"`   // csv file with lines: patient id, event date; used if Column is -1
+}
+
+// DefaultExtraCodes are the extra codes for bladder cancer treatments from the TriNetX treatment file: radical
+// cystectomy, MVAC chemotherapy, and intravesical therapy. Only the radical cystectomies and MVAC chemotherapies are
+// added as diagnoses. Intravesical therapy is registered in the analysis maps, but its events are only added with
+// IntravesicalTherapyEvents, because adding them changes the diagnoses, and hence the cohorts and trajectories, of the
+// patients with intravesical therapy.
+var DefaultExtraCodes = []ExtraCode{
+	{Code: RadicalCystectomyCode, Description: "Radical cystectomy (bladder cancer)", Column: 10},
+	{Code: MVACCode, Description: "MVAC Chemotherapy (bladder cancer)", Column: 11},
+	{Code: IntravesicalTherapyCode, Description: "Intravesical therapy (bladder cancer)", Column: -1},
+}
+
+// intravesicalTherapyColumn is the column with the intravesical therapy dates in the TriNetX treatment file.
+const intravesicalTherapyColumn = 13
+
+// The pseudo ICD10 codes of the bladder cancer treatments in DefaultExtraCodes.
+const (
+	RadicalCystectomyCode   = "C98"
+	MVACCode                = "C99"
+	IntravesicalTherapyCode = "C100"
+)
+
+// IntravesicalTherapyEvents returns a copy of the extra codes in which the intravesical therapy code, cf.
+// IntravesicalTherapyCode, takes its events from the intravesical therapy column of the TriNetX treatment file, so
+// that intravesical therapies are added as diagnoses.
+func IntravesicalTherapyEvents(extraCodes []ExtraCode) []ExtraCode {
+	result := make([]ExtraCode, len(extraCodes))
+	copy(result, extraCodes)
+	for i := range result {
+		if result[i].Code == IntravesicalTherapyCode {
+			result[i].Column = intravesicalTherapyColumn
+			result[i].EventFile = ""
+		}
+	}
+	return result
+}
+
+// ParseExtraCodesFile parses a file with extra code definitions. A .json file contains a list of objects with the fields
+// code, description, column, and eventFile. Any other file is a csv file with lines: code, description, source. The
+// source is either a column index in the treatment file, or the name of an event csv file. An optional header line
+// starting with "code" is skipped. Relative event file names are resolved from the directory of the definition file.
+func ParseExtraCodesFile(config *ParseConfig, fileName string) []ExtraCode {
+	extraCodes := []ExtraCode{}
+	if strings.HasSuffix(strings.ToLower(fileName), ".json") {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			panic(err)
+		}
+		if err := json.Unmarshal(data, &extraCodes); err != nil {
+			panic(err)
+		}
+		for i := range extraCodes {
+			if extraCodes[i].EventFile != "" {
+				extraCodes[i].Column = -1
+			}
+		}
+	} else {
+		file, err := os.Open(fileName)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		records, err := config.newCSVReader(file).ReadAll()
+		if err != nil {
+			panic(err)
+		}
+		for i, record := range records {
+			if i == 0 && strings.EqualFold(record[0], "code") {
+				continue // skip header
+			}
+			extraCode := ExtraCode{Code: record[0], Description: record[1], Column: -1}
+			if column, err := strconv.Atoi(record[2]); err == nil {
+				extraCode.Column = column
+			} else {
+				extraCode.EventFile = record[2]
+			}
+			extraCodes = append(extraCodes, extraCode)
+		}
+	}
+	for i := range extraCodes {
+		if extraCodes[i].EventFile != "" && !filepath.IsAbs(extraCodes[i].EventFile) {
+			extraCodes[i].EventFile = filepath.Join(filepath.Dir(fileName), extraCodes[i].EventFile)
+		}
+	}
+	return extraCodes
+}
+
+// addExtraCodeEvent adds an event for an extra code to the treatment info of a patient.
+func addExtraCodeEvent(result map[string]TreatmentInfo, PIDString, code, date string) {
+	if len(date) != 10 { // no valid date
+		return
+	}
+	info, ok := result[PIDString]
+	if !ok {
+		info = TreatmentInfo{}
+		result[PIDString] = info
+	}
+	info[code] = append(info[code], parseTriNetXDiagnosisDate(date))
+}
+
+// parseExtraCodeEvents collects the events for the extra codes from the treatment file and the event files. It returns a
+// map from PID -> TreatmentInfo. Extra codes that refer to a column of the treatment file are skipped if no treatment
+// file is given.
+func parseExtraCodeEvents(config *ParseConfig, extraCodes []ExtraCode,
+	treatmentInfoFile string) map[string]TreatmentInfo {
+	result := map[string]TreatmentInfo{}
+	forEachRecord := func(fileName string, f func(record []string)) {
+		file, err := os.Open(fileName)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		reader := config.newCSVReader(file)
+		reader.FieldsPerRecord = -1
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			f(record)
+		}
+	}
+	if treatmentInfoFile != "" {
+		forEachRecord(treatmentInfoFile, func(record []string) {
+			for _, extraCode := range extraCodes {
+				if extraCode.Column >= 0 && extraCode.Column < len(record) {
+					addExtraCodeEvent(result, record[0], extraCode.Code, record[extraCode.Column])
+				}
+			}
+		})
+	}
+	for _, extraCode := range extraCodes {
+		if extraCode.Column < 0 && extraCode.EventFile != "" {
+			code := extraCode.Code
+			forEachRecord(extraCode.EventFile, func(record []string) {
+				if len(record) >= 2 {
+					addExtraCodeEvent(result, record[0], code, record[1])
+				}
+			})
+		}
+	}
+	return result
+}
+
+// ParseTriNetXTreatmentFile parses the bladder cancer treatments of the default extra codes from a TriNetX treatment
+// file, including intravesical therapy, cf. DefaultExtraCodes and IntravesicalTherapyEvents. It returns a map from
+// PID -> TreatmentInfo, e.g. for the treatment patient filters, cf. TreatmentFilter.
+func ParseTriNetXTreatmentFile(config *ParseConfig, treatmentInfoFile string) map[string]TreatmentInfo {
+	return parseExtraCodeEvents(config, IntravesicalTherapyEvents(DefaultExtraCodes), treatmentInfoFile)
+}
+
+// HasExtraCodeEvents checks if there are events to collect for the extra codes, given a treatment file.
+func HasExtraCodeEvents(extraCodes []ExtraCode, treatmentInfoFile string) bool {
+	for _, extraCode := range extraCodes {
+		if (extraCode.Column >= 0 && treatmentInfoFile != "") || (extraCode.Column < 0 && extraCode.EventFile != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// fillInExtraCodeDiagnoses adds the events of a patient as diagnoses, using getDIDs to look up the analysis DIDs of
+// the extra codes. It returns 1 if diagnoses were added for the patient, 0 otherwise. The codes are added in sorted
+// order, so that the resulting diagnoses do not depend on the iteration order of the map.
+func fillInExtraCodeDiagnoses(patient *trajectory.Patient, infoMap map[string]TreatmentInfo, getDIDs func(code string) []int) int {
+	nonIcd := 0
+	if info, ok := infoMap[patient.PIDString]; ok {
+		codes := make([]string, 0, len(info))
+		for code := range info {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			dates := info[code]
+			for _, did := range getDIDs(code) {
+				for _, date := range dates {
+					nonIcd = 1
+					trajectory.AddDiagnosis(patient, &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: date})
+				}
+			}
+		}
+	}
+	return nonIcd
+}
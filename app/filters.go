@@ -19,33 +19,99 @@
 package app
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"ptra/trajectory"
+	"sort"
 	"strings"
 )
 
+// StageSelection configures which tumor information entry of a patient a cancer stage aggregator checks. By default, it
+// is the latest entry that satisfies the aggregator's predicate. With NearestEOI, it is the entry recorded closest to,
+// and not after, the patient's event of interest, and the patient is only kept if that entry satisfies the predicate.
+type StageSelection struct {
+	NearestEOI bool
+	Tolerance  float64 // with NearestEOI, the max nr of years the entry may precede the event of interest, 0 for no max
+}
+
+// LatestStage is the default stage selection: the latest tumor information entry that satisfies the predicate.
+var LatestStage = StageSelection{}
+
+// NearestEOIStage returns a stage selection of the tumor information entry recorded closest to, and not after, the
+// event of interest, at most tolerance years before it. A tolerance of 0 means there is no maximum.
+func NearestEOIStage(tolerance float64) StageSelection {
+	return StageSelection{NearestEOI: true, Tolerance: tolerance}
+}
+
+// selectTumorInfo returns the index of the tumor information entry of a patient that a cancer stage aggregator checks,
+// cf. StageSelection, or -1 if there is no such entry. Only the entries of the given sites are candidates.
+func (selection StageSelection) selectTumorInfo(p *trajectory.Patient, tInfos []*TumorInfo,
+	site func(tInfo *TumorInfo) bool, predicate func(tInfo *TumorInfo) bool) int {
+	tInfoToUseIndex := -1
+	if !selection.NearestEOI {
+		for i, tInfo := range tInfos { //go over all infos to grab the latest cancer stage that satisfies the predicate
+			if site(tInfo) && predicate(tInfo) {
+				tInfoToUseIndex = i
+			}
+		}
+		return tInfoToUseIndex
+	}
+	if p.EOIDate == nil {
+		return -1
+	}
+	eoi := trajectory.DiagnosisDateToFloat(*p.EOIDate)
+	for i, tInfo := range tInfos {
+		date := trajectory.DiagnosisDateToFloat(tInfo.Date)
+		if !site(tInfo) || date > eoi || (selection.Tolerance > 0 && eoi-date > selection.Tolerance) {
+			continue
+		}
+		if tInfoToUseIndex == -1 || date >= trajectory.DiagnosisDateToFloat(tInfos[tInfoToUseIndex].Date) {
+			tInfoToUseIndex = i
+		}
+	}
+	if tInfoToUseIndex != -1 && !predicate(tInfos[tInfoToUseIndex]) {
+		return -1
+	}
+	return tInfoToUseIndex
+}
+
+// nextStageDate returns the date of the tumor information entry that follows the selected entry, or nil if there is
+// none. By default, this is the next entry in the list. With NearestEOI, it is the earliest entry dated after the
+// selected entry.
+func (selection StageSelection) nextStageDate(tInfos []*TumorInfo, index int) *trajectory.DiagnosisDate {
+	if !selection.NearestEOI {
+		if index+1 < len(tInfos) {
+			return &tInfos[index+1].Date
+		}
+		return nil
+	}
+	var next *trajectory.DiagnosisDate
+	for _, tInfo := range tInfos {
+		if trajectory.DiagnosisDateSmallerThan(tInfos[index].Date, tInfo.Date) &&
+			(next == nil || trajectory.DiagnosisDateSmallerThan(tInfo.Date, *next)) {
+			next = &tInfo.Date
+		}
+	}
+	return next
+}
+
 // cancerStageAggregator filters a set of patients to only include those that satisfy a given predicate that is applied
-// on the patient's tumor information (which encodes cancer stages etc).
-func cancerStageAggregator(predicate func(tInfo *TumorInfo) bool, tInfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
+// on the patient's tumor information (which encodes cancer stages etc). Only the tumor information of the given sites
+// is considered. The stage selection determines which tumor information entry the predicate is applied on.
+func cancerStageAggregator(site func(tInfo *TumorInfo) bool, predicate func(tInfo *TumorInfo) bool,
+	tInfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
 	return func(p *trajectory.Patient) bool {
 		//multiple tumor info entries per patient possible
 		if tInfos, ok := tInfoMap[p.PIDString]; ok {
-			if !ok {
-				return false
-			}
-			tInfoToUseIndex := -1
-			for i, tInfo := range tInfos { //go over all infos to grab the latest cancer stage that satisfies the predicate
-				if predicate(tInfo) {
-					tInfoToUseIndex = i
-				}
-			}
+			tInfoToUseIndex := selection.selectTumorInfo(p, tInfos, site, predicate)
 			if tInfoToUseIndex != -1 {
 				// have a patient with specific cancer stage diagnosis
 				// filter out diagnoses at later dates if possibly followed by other cancer stage
-				if tInfoToUseIndex+1 < len(tInfos) {
-					nextStageDate := tInfos[tInfoToUseIndex+1].Date
+				if nextStageDate := selection.nextStageDate(tInfos, tInfoToUseIndex); nextStageDate != nil {
 					newD := []*trajectory.Diagnosis{}
 					for _, d := range p.Diagnoses {
-						if trajectory.DiagnosisDateSmallerThan(d.Date, nextStageDate) {
+						if trajectory.DiagnosisDateSmallerThan(d.Date, *nextStageDate) {
 							newD = append(newD, d)
 						} else {
 							continue
@@ -60,160 +126,371 @@ func cancerStageAggregator(predicate func(tInfo *TumorInfo) bool, tInfoMap map[s
 	}
 }
 
-// NMIBCAggregator checks all patients if they match the cancer criteria to be defined as non muscle invasive bladder
-// cancer patients.
-func NMIBCAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
-		if tInfo.TStage == "Tis" || tInfo.TStage == "Ta" ||
-			(tInfo.TStage == "T1" && tInfo.NStage == "N0" && tInfo.MStage == "M0") {
-			return true
+// anySite is the site selector of cancer stage aggregators that apply to the tumors of all sites.
+func anySite(tInfo *TumorInfo) bool {
+	return true
+}
+
+// bladderCancerSite is the site selector of cancer stage aggregators that only apply to bladder cancer tumors, so that
+// patients with multiple primaries are staged by their bladder cancer.
+func bladderCancerSite(tInfo *TumorInfo) bool {
+	return strings.HasPrefix(tInfo.Site, "C67")
+}
+
+// bladderCancerStageAggregator is a cancerStageAggregator that only applies the predicate on bladder cancer tumors, so
+// that patients with multiple primaries are staged by their bladder cancer.
+func bladderCancerStageAggregator(predicate func(tInfo *TumorInfo) bool, tInfoMap map[string][]*TumorInfo,
+	selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(bladderCancerSite, predicate, tInfoMap, selection)
+}
+
+// AnchorDiagnosisFilter filters a set of patients to only include those that are diagnosed with the anchor diagnosis,
+// i.e. the index event. The anchor ICD10 code is resolved to analysis DIDs with the analysis maps, and may be a prefix.
+// The diagnoses of the remaining patients are trimmed to start from the date of their first anchor diagnosis, so that
+// trajectories start at the index event. Diagnoses on the same date as the anchor diagnosis are kept, even if they are
+// sorted before it.
+func AnchorDiagnosisFilter(anchorICDCode string, analysisMaps AnalysisMaps) trajectory.PatientFilter {
+	anchors := map[int]bool{}
+	for _, did := range analysisMaps.GetDIDs(anchorICDCode) {
+		anchors[did] = true
+	}
+	return func(p *trajectory.Patient) bool {
+		for i, d := range p.Diagnoses {
+			if anchors[d.DID] {
+				for i > 0 && !trajectory.DiagnosisDateSmallerThan(p.Diagnoses[i-1].Date, d.Date) {
+					i--
+				}
+				p.Diagnoses = p.Diagnoses[i:]
+				return true
+			}
 		}
 		return false
-	}, tinfoMap)
+	}
+}
+
+// HasCodeFilter filters a set of patients to only include those that are diagnosed with at least one of the given
+// ICD10 codes. The codes may be prefixes, e.g. E11, and are resolved to analysis DIDs with the analysis maps, so that a
+// code matches all diagnoses that are collapsed onto the same analysis code at the analysis level.
+func HasCodeFilter(analysisMaps AnalysisMaps, icd10Codes ...string) trajectory.PatientFilter {
+	dids := map[int]bool{}
+	for _, code := range icd10Codes {
+		for _, did := range analysisMaps.GetDIDs(code) {
+			dids[did] = true
+		}
+	}
+	return func(p *trajectory.Patient) bool {
+		for _, d := range p.Diagnoses {
+			if dids[d.DID] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasNoCodeFilter filters a set of patients to only include those that are not diagnosed with any of the given ICD10
+// codes, cf. HasCodeFilter.
+func HasNoCodeFilter(analysisMaps AnalysisMaps, icd10Codes ...string) trajectory.PatientFilter {
+	return trajectory.NotFilter(HasCodeFilter(analysisMaps, icd10Codes...))
+}
+
+// RegionNameFilter keeps the patients who live in the region with the given name, e.g. Northeast. The regionIDs map
+// the region names onto the region IDs of the patients, cf. ParseTriNetXRegions. If the region name is unknown, all
+// patients are removed.
+func RegionNameFilter(regionName string, regionIDs map[string]int) trajectory.PatientFilter {
+	regionID, ok := regionIDs[regionName]
+	if !ok {
+		return func(p *trajectory.Patient) bool { return false }
+	}
+	return trajectory.RegionFilter(regionID)
+}
+
+// TreatmentFilter filters a set of patients to only include those that received a treatment, given the treatment
+// information parsed from a TriNetX treatment file, cf. ParseTriNetXTreatmentFile. The treatment is identified by the
+// pseudo ICD10 code of its extra code, e.g. RadicalCystectomyCode. If truncate is true, the diagnoses of the remaining
+// patients are trimmed to those before their first treatment date, the same way cancerStageAggregator trims them at
+// the date of a next cancer stage.
+func TreatmentFilter(treatments map[string]TreatmentInfo, code string, truncate bool) trajectory.PatientFilter {
+	return func(p *trajectory.Patient) bool {
+		dates := treatments[p.PIDString][code]
+		if len(dates) == 0 {
+			return false
+		}
+		if truncate {
+			first := dates[0]
+			for _, date := range dates[1:] {
+				if trajectory.DiagnosisDateSmallerThan(date, first) {
+					first = date
+				}
+			}
+			newD := []*trajectory.Diagnosis{}
+			for _, d := range p.Diagnoses {
+				if trajectory.DiagnosisDateSmallerThan(d.Date, first) {
+					newD = append(newD, d)
+				}
+			}
+			p.Diagnoses = newD
+		}
+		return true
+	}
+}
+
+// NoTreatmentFilter filters a set of patients to only include those that did not receive a treatment, cf.
+// TreatmentFilter.
+func NoTreatmentFilter(treatments map[string]TreatmentInfo, code string) trajectory.PatientFilter {
+	return trajectory.NotFilter(TreatmentFilter(treatments, code, false))
+}
+
+// CohortList is a curated list of TriNetX patient IDs for selecting or excluding patients, cf. ParseCohortFile.
+type CohortList struct {
+	File    string          // the file the list is parsed from
+	Exclude bool            // whether the listed patients are removed instead of kept
+	PIDs    map[string]bool // the listed patient IDs
+	Found   map[string]bool // the listed patient IDs seen by the filter
+}
+
+// ParseCohortFile parses a file with one TriNetX patient ID per line into a cohort list. Empty lines are skipped, and so
+// is an optional header line "patient_id". If exclude is true, the filter of the list removes the listed patients
+// instead of keeping them.
+func ParseCohortFile(fileName string, exclude bool) *CohortList {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	cohort := &CohortList{File: fileName, Exclude: exclude, PIDs: map[string]bool{}, Found: map[string]bool{}}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (i == 0 && strings.EqualFold(line, "patient_id")) {
+			continue
+		}
+		cohort.PIDs[line] = true
+	}
+	return cohort
+}
+
+// Filter returns a patient filter that keeps the listed patients, or removes them if the list excludes patients. The
+// filter records which listed patients it sees, cf. Missing.
+func (cohort *CohortList) Filter() trajectory.PatientFilter {
+	return func(p *trajectory.Patient) bool {
+		listed := cohort.PIDs[p.PIDString]
+		if listed {
+			cohort.Found[p.PIDString] = true
+		}
+		return listed != cohort.Exclude
+	}
+}
+
+// Missing returns the number of listed patient IDs that the filter has not seen, e.g. because they do not occur in the
+// patient file.
+func (cohort *CohortList) Missing() int {
+	return len(cohort.PIDs) - len(cohort.Found)
+}
+
+// PrintMissing prints how many listed patient IDs were not found among the patients.
+func (cohort *CohortList) PrintMissing() {
+	fmt.Println("Found ", len(cohort.Found), " of ", len(cohort.PIDs), " patient IDs listed in ", cohort.File, ", ",
+		cohort.Missing(), " listed patient IDs were not found in the patient file.")
+}
+
+// NMIBCAggregator checks all patients if they match the cancer criteria to be defined as non muscle invasive bladder
+// cancer patients.
+func NMIBCAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return bladderCancerStageAggregator(isNMIBC, tinfoMap, selection)
+}
+
+// isNMIBC checks if tumor information matches the cancer criteria for non muscle invasive bladder cancer.
+func isNMIBC(tInfo *TumorInfo) bool {
+	if tInfo.TStage == "Tis" || tInfo.TStage == "Ta" ||
+		(tInfo.TStage == "T1" && tInfo.NStage == "N0" && tInfo.MStage == "M0") {
+		return true
+	}
+	return false
 }
 
 // MIBCAggregator checks all patients if they match the cancer criteria to be defined as muscle invasive bladder cancer
 // patients.
-func MIBCAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
-		if tInfo.TStage == "T2" || tInfo.TStage == "T3" ||
-			(tInfo.TStage == "T4" && tInfo.MStage == "M0" &&
-				(tInfo.NStage == "N0" || tInfo.NStage == "N1" || tInfo.NStage == "N2" || tInfo.NStage == "N3")) {
-			return true
+func MIBCAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return bladderCancerStageAggregator(isMIBC, tinfoMap, selection)
+}
+
+// isMIBC checks if tumor information matches the cancer criteria for muscle invasive bladder cancer.
+func isMIBC(tInfo *TumorInfo) bool {
+	if tInfo.TStage == "T2" || tInfo.TStage == "T3" ||
+		(tInfo.TStage == "T4" && tInfo.MStage == "M0" &&
+			(tInfo.NStage == "N0" || tInfo.NStage == "N1" || tInfo.NStage == "N2" || tInfo.NStage == "N3")) {
+		return true
+	}
+	return false
+}
+
+// ProgressionAggregator collects the patients who progressed from non muscle invasive to muscle invasive bladder
+// cancer: the bladder cancer tumor information of a patient, sorted by date, must have an entry that matches the NMIBC
+// criteria, cf. NMIBCAggregator, followed by a later entry that matches the MIBC criteria, cf. MIBCAggregator. The
+// progression date is the date of the first such MIBC entry. If truncate is true, the diagnoses of the remaining
+// patients are trimmed to those before the progression date.
+func ProgressionAggregator(tinfoMap map[string][]*TumorInfo, truncate bool) trajectory.PatientFilter {
+	return func(p *trajectory.Patient) bool {
+		tInfos := []*TumorInfo{}
+		for _, tInfo := range tinfoMap[p.PIDString] {
+			if bladderCancerSite(tInfo) {
+				tInfos = append(tInfos, tInfo)
+			}
+		}
+		sort.SliceStable(tInfos, func(i, j int) bool {
+			return trajectory.DiagnosisDateSmallerThan(tInfos[i].Date, tInfos[j].Date)
+		})
+		var nmibcDate *trajectory.DiagnosisDate
+		for _, tInfo := range tInfos {
+			if nmibcDate != nil && isMIBC(tInfo) && trajectory.DiagnosisDateSmallerThan(*nmibcDate, tInfo.Date) {
+				if truncate {
+					newD := []*trajectory.Diagnosis{}
+					for _, d := range p.Diagnoses {
+						if trajectory.DiagnosisDateSmallerThan(d.Date, tInfo.Date) {
+							newD = append(newD, d)
+						}
+					}
+					p.Diagnoses = newD
+				}
+				return true
+			}
+			if nmibcDate == nil && isNMIBC(tInfo) {
+				date := tInfo.Date
+				nmibcDate = &date
+			}
 		}
 		return false
-	}, tinfoMap)
+	}
 }
 
 // MUCAggregator checks all patients if they match the cancer criteria to be defined as metastisized bladder cancer
 // patients.
-func MUCAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func MUCAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return bladderCancerStageAggregator(func(tInfo *TumorInfo) bool {
 		if tInfo.MStage == "M0" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // TaStageAggregator collects patients with stage Ta bladder cancer.
-func TaStageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func TaStageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "Ta" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // T1StageAggregator collects patients with stage T1 bladder cancer.
-func T1StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func T1StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "T1" || tInfo.TStage == "T1a" || tInfo.TStage == "T1c" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // TisStageAggregator collects patients with stage Tis bladder cancer.
-func TisStageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func TisStageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "Tis" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // T2StageAggregator collects patients with stage T2 bladder cancer.
-func T2StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func T2StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "T2" || tInfo.TStage == "T2a" || tInfo.TStage == "T2b" || tInfo.TStage == "T2c" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // T3StageAggregator collects patients with stage T3 bladder cancer.
-func T3StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func T3StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "T3" || tInfo.TStage == "T3a" || tInfo.TStage == "T3b" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // T4StageAggregator collects patients with stage T4 bladder cancer.
-func T4StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func T4StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.TStage == "T4" || tInfo.TStage == "T4a" || tInfo.TStage == "T4b" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // N0StageAggregator collects patients with stage N0 bladder cancer.
-func N0StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func N0StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.NStage == "N0" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // N1StageAggregator collects patients with stage N1 bladder cancer.
-func N1StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func N1StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.NStage == "N1" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // N2StageAggregator collects patients with stage N2 bladder cancer.
-func N2StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func N2StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.NStage == "N2" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // N3StageAggregator collects patients with stage N0 bladder cancer.
-func N3StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func N3StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.NStage == "N3" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // M0StageAggregator collects patients with stage M0 bladder cancer.
-func M0StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func M0StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.MStage == "M0" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // M1StageAggregator collects patients with stage M1 bladder cancer.
-func M1StageAggregator(tinfoMap map[string][]*TumorInfo) trajectory.PatientFilter {
-	return cancerStageAggregator(func(tInfo *TumorInfo) bool {
+func M1StageAggregator(tinfoMap map[string][]*TumorInfo, selection StageSelection) trajectory.PatientFilter {
+	return cancerStageAggregator(anySite, func(tInfo *TumorInfo) bool {
 		if tInfo.MStage == "M1" || tInfo.MStage == "M1a" || tInfo.MStage == "M1b" {
 			return true
 		}
 		return false
-	}, tinfoMap)
+	}, tinfoMap, selection)
 }
 
 // CancerTrajectoryFilter filters trajectories down to trajectories that contain at least one diagnosis code that is
@@ -269,3 +546,153 @@ func BladderCancerTrajectoryFilter(exp *trajectory.Experiment) trajectory.Trajec
 		return false
 	}
 }
+
+// CCSRCategoryTrajectoryFilter filters trajectories down to trajectories with at least one diagnosis whose name
+// contains the given substring, e.g. "Urinary" for the CCSR categories of the urinary system. The substring is matched
+// case-insensitively against the names in the experiment's NameMap, i.e. the CCSR category names for a CCSR-mapped
+// experiment. It returns an error if the substring is empty or does not match any diagnosis.
+func CCSRCategoryTrajectoryFilter(categorySubstring string,
+	exp *trajectory.Experiment) (trajectory.TrajectoryFilter, error) {
+	category := strings.ToLower(strings.TrimSpace(categorySubstring))
+	if category == "" {
+		return nil, errors.New("empty trajectory filter CCSR category")
+	}
+	categoryMap := map[int]bool{}
+	for did, medName := range exp.NameMap {
+		if strings.Contains(strings.ToLower(medName), category) {
+			categoryMap[did] = true
+		}
+	}
+	if len(categoryMap) == 0 {
+		return nil, fmt.Errorf("unknown trajectory filter CCSR category: %s", categorySubstring)
+	}
+	return func(t *trajectory.Trajectory) bool {
+		for _, did := range t.Diagnoses {
+			if categoryMap[did] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// ContainsCodeTrajectoryFilter filters trajectories down to trajectories that contain at least one diagnosis that
+// matches one of the given ICD10 codes, e.g. J44, J45, J96 for a COPD study. A code matches the diagnoses whose ICD10
+// code starts with the code. The codes are resolved to analysis DIDs through the analysis maps, so that under CCSR maps
+// a code matches all CCSR categories its ICD10 codes map onto. The experiment's IdMap only holds one ICD10 code per CCSR
+// category, so it is only used to resolve the codes if the analysis maps are nil. It returns an error if a code does
+// not match any diagnosis.
+func ContainsCodeTrajectoryFilter(exp *trajectory.Experiment, codes []string,
+	analysisMaps AnalysisMaps) (trajectory.TrajectoryFilter, error) {
+	containsMap, err := resolveTrajectoryFilterCodes(exp, codes, analysisMaps)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *trajectory.Trajectory) bool {
+		for _, did := range t.Diagnoses {
+			if containsMap[did] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// StartsWithCodeFilter filters trajectories down to trajectories whose first diagnosis matches one of the given ICD10
+// codes, e.g. C67 for the trajectories that start with the index bladder cancer diagnosis. A trajectory that contains
+// a matching diagnosis at another position is removed. The codes are resolved as for ContainsCodeTrajectoryFilter.
+func StartsWithCodeFilter(exp *trajectory.Experiment, codes []string,
+	analysisMaps AnalysisMaps) (trajectory.TrajectoryFilter, error) {
+	startsMap, err := resolveTrajectoryFilterCodes(exp, codes, analysisMaps)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *trajectory.Trajectory) bool {
+		return len(t.Diagnoses) > 0 && startsMap[t.Diagnoses[0]]
+	}, nil
+}
+
+// EndsWithCodeFilter filters trajectories down to trajectories whose last diagnosis matches one of the given ICD10
+// codes, e.g. N18 for the trajectories that end in chronic kidney disease. A trajectory that contains a matching
+// diagnosis at another position is removed. The codes are resolved as for ContainsCodeTrajectoryFilter.
+func EndsWithCodeFilter(exp *trajectory.Experiment, codes []string,
+	analysisMaps AnalysisMaps) (trajectory.TrajectoryFilter, error) {
+	endsMap, err := resolveTrajectoryFilterCodes(exp, codes, analysisMaps)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *trajectory.Trajectory) bool {
+		return len(t.Diagnoses) > 0 && endsMap[t.Diagnoses[len(t.Diagnoses)-1]]
+	}, nil
+}
+
+// ExcludesCodeTrajectoryFilter filters trajectories down to trajectories that contain no diagnosis that matches one of
+// the given ICD10 codes or medical names, e.g. I10 and E78 to suppress the trajectories with hypertension or
+// hyperlipidemia, which dominate many trajectories. A name matches the diagnoses whose name in the experiment's NameMap
+// is equal to it, and other codes are resolved as for ContainsCodeTrajectoryFilter. The filter only removes
+// trajectories from the output, so that the diagnosis pairs the trajectories are built from are not affected. It
+// returns an error if a code or name does not match any diagnosis.
+func ExcludesCodeTrajectoryFilter(exp *trajectory.Experiment, codes []string,
+	analysisMaps AnalysisMaps) (trajectory.TrajectoryFilter, error) {
+	excludesMap := map[int]bool{}
+	icdCodes := []string{}
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		matched := false
+		for did, medName := range exp.NameMap {
+			if code != "" && medName == code {
+				excludesMap[did] = true
+				matched = true
+			}
+		}
+		if !matched {
+			icdCodes = append(icdCodes, code)
+		}
+	}
+	didMap, err := resolveTrajectoryFilterCodes(exp, icdCodes, analysisMaps)
+	if err != nil {
+		return nil, err
+	}
+	for did := range didMap {
+		excludesMap[did] = true
+	}
+	return func(t *trajectory.Trajectory) bool {
+		for _, did := range t.Diagnoses {
+			if excludesMap[did] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// resolveTrajectoryFilterCodes resolves ICD10 codes to the set of analysis DIDs they match, cf.
+// ContainsCodeTrajectoryFilter. It returns an error if a code does not match any diagnosis.
+func resolveTrajectoryFilterCodes(exp *trajectory.Experiment, codes []string,
+	analysisMaps AnalysisMaps) (map[int]bool, error) {
+	didMap := map[int]bool{}
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		matched := false
+		if analysisMaps != nil {
+			for _, did := range analysisMaps.GetDIDs(code) {
+				didMap[did] = true
+				matched = true
+			}
+		} else {
+			for did, icdCode := range exp.IdMap {
+				if strings.HasPrefix(icdCode, code) {
+					didMap[did] = true
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unknown trajectory filter ICD10 code: %s", code)
+		}
+	}
+	return didMap, nil
+}
@@ -19,10 +19,13 @@
 package app
 
 import (
+	"bufio"
 	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math"
@@ -30,9 +33,12 @@ import (
 	"path/filepath"
 	"ptra/trajectory"
 	"ptra/utils"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 //Package ptra implements a patient trajectory analysis tool.
@@ -43,6 +49,8 @@ import (
 
 //TriNetX Database stores diagnoses data using a mix of ICD10 and ICD9 codes.
 //We have an additional file that maps ICD9 IDs -> ICD10 IDs.
+//Some TriNetX sites export diagnoses using SNOMED CT codes, which can be mapped onto ICD10 IDs with the NLM SNOMED CT
+//to ICD-10-CM map.
 //We can download the ICD10 ID -> medical name from https://www.cms.gov/medicare/icd-10/2022-icd-10-cm as an xml file.
 //TriNetX stores patient info as a csv file, as well as the diagnoses info.
 //For the medical name mapping, we can also use the ICD10 -> CCSR Mapping which maps ICD10 onto 530 categories with medical meaning. This
@@ -242,6 +250,132 @@ func initializeIcd10NameMap(file string) map[string]icd10Name {
 	return icd10NameMap
 }
 
+//Parsing the WHO ICD10 hierarchy from xml
+//The WHO distributes ICD10 (as opposed to ICD10-CM) in the ClaML format: a flat list of classes, where each class has a
+//code, a kind (chapter, block, or category), a reference to its parent class, references to its child classes, and
+//labels. The classes are mapped onto the same levels as the ICD10-CM hierarchy: chapters are level 0, the blocks that
+//contain the 3-character codes are level 1, the 3-character codes level 2, the 4-character codes level 3, and so on.
+
+// Flavors of the ICD10 xml hierarchy.
+const (
+	IcdFlavorAuto = "auto" // detect the flavor from the root element of the xml file
+	IcdFlavorCM   = "cm"   // ICD10-CM tabular xml, cf. https://www.cms.gov/medicare/icd-10/2022-icd-10-cm
+	IcdFlavorWHO  = "who"  // WHO ICD10 ClaML xml
+)
+
+// clamlCode captures a reference to another class in a ClaML file.
+type clamlCode struct {
+	Code string `xml:"code,attr"`
+}
+
+// clamlRubric captures a label of a class in a ClaML file.
+type clamlRubric struct {
+	Kind  string `xml:"kind,attr"` //the preferred label is the medical name
+	Label string `xml:"Label"`
+}
+
+// clamlClass captures a chapter, block, or category in a ClaML file.
+type clamlClass struct {
+	Code       string        `xml:"code,attr"`
+	Kind       string        `xml:"kind,attr"`
+	SuperClass clamlCode     `xml:"SuperClass"`
+	SubClasses []clamlCode   `xml:"SubClass"`
+	Rubrics    []clamlRubric `xml:"Rubric"`
+}
+
+// clamlClassification contains the full ClaML file with the WHO ICD10 classes.
+type clamlClassification struct {
+	XmlName xml.Name     `xml:"ClaML"`
+	Classes []clamlClass `xml:"Class"`
+}
+
+// detectIcdFlavor returns IcdFlavorWHO if the root element of an xml file is ClaML, and IcdFlavorCM otherwise.
+func detectIcdFlavor(file string) string {
+	xmlFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer xmlFile.Close()
+	decoder := xml.NewDecoder(xmlFile)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return IcdFlavorCM
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if start.Name.Local == "ClaML" {
+				return IcdFlavorWHO
+			}
+			return IcdFlavorCM
+		}
+	}
+}
+
+// preferredLabel returns the preferred label of a ClaML class.
+func (class clamlClass) preferredLabel() string {
+	for _, rubric := range class.Rubrics {
+		if rubric.Kind == "preferred" {
+			return strings.TrimSpace(rubric.Label)
+		}
+	}
+	return ""
+}
+
+// initializeWHOIcd10NameMap initializes a name map for ICD10 DID -> medical name, level, and categories it belongs to
+// from a WHO ICD10 ClaML file. Only the codes without subcodes are added to the map, as for ICD10-CM. The names of the
+// chapters include their range of codes, e.g. Neoplasms (C00-D48), as in the ICD10-CM hierarchy.
+func initializeWHOIcd10NameMap(file string) map[string]icd10Name {
+	fmt.Println("Parsing WHO ICD10 code hierarchy from XML file: ", file)
+	xmlFileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	classification := clamlClassification{}
+	xml.Unmarshal(xmlFileBytes, &classification)
+	classes := map[string]clamlClass{}
+	for _, class := range classification.Classes {
+		classes[class.Code] = class
+	}
+	desc := func(class clamlClass) string {
+		if class.Kind == "chapter" && len(class.SubClasses) > 0 {
+			first := strings.Split(class.SubClasses[0].Code, "-")[0]
+			lastRange := strings.Split(class.SubClasses[len(class.SubClasses)-1].Code, "-")
+			return fmt.Sprintf("%s (%s-%s)", class.preferredLabel(), first, lastRange[len(lastRange)-1])
+		}
+		return class.preferredLabel()
+	}
+	icd10NameMap := map[string]icd10Name{}
+	for _, class := range classification.Classes {
+		if class.Kind != "category" || len(class.SubClasses) > 0 {
+			continue
+		}
+		// collect the categories from the code up to its chapter
+		var chapter, block string
+		categories := []string{}
+		for parent, ok := classes[class.SuperClass.Code]; ok; parent, ok = classes[parent.SuperClass.Code] {
+			switch parent.Kind {
+			case "chapter":
+				chapter = desc(parent)
+			case "block":
+				if block == "" { // the innermost block
+					block = desc(parent)
+				}
+			default:
+				categories = append([]string{desc(parent)}, categories...)
+			}
+		}
+		name := icd10Name{name: desc(class), level: 2 + len(categories),
+			categories: [6]string{chapter, block, "NONE", "NONE", "NONE", "NONE"}}
+		for i, category := range categories {
+			if i+2 < len(name.categories) {
+				name.categories[i+2] = category
+			}
+		}
+		icd10NameMap[class.Code] = name
+	}
+	return icd10NameMap
+}
+
 // getIcd10DescToExcludeFromAnalysis returns a map that lists ICD10 categories to be excluded from analysis by mapping
 // the ICD10 category description (string) onto a boolean.
 func getIcd10DescToExcludeFromAnalysis() map[string]bool {
@@ -252,6 +386,10 @@ func getIcd10DescToExcludeFromAnalysis() map[string]bool {
 	exclude["Injury, poisoning and certain other consequences of external causes (S00-T88)"] = true
 	exclude["External causes of morbidity (V00-Y99)"] = true
 	exclude["Factors influencing health status and contact with health services (Z00-Z99)"] = true
+	// WHO ICD10 chapters that differ from ICD10-CM
+	exclude["Pregnancy, childbirth and the puerperium (O00-O99)"] = true
+	exclude["Injury, poisoning and certain other consequences of external causes (S00-T98)"] = true
+	exclude["External causes of morbidity and mortality (V01-Y98)"] = true
 	return exclude
 }
 
@@ -270,30 +408,80 @@ func getIcd10CodesToExcludeFromAnalysis() map[string]bool {
 	return exclude
 }
 
-// getNonICD10CodesToAddToAnalysis returns a set of mockup ICD10 codes to be able to introduce non ICD codes to be
-// included for analysis. It returns a map from mockup ICD10 code (string) to description string. It introduces "C98" for
-// "Radical custectomy (bladder cancer)", "C99" for "MVAC Chemotherapy (bladder cancer)", and "C100" for "Intravesical
-// therapy (bladder cancer)".
-func getNonICD10CodesToAddToAnalysis() map[string]string {
-	return map[string]string{
-		"C98":  "Radical cystectomy (bladder cancer)",
-		"C99":  "MVAC Chemotherapy (bladder cancer)",
-		"C100": "Intravesical therapy (bladder cancer)",
+// icd10ExclusionConfig is the json format of an ICD10 exclusion config file, cf. loadExclusionConfig.
+type icd10ExclusionConfig struct {
+	ExcludeDescriptions []string `json:"excludeDescriptions"`
+	ExcludeCodePrefixes []string `json:"excludeCodePrefixes"`
+}
+
+// loadExclusionConfig reads the ICD10 codes to exclude from analysis from a json file of the form
+// {"excludeDescriptions": [...], "excludeCodePrefixes": [...]}. The descriptions are level 0 categories of an ICD10 xml
+// hierarchy, e.g. "External causes of morbidity (V00-Y99)", and the code prefixes apply to the ICD10 codes of a CCSR
+// file, e.g. "V". A list that is left out keeps its default, cf. getIcd10DescToExcludeFromAnalysis and
+// getIcd10CodesToExcludeFromAnalysis, while an empty list excludes nothing.
+func loadExclusionConfig(path string) (descExclusions map[string]bool, codeExclusions map[string]bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	var config icd10ExclusionConfig
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, nil, fmt.Errorf("invalid ICD10 exclusion config %s: %v", path, err)
+	}
+	descExclusions = getIcd10DescToExcludeFromAnalysis()
+	if config.ExcludeDescriptions != nil {
+		descExclusions = map[string]bool{}
+		for _, desc := range config.ExcludeDescriptions {
+			descExclusions[desc] = true
+		}
+	}
+	codeExclusions = getIcd10CodesToExcludeFromAnalysis()
+	if config.ExcludeCodePrefixes != nil {
+		codeExclusions = map[string]bool{}
+		for _, prefix := range config.ExcludeCodePrefixes {
+			codeExclusions[strings.ToUpper(prefix)] = true
+		}
+	}
+	return descExclusions, codeExclusions, nil
+}
+
+// SetIcd10ExclusionConfig replaces the ICD10 codes to exclude from analysis by those of a json config file, cf.
+// loadExclusionConfig.
+func (config *ParseConfig) SetIcd10ExclusionConfig(path string) error {
+	descExclusions, codeExclusions, err := loadExclusionConfig(path)
+	if err != nil {
+		return err
+	}
+	config.Icd10DescExclusions, config.Icd10CodeExclusions = descExclusions, codeExclusions
+	return nil
+}
+
+// excludedIcd10Code checks if an ICD10 code starts with one of the code prefixes to exclude from analysis.
+func excludedIcd10Code(code string, codeExclusions map[string]bool) bool {
+	for prefix := range codeExclusions {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
 	}
+	return false
 }
 
 // initializeIcd10AnalysisIDMap creates a map ICD10 DID -> analysis DID and a map analysis ID -> medical name. This is
 // useful to remap diagnosis codes used in the input to a higher level in the ICD10 hierarchy. E.g "typhoid fever" and
 // "cholera" are both "infectuous intestinal diseases", so they could both be identified as such during the analysis.
-// This can be interesting to obtain more global patient trajectories/clusters.
-func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int) (map[string]int, map[int]string, int) {
-	analysisIdMap := map[string]int{}                     // maps icd 10 code to analysis ID
-	analysisNameMap := map[int]string{}                   // maps analysis ID to a medical name
-	nameToAnalysisIdMap := map[string]int{}               // maps medical name to analysis ID
-	ctr := 0                                              //serves as analysis ID generator
-	icd10ToExclude := getIcd10DescToExcludeFromAnalysis() // a list of level 0 categories to exclude from analysis
+// This can be interesting to obtain more global patient trajectories/clusters. The extra codes are added as analysis IDs
+// of their own. The codes of the level 0 categories in descExclusions are excluded from analysis.
+func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int, extraCodes []ExtraCode,
+	descExclusions map[string]bool) (map[string]int, map[int]string, int) {
+	analysisIdMap := map[string]int{}       // maps icd 10 code to analysis ID
+	analysisNameMap := map[int]string{}     // maps analysis ID to a medical name
+	nameToAnalysisIdMap := map[string]int{} // maps medical name to analysis ID
+	ctr := 0                                //serves as analysis ID generator
 	for icd10Code, icd10Name := range icd10NameMap {
-		if _, ok := icd10ToExclude[icd10Name.categories[0]]; ok {
+		if descExclusions[icd10Name.categories[0]] {
 			// code to exclude from analysis
 			continue
 		}
@@ -313,11 +501,10 @@ func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int) (m
 		}
 		analysisIdMap[icd10Code] = newID
 	}
-	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
-		analysisNameMap[ctr] = name
-		nameToAnalysisIdMap[name] = ctr
-		analysisIdMap[code] = ctr
+	for _, extra := range extraCodes {
+		analysisNameMap[ctr] = extra.Description
+		nameToAnalysisIdMap[extra.Description] = ctr
+		analysisIdMap[extra.Code] = ctr
 		ctr++
 	}
 	fmt.Println("Mapped ", len(icd10NameMap), " ICD10 codes to ", ctr, " analysis IDs of level ", level)
@@ -332,6 +519,56 @@ type ccsrCategory struct {
 	categories map[string]string //Up to 6 different CCSR categories an ICD10 code is mapped to
 }
 
+// CCSR modes for mapping ICD10 codes onto CCSR categories: only the default category of each ICD10 code, or all of its
+// categories.
+const (
+	CCSRModeDefault = "default"
+	CCSRModeAll     = "all"
+)
+
+// ccsrBodySystems maps the body-system prefixes of CCSR IDs onto their medical names.
+var ccsrBodySystems = map[string]string{
+	"BLD": "Diseases of the blood and blood-forming organs and certain disorders involving the immune mechanism",
+	"CIR": "Diseases of the circulatory system",
+	"DEN": "Dental diseases",
+	"DIG": "Diseases of the digestive system",
+	"EAR": "Diseases of the ear and mastoid process",
+	"END": "Endocrine, nutritional and metabolic diseases",
+	"EXT": "External causes of morbidity",
+	"EYE": "Diseases of the eye and adnexa",
+	"FAC": "Factors influencing health status and contact with health services",
+	"GEN": "Diseases of the genitourinary system",
+	"INF": "Certain infectious and parasitic diseases",
+	"INJ": "Injury, poisoning and certain other consequences of external causes",
+	"MAL": "Congenital malformations, deformations and chromosomal abnormalities",
+	"MBD": "Mental, behavioral and neurodevelopmental disorders",
+	"MUS": "Diseases of the musculoskeletal system and connective tissue",
+	"NEO": "Neoplasms",
+	"NVS": "Diseases of the nervous system",
+	"PNL": "Certain conditions originating in the perinatal period",
+	"PRG": "Pregnancy, childbirth and the puerperium",
+	"RSP": "Diseases of the respiratory system",
+	"SKN": "Diseases of the skin and subcutaneous tissue",
+	"SYM": "Symptoms, signs and abnormal clinical and laboratory findings, not elsewhere classified",
+}
+
+// ccsrBodySystem returns the body-system prefix of a CCSR ID, i.e. its first three letters, and its medical name.
+func ccsrBodySystem(id string) (string, string) {
+	prefix := strings.Trim(id, "' ")
+	if len(prefix) > 3 {
+		prefix = prefix[0:3]
+	}
+	if name, ok := ccsrBodySystems[prefix]; ok {
+		return prefix, name
+	}
+	return prefix, prefix
+}
+
+// ccsrUnacceptable checks if a CCSR ID marks an ICD10 code as unacceptable for a default category, e.g. XXX000.
+func ccsrUnacceptable(id string) bool {
+	return strings.HasPrefix(strings.Trim(id, "' "), "XXX")
+}
+
 type icd10ToCCSRTable map[string]ccsrCategory //maps ICD10 DID to its CCSR categories
 
 // ccsrIcd10ToProperIcd10 transforms the ICD10 code from a ccsr file into a proper ICD10 code. The ICD10 codes in the
@@ -342,7 +579,7 @@ func ccsrIcd10ToProperIcd10(code string) string {
 }
 
 // initializeIcd10NameMapFromCCSR initializes a name map for ICD10 DID -> CCSR categories (medical names)
-func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
+func initializeIcd10ToCCSRMap(config *ParseConfig, file string) map[string]ccsrCategory {
 	//map to collect data
 	icd10ToCCSRTable := map[string]ccsrCategory{}
 	//open file
@@ -356,14 +593,15 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 		}
 	}()
 	//parse file
-	reader := csv.NewReader(csvFile)
+	csvReader := config.newCSVReader(csvFile)
 	//the header is 'ICD-10-CM CODE','ICD-10-CM CODE DESCRIPTION','Default CCSR CATEGORY IP','
 	//Default CCSR CATEGORY DESCRIPTION IP','Default CCSR CATEGORY OP','Default CCSR CATEGORY DESCRIPTION OP','
 	//CCSR CATEGORY 1','CCSR CATEGORY 1 DESCRIPTION','CCSR CATEGORY 2','CCSR CATEGORY 2 DESCRIPTION',
 	//'CCSR CATEGORY 3','CCSR CATEGORY 3 DESCRIPTION','CCSR CATEGORY 4','CCSR CATEGORY 4 DESCRIPTION',
 	//'CCSR CATEGORY 5','CCSR CATEGORY 5 DESCRIPTION','CCSR CATEGORY 6','CCSR CATEGORY 6 DESCRIPTION'
 	// skip header
-	reader.Read()
+	csvReader.Read()
+	reader := config.newWarningReader(csvReader, file, 18)
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -372,8 +610,11 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 		if err != nil {
 			panic(err)
 		}
-		//create CSSR category, set default category
-		category := ccsrCategory{name: record[2], id: record[3], categories: map[string]string{}}
+		//create CSSR category, set default category: the inpatient default, or else the outpatient default
+		category := ccsrCategory{id: record[2], name: record[3], categories: map[string]string{}}
+		if ccsrUnacceptable(category.id) {
+			category.id, category.name = record[4], record[5]
+		}
 		//fill in unique CSSR alternative categories, up to 6 possible
 		for i := 6; i <= 17; i = i + 2 {
 			catID := record[i]
@@ -385,10 +626,14 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 				category.categories[catID] = catName
 			}
 		}
+		if ccsrUnacceptable(category.id) { // no acceptable default, take the first category
+			category.id, category.name = record[6], record[7]
+		}
 		//add category to result
 		icd10Code := ccsrIcd10ToProperIcd10(record[0])
 		icd10ToCCSRTable[icd10Code] = category
 	}
+	reader.finish()
 	return icd10ToCCSRTable
 }
 
@@ -407,20 +652,30 @@ func printIcd10ToCCSRTable(tab map[string]ccsrCategory) {
 
 // initializeIcd10AnalysisMapsCCSR creates a map ICD10 DID -> [analysis DID] and a map analysis ID -> medical name,
 // starting from a CCSR mapping, which maps ICD10 codes onto medical meaningful categories.
-// Each icd10 code can be mapped to multiple ccsr categories, and therefore to multiple analysis IDs.
-// TO DO: exclude specific ICD10 codes from the analysis.
-func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (map[string][]int, map[int]string, int) {
+// In CCSRModeAll, each icd10 code can be mapped to multiple ccsr categories, and therefore to multiple analysis IDs. In
+// CCSRModeDefault, each icd10 code is only mapped to its default category. With level 0, the categories are collapsed
+// into their body systems, e.g. all DIG categories into Diseases of the digestive system. The extra codes are added as
+// analysis IDs of their own. The ICD10 codes that start with a prefix in codeExclusions are excluded from analysis.
+func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory, mode string, level int,
+	extraCodes []ExtraCode, codeExclusions map[string]bool) (map[string][]int, map[int]string, int) {
 	analysisIdMap := map[string][]int{} // maps icd 10 code to analysis IDs
 	analysisNameMap := map[int]string{} // maps analysis ID to a medical name
 	ccsrIDMap := map[string]int{}
 	ctr := 0 //serves as analysis ID generator
-	icd10ToExclude := getIcd10CodesToExcludeFromAnalysis()
 	for icd10Code, ccsr := range icd10ToCssrMap {
-		if _, ok := icd10ToExclude[icd10Code[0:1]]; ok {
+		if excludedIcd10Code(icd10Code, codeExclusions) {
 			continue
 		}
+		categories := ccsr.categories
+		if mode == CCSRModeDefault {
+			categories = map[string]string{ccsr.id: ccsr.name}
+		}
 		ids := []int{}
-		for id, name := range ccsr.categories {
+		seen := map[int]bool{}
+		for id, name := range categories {
+			if level == 0 {
+				id, name = ccsrBodySystem(id)
+			}
 			var ccsrID int
 			var ok bool
 			if ccsrID, ok = ccsrIDMap[id]; !ok {
@@ -429,17 +684,24 @@ func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (ma
 				ccsrIDMap[id] = ccsrID
 				ctr++
 			}
-			ids = append(ids, ccsrID)
+			if !seen[ccsrID] { // categories may collapse into the same body system
+				seen[ccsrID] = true
+				ids = append(ids, ccsrID)
+			}
 		}
 		analysisIdMap[icd10Code] = ids
 	}
-	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
-		analysisNameMap[ctr] = name
-		analysisIdMap[code] = []int{ctr}
+	for _, extra := range extraCodes {
+		analysisNameMap[ctr] = extra.Description
+		analysisIdMap[extra.Code] = []int{ctr}
 		ctr++
 	}
-	fmt.Println("Mapped ", len(icd10ToCssrMap), " ICD10 codes to ", ctr, " analysis IDs")
+	granularity := "categories"
+	if level == 0 {
+		granularity = "body systems"
+	}
+	fmt.Println("Mapped ", len(icd10ToCssrMap), " ICD10 codes to ", ctr, " analysis IDs with CCSR mode ", mode,
+		" and CCSR ", granularity)
 	return analysisIdMap, analysisNameMap, ctr
 }
 
@@ -490,6 +752,54 @@ func (analysisMap icd10AnalysisMapsFromCCSR) GetICDCode(did int) string {
 	return ""
 }
 
+func (analysisMap icd10AnalysisMapsFromXML) getNameMap() map[int]string {
+	return analysisMap.NameMap
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) getNameMap() map[int]string {
+	return analysisMap.NameMap
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) getNofDiagnosisCodes() int {
+	return analysisMap.NofDiagnosisCodes
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) getNofDiagnosisCodes() int {
+	return analysisMap.NofDiagnosisCodes
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) GetDIDs(icd10Code string) []int {
+	dids := map[int]bool{}
+	for code, did := range analysisMap.DIDMap {
+		if strings.HasPrefix(code, icd10Code) {
+			dids[did] = true
+		}
+	}
+	return sortedDIDs(dids)
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) GetDIDs(icd10Code string) []int {
+	dids := map[int]bool{}
+	for code, didCodes := range analysisMap.DIDMap {
+		if strings.HasPrefix(code, icd10Code) {
+			for _, did := range didCodes {
+				dids[did] = true
+			}
+		}
+	}
+	return sortedDIDs(dids)
+}
+
+// sortedDIDs returns the DIDs in a set as a sorted list.
+func sortedDIDs(dids map[int]bool) []int {
+	result := []int{}
+	for did := range dids {
+		result = append(result, did)
+	}
+	sort.Ints(result)
+	return result
+}
+
 func (analysisMap icd10AnalysisMapsFromXML) getIdMap() map[int]string {
 	res := map[int]string{}
 	for icd10Code, didCode := range analysisMap.DIDMap {
@@ -510,13 +820,17 @@ func (analysisMap icd10AnalysisMapsFromCCSR) getIdMap() map[int]string {
 
 // AnalysisMaps represent maps extracted from the input that map analysis IDs onto medical terms and vice versa. This is
 // an interface that defines several methods. getICDCode returns for a did the original id in the input for the
-// diagnostic event. fillInPatientDiagnoses creates for a given diagnosis identifier from the input a Diagnosis object
-// and adds it to a patient's list of diagnoses.
+// diagnostic event. GetDIDs returns the analysis IDs of all diagnostic events in the input whose id starts with a given
+// code, e.g. "C67" or "C67.1". fillInPatientDiagnoses creates for a given diagnosis identifier from the input a
+// Diagnosis object and adds it to a patient's list of diagnoses.
 type AnalysisMaps interface {
 	fillInPatientDiagnoses(patient *trajectory.Patient, DidString string, date trajectory.DiagnosisDate) int
-	fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]*TreatmentInfo) int
+	fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]TreatmentInfo) int
 	GetICDCode(did int) string
+	GetDIDs(icd10Code string) []int
 	getIdMap() map[int]string
+	getNameMap() map[int]string
+	getNofDiagnosisCodes() int
 }
 
 func (analysisMap icd10AnalysisMapsFromXML) fillInPatientDiagnoses(patient *trajectory.Patient, DIDString string, date trajectory.DiagnosisDate) int {
@@ -541,81 +855,256 @@ func (analysisMap icd10AnalysisMapsFromCCSR) fillInPatientDiagnoses(patient *tra
 	return 0
 }
 
-func (analysisMap icd10AnalysisMapsFromXML) fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]*TreatmentInfo) int {
-	nonIcd := 0
-	if info, ok := infoMap[patient.PIDString]; ok {
-		if info.RCDate != nil {
-			diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C98"], Date: *info.RCDate}
-			nonIcd = 1
-			trajectory.AddDiagnosis(patient, diagnosis)
-		}
-		if info.MVACDate != nil {
-			nonIcd = 1
-			diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C99"], Date: *info.MVACDate}
-			trajectory.AddDiagnosis(patient, diagnosis)
+func (analysisMap icd10AnalysisMapsFromXML) fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]TreatmentInfo) int {
+	return fillInExtraCodeDiagnoses(patient, infoMap, func(code string) []int {
+		if did := analysisMap.getDID(code); did != -1 {
+			return []int{did}
 		}
-		if info.IVTDate != nil {
-			nonIcd = 1
-			diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C100"], Date: *info.IVTDate}
-			trajectory.AddDiagnosis(patient, diagnosis)
+		return nil
+	})
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]TreatmentInfo) int {
+	return fillInExtraCodeDiagnoses(patient, infoMap, analysisMap.getDID)
+}
+
+// initializeIcd10AnalysisMaps returns a map ICD10 DID -> internal analysis DID and a map analysis DID ->
+// medical name for an ICD10 Hierarchy passed as xml file and a requested hierarchy level. The icdFlavor is IcdFlavorCM
+// or IcdFlavorWHO, or IcdFlavorAuto to detect the flavor from the file. It panics if the file contains no ICD10 codes,
+// which is typically the case when the wrong flavor is given.
+func initializeIcd10AnalysisMapsFromXML(config *ParseConfig, file, icdFlavor string, level int,
+	extraCodes []ExtraCode) icd10AnalysisMapsFromXML {
+	if icdFlavor == IcdFlavorAuto {
+		icdFlavor = detectIcdFlavor(file)
+	}
+	var icd10NameMapFromXml map[string]icd10Name // map ICD10 DID -> ICD 10 Name (medical desc, categories, level)
+	if icdFlavor == IcdFlavorWHO {
+		icd10NameMapFromXml = initializeWHOIcd10NameMap(file)
+	} else {
+		icd10NameMapFromXml = initializeIcd10NameMap(file)
+	}
+	if len(icd10NameMapFromXml) == 0 {
+		panic(fmt.Sprint("No ICD10 codes found in ", file, " for ICD10 flavor ", icdFlavor,
+			", check the flavor with --icdFlavor who | cm"))
+	}
+	analysisIdMap, analysisNameMap, ctr := intializeIcd10AnalysisMaps(icd10NameMapFromXml, level, extraCodes,
+		config.Icd10DescExclusions)
+	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+}
+
+// initializeIcd10AnalysisMapsFromCCSR returns a map ICD10 -> []{internal analysis DID} and map analysis DID -> medical
+// name for ICD10 CCSR categorization passed as a csv file, cf. initializeIcd10AnalysisMapsCCSR for the mode and level.
+func initializeIcd10AnalysisMapsFromCCSR(config *ParseConfig, file, mode string, level int,
+	extraCodes []ExtraCode) icd10AnalysisMapsFromCCSR {
+	icd10ToCssrMap := initializeIcd10ToCCSRMap(config, file) // map ICD10 Code -> CCSR Name
+	analysisIdMap, analysisNameMap, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap, mode, level, extraCodes,
+		config.Icd10CodeExclusions)
+	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+}
+
+//Parsing patient information.
+
+// recordReader abstracts over the sources from which TriNetX rows can be read, e.g. a csv file or a SQL query. Read
+// returns the next row as a list of fields, or io.EOF when there are no more rows. A *csv.Reader satisfies this
+// interface.
+type recordReader interface {
+	Read() ([]string, error)
+}
+
+// ParseConfig configures the parsing of the input files: the format of the csv input files, cf. SetCSVFormat, the
+// handling of malformed rows, cf. SetMaxParseWarnings, and the ICD10 codes to exclude from analysis, cf.
+// SetIcd10ExclusionConfig. It also determines how the RR matrix of a parsed experiment is allocated. It is passed to
+// the functions that parse input files, so that analyses with different configurations can run side by side.
+type ParseConfig struct {
+	Delimiter           rune
+	LazyQuotes          bool
+	MaxParseWarnings    int
+	ParseWarningLog     string          // csv file the malformed rows are logged to, or empty
+	Icd10DescExclusions map[string]bool // level 0 categories of an ICD10 xml hierarchy
+	Icd10CodeExclusions map[string]bool // code prefixes of a CCSR file
+	// MakeDxDRR allocates the RR matrix of the parsed experiment, e.g. backed by a trajectory.MappedMatrix, or nil
+	// for trajectory.MakeDxDRR
+	MakeDxDRR func(size int) [][]float64
+}
+
+// DefaultParseConfig returns a parse config for comma-separated files, which skips at most DefaultMaxParseWarnings
+// malformed rows per input file without logging them, and excludes the default ICD10 codes from analysis, cf.
+// getIcd10DescToExcludeFromAnalysis and getIcd10CodesToExcludeFromAnalysis.
+func DefaultParseConfig() *ParseConfig {
+	return &ParseConfig{
+		Delimiter:           ',',
+		MaxParseWarnings:    DefaultMaxParseWarnings,
+		Icd10DescExclusions: getIcd10DescToExcludeFromAnalysis(),
+		Icd10CodeExclusions: getIcd10CodesToExcludeFromAnalysis(),
+	}
+}
+
+// SetCSVFormat sets the field delimiter of the csv input files, i.e. the TriNetX patient, diagnosis, tumor, treatment
+// and procedure files, the CCSR file, and the extra code and procedure code files. With lazyQuotes, a quote may appear
+// in an unquoted field, and a non-doubled quote may appear in a quoted field, cf. csv.Reader. The files that ptra
+// writes itself, e.g. the RR matrix files, are always tab-separated. It returns an error if the delimiter is invalid.
+func (config *ParseConfig) SetCSVFormat(delimiter rune, lazyQuotes bool) error {
+	if delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError ||
+		!utf8.ValidRune(delimiter) {
+		return fmt.Errorf("invalid csv delimiter: %q", delimiter)
+	}
+	config.Delimiter = delimiter
+	config.LazyQuotes = lazyQuotes
+	return nil
+}
+
+// newCSVReader creates a csv reader for an input file with the csv format of the config, cf. SetCSVFormat.
+func (config *ParseConfig) newCSVReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = config.Delimiter
+	reader.LazyQuotes = config.LazyQuotes
+	return reader
+}
+
+// ParseWarning describes a malformed row of an input file, which is skipped instead of aborting the parse, cf.
+// SetMaxParseWarnings.
+type ParseWarning struct {
+	Line   int    // line of the row in the file
+	File   string // name of the file
+	Field  string // name of the malformed field, empty if the row as a whole is malformed
+	Value  string // value of the malformed field, or the row as a whole
+	Reason string // why the row is malformed
+}
+
+// DefaultMaxParseWarnings is the default maximum number of malformed rows per input file, cf. SetMaxParseWarnings.
+const DefaultMaxParseWarnings = 100
+
+// SetMaxParseWarnings sets the maximum number of malformed rows that are skipped per input file, i.e. the TriNetX
+// patient, diagnosis and tumor files, and the CCSR file. The parse of a file with more malformed rows is aborted. The
+// skipped rows are logged to the given csv file with header line,file,field,value,reason, unless the log file is empty.
+// The log file is created anew, and the warnings of all input files are appended to it.
+func (config *ParseConfig) SetMaxParseWarnings(max int, logFile string) error {
+	if logFile != "" {
+		if err := ioutil.WriteFile(logFile, []byte("line,file,field,value,reason\n"), 0600); err != nil {
+			return err
 		}
 	}
-	return nonIcd
+	config.MaxParseWarnings = max
+	config.ParseWarningLog = logFile
+	return nil
 }
 
-func (analysisMap icd10AnalysisMapsFromCCSR) fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]*TreatmentInfo) int {
-	nonIcd := 0
-	if info, ok := infoMap[patient.PIDString]; ok {
-		if info.RCDate != nil {
-			dids := analysisMap.DIDMap["C98"]
-			for _, did := range dids {
-				diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: *info.RCDate}
-				nonIcd = 1
-				trajectory.AddDiagnosis(patient, diagnosis)
-			}
+// fieldCheck checks the value of a field of the rows of an input file, cf. warningReader.
+type fieldCheck struct {
+	index int
+	name  string
+	check func(value string) error
+}
+
+// dateFieldCheck checks that a field contains a TriNetX date.
+func dateFieldCheck(index int, name string) fieldCheck {
+	return fieldCheck{index: index, name: name, check: func(value string) error {
+		_, err := tryParseTriNetXDiagnosisDate(value)
+		return err
+	}}
+}
+
+// warningReader is a recordReader that skips the malformed rows of an input file: rows that cannot be parsed as csv,
+// rows with too few fields, and rows with a field that fails its check. The skipped rows are collected as parse
+// warnings, which are handled by finish once the file is parsed.
+type warningReader struct {
+	reader    recordReader
+	config    *ParseConfig
+	file      string
+	minFields int
+	checks    []fieldCheck
+	row       int // nr of rows read
+	line      int // line of the last row read
+	warnings  []ParseWarning
+}
+
+// newWarningReader creates a warningReader for the rows of a file, which need at least minFields fields that pass the
+// given checks.
+func (config *ParseConfig) newWarningReader(reader recordReader, file string, minFields int,
+	checks ...fieldCheck) *warningReader {
+	return &warningReader{reader: reader, config: config, file: file, minFields: minFields, checks: checks}
+}
+
+func (r *warningReader) Read() ([]string, error) {
+	for {
+		record, err := r.reader.Read()
+		r.row++
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			r.warnings = append(r.warnings, ParseWarning{Line: parseErr.StartLine, File: r.file,
+				Value: strings.Join(record, string(r.config.Delimiter)), Reason: parseErr.Err.Error()})
+			continue
 		}
-		if info.MVACDate != nil {
-			dids := analysisMap.DIDMap["C99"]
-			for _, did := range dids {
-				diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: *info.MVACDate}
-				nonIcd = 1
-				trajectory.AddDiagnosis(patient, diagnosis)
-			}
+		if err != nil {
+			return nil, err
+		}
+		r.line = r.row
+		if csvReader, ok := r.reader.(*csv.Reader); ok {
+			r.line, _ = csvReader.FieldPos(0)
+		}
+		if len(record) < r.minFields {
+			r.warn("", strings.Join(record, string(r.config.Delimiter)),
+				fmt.Errorf("expected at least %d fields, got %d", r.minFields, len(record)))
+			continue
 		}
-		if info.IVTDate != nil {
-			dids := analysisMap.DIDMap["C100"]
-			for _, did := range dids {
-				nonIcd = 1
-				diagnosis := &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: *info.IVTDate}
-				trajectory.AddDiagnosis(patient, diagnosis)
+		malformed := false
+		for _, check := range r.checks {
+			if err := check.check(record[check.index]); err != nil {
+				r.warn(check.name, record[check.index], err)
+				malformed = true
+				break
 			}
 		}
+		if !malformed {
+			return record, nil
+		}
 	}
-	return nonIcd
 }
 
-// initializeIcd10AnalysisMaps returns a map ICD10 DID -> internal analysis DID and a map analysis DID ->
-// medical name for an ICD10 Hierarchy passed as xml file and a requested hierarchy level.
-func initializeIcd10AnalysisMapsFromXML(file string, level int) icd10AnalysisMapsFromXML {
-	icd10NameMapFromXml := initializeIcd10NameMap(file) // map ICD10 DID -> ICD 10 Name (medical desc, categories, level)
-	analysisIdMap, analysisNameMap, ctr := intializeIcd10AnalysisMaps(icd10NameMapFromXml, level)
-	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+// warn adds a parse warning for a field of the last row read, for malformed rows that are detected by the caller.
+func (r *warningReader) warn(field, value string, err error) {
+	r.warnings = append(r.warnings, ParseWarning{Line: r.line, File: r.file, Field: field, Value: value,
+		Reason: err.Error()})
 }
 
-// initializeIcd10AnalysisMapsFromCCSR returns a map ICD10 -> []{internal analysis DID} and map analysis DID -> medical
-// name for ICD10 CCSR categorization passed as a csv file.
-func initializeIcd10AnalysisMapsFromCCSR(file string) icd10AnalysisMapsFromCCSR {
-	icd10ToCssrMap := initializeIcd10ToCCSRMap(file) // map ICD10 Code -> CCSR Name
-	analysisIdMap, analysisNameMap, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap)
-	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+// finish handles the parse warnings once the file is parsed. It panics if there are more warnings than allowed, cf.
+// SetMaxParseWarnings, and logs the warnings otherwise.
+func (r *warningReader) finish() {
+	if len(r.warnings) == 0 {
+		return
+	}
+	if len(r.warnings) > r.config.MaxParseWarnings {
+		first := r.warnings[0]
+		panic(fmt.Errorf("%d malformed rows in %s, more than the allowed %d; the first one on line %d: %s",
+			len(r.warnings), r.file, r.config.MaxParseWarnings, first.Line, first.Reason))
+	}
+	fmt.Println("Skipped ", len(r.warnings), " malformed rows in ", r.file)
+	if r.config.ParseWarningLog == "" {
+		return
+	}
+	file, err := os.OpenFile(r.config.ParseWarningLog, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	writer := csv.NewWriter(file)
+	for _, w := range r.warnings {
+		writer.Write([]string{strconv.Itoa(w.Line), w.File, w.Field, w.Value, w.Reason})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		panic(err)
+	}
+	if err := file.Close(); err != nil {
+		panic(err)
+	}
 }
 
-//Parsing patient information.
-
 // parseTriNetXPatientData parses a file with patient information from the TriNetX database. Input: a patient file in csv
-// format, a desired number of age groups to initialize cohorts. Diagnoses of the patient need to be filled in after
-// parsing the diagnoses file.
-func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.PatientMap, int) {
+// format, a desired number of age groups to initialize cohorts, and optionally explicit age group boundaries that
+// override the number of age groups, cf. assignAgeGroups. Diagnoses of the patient need to be filled in after parsing
+// the diagnoses file.
+func parseTriNetXPatientData(config *ParseConfig, file string, nofCohortAges int,
+	ageGroupBounds []int) (*trajectory.PatientMap, int) {
 	//open file
 	csvFile, err := os.Open(file)
 	if err != nil {
@@ -626,14 +1115,50 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 			panic(err)
 		}
 	}()
+	reader := config.newWarningReader(config.newCSVReader(csvFile), file, 11)
+	patientMap, nofRegions, err := parseTriNetXPatientRecords(reader, nofCohortAges, ageGroupBounds)
+	if err != nil {
+		panic(err)
+	}
+	reader.finish()
+	return patientMap, nofRegions
+}
+
+// RegionIDs returns the regions the parsed patients live in, mapped onto the region IDs of the patients, cf.
+// trajectory.Patient.Region. The region IDs are assigned in the order in which the regions first occur in the patient
+// file.
+func RegionIDs(patients *trajectory.PatientMap) map[string]int {
+	regionIDs := map[string]int{}
+	for id, region := range patients.Regions {
+		regionIDs[region] = id
+	}
+	return regionIDs
+}
+
+// parseTriNetXPatientRecords parses patient rows in TriNetX format from a record reader. It returns the parsed patients
+// and the number of regions the patients live in. A patient that occurs in multiple rows, e.g. when extracts of
+// multiple TriNetX networks are combined, is parsed into a single patient, so that the patient's diagnoses are
+// accumulated. The demographics of the first row are kept, and conflicting years of birth or sexes are reported.
+func parseTriNetXPatientRecords(reader recordReader, nofCohortAges int, ageGroupBounds []int) (*trajectory.PatientMap,
+	int, error) {
 	patientMap := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{}, PIDStringMap: map[string]int{}}
 	maxYOB := 1850
 	minYOB := 2021
 	deathCr := 0
+	duplicateCtr, conflictCtr := 0, 0
 	regions := map[string]int{} //counts per region
 	regionIds := map[string]int{}
-	//parse file
-	reader := csv.NewReader(csvFile)
+	raceIds := map[string]int{}
+	ethnicityIds := map[string]int{}
+	encode := func(ids map[string]int, names *[]string, value string) int {
+		id, ok := ids[value]
+		if !ok {
+			id = len(*names)
+			ids[value] = id
+			*names = append(*names, value)
+		}
+		return id
+	}
 	//the header is omitted from the TriNetX file, but is should be: patient_id, sex, race, ethnicity, year_of_birth,
 	//age_at_death, patient_regional_location, postal_code, marital_status, reason_yob_missing, month_year_death,
 	//source_id
@@ -643,23 +1168,19 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 			break
 		}
 		if err != nil {
-			panic(err)
+			return nil, 0, err
 		}
 		var yob int
 		if yob, err = strconv.Atoi(record[4]); err != nil {
 			continue //skip patients without year of birth
 		}
 		pidString := record[0]
-		patientMap.Ctr++      // avoid using 0 as PID
-		pid := patientMap.Ctr //analysis ID
 		var sex int
 		if record[1] == "M" {
 			sex = trajectory.Male
-			patientMap.MaleCtr++
 		}
 		if record[1] == "F" {
 			sex = trajectory.Female
-			patientMap.FemaleCtr++
 		}
 		dateOfDeathString := record[10]
 		var dateOfDeath *trajectory.DiagnosisDate
@@ -668,7 +1189,6 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 			if err == nil {
 				month, err := strconv.Atoi(dateOfDeathString[4:6])
 				if err == nil {
-					deathCr++
 					dateOfDeath = &trajectory.DiagnosisDate{
 						Year:  year,
 						Month: month,
@@ -677,13 +1197,32 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 				}
 			}
 		}
-		region := record[6]
-		if _, ok := regions[region]; !ok {
-			regions[region] = 0
-			regionIds[region] = len(regionIds)
-		} else {
-			regions[region]++
+		if existing, ok := trajectory.GetPatient(pidString, patientMap); ok { // merge duplicate patient
+			duplicateCtr++
+			if existing.YOB != yob || existing.Sex != sex {
+				conflictCtr++
+				fmt.Println("Conflicting demographics for duplicate patient ", pidString, ": year of birth ",
+					existing.YOB, " vs ", yob, ", sex ", existing.Sex, " vs ", sex, ", keeping the first.")
+			}
+			if existing.DeathDate == nil && dateOfDeath != nil {
+				deathCr++
+				existing.DeathDate = dateOfDeath
+			}
+			continue
+		}
+		patientMap.Ctr++      // avoid using 0 as PID
+		pid := patientMap.Ctr //analysis ID
+		if record[1] == "M" {
+			patientMap.MaleCtr++
+		}
+		if record[1] == "F" {
+			patientMap.FemaleCtr++
+		}
+		if dateOfDeath != nil {
+			deathCr++
 		}
+		region := record[6]
+		regions[region]++
 		patient := trajectory.Patient{
 			PID:       pid,
 			PIDString: pidString,
@@ -692,25 +1231,24 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 			Sex:       sex,
 			Diagnoses: []*trajectory.Diagnosis{},
 			DeathDate: dateOfDeath,
-			Region:    regionIds[region],
+			Region:    encode(regionIds, &patientMap.Regions, region),
+			Race:      encode(raceIds, &patientMap.Races, record[2]),
+			Ethnicity: encode(ethnicityIds, &patientMap.Ethnicities, record[3]),
 		}
 		patientMap.PIDMap[pid] = &patient
 		patientMap.PIDStringMap[pidString] = pid
 		maxYOB = utils.MaxInt(yob, maxYOB)
 		minYOB = utils.MinInt(yob, minYOB)
 	}
-	// initialize patient age groups
-	ageRange := float64(maxYOB-minYOB) / float64(nofCohortAges)
-	ageRange = math.Ceil(ageRange)
-	if nofCohortAges > 1 {
-		for _, p := range patientMap.PIDMap {
-			p.CohortAge = int(math.Floor(float64(p.YOB-minYOB) / float64(ageRange)))
-		}
-	}
+	InitializeAgeGroups(patientMap, nofCohortAges, ageGroupBounds)
 	fmt.Println("Parsed patient data.")
 	fmt.Print("Parsed ", patientMap.Ctr, " patients with year of birth known ")
 	fmt.Print("of which ", patientMap.FemaleCtr, " females and ")
 	fmt.Println(patientMap.MaleCtr, "males; and of which ", deathCr, " have a known date of death.")
+	if duplicateCtr > 0 {
+		fmt.Println("Merged ", duplicateCtr, " duplicate patient rows, of which ", conflictCtr, " with conflicting "+
+			"year of birth or sex.")
+	}
 	fmt.Println("Year of birth oldest patient:", minYOB)
 	fmt.Println("Year of birth youngest patient:", maxYOB)
 	fmt.Println("Patients are of ", len(regions), " regions: ")
@@ -718,219 +1256,914 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 		fmt.Print(region, ": ", nr, ", ")
 	}
 	fmt.Println("")
-	return patientMap, len(regions)
+	fmt.Println("Patients are of ", len(patientMap.Races), " races and ", len(patientMap.Ethnicities), " ethnicities.")
+	return patientMap, len(regions), nil
 }
 
-//Parsing patient diagnoses
-
-// parseTriNetXDiagnosisDate turns a TriNetX date string into DiagnosisDate object.
-func parseTriNetXDiagnosisDate(date string) trajectory.DiagnosisDate {
-	year, err := strconv.Atoi(date[0:4])
-	if err != nil {
-		panic(err)
+// InitializeAgeGroups divides the parsed patients into nofCohortAges age groups of equal width, or into the age groups
+// with explicit boundaries, if any, cf. assignAgeGroups. It replaces any previous age groups of the patients, so that
+// the patients can be parsed once, e.g. to select the number of age groups with AutoSelectAgeGroups, and divided into
+// age groups afterwards.
+func InitializeAgeGroups(patients *trajectory.PatientMap, nofCohortAges int, ageGroupBounds []int) {
+	patients.AgeGroups = nil
+	if len(ageGroupBounds) > 1 {
+		assignAgeGroups(patients, ageGroupBounds)
+		return
 	}
-	month, err := strconv.Atoi(date[5:7])
-	if err != nil {
-		panic(err)
+	maxYOB := 1850
+	minYOB := 2021
+	for _, p := range patients.PIDMap {
+		p.CohortAge = 0
+		maxYOB = utils.MaxInt(p.YOB, maxYOB)
+		minYOB = utils.MinInt(p.YOB, minYOB)
 	}
-	day, err := strconv.Atoi(date[8:10])
-	if err != nil {
-		panic(err)
+	if nofCohortAges > 1 {
+		ageRange := equalAgeGroupWidth(minYOB, maxYOB, nofCohortAges)
+		for _, p := range patients.PIDMap {
+			p.CohortAge = equalAgeGroup(p.YOB, minYOB, ageRange, nofCohortAges)
+		}
+		for i := 0; i < nofCohortAges; i++ {
+			patients.AgeGroups = append(patients.AgeGroups,
+				fmt.Sprintf("%d-%d", minYOB+i*ageRange, minYOB+(i+1)*ageRange))
+		}
 	}
-	return trajectory.DiagnosisDate{Year: year, Month: month, Day: day}
 }
 
-// TriNetXEventOfInterest checks if the ICD10 code is related to bladder cancer
-func TriNetXEventOfInterest(icd10ID string) bool {
-	if icd10ID == "Z85.1" {
-		return true
-	}
-	if len(icd10ID) >= 3 && icd10ID[0:3] == "C67" {
-		return true
-	}
-	return false
+// equalAgeGroupWidth returns the number of years of birth per age group when the years of birth from minYOB to maxYOB
+// are divided into nofCohortAges age groups of equal width.
+func equalAgeGroupWidth(minYOB, maxYOB, nofCohortAges int) int {
+	return int(math.Ceil(float64(maxYOB-minYOB) / float64(nofCohortAges)))
 }
 
-// TreatmentInfo implements a structure for storing the dates of certain bladder cancer treatments.
-type TreatmentInfo struct {
-	RCDate   *trajectory.DiagnosisDate //Date of radical cystectomy
-	MVACDate *trajectory.DiagnosisDate //Date of MVAC chemotherapy
-	IVTDate  *trajectory.DiagnosisDate //Date of intravesical therapy
+// equalAgeGroup returns the age group of a year of birth when the years of birth are divided into nofCohortAges age
+// groups of equal width, cf. equalAgeGroupWidth.
+func equalAgeGroup(yob, minYOB, width, nofCohortAges int) int {
+	if width == 0 {
+		return 0
+	}
+	// the youngest patients may fall just outside the last age range
+	return utils.MinInt(int(math.Floor(float64(yob-minYOB)/float64(width))), nofCohortAges-1)
 }
 
-// parseTriNetXTreatmentFile parses a csv file that contains information of patient's treatments at different time stamps.
-// It returns a map from PID -> TreatmentInfo.
-func parseTriNetXTreatmentFile(fileName string) map[string]*TreatmentInfo {
-	result := map[string]*TreatmentInfo{}
-	file, err := os.Open(fileName)
-	if err != nil {
-		panic(err)
+// AutoSelectAgeGroups returns the number of age groups to divide the patients into, so that each age group contains at
+// least targetGroupSize patients. The age groups are of equal width, as when the number of age groups is given, cf.
+// parseTriNetXPatientRecords. It returns the largest number of age groups for which all groups are large enough, and 1
+// if there is no such number.
+func AutoSelectAgeGroups(patients *trajectory.PatientMap, targetGroupSize int) int {
+	if len(patients.PIDMap) == 0 {
+		return 1
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	reader := csv.NewReader(file)
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		PIDString := record[0]
-		var rcDate, mvacDate, ivtDate *trajectory.DiagnosisDate
-		if len(record[10]) == 10 { // valid date
-			d := parseTriNetXDiagnosisDate(record[10])
-			rcDate = &d
+	minYOB, maxYOB := math.MaxInt32, math.MinInt32
+	yobs := map[int]int{} // nr of patients per year of birth
+	for _, p := range patients.PIDMap {
+		yobs[p.YOB]++
+		minYOB = utils.MinInt(minYOB, p.YOB)
+		maxYOB = utils.MaxInt(maxYOB, p.YOB)
+	}
+	result := 1
+	for n := 2; n <= maxYOB-minYOB+1 && n*targetGroupSize <= len(patients.PIDMap); n++ {
+		width := equalAgeGroupWidth(minYOB, maxYOB, n)
+		sizes := make([]int, n)
+		for yob, ctr := range yobs {
+			sizes[equalAgeGroup(yob, minYOB, width, n)] += ctr
 		}
-		if len(record[11]) == 10 {
-			d := parseTriNetXDiagnosisDate(record[11])
-			mvacDate = &d
+		largeEnough := true
+		for _, size := range sizes {
+			if size < targetGroupSize {
+				largeEnough = false
+				break
+			}
 		}
-		if len(record[13]) == 10 {
-			d := parseTriNetXDiagnosisDate(record[13])
-			rcDate = &d
+		if largeEnough {
+			result = n
 		}
-		result[PIDString] = &TreatmentInfo{RCDate: rcDate, MVACDate: mvacDate, IVTDate: ivtDate}
 	}
 	return result
 }
 
-// parseTrinetXPatientDiagnoses parses a csv file containing patient diagnoses. It fills in those diagnoses for the given
-// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses.
-// TO DO: Handle ICD09 diagnoses.
-func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, patients *trajectory.PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string) {
-	file, err := os.Open(diagnosesFile)
-	if err != nil {
-		panic(err)
-	}
+// ParseTriNetXPatients parses the patients of a TriNetX patient file without dividing them into age groups, e.g. to
+// select the number of age groups with AutoSelectAgeGroups, or to look up their regions with RegionIDs, before the
+// patients are passed to ParseTriNetXDiagnosisData.
+func ParseTriNetXPatients(config *ParseConfig, file string) *trajectory.PatientMap {
+	patients, _ := parseTriNetXPatientData(config, file, 1, nil)
+	return patients
+}
+
+// assignAgeGroups assigns the patients to age groups with explicit boundaries. The boundaries are years of birth in
+// increasing order, where age group i contains the patients born from boundary i up to, but not including, boundary
+// i+1. Patients born before the first boundary are assigned to the first age group, patients born on or after the last
+// boundary to the last age group. There is one age group less than there are boundaries.
+func assignAgeGroups(patients *trajectory.PatientMap, bounds []int) {
+	for _, p := range patients.PIDMap {
+		p.CohortAge = 0
+		for i := 1; i < len(bounds)-1; i++ {
+			if p.YOB >= bounds[i] {
+				p.CohortAge = i
+			}
+		}
+	}
+	patients.AgeGroups = nil
+	for i := 0; i < len(bounds)-1; i++ {
+		patients.AgeGroups = append(patients.AgeGroups, fmt.Sprintf("%d-%d", bounds[i], bounds[i+1]))
+	}
+}
+
+// ParseAgeGroupBounds parses a comma-separated list of age group boundaries, cf. assignAgeGroups. The boundaries must be
+// years of birth in strictly increasing order, and there must be at least 2 of them.
+func ParseAgeGroupBounds(s string) ([]int, error) {
+	bounds := []int{}
+	for _, field := range strings.Split(s, ",") {
+		bound, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age group boundary %q: %w", field, err)
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("age group boundaries must be increasing: %s", s)
+		}
+		bounds = append(bounds, bound)
+	}
+	if len(bounds) < 2 {
+		return nil, fmt.Errorf("at least 2 age group boundaries are needed: %s", s)
+	}
+	return bounds, nil
+}
+
+// ParseDateRange parses a period of the form start:end, with dates in TriNetX format, e.g. 2012-01-01:2019-12-31. The
+// start must not come after the end.
+func ParseDateRange(s string) (trajectory.DiagnosisDate, trajectory.DiagnosisDate, error) {
+	dates := strings.Split(s, ":")
+	if len(dates) != 2 {
+		return trajectory.DiagnosisDate{}, trajectory.DiagnosisDate{}, fmt.Errorf("invalid date range %q, expected "+
+			"start:end, e.g. 2012-01-01:2019-12-31", s)
+	}
+	start, err := tryParseTriNetXDiagnosisDate(dates[0])
+	if err != nil {
+		return trajectory.DiagnosisDate{}, trajectory.DiagnosisDate{}, fmt.Errorf("invalid date range start: %w", err)
+	}
+	end, err := tryParseTriNetXDiagnosisDate(dates[1])
+	if err != nil {
+		return trajectory.DiagnosisDate{}, trajectory.DiagnosisDate{}, fmt.Errorf("invalid date range end: %w", err)
+	}
+	if trajectory.DiagnosisDateSmallerThan(end, start) {
+		return trajectory.DiagnosisDate{}, trajectory.DiagnosisDate{}, fmt.Errorf("date range %q ends before it "+
+			"starts", s)
+	}
+	return start, end, nil
+}
+
+//Parsing patient diagnoses
+
+// parseTriNetXDiagnosisDate turns a TriNetX date string into DiagnosisDate object.
+func parseTriNetXDiagnosisDate(date string) trajectory.DiagnosisDate {
+	result, err := tryParseTriNetXDiagnosisDate(date)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// tryParseTriNetXDiagnosisDate turns a TriNetX date string of the form yyyy-mm-dd into a DiagnosisDate object, or
+// returns an error if the date string is malformed.
+func tryParseTriNetXDiagnosisDate(date string) (trajectory.DiagnosisDate, error) {
+	if len(date) < 10 {
+		return trajectory.DiagnosisDate{}, fmt.Errorf("invalid TriNetX date %q", date)
+	}
+	year, err := strconv.Atoi(date[0:4])
+	if err != nil {
+		return trajectory.DiagnosisDate{}, err
+	}
+	month, err := strconv.Atoi(date[5:7])
+	if err != nil {
+		return trajectory.DiagnosisDate{}, err
+	}
+	day, err := strconv.Atoi(date[8:10])
+	if err != nil {
+		return trajectory.DiagnosisDate{}, err
+	}
+	return trajectory.DiagnosisDate{Year: year, Month: month, Day: day}, nil
+}
+
+// DefaultEventOfInterestCodes are the ICD10 codes that define the default event of interest: bladder cancer.
+var DefaultEventOfInterestCodes = []string{"Z85.1", "C67"}
+
+// EventOfInterest is a matcher for the ICD10 codes that define the event of interest (e.g. a cancer diagnosis). Codes
+// without a dot, e.g. C67, and codes ending in *, e.g. Z85.5*, match all ICD10 codes that start with them. Other
+// codes, e.g. Z85.1, only match exactly.
+type EventOfInterest struct {
+	codes    map[string]bool
+	prefixes []string
+}
+
+// NewEventOfInterest compiles a list of ICD10 codes into an event of interest matcher.
+func NewEventOfInterest(codes []string) *EventOfInterest {
+	eoi := &EventOfInterest{codes: map[string]bool{}}
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		switch {
+		case code == "":
+			continue
+		case strings.HasSuffix(code, "*"):
+			eoi.prefixes = append(eoi.prefixes, strings.TrimSuffix(code, "*"))
+		case !strings.Contains(code, "."):
+			eoi.prefixes = append(eoi.prefixes, code)
+		default:
+			eoi.codes[code] = true
+		}
+	}
+	return eoi
+}
+
+// Match checks if the ICD10 code is an event of interest.
+func (eoi *EventOfInterest) Match(icd10ID string) bool {
+	if eoi.codes[icd10ID] {
+		return true
+	}
+	for _, prefix := range eoi.prefixes {
+		if strings.HasPrefix(icd10ID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEventOfInterestFile parses a file with one ICD10 code per line into a list of codes for NewEventOfInterest.
+// Empty lines and lines starting with # are skipped.
+func ParseEventOfInterestFile(fileName string) []string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	codes := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		codes = append(codes, line)
+	}
+	return codes
+}
+
+var defaultEventOfInterest = NewEventOfInterest(DefaultEventOfInterestCodes)
+
+// TriNetXEventOfInterest checks if the ICD10 code is related to bladder cancer
+func TriNetXEventOfInterest(icd10ID string) bool {
+	return defaultEventOfInterest.Match(icd10ID)
+}
+
+// TreatmentInfo stores for a patient the dates of events that are added to the analysis as extra codes, e.g. bladder
+// cancer treatments. It maps the pseudo ICD10 code of an extra code onto the dates of its events.
+type TreatmentInfo map[string][]trajectory.DiagnosisDate
+
+// UnmappedICD9Report collects the ICD9 codes in the diagnosis input that cannot be mapped onto ICD10 codes, and are
+// therefore dropped from the analysis.
+type UnmappedICD9Report struct {
+	Rows     int            // nr of diagnosis rows parsed
+	Dropped  int            // nr of diagnosis rows dropped because their ICD9 code is unmapped
+	Unmapped map[string]int // maps an unmapped ICD9 code onto its nr of occurrences
+}
+
+// NewUnmappedICD9Report creates an empty report for collecting unmapped ICD9 codes.
+func NewUnmappedICD9Report() *UnmappedICD9Report {
+	return &UnmappedICD9Report{Unmapped: map[string]int{}}
+}
+
+// Percentage returns the percentage of the parsed diagnosis rows that were dropped because of an unmapped ICD9 code.
+func (r *UnmappedICD9Report) Percentage() float64 {
+	if r.Rows == 0 {
+		return 0
+	}
+	return 100.0 * float64(r.Dropped) / float64(r.Rows)
+}
+
+// sortedCodes returns the unmapped ICD9 codes, the most frequent first.
+func (r *UnmappedICD9Report) sortedCodes() []string {
+	codes := []string{}
+	for code := range r.Unmapped {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if r.Unmapped[codes[i]] != r.Unmapped[codes[j]] {
+			return r.Unmapped[codes[i]] > r.Unmapped[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
+// PrintTop prints the n most frequent unmapped ICD9 codes.
+func (r *UnmappedICD9Report) PrintTop(n int) {
+	fmt.Println("Dropped ", r.Dropped, " of ", r.Rows, " diagnoses (", strconv.FormatFloat(r.Percentage(), 'f', 2, 64),
+		"%) with ", len(r.Unmapped), " unmapped ICD9 codes.")
+	for i, code := range r.sortedCodes() {
+		if i >= n {
+			break
+		}
+		fmt.Println("Unmapped ICD9 code: ", code, " occurrences: ", r.Unmapped[code])
+	}
+}
+
+// WriteCSV writes the unmapped ICD9 codes with their nr of occurrences to a csv file, the most frequent first. The
+// header is: code,occurrences.
+func (r *UnmappedICD9Report) WriteCSV(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"code", "occurrences"})
+	for _, code := range r.sortedCodes() {
+		writer.Write([]string{code, strconv.Itoa(r.Unmapped[code])})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// parseTrinetXPatientDiagnoses parses a csv file containing patient diagnoses. It fills in those diagnoses for the given
+// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses, and passes the diagnoses to
+// the given processors for post-processing. ICD9 codes that cannot be mapped onto ICD10 codes are collected in the
+// report, if one is given. The rows are parsed in parallel, using as many workers as there are available processors.
+func parseTrinetXPatientDiagnoses(config *ParseConfig, diagnosesFile string, patients *trajectory.PatientMap,
+	icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map ICD9Mapping, processors []DiagnosisProcessor,
+	report *UnmappedICD9Report) {
+	parseTrinetXPatientDiagnosisFile(config, diagnosesFile, patients, icd10AnalysisMap, icd9ToIcd10Map, processors,
+		report, runtime.GOMAXPROCS(0))
+}
+
+// parseTrinetXPatientDiagnosisFile parses a csv file containing patient diagnoses with the given number of workers, cf.
+// parseTrinetXPatientDiagnosisRecords.
+func parseTrinetXPatientDiagnosisFile(config *ParseConfig, diagnosesFile string, patients *trajectory.PatientMap,
+	icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map ICD9Mapping, processors []DiagnosisProcessor,
+	report *UnmappedICD9Report, nofWorkers int) {
+	file, err := os.Open(diagnosesFile)
+	if err != nil {
+		panic(err)
+	}
 	defer func() {
 		if err := file.Close(); err != nil {
 			panic(err)
 		}
 	}()
-	reader := csv.NewReader(file)
-	ctr := 0 //for counting the number of parsed diagnoses
-	ctrID09 := 0
-	ctrExcl := 0
-	EOICtr := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+	reader := config.newWarningReader(config.newCSVReader(file), diagnosesFile, 8, dateFieldCheck(7, "date"))
+	err = parseTrinetXPatientDiagnosisRecords(reader, patients, icd10AnalysisMap, icd9ToIcd10Map, processors, report,
+		nofWorkers)
+	if err != nil {
+		panic(err)
+	}
+	reader.finish()
+}
+
+// diagnosisChunkSize is the number of diagnosis rows that are handed to a worker at once.
+const diagnosisChunkSize = 4096
+
+// diagnosisCounters collects the counts of a worker that parses diagnosis rows, cf. parseTrinetXPatientDiagnosisRecord.
+type diagnosisCounters struct {
+	rows, icd9, approximate, excluded, dropped int
+	snomed, snomedDropped                      int
+	unmapped                                   map[string]int // maps an unmapped ICD9 code onto its nr of occurrences
+}
+
+// merge adds the counts of another worker to the counters.
+func (c *diagnosisCounters) merge(other *diagnosisCounters) {
+	c.rows = c.rows + other.rows
+	c.icd9 = c.icd9 + other.icd9
+	c.approximate = c.approximate + other.approximate
+	c.excluded = c.excluded + other.excluded
+	c.dropped = c.dropped + other.dropped
+	c.snomed = c.snomed + other.snomed
+	c.snomedDropped = c.snomedDropped + other.snomedDropped
+	for code, n := range other.unmapped {
+		c.unmapped[code] = c.unmapped[code] + n
+	}
+}
+
+// parseTrinetXPatientDiagnosisRecord parses a single diagnosis row in TriNetX format, fills it in for its patient, and
+// passes it to the processors. An ICD9 code is remapped onto all of its ICD10 codes, which are each filled in. A SNOMED
+// CT code is remapped onto its ICD10 code, cf. isSNOMEDCodeSystem.
+func parseTrinetXPatientDiagnosisRecord(record []string, patients *trajectory.PatientMap,
+	icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map ICD9Mapping, processors []DiagnosisProcessor,
+	ctrs *diagnosisCounters) {
+	ctrs.rows++
+	PIDString := record[0]
+	patient, ok := trajectory.GetPatient(PIDString, patients)
+	if !ok {
+		return //skip unknown patients
+	}
+	DIDCodeSystem := record[2]
+	DIDStrings := []string{record[3]}
+	if isSNOMEDCodeSystem(DIDCodeSystem) {
+		icd10Code, ok := icd9ToIcd10Map.SNOMED[record[3]]
+		if !ok {
+			ctrs.snomedDropped++
+			return // skip unknown SNOMED CT codes
 		}
-		if err != nil {
-			panic(err)
+		ctrs.snomed++
+		DIDStrings = []string{icd10Code}
+	} else if DIDCodeSystem != "ICD-10-CM" {
+		// try to remap ICD9 code to ICD10 codes
+		icd9Code := record[3]
+		if DIDStrings, ok = icd9ToIcd10Map.Codes[icd9Code]; !ok {
+			ctrs.dropped++
+			ctrs.unmapped[icd9Code]++
+			return // skip unkown ICD9 codes
 		}
-		ctr++
-		PIDString := record[0]
-		patient, ok := trajectory.GetPatient(PIDString, patients)
-		if !ok {
-			continue //skip unknown patients
-		}
-		DIDCodeSystem := record[2]
-		DIDString := record[3]
-		if DIDCodeSystem != "ICD-10-CM" {
-			// try to remap ICD9 code to ICD10 codes
-			if DIDString, ok = icd9ToIcd10Map[DIDString]; !ok {
-				continue // skip unkown ICD9 codes
-			}
-			ctrID09++
+		ctrs.icd9++
+		if icd9ToIcd10Map.Approximate[icd9Code] {
+			ctrs.approximate++
 		}
-		date := parseTriNetXDiagnosisDate(record[7])
-
+	}
+	date := parseTriNetXDiagnosisDate(record[7])
+	for _, DIDString := range DIDStrings {
+		trajectory.RecordComorbidity(patient, DIDString, date)
 		nr := icd10AnalysisMap.fillInPatientDiagnoses(patient, DIDString, date)
 		if nr > 0 {
-			ctrExcl++
+			ctrs.excluded++
 			continue
 		}
-		//Check if diagnosis is event of interest.
-		if patient.EOIDate == nil && TriNetXEventOfInterest(DIDString) {
-			EOICtr++
-			patient.EOIDate = &date // mark first event of interest (e.g. bladder cancers diagnosis)
+		for _, processor := range processors {
+			processor.ProcessDiagnosis(patient, DIDString, date)
 		}
 	}
-	var nonICD10DiagnosesMap map[string]*TreatmentInfo
-	nonICDCtr := 0
-	if treatmentInfoFile != "" {
-		nonICD10DiagnosesMap = parseTriNetXTreatmentFile(treatmentInfoFile)
-		for _, patient := range patients.PIDMap {
-			//fill in non ICD10 diagnoses derived from procedure info
-			r := icd10AnalysisMap.fillInNonICDPatientDiagnoses(patient, nonICD10DiagnosesMap)
-			nonICDCtr = nonICDCtr + r
+}
+
+// diagnosisShard returns the worker that parses the diagnosis rows of a patient.
+func diagnosisShard(PIDString string, nofWorkers int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(PIDString))
+	return int(hash.Sum32() % uint32(nofWorkers))
+}
+
+// parseTrinetXPatientDiagnosisRecordsInParallel parses diagnosis rows from a record reader on a pool of workers. The
+// rows are read in chunks, and the patients are sharded over the workers by a hash of their PID, so that each worker
+// fills in the diagnoses of its patients in the order of the input. The workers use local counters, which are merged
+// into the given counters at the end.
+func parseTrinetXPatientDiagnosisRecordsInParallel(reader recordReader, patients *trajectory.PatientMap,
+	icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map ICD9Mapping, processors []DiagnosisProcessor,
+	ctrs *diagnosisCounters, nofWorkers int) error {
+	shards := make([]chan [][]string, nofWorkers)
+	workerCtrs := make([]diagnosisCounters, nofWorkers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan [][]string, 4)
+		workerCtrs[i] = diagnosisCounters{unmapped: map[string]int{}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for chunk := range shards[i] {
+				for _, record := range chunk {
+					parseTrinetXPatientDiagnosisRecord(record, patients, icd10AnalysisMap, icd9ToIcd10Map, processors,
+						&workerCtrs[i])
+				}
+			}
+		}(i)
+	}
+	chunks := make([][][]string, nofWorkers)
+	var err error
+	for {
+		var record []string
+		if record, err = reader.Read(); err != nil {
+			break
+		}
+		shard := diagnosisShard(record[0], nofWorkers)
+		chunks[shard] = append(chunks[shard], record)
+		if len(chunks[shard]) == diagnosisChunkSize {
+			shards[shard] <- chunks[shard]
+			chunks[shard] = nil
 		}
 	}
+	for i, chunk := range chunks {
+		if len(chunk) > 0 {
+			shards[i] <- chunk
+		}
+		close(shards[i])
+	}
+	wg.Wait()
+	for i := range workerCtrs {
+		ctrs.merge(&workerCtrs[i])
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// patientList returns the patients of a patient map as a slice, so that they can be processed in parallel.
+func patientList(patients *trajectory.PatientMap) []*trajectory.Patient {
+	list := make([]*trajectory.Patient, 0, len(patients.PIDMap))
 	for _, patient := range patients.PIDMap {
-		trajectory.SortDiagnoses(patient)
-		trajectory.CompactDiagnoses(patient)
+		list = append(list, patient)
+	}
+	return list
+}
+
+// parseTrinetXPatientDiagnosisRecords parses diagnosis rows in TriNetX format from a record reader and fills them in for
+// the given patients. Each diagnosis that is filled in is passed to the processors, which are finished after all rows
+// are parsed. The diagnoses of each patient are then sorted by date, and duplicate diagnoses on the same day are
+// removed, cf. trajectory.CompactDiagnoses. ICD9 codes that cannot be mapped onto ICD10 codes are collected in the
+// report, if one is given. With more than one worker, the rows are parsed in parallel, cf.
+// parseTrinetXPatientDiagnosisRecordsInParallel. The resulting diagnoses are the same as when the rows are parsed
+// sequentially.
+func parseTrinetXPatientDiagnosisRecords(reader recordReader, patients *trajectory.PatientMap,
+	icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map ICD9Mapping, processors []DiagnosisProcessor,
+	report *UnmappedICD9Report, nofWorkers int) error {
+	ctrs := diagnosisCounters{unmapped: map[string]int{}}
+	if nofWorkers > 1 {
+		err := parseTrinetXPatientDiagnosisRecordsInParallel(reader, patients, icd10AnalysisMap, icd9ToIcd10Map,
+			processors, &ctrs, nofWorkers)
+		if err != nil {
+			return err
+		}
+	} else {
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			parseTrinetXPatientDiagnosisRecord(record, patients, icd10AnalysisMap, icd9ToIcd10Map, processors, &ctrs)
+		}
+	}
+	if report != nil {
+		report.Rows = report.Rows + ctrs.rows
+		report.Dropped = report.Dropped + ctrs.dropped
+		for code, n := range ctrs.unmapped {
+			report.Unmapped[code] = report.Unmapped[code] + n
+		}
 	}
 	fmt.Println("Parsed diagnosis data.")
-	fmt.Print("Parsed ", ctr, " diagnoses ")
-	fmt.Println("of which ", ctrID09, " ICD09 diagnoses and ", ctr-ctrID09, " ICD10 diagnoses, and ", ctrExcl, " diagnoses excluded from analysis")
-	fmt.Println("and of which ", EOICtr, " events of interest.")
-	fmt.Println("Parsed non ICD diagnoses for: ", nonICDCtr, " patients.")
-}
-
-func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treatmentInfoFile string, nofCohortAges,
-	level int, minYears, maxYears float64, icd9ToIcd10File string, filters []trajectory.PatientFilter) (*trajectory.Experiment, *trajectory.PatientMap) {
-	// parse data
-	// fill in patients
-	patients, nofRegions := parseTriNetXPatientData(patientFile, nofCohortAges)
-	// fill in icd10 to analysis map
+	fmt.Print("Parsed ", ctrs.rows, " diagnoses ")
+	fmt.Println("of which ", ctrs.icd9, " ICD09 diagnoses and ", ctrs.rows-ctrs.icd9, " ICD10 diagnoses, and ", ctrs.excluded, " diagnoses excluded from analysis")
+	if ctrs.snomed+ctrs.snomedDropped > 0 {
+		fmt.Println("Remapped ", ctrs.snomed, " SNOMED CT diagnoses, and dropped ", ctrs.snomedDropped,
+			" SNOMED CT diagnoses with unmapped codes.")
+	}
+	if ctrs.approximate > 0 {
+		fmt.Println("Remapped ", ctrs.approximate, " ICD09 diagnoses with approximate mappings only.")
+	}
+	for _, processor := range processors {
+		processor.Finish(patients)
+	}
+	patientList := patientList(patients)
+	parallel.Range(0, len(patientList), 0, func(low, high int) {
+		for _, patient := range patientList[low:high] {
+			trajectory.SortDiagnoses(patient)
+			trajectory.CompactDiagnoses(patient)
+		}
+	})
+	return nil
+}
+
+// DataQualityReport describes the quality of the TriNetX patient and diagnosis input files, cf. ValidateInputData.
+type DataQualityReport struct {
+	PatientRows              int            `json:"patientRows"`
+	DiagnosisRows            int            `json:"diagnosisRows"`
+	SkippedPatientRows       map[string]int `json:"skippedPatientRows"`   // maps a reason onto its nr of skipped rows
+	SkippedDiagnosisRows     map[string]int `json:"skippedDiagnosisRows"` // maps a reason onto its nr of skipped rows
+	PatientsWithoutDiagnoses float64        `json:"patientsWithoutDiagnosesPercentage"`
+	UnrecognisedCodes        float64        `json:"unrecognisedCodesPercentage"`
+	DateParseFailures        int            `json:"dateParseFailures"`
+}
+
+// Reasons for skipping input rows in a data quality report.
+const (
+	skipMalformed     = "malformed csv"
+	skipTooFewFields  = "too few fields"
+	skipNoYOB         = "missing year of birth"
+	skipUnknownPID    = "unknown patient"
+	skipDateParseFail = "invalid date"
+)
+
+// wellFormedICDCode checks if a diagnosis code is well-formed for its TriNetX code system, ICD-10-CM or ICD-9-CM. Codes
+// of other code systems are not recognised.
+func wellFormedICDCode(codeSystem, code string) bool {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isAlnum := func(c byte) bool { return isDigit(c) || (c >= 'A' && c <= 'Z') }
+	switch codeSystem {
+	case "ICD-10-CM":
+		if len(code) < 3 || code[0] < 'A' || code[0] > 'Z' || !isDigit(code[1]) || !isAlnum(code[2]) {
+			return false
+		}
+		if len(code) == 3 {
+			return true
+		}
+		if code[3] != '.' || len(code) == 4 || len(code) > 8 {
+			return false
+		}
+		for i := 4; i < len(code); i++ {
+			if !isAlnum(code[i]) {
+				return false
+			}
+		}
+		return true
+	case "ICD-9-CM":
+		digits := strings.Replace(code, ".", "", 1)
+		if strings.HasPrefix(digits, "V") || strings.HasPrefix(digits, "E") {
+			digits = digits[1:]
+		}
+		if len(digits) < 2 || len(digits) > 5 {
+			return false
+		}
+		for i := 0; i < len(digits); i++ {
+			if !isDigit(digits[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ValidateInputData checks the TriNetX patient and diagnosis csv files before they are analysed, so that it is known
+// how much data the analysis loses. It counts the rows of both files, and the rows that the parser skips, per reason:
+// malformed csv, too few fields, a missing year of birth for patients, and an unknown patient or an invalid date for
+// diagnoses. It also computes the percentage of patients without diagnoses, and the percentage of diagnoses with codes
+// that are not well-formed ICD-10-CM or ICD-9-CM codes.
+func ValidateInputData(config *ParseConfig, patientFile, diagnosisFile string) DataQualityReport {
+	report := DataQualityReport{SkippedPatientRows: map[string]int{}, SkippedDiagnosisRows: map[string]int{}}
+	diagnosed := map[string]bool{}
+	validateFile(config, patientFile, func(record []string, err error) {
+		report.PatientRows++
+		if err != nil {
+			report.SkippedPatientRows[skipMalformed]++
+		} else if len(record) < 11 {
+			report.SkippedPatientRows[skipTooFewFields]++
+		} else if _, err := strconv.Atoi(record[4]); err != nil {
+			report.SkippedPatientRows[skipNoYOB]++
+		} else {
+			diagnosed[record[0]] = false
+		}
+	})
+	unrecognised := 0
+	validateFile(config, diagnosisFile, func(record []string, err error) {
+		report.DiagnosisRows++
+		if err != nil {
+			report.SkippedDiagnosisRows[skipMalformed]++
+			return
+		}
+		if len(record) < 8 {
+			report.SkippedDiagnosisRows[skipTooFewFields]++
+			return
+		}
+		if !wellFormedICDCode(record[2], record[3]) {
+			unrecognised++
+		}
+		if _, err := tryParseTriNetXDiagnosisDate(record[7]); err != nil {
+			report.DateParseFailures++
+			report.SkippedDiagnosisRows[skipDateParseFail]++
+			return
+		}
+		if _, ok := diagnosed[record[0]]; !ok {
+			report.SkippedDiagnosisRows[skipUnknownPID]++
+			return
+		}
+		diagnosed[record[0]] = true
+	})
+	withoutDiagnoses := 0
+	for _, ok := range diagnosed {
+		if !ok {
+			withoutDiagnoses++
+		}
+	}
+	if len(diagnosed) > 0 {
+		report.PatientsWithoutDiagnoses = 100.0 * float64(withoutDiagnoses) / float64(len(diagnosed))
+	}
+	if report.DiagnosisRows > 0 {
+		report.UnrecognisedCodes = 100.0 * float64(unrecognised) / float64(report.DiagnosisRows)
+	}
+	return report
+}
+
+// validateFile reads the rows of a csv input file and passes them to the validate function. Rows that cannot be
+// parsed are passed with their parse error.
+func validateFile(config *ParseConfig, fileName string, validate func(record []string, err error)) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := config.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			panic(err)
+		}
+		validate(record, err)
+	}
+}
+
+// Print prints a summary of the data quality report.
+func (r DataQualityReport) Print() {
+	fmt.Println("Validated ", r.PatientRows, " patient rows and ", r.DiagnosisRows, " diagnosis rows.")
+	printSkipped := func(kind string, skipped map[string]int) {
+		reasons := []string{}
+		for reason := range skipped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Println("Skipped ", skipped[reason], " ", kind, " rows: ", reason)
+		}
+	}
+	printSkipped("patient", r.SkippedPatientRows)
+	printSkipped("diagnosis", r.SkippedDiagnosisRows)
+	fmt.Println(strconv.FormatFloat(r.PatientsWithoutDiagnoses, 'f', 2, 64), "% of the patients have no diagnoses, ",
+		strconv.FormatFloat(r.UnrecognisedCodes, 'f', 2, 64), "% of the diagnoses have unrecognised ICD codes, and ",
+		r.DateParseFailures, " diagnosis dates cannot be parsed.")
+}
+
+// WriteJSON writes the data quality report to a json file.
+func (r DataQualityReport) WriteJSON(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ParseTriNetXData parses the TriNetX patient and diagnosis csv files into an experiment. It returns the experiment and
+// the patients that pass the given filters. ICD9 codes that cannot be mapped onto ICD10 codes are collected in the
+// report, if one is given. SNOMED CT codes are mapped onto ICD10 codes with the snomedToIcd10File, if one is given, cf.
+// parseSNOMEDToICD10Mapping. If stratifyByRegion is true, the cohorts are stratified by region as well as by age and
+// sex. If nofRaceGroups is not 0, the cohorts are stratified by race as well, cf. trajectory.GroupRaces.
+func ParseTriNetXData(config *ParseConfig, name, patientFile, diagnosisFile string, analysisMaps AnalysisMaps,
+	processors []DiagnosisProcessor, nofCohortAges, level int, ageGroupBounds []int, stratifyByRegion bool,
+	nofRaceGroups int, minYears, maxYears float64, icd9ToIcd10File, snomedToIcd10File string,
+	report *UnmappedICD9Report, filters []trajectory.PatientFilter) (*trajectory.Experiment, *trajectory.PatientMap) {
+	return ParseTriNetXDiagnosisData(config, name, ParseTriNetXPatients(config, patientFile), diagnosisFile,
+		analysisMaps, processors, nofCohortAges, level, ageGroupBounds, stratifyByRegion, nofRaceGroups, minYears,
+		maxYears, icd9ToIcd10File, snomedToIcd10File, report, filters)
+}
+
+// ParseTriNetXDiagnosisData parses the TriNetX diagnosis csv file for patients that are parsed from a TriNetX patient
+// file, cf. ParseTriNetXPatients, into an experiment, as ParseTriNetXData does for the patient file. The patients are
+// divided into age groups, cf. InitializeAgeGroups.
+func ParseTriNetXDiagnosisData(config *ParseConfig, name string, patients *trajectory.PatientMap, diagnosisFile string,
+	analysisMaps AnalysisMaps, processors []DiagnosisProcessor, nofCohortAges, level int, ageGroupBounds []int,
+	stratifyByRegion bool, nofRaceGroups int, minYears, maxYears float64, icd9ToIcd10File, snomedToIcd10File string,
+	report *UnmappedICD9Report, filters []trajectory.PatientFilter) (*trajectory.Experiment, *trajectory.PatientMap) {
+	InitializeAgeGroups(patients, nofCohortAges, ageGroupBounds)
+	nofRegions := len(patients.Regions)
+	icd9ToIcd10Map := parseDiagnosisCodeMappings(config, icd9ToIcd10File, snomedToIcd10File)
+	// fill in diagnoses for patients
+	parseTrinetXPatientDiagnoses(config, diagnosisFile, patients, analysisMaps, icd9ToIcd10Map, processors, report)
+	exp, patients := initializeExperiment(config, name, patients, nofRegions, nofCohortAges, level, ageGroupBounds,
+		stratifyByRegion, nofRaceGroups, analysisMaps, filters)
+	return exp, patients
+}
+
+// InitializeAnalysisMaps creates the analysis maps for a diagnosis info file. This is either an xml file with the ICD10
+// hierarchy, or a csv file with the CCSR categorization of ICD10 codes. For xml, the icdFlavor determines if the file
+// contains the ICD10-CM or the WHO ICD10 hierarchy, cf. initializeIcd10AnalysisMapsFromXML. For CCSR, the ccsrMode
+// determines if ICD10 codes are mapped onto their default category only, or onto all their categories, and level 0
+// collapses the categories into their body systems. The extra codes are registered in the analysis maps next to the
+// ICD10 codes.
+func InitializeAnalysisMaps(config *ParseConfig, diagnosisInfoFile string, level int, ccsrMode, icdFlavor string,
+	extraCodes []ExtraCode) AnalysisMaps {
 	var analysisMaps AnalysisMaps
-	var nofDiagnosisCodes int
-	var nameMap map[int]string
-	var idMap map[int]string
 	if filepath.Ext(diagnosisInfoFile) == ".xml" {
-		maps := initializeIcd10AnalysisMapsFromXML(diagnosisInfoFile, level)
-		analysisMaps = maps
-		nofDiagnosisCodes = maps.NofDiagnosisCodes
-		nameMap = maps.NameMap
-		idMap = maps.getIdMap()
+		analysisMaps = initializeIcd10AnalysisMapsFromXML(config, diagnosisInfoFile, icdFlavor, level, extraCodes)
 	}
 	if filepath.Ext(diagnosisInfoFile) == ".csv" || filepath.Ext(diagnosisInfoFile) == ".CSV" {
-		maps := initializeIcd10AnalysisMapsFromCCSR(diagnosisInfoFile)
-		analysisMaps = maps
-		nofDiagnosisCodes = maps.NofDiagnosisCodes
-		nameMap = maps.NameMap
-		idMap = maps.getIdMap()
+		analysisMaps = initializeIcd10AnalysisMapsFromCCSR(config, diagnosisInfoFile, ccsrMode, level, extraCodes)
 	}
-	icd9ToIcd10Map := map[string]string{}
-	if icd9ToIcd10File != "" {
-		icd9ToIcd10Map = parseIcd9ToIcd10Mapping(icd9ToIcd10File)
+	return analysisMaps
+}
+
+// ICD10Codes returns the sorted ICD10 codes of a diagnosis info file, cf. InitializeAnalysisMaps. For an xml file, the
+// codes of the chapters that are excluded from the analysis are left out.
+func ICD10Codes(config *ParseConfig, diagnosisInfoFile, icdFlavor string) []string {
+	codes := []string{}
+	if filepath.Ext(diagnosisInfoFile) == ".xml" {
+		if icdFlavor == IcdFlavorAuto {
+			icdFlavor = detectIcdFlavor(diagnosisInfoFile)
+		}
+		var icd10NameMap map[string]icd10Name
+		if icdFlavor == IcdFlavorWHO {
+			icd10NameMap = initializeWHOIcd10NameMap(diagnosisInfoFile)
+		} else {
+			icd10NameMap = initializeIcd10NameMap(diagnosisInfoFile)
+		}
+		for code, name := range icd10NameMap {
+			if !config.Icd10DescExclusions[name.categories[0]] {
+				codes = append(codes, code)
+			}
+		}
+	}
+	if filepath.Ext(diagnosisInfoFile) == ".csv" || filepath.Ext(diagnosisInfoFile) == ".CSV" {
+		for code := range initializeIcd10ToCCSRMap(config, diagnosisInfoFile) {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// DiagnosisCodesPerLevel returns the number of analysis codes the ICD10 codes of a diagnosis info file are collapsed
+// into for each level of --lvl, cf. InitializeAnalysisMaps. For an xml file, these are the levels 0 to 3, for a CCSR
+// file the levels 0 (body systems) and 1 (categories). Extra codes are not included.
+func DiagnosisCodesPerLevel(config *ParseConfig, diagnosisInfoFile, ccsrMode, icdFlavor string) []int {
+	ctrs := []int{}
+	if filepath.Ext(diagnosisInfoFile) == ".xml" {
+		if icdFlavor == IcdFlavorAuto {
+			icdFlavor = detectIcdFlavor(diagnosisInfoFile)
+		}
+		var icd10NameMap map[string]icd10Name
+		if icdFlavor == IcdFlavorWHO {
+			icd10NameMap = initializeWHOIcd10NameMap(diagnosisInfoFile)
+		} else {
+			icd10NameMap = initializeIcd10NameMap(diagnosisInfoFile)
+		}
+		for level := 0; level <= 3; level++ {
+			_, _, ctr := intializeIcd10AnalysisMaps(icd10NameMap, level, nil, config.Icd10DescExclusions)
+			ctrs = append(ctrs, ctr)
+		}
+	}
+	if filepath.Ext(diagnosisInfoFile) == ".csv" || filepath.Ext(diagnosisInfoFile) == ".CSV" {
+		icd10ToCCSRMap := initializeIcd10ToCCSRMap(config, diagnosisInfoFile)
+		for level := 0; level <= 1; level++ {
+			_, _, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCCSRMap, ccsrMode, level, nil,
+				config.Icd10CodeExclusions)
+			ctrs = append(ctrs, ctr)
+		}
+	}
+	return ctrs
+}
+
+// initializeExperiment applies the patient filters to the parsed patients, creates the cohorts, and returns an
+// experiment ready for calculating relative risk ratios, together with the filtered patients. If stratifyByRegion is
+// true, the cohorts are stratified by region. If nofRaceGroups is not 0, the races of the patients are grouped into at
+// most nofRaceGroups race groups, cf. trajectory.GroupRaces, and the cohorts are stratified by race group. The RR
+// matrix of the experiment is allocated with the MakeDxDRR function of the config, if any.
+func initializeExperiment(config *ParseConfig, name string, patients *trajectory.PatientMap, nofRegions,
+	nofCohortAges, level int, ageGroupBounds []int, stratifyByRegion bool, nofRaceGroups int, analysisMaps AnalysisMaps,
+	filters []trajectory.PatientFilter) (*trajectory.Experiment, *trajectory.PatientMap) {
+	nofDiagnosisCodes := analysisMaps.getNofDiagnosisCodes()
+	if !stratifyByRegion {
+		nofRegions = 1
+	}
+	nofRaces := 1
+	if nofRaceGroups != 0 {
+		nofRaces = trajectory.GroupRaces(patients, nofRaceGroups)
 	}
-	// fill in diagnoses for patients
-	parseTrinetXPatientDiagnoses(diagnosisFile, treatmentInfoFile, patients, analysisMaps, icd9ToIcd10Map)
 	// Apply patient filter
 	patients = trajectory.ApplyPatientFilters(filters, patients)
-	fmt.Println("Filtered down to: ", len(patients.PIDMap), " patients.")
+	fmt.Println("Filtered down to: ", len(patients.PIDMap), " patients, of which ", patients.MaleCtr, " males and ",
+		patients.FemaleCtr, " females.")
+	// compute the Charlson comorbidity indices, e.g. for stratifying cohorts by comorbidity burden
+	trajectory.InitializeCharlsonIndices(patients)
 	// create cohorts
-	cohorts := trajectory.InitializeCohorts(patients, nofCohortAges, nofRegions, nofDiagnosisCodes)
+	cohorts := trajectory.InitializeCohorts(patients, nofCohortAges, nofRegions, nofRaces, nofDiagnosisCodes)
 	mergedCohort := trajectory.MergeCohorts(cohorts)
+	makeDxDRR := trajectory.MakeDxDRR
+	if config.MakeDxDRR != nil {
+		makeDxDRR = config.MakeDxDRR
+	}
 	exp := trajectory.Experiment{
 		NofAgeGroups:      nofCohortAges,
+		AgeGroupBounds:    ageGroupBounds,
 		Level:             level,
 		NofDiagnosisCodes: nofDiagnosisCodes,
-		DxDRR:             trajectory.MakeDxDRR(nofDiagnosisCodes),
+		DxDRR:             makeDxDRR(nofDiagnosisCodes),
 		DxDPatients:       trajectory.MakeDxDPatients(nofDiagnosisCodes),
 		DPatients:         mergedCohort.DPatients,
 		Cohorts:           cohorts,
 		Name:              name,
-		NameMap:           nameMap,
+		NameMap:           analysisMaps.getNameMap(),
 		NofRegions:        nofRegions,
-		IdMap:             idMap,
+		NofRaces:          nofRaces,
+		IdMap:             analysisMaps.getIdMap(),
 		FCtr:              patients.FemaleCtr,
 		MCtr:              patients.MaleCtr,
 	}
 	return &exp, patients
 }
 
-// opening json file with ICD09 -> ICD10 mapping
-
-func parseIcd9ToIcd10Mapping(file string) map[string]string {
+// parseIcd9ToIcd10Mapping parses a mapping from ICD9 to ICD10 codes. This is either a json file that maps each ICD9 code
+// onto a single ICD10 code, or a CMS GEM file, cf. parseIcd9ToIcd10GEM.
+func parseIcd9ToIcd10Mapping(file string) ICD9Mapping {
+	if filepath.Ext(file) != ".json" {
+		return parseIcd9ToIcd10GEM(file)
+	}
 	jsonFile, err := os.Open(file)
 	if err != nil {
 		panic(err)
@@ -940,17 +2173,254 @@ func parseIcd9ToIcd10Mapping(file string) map[string]string {
 	jsonBytes, _ := ioutil.ReadAll(jsonFile)
 	var mapping map[string]string
 	json.Unmarshal(jsonBytes, &mapping)
-	return mapping
+	result := ICD9Mapping{Codes: map[string][]string{}, Approximate: map[string]bool{}}
+	for icd9Code, icd10Code := range mapping {
+		result.Codes[icd9Code] = []string{icd10Code}
+	}
+	return result
 }
 
-// TumorInfo is a struct for storing bladder cancer tumor information concerning: tumor size, tumor lymph nodes, tumor
-// metastasis
+// ICD9Mapping maps ICD9 codes onto ICD10 codes. An ICD9 code may map onto several ICD10 codes, e.g. for combination
+// codes. It also maps SNOMED CT codes onto ICD10 codes, if a SNOMED CT mapping is given.
+type ICD9Mapping struct {
+	Codes       map[string][]string // maps an ICD9 code onto its ICD10 codes
+	Approximate map[string]bool     // the ICD9 codes that only have approximate mappings
+	SNOMED      map[string]string   // maps a SNOMED CT concept ID onto its ICD10 code
+}
+
+// parseDiagnosisCodeMappings parses the mappings from ICD9 and SNOMED CT codes onto ICD10 codes. Either file may be
+// empty, in which case the corresponding codes are not mapped.
+func parseDiagnosisCodeMappings(config *ParseConfig, icd9ToIcd10File, snomedToIcd10File string) ICD9Mapping {
+	icd9ToIcd10Map := ICD9Mapping{}
+	if icd9ToIcd10File != "" {
+		icd9ToIcd10Map = parseIcd9ToIcd10Mapping(icd9ToIcd10File)
+	}
+	if snomedToIcd10File != "" {
+		icd9ToIcd10Map.SNOMED = parseSNOMEDToICD10Mapping(config, snomedToIcd10File)
+	}
+	return icd9ToIcd10Map
+}
+
+// isSNOMEDCodeSystem checks if a TriNetX code system is SNOMED CT, e.g. SNOMEDCT.
+func isSNOMEDCodeSystem(codeSystem string) bool {
+	return strings.HasPrefix(strings.ToUpper(codeSystem), "SNOMED")
+}
+
+// parseSNOMEDToICD10Mapping parses a mapping from SNOMED CT concept IDs onto ICD10 codes. This is either the NLM SNOMED
+// CT to ICD-10-CM map, or a csv file with lines: SNOMED CT concept ID, ICD10 code. The NLM map is a tab-separated file
+// with a header line that names the columns, of which referencedComponentId, mapGroup, mapPriority, mapRule, and
+// mapTarget are used. A concept is mapped onto the target of its first map group with the lowest priority whose rule
+// is unconditional, i.e. TRUE or OTHERWISE TRUE. The rules that depend on the age or sex of the patient are skipped, as
+// are inactive rows and rows without a target.
+func parseSNOMEDToICD10Mapping(config *ParseConfig, file string) map[string]string {
+	mapFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := mapFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := config.newCSVReader(mapFile)
+	reader.FieldsPerRecord = -1
+	if ext := strings.ToLower(filepath.Ext(file)); ext == ".tsv" || ext == ".txt" {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		panic(err)
+	}
+	result := map[string]string{}
+	if len(records) == 0 {
+		return result
+	}
+	columns := map[string]int{}
+	for i, column := range records[0] {
+		columns[column] = i
+	}
+	concept, hasConcept := columns["referencedComponentId"]
+	target, hasTarget := columns["mapTarget"]
+	if !hasConcept || !hasTarget {
+		fmt.Println("Parsing SNOMED CT to ICD10 mapping from a csv file.")
+		for _, record := range records {
+			if len(record) >= 2 && record[1] != "" {
+				result[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+			}
+		}
+		return result
+	}
+	fmt.Println("Parsing SNOMED CT to ICD10 mapping from an NLM map file.")
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	priorities := map[string]int{}
+	for _, record := range records[1:] {
+		if len(record) <= concept || len(record) <= target || record[target] == "" {
+			continue
+		}
+		if active := field(record, "active"); active != "" && active != "1" {
+			continue
+		}
+		if group := field(record, "mapGroup"); group != "" && group != "1" {
+			continue
+		}
+		if rule := field(record, "mapRule"); rule != "" && rule != "TRUE" && rule != "OTHERWISE TRUE" {
+			continue
+		}
+		priority, err := strconv.Atoi(field(record, "mapPriority"))
+		if err != nil {
+			priority = 0
+		}
+		if p, ok := priorities[record[concept]]; !ok || priority < p {
+			priorities[record[concept]] = priority
+			result[record[concept]] = record[target]
+		}
+	}
+	fmt.Println("Mapped ", len(result), " SNOMED CT codes.")
+	return result
+}
+
+// gemICD9Code inserts the dot into an ICD9 code from a GEM file, e.g. 4019 -> 401.9 and E8800 -> E880.0.
+func gemICD9Code(code string) string {
+	n := 3
+	if strings.HasPrefix(code, "E") {
+		n = 4
+	}
+	if len(code) <= n {
+		return code
+	}
+	return code[:n] + "." + code[n:]
+}
+
+// gemICD10Code inserts the dot into an ICD10 code from a GEM file, e.g. E119 -> E11.9.
+func gemICD10Code(code string) string {
+	if len(code) <= 3 {
+		return code
+	}
+	return code[:3] + "." + code[3:]
+}
+
+// parseIcd9ToIcd10GEM parses a CMS General Equivalence Mapping (GEM) file from ICD9 to ICD10 codes, e.g.
+// 2018_I9gem.txt. Each line has the form: ICD9 code, ICD10 code, flags, separated by whitespace and without dots in the
+// codes, e.g. 25000 E119 00000. The flags are the approximate, no map, combination, scenario and choice list flags. An
+// ICD9 code is mapped onto all of its ICD10 codes, so that one-to-many mappings are preserved. Lines with the no map
+// flag are skipped. ICD9 codes whose mappings all have the approximate flag are marked as approximate.
+func parseIcd9ToIcd10GEM(file string) ICD9Mapping {
+	gemFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := gemFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Println("Parsing ICD9 to ICD10 mapping from a GEM file.")
+	result := ICD9Mapping{Codes: map[string][]string{}, Approximate: map[string]bool{}}
+	exact := map[string]bool{}
+	scanner := bufio.NewScanner(gemFile)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || len(fields[2]) < 2 {
+			continue
+		}
+		flags := fields[2]
+		if flags[1] == '1' {
+			continue // no map
+		}
+		icd9Code, icd10Code := gemICD9Code(fields[0]), gemICD10Code(fields[1])
+		if !utils.MemberString(icd10Code, result.Codes[icd9Code]) {
+			result.Codes[icd9Code] = append(result.Codes[icd9Code], icd10Code)
+		}
+		if flags[0] != '1' {
+			exact[icd9Code] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	oneToMany := 0
+	for icd9Code, icd10Codes := range result.Codes {
+		if !exact[icd9Code] {
+			result.Approximate[icd9Code] = true
+		}
+		if len(icd10Codes) > 1 {
+			oneToMany++
+		}
+	}
+	fmt.Println("Mapped ", len(result.Codes), " ICD9 codes, of which ", oneToMany, " onto several ICD10 codes and ",
+		len(result.Approximate), " with approximate mappings only.")
+	return result
+}
+
+// TumorInfo is a struct for storing cancer tumor information concerning: tumor size, tumor lymph nodes, tumor
+// metastasis. The site is the ICD10 prefix of the tumor site that accepted the tumor, e.g. C67 for bladder cancer.
 type TumorInfo struct {
 	TStage, NStage, MStage, Stage string
+	Site                          string
 	Date                          trajectory.DiagnosisDate
 }
 
-// getTumorStage converts tumor size, number of lymph nodes, and metastatis level into an overall cancer stage.
+// DefaultTumorSites are the ICD10 prefixes of the tumor sites for which tumor info is parsed by default: bladder cancer.
+var DefaultTumorSites = []string{"C67"}
+
+// StageDeriver derives an overall cancer stage from the tumor size, number of lymph nodes, and metastasis level. How the
+// stage is derived depends on the tumor site.
+type StageDeriver interface {
+	TumorStage(tStage, nStage, mStage string) string
+}
+
+// BladderStageDeriver derives the cancer stage for bladder cancer, cf. getTumorStage.
+type BladderStageDeriver struct{}
+
+func (BladderStageDeriver) TumorStage(tStage, nStage, mStage string) string {
+	return getTumorStage(tStage, nStage, mStage)
+}
+
+// TNMStageDeriver is the stage deriver for sites without a specific stage derivation. The stage is the concatenation of
+// the TNM stages, e.g. T2N0M0.
+type TNMStageDeriver struct{}
+
+func (TNMStageDeriver) TumorStage(tStage, nStage, mStage string) string {
+	return tStage + nStage + mStage
+}
+
+// StageDerivers maps ICD10 prefixes of tumor sites onto their stage derivers. Sites that are not in the map use the
+// TNMStageDeriver.
+var StageDerivers = map[string]StageDeriver{
+	"C67": BladderStageDeriver{},
+}
+
+// stageDeriverForSite returns the stage deriver for a tumor site. The deriver registered for the longest prefix of the
+// site is used.
+func stageDeriverForSite(site string) StageDeriver {
+	var deriver StageDeriver = TNMStageDeriver{}
+	prefix := ""
+	for p, d := range StageDerivers {
+		if strings.HasPrefix(site, p) && len(p) > len(prefix) {
+			prefix = p
+			deriver = d
+		}
+	}
+	return deriver
+}
+
+// matchTumorSite returns the first of the given ICD10 prefixes that matches a tumor site code.
+func matchTumorSite(siteCode string, sites []string) (string, bool) {
+	for _, site := range sites {
+		if strings.HasPrefix(siteCode, site) {
+			return site, true
+		}
+	}
+	return "", false
+}
+
+// getTumorStage converts tumor size, number of lymph nodes, and metastatis level into an overall bladder cancer stage.
 // T stages: Ta,T1,Tis,T2,T3,T4
 // N stages: N0,N1,N2,N3
 // M stages: M0,M1
@@ -1006,8 +2476,10 @@ func tumorIsCISStage(tumor *TumorInfo) bool {
 	return tumor.Stage == "0is"
 }
 
-// parsetTriNetXTumorData parses the tumor data from a csv file and returns a map PIDString -> []*TumorInfo.
-func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
+// parsetTriNetXTumorData parses the tumor data from a csv file and returns a map PIDString -> []*TumorInfo. Only tumors
+// with a site that starts with one of the given ICD10 prefixes (sites) are recorded. The cancer stage is derived with
+// the stage deriver for the site.
+func ParsetTriNetXTumorData(config *ParseConfig, fileName string, sites []string) map[string][]*TumorInfo {
 	file, err := os.Open(fileName)
 	if err != nil {
 		panic(err)
@@ -1018,7 +2490,7 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 		}
 	}()
 	result := map[string][]*TumorInfo{}
-	reader := csv.NewReader(file)
+	reader := config.newWarningReader(config.newCSVReader(file), fileName, 5)
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -1027,10 +2499,18 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 		if err != nil {
 			panic(err)
 		}
-		tumorSite := strings.Split(record[4], ".")
-		if tumorSite[0] == "C67" { //only record bladder cancer information
+		if site, ok := matchTumorSite(record[4], sites); ok { //only record information for the requested sites
+			if len(record) < 13 {
+				reader.warn("", strings.Join(record, string(config.Delimiter)),
+					fmt.Errorf("expected at least 13 fields, got %d", len(record)))
+				continue
+			}
 			PIDString := record[0]
-			date := parseTriNetXDiagnosisDate(record[1])
+			date, err := tryParseTriNetXDiagnosisDate(record[1])
+			if err != nil {
+				reader.warn("date", record[1], err)
+				continue
+			}
 			tumorSizeInfo := strings.Split(record[10], "_")
 			numberOfLymphNodesInfo := strings.Split(record[11], "_")
 			metastaticInfo := strings.Split(record[12], "_")
@@ -1038,8 +2518,9 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 				continue
 			}
 			tumor := &TumorInfo{Date: date, TStage: tumorSizeInfo[1], NStage: numberOfLymphNodesInfo[1],
-				MStage: metastaticInfo[1]}
-			tumor.Stage = getTumorStage(tumorSizeInfo[1], numberOfLymphNodesInfo[1], metastaticInfo[1])
+				MStage: metastaticInfo[1], Site: site}
+			tumor.Stage = stageDeriverForSite(site).TumorStage(tumorSizeInfo[1], numberOfLymphNodesInfo[1],
+				metastaticInfo[1])
 			if ts, ok := result[PIDString]; ok {
 				result[PIDString] = append(ts, tumor)
 			} else {
@@ -1047,6 +2528,7 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 			}
 		}
 	}
+	reader.finish()
 	printTumorInfoSummary(result)
 	return result
 }
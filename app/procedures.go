@@ -0,0 +1,219 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"ptra/trajectory"
+	"sort"
+	"strings"
+)
+
+//Procedures.
+//Procedures from the TriNetX procedure table, coded in CPT or HCPCS, can be added to the analysis as trajectory events.
+//A mapping file maps CPT/HCPCS codes, code ranges, or code prefixes onto pseudo ICD10 codes, which are registered in
+//the analysis maps as extra codes.
+
+// ProcedureCodePrefix is the reserved prefix of the pseudo ICD10 codes of procedures, e.g. PROC01. Its second letter
+// is not a digit, so the pseudo codes cannot collide with ICD10 codes, e.g. with the ICD10 codes P01 and P02 of
+// chapter P.
+const ProcedureCodePrefix = "PROC"
+
+// ProcedureCode maps a set of CPT/HCPCS procedure codes onto a pseudo ICD10 code. The set is either a single code, an
+// inclusive range of codes of the same length, e.g. 51590-51597, or all codes that start with a prefix, e.g. J90*.
+type ProcedureCode struct {
+	From        string // first code of the range, or the prefix
+	To          string // last code of the range, equal to From for a single code, empty for a prefix
+	Code        string // pseudo ICD10 code, e.g. PROC01
+	Description string // medical name
+}
+
+// Match checks if a CPT/HCPCS code belongs to the set of codes of a procedure code mapping.
+func (pc ProcedureCode) Match(cpt string) bool {
+	if pc.To == "" {
+		return strings.HasPrefix(cpt, pc.From)
+	}
+	return len(cpt) == len(pc.From) && cpt >= pc.From && cpt <= pc.To
+}
+
+// parseProcedureCodeSet parses a CPT/HCPCS code, code range, or code prefix into a procedure code mapping.
+func parseProcedureCodeSet(codes, code, description string) (ProcedureCode, error) {
+	if !strings.HasPrefix(code, ProcedureCodePrefix) {
+		return ProcedureCode{}, fmt.Errorf("invalid procedure pseudo code %s, it must start with %s", code,
+			ProcedureCodePrefix)
+	}
+	codes = strings.ToUpper(strings.TrimSpace(codes))
+	if strings.HasSuffix(codes, "*") {
+		return ProcedureCode{From: strings.TrimSuffix(codes, "*"), Code: code, Description: description}, nil
+	}
+	if bounds := strings.Split(codes, "-"); len(bounds) == 2 {
+		from, to := strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1])
+		if len(from) != len(to) || from > to {
+			return ProcedureCode{}, fmt.Errorf("invalid procedure code range %s", codes)
+		}
+		return ProcedureCode{From: from, To: to, Code: code, Description: description}, nil
+	}
+	return ProcedureCode{From: codes, To: codes, Code: code, Description: description}, nil
+}
+
+// ParseProcedureCodesFile parses a csv file that maps CPT/HCPCS procedure codes onto pseudo ICD10 codes. Each line has
+// the form: procedure codes, code, description. The procedure codes are a single code, a range, e.g. 51590-51597, or a
+// prefix ending in *, e.g. J90*. The pseudo codes must start with ProcedureCodePrefix. Several lines may map onto the
+// same pseudo code. An optional header line starting with "cpt" is skipped. It returns an error for lines with fewer
+// than 3 fields, invalid ranges, or pseudo codes outside the reserved namespace.
+func ParseProcedureCodesFile(config *ParseConfig, fileName string) ([]ProcedureCode, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := config.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	procedureCodes := []ProcedureCode{}
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "cpt") {
+			continue // skip header
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s line %d: expected procedures, code, description, got %q", fileName, i+1,
+				strings.Join(record, ","))
+		}
+		procedureCode, err := parseProcedureCodeSet(record[0], record[1], record[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", fileName, i+1, err)
+		}
+		procedureCodes = append(procedureCodes, procedureCode)
+	}
+	return procedureCodes, nil
+}
+
+// ProcedureExtraCodes returns the pseudo ICD10 codes of procedure code mappings as extra codes, so that they can be
+// registered in the analysis maps. Each pseudo code occurs once, with the description of its first mapping.
+func ProcedureExtraCodes(procedureCodes []ProcedureCode) []ExtraCode {
+	extraCodes := []ExtraCode{}
+	seen := map[string]bool{}
+	for _, pc := range procedureCodes {
+		if !seen[pc.Code] {
+			seen[pc.Code] = true
+			extraCodes = append(extraCodes, ExtraCode{Code: pc.Code, Description: pc.Description, Column: -1})
+		}
+	}
+	return extraCodes
+}
+
+// isProcedureCodeSystem checks if a TriNetX code system is CPT or HCPCS.
+func isProcedureCodeSystem(codeSystem string) bool {
+	codeSystem = strings.ToUpper(codeSystem)
+	return strings.HasPrefix(codeSystem, "CPT") || strings.HasPrefix(codeSystem, "HCPCS")
+}
+
+// parseTriNetXProcedureFile collects the procedure events from a TriNetX procedure file, cf. parseExtraCodeEvents. It
+// returns a map from PID -> TreatmentInfo with the events of the pseudo codes the procedures map onto. A procedure that
+// matches several mappings is added for each of their pseudo codes once. Rows with codes of other code systems than CPT
+// or HCPCS are skipped.
+func parseTriNetXProcedureFile(config *ParseConfig, procedureCodes []ProcedureCode,
+	procedureInfoFile string) map[string]TreatmentInfo {
+	file, err := os.Open(procedureInfoFile)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	result := map[string]TreatmentInfo{}
+	reader := config.newCSVReader(file)
+	reader.FieldsPerRecord = -1
+	//the header is omitted from the TriNetX file, but is should be: patient_id, encounter_id, code_system, code,
+	//principal_procedure_indicator, date, derived_by_TriNetX, source_id
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		if len(record) < 6 || !isProcedureCodeSystem(record[2]) {
+			continue
+		}
+		cpt := strings.ToUpper(record[3])
+		added := map[string]bool{}
+		for _, pc := range procedureCodes {
+			if !added[pc.Code] && pc.Match(cpt) {
+				added[pc.Code] = true
+				addExtraCodeEvent(result, record[0], pc.Code, record[5])
+			}
+		}
+	}
+	return result
+}
+
+// ProcedureInjector is a diagnosis processor that adds the procedures of patients from a TriNetX procedure file as
+// diagnoses, using the pseudo ICD10 codes the procedures are mapped onto.
+type ProcedureInjector struct {
+	Procedures   map[string]TreatmentInfo
+	AnalysisMaps AnalysisMaps
+	Ctr          map[string]int // the nr of procedure events added per pseudo code
+}
+
+// NewProcedureInjector creates a diagnosis processor that adds the procedures from a TriNetX procedure file as
+// diagnoses. The pseudo codes of the procedure code mappings must be registered in the analysis maps, cf.
+// ProcedureExtraCodes.
+func NewProcedureInjector(config *ParseConfig, procedureCodes []ProcedureCode, procedureInfoFile string,
+	analysisMaps AnalysisMaps) *ProcedureInjector {
+	return &ProcedureInjector{Procedures: parseTriNetXProcedureFile(config, procedureCodes, procedureInfoFile),
+		AnalysisMaps: analysisMaps, Ctr: map[string]int{}}
+}
+
+func (pi *ProcedureInjector) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (pi *ProcedureInjector) Finish(patients *trajectory.PatientMap) {
+	pCtr := 0
+	for _, patient := range patients.PIDMap {
+		if pi.AnalysisMaps.fillInNonICDPatientDiagnoses(patient, pi.Procedures) == 0 {
+			continue
+		}
+		pCtr++
+		for code, dates := range pi.Procedures[patient.PIDString] {
+			pi.Ctr[code] = pi.Ctr[code] + len(dates)
+		}
+	}
+	fmt.Println("Parsed procedures for: ", pCtr, " patients.")
+	codes := []string{}
+	for code := range pi.Ctr {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Println("Added ", pi.Ctr[code], " procedure events for ", code)
+	}
+}
@@ -0,0 +1,338 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"ptra/trajectory"
+	"strings"
+)
+
+//Post-processors for parsed diagnoses.
+//The diagnosis parser only maps the input onto diagnoses. Everything that is specific to a disease area, such as
+//marking the event of interest or adding treatments as diagnoses, is done by diagnosis processors that are configured
+//from the command line.
+
+// DiagnosisProcessor post-processes the diagnoses that are parsed for patients. ProcessDiagnosis is called for each
+// diagnosis that is filled in for a patient, in the order of the input, with its original ICD10 code. Finish is called
+// once all diagnoses are parsed. Processors are run in the order in which they are passed to the parser. The diagnoses
+// are parsed in parallel, so ProcessDiagnosis may be called concurrently for different patients, and must only update
+// the given patient.
+type DiagnosisProcessor interface {
+	ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate)
+	Finish(patients *trajectory.PatientMap)
+}
+
+// EOIMarker is a diagnosis processor that marks the diagnoses that match an event of interest. The dates of all events
+// of interest are collected in the patient's EOIDates, the first one is the patient's event of interest date.
+type EOIMarker struct {
+	EOI *EventOfInterest
+	Ctr int // the nr of events of interest marked
+}
+
+// NewEOIMarker creates a diagnosis processor that marks the events of interest.
+func NewEOIMarker(eoi *EventOfInterest) *EOIMarker {
+	return &EOIMarker{EOI: eoi}
+}
+
+func (m *EOIMarker) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+	if m.EOI.Match(icd10ID) {
+		patient.EOIDates = append(patient.EOIDates, date)
+	}
+}
+
+func (m *EOIMarker) Finish(patients *trajectory.PatientMap) {
+	pCtr := 0
+	for _, patient := range patients.PIDMap {
+		if len(patient.EOIDates) > 0 {
+			m.Ctr = m.Ctr + len(patient.EOIDates)
+			pCtr++
+			trajectory.SortEOIDates(patient)
+			patient.EOIDate = &patient.EOIDates[0] // mark first event of interest (e.g. bladder cancers diagnosis)
+		}
+	}
+	fmt.Println("Marked ", m.Ctr, " events of interest for ", pCtr, " patients.")
+}
+
+// NamedEOIMarker is a diagnosis processor that registers named events of interest next to the default event of
+// interest, e.g. the start of a treatment, cf. trajectory.RegisterEOI.
+type NamedEOIMarker struct {
+	Names []string                    // the names of the events of interest, in order of definition
+	EOIs  map[string]*EventOfInterest // the definition per name
+	Ctr   map[string]int              // the nr of patients per named event of interest
+}
+
+// NewNamedEOIMarker creates a diagnosis processor that registers named events of interest from a list of definitions
+// of the form name:ICD10Code, e.g. treatment:Z51.1. The ICD10 codes are matched as for NewEventOfInterest. Definitions
+// with the same name are combined. It returns an error for a malformed definition.
+func NewNamedEOIMarker(definitions []string) (*NamedEOIMarker, error) {
+	codes := map[string][]string{}
+	m := &NamedEOIMarker{EOIs: map[string]*EventOfInterest{}, Ctr: map[string]int{}}
+	for _, definition := range definitions {
+		fields := strings.Split(definition, ":")
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("invalid event of interest, expected name:ICD10Code: %s", definition)
+		}
+		name := strings.TrimSpace(fields[0])
+		if _, ok := codes[name]; !ok {
+			m.Names = append(m.Names, name)
+		}
+		codes[name] = append(codes[name], fields[1])
+	}
+	for name, nameCodes := range codes {
+		m.EOIs[name] = NewEventOfInterest(nameCodes)
+	}
+	return m, nil
+}
+
+func (m *NamedEOIMarker) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+	for _, name := range m.Names {
+		if m.EOIs[name].Match(icd10ID) {
+			trajectory.RegisterEOI(patient, name, icd10ID, date)
+		}
+	}
+}
+
+func (m *NamedEOIMarker) Finish(patients *trajectory.PatientMap) {
+	for _, patient := range patients.PIDMap {
+		for name := range patient.NamedEOIs {
+			m.Ctr[name]++
+		}
+	}
+	for _, name := range m.Names {
+		fmt.Println("Marked event of interest ", name, " for ", m.Ctr[name], " patients.")
+	}
+}
+
+// TreatmentInjector is a diagnosis processor that adds the treatments of patients, or other events defined as extra
+// codes, as diagnoses, so that they can be used to build trajectories.
+type TreatmentInjector struct {
+	Treatments   map[string]TreatmentInfo
+	AnalysisMaps AnalysisMaps
+}
+
+// NewTreatmentInjector creates a diagnosis processor that adds the events for the extra codes from a TriNetX treatment
+// file and the extra codes' event files as diagnoses. The extra codes must be registered in the analysis maps.
+func NewTreatmentInjector(config *ParseConfig, extraCodes []ExtraCode, treatmentInfoFile string,
+	analysisMaps AnalysisMaps) *TreatmentInjector {
+	return &TreatmentInjector{Treatments: parseExtraCodeEvents(config, extraCodes, treatmentInfoFile),
+		AnalysisMaps: analysisMaps}
+}
+
+func (ti *TreatmentInjector) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (ti *TreatmentInjector) Finish(patients *trajectory.PatientMap) {
+	nonICDCtr := 0
+	for _, patient := range patients.PIDMap {
+		//fill in non ICD10 diagnoses derived from procedure info
+		nonICDCtr = nonICDCtr + ti.AnalysisMaps.fillInNonICDPatientDiagnoses(patient, ti.Treatments)
+	}
+	fmt.Println("Parsed non ICD diagnoses for: ", nonICDCtr, " patients.")
+}
+
+// DeathCensor is a diagnosis processor that removes the diagnoses that are dated after a patient's death date. Such
+// diagnoses are administrative coding artifacts. Patients without a known death date are left unchanged.
+type DeathCensor struct {
+	Ctr int // the nr of diagnoses censored
+}
+
+// NewDeathCensor creates a diagnosis processor that censors the diagnoses recorded after the patients' death dates.
+func NewDeathCensor() *DeathCensor {
+	return &DeathCensor{}
+}
+
+func (dc *DeathCensor) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (dc *DeathCensor) Finish(patients *trajectory.PatientMap) {
+	pCtr := 0
+	for _, patient := range patients.PIDMap {
+		if n := censorAfterDeath(patient); n > 0 {
+			dc.Ctr = dc.Ctr + n
+			pCtr++
+		}
+	}
+	fmt.Println("Censored ", dc.Ctr, " diagnoses recorded after death for ", pCtr, " patients.")
+}
+
+// DeathCode is the pseudo ICD10 code of the death node, cf. DeathInjector.
+const DeathCode = "DEATH"
+
+// DeathExtraCode is the extra code that registers the death node in the analysis maps, cf. DeathInjector.
+var DeathExtraCode = ExtraCode{Code: DeathCode, Description: "Death", Column: -1}
+
+// DeathInjector is a diagnosis processor that adds the deaths of patients as diagnoses at their death dates, so that
+// trajectories can end in death. The death node must be registered in the analysis maps, cf. DeathExtraCode, and be
+// marked as a terminal diagnosis of the experiment, cf. MarkDeathTerminal.
+type DeathInjector struct {
+	AnalysisMaps AnalysisMaps
+	Ctr          int // the nr of deaths added
+}
+
+// NewDeathInjector creates a diagnosis processor that adds the deaths of patients with a known death date as
+// diagnoses.
+func NewDeathInjector(analysisMaps AnalysisMaps) *DeathInjector {
+	return &DeathInjector{AnalysisMaps: analysisMaps}
+}
+
+func (di *DeathInjector) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (di *DeathInjector) Finish(patients *trajectory.PatientMap) {
+	dids := di.AnalysisMaps.GetDIDs(DeathCode)
+	for _, patient := range patients.PIDMap {
+		if patient.DeathDate == nil {
+			continue
+		}
+		di.Ctr++
+		for _, did := range dids {
+			trajectory.AddDiagnosis(patient, &trajectory.Diagnosis{PID: patient.PID, DID: did, Date: *patient.DeathDate})
+		}
+	}
+	fmt.Println("Added the death of ", di.Ctr, " patients as diagnoses.")
+}
+
+// MarkDeathTerminal marks the death node as a terminal diagnosis of an experiment, so that trajectories are never
+// extended past death.
+func MarkDeathTerminal(exp *trajectory.Experiment, analysisMaps AnalysisMaps) {
+	if exp.TerminalDiagnoses == nil {
+		exp.TerminalDiagnoses = map[int]bool{}
+	}
+	for _, did := range analysisMaps.GetDIDs(DeathCode) {
+		exp.TerminalDiagnoses[did] = true
+	}
+}
+
+// censorAfterDeath removes the diagnoses of a patient that are dated after the patient's death date, and returns the
+// number of removed diagnoses.
+func censorAfterDeath(patient *trajectory.Patient) int {
+	if patient.DeathDate == nil {
+		return 0
+	}
+	newDiagnoses := []*trajectory.Diagnosis{}
+	for _, diagnosis := range patient.Diagnoses {
+		if trajectory.DiagnosisDateSmallerThan(*patient.DeathDate, diagnosis.Date) {
+			continue
+		}
+		newDiagnoses = append(newDiagnoses, diagnosis)
+	}
+	n := len(patient.Diagnoses) - len(newDiagnoses)
+	patient.Diagnoses = newDiagnoses
+	return n
+}
+
+// Modes for handling diagnoses dated before a patient's year of birth.
+const (
+	BeforeYOBDrop  = "drop"  // remove the diagnoses
+	BeforeYOBClamp = "clamp" // move the diagnoses to January 1st of the year of birth
+)
+
+// BirthCensor is a diagnosis processor that handles the diagnoses that are dated before a patient's year of birth.
+// Such diagnoses are data errors that would result in negative ages. Depending on the mode, the diagnoses are dropped,
+// or their date is clamped to January 1st of the year of birth.
+type BirthCensor struct {
+	Mode string
+	Ctr  int // the nr of diagnoses dated before the year of birth
+}
+
+// NewBirthCensor creates a diagnosis processor that drops or clamps the diagnoses dated before the patients' year of
+// birth. The mode is BeforeYOBDrop or BeforeYOBClamp.
+func NewBirthCensor(mode string) *BirthCensor {
+	return &BirthCensor{Mode: mode}
+}
+
+func (bc *BirthCensor) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (bc *BirthCensor) Finish(patients *trajectory.PatientMap) {
+	pCtr := 0
+	for _, patient := range patients.PIDMap {
+		newDiagnoses := []*trajectory.Diagnosis{}
+		n := 0
+		for _, diagnosis := range patient.Diagnoses {
+			if diagnosis.Date.Year < patient.YOB {
+				n++
+				if bc.Mode != BeforeYOBClamp {
+					continue
+				}
+				diagnosis.Date = trajectory.DiagnosisDate{Year: patient.YOB, Month: 1, Day: 1}
+			}
+			newDiagnoses = append(newDiagnoses, diagnosis)
+		}
+		patient.Diagnoses = newDiagnoses
+		if n > 0 {
+			bc.Ctr = bc.Ctr + n
+			pCtr++
+		}
+	}
+	if bc.Mode == BeforeYOBClamp {
+		fmt.Println("Clamped ", bc.Ctr, " diagnoses dated before the year of birth for ", pCtr, " patients.")
+	} else {
+		fmt.Println("Dropped ", bc.Ctr, " diagnoses dated before the year of birth for ", pCtr, " patients.")
+	}
+}
+
+// BurstCollapser is a diagnosis processor that collapses bursts of the same diagnosis into a single diagnosis. A burst
+// is a series of occurrences of the same diagnosis where each occurrence follows the previous one within Window years.
+// Only the first occurrence of a burst is kept. With a window of 0, the collapser does nothing, since duplicate
+// diagnoses on the same day are already removed after parsing, cf. parseTrinetXPatientDiagnosisRecords. The collapser
+// sorts the diagnoses of each patient by date.
+type BurstCollapser struct {
+	Window float64
+}
+
+// NewBurstCollapser creates a diagnosis processor that collapses bursts of the same diagnosis within a window of years.
+func NewBurstCollapser(window float64) *BurstCollapser {
+	return &BurstCollapser{Window: window}
+}
+
+func (bc *BurstCollapser) ProcessDiagnosis(patient *trajectory.Patient, icd10ID string, date trajectory.DiagnosisDate) {
+}
+
+func (bc *BurstCollapser) Finish(patients *trajectory.PatientMap) {
+	if bc.Window <= 0 {
+		return
+	}
+	patientList := patientList(patients)
+	parallel.Range(0, len(patientList), 0, func(low, high int) {
+		for _, patient := range patientList[low:high] {
+			trajectory.SortDiagnoses(patient)
+			collapseBursts(patient, bc.Window)
+		}
+	})
+}
+
+// collapseBursts removes the diagnoses of a patient that follow an occurrence of the same diagnosis within window years.
+// The patient's diagnoses must be sorted.
+func collapseBursts(patient *trajectory.Patient, window float64) {
+	last := map[int]float64{} // DID -> date of the last occurrence
+	newDiagnoses := []*trajectory.Diagnosis{}
+	for _, diagnosis := range patient.Diagnoses {
+		date := trajectory.DiagnosisDateToFloat(diagnosis.Date)
+		prev, ok := last[diagnosis.DID]
+		last[diagnosis.DID] = date
+		if ok && date-prev <= window {
+			continue
+		}
+		newDiagnoses = append(newDiagnoses, diagnosis)
+	}
+	patient.Diagnoses = newDiagnoses
+}
@@ -0,0 +1,309 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"fmt"
+	"ptra/trajectory"
+	"strings"
+)
+
+//Filter registry.
+//The patient filters of --pfilters and the trajectory filters of --tfilters are looked up by name in a registry, so
+//that use-case specific filters can live in a separate package instead of in ptra's main package. Such a package
+//registers its filters in an init function, and is linked into ptra with a blank import in main.go, e.g.
+//
+//	import _ "ptra/examples/customfilter"
+//
+//A filter is written as name or name:args on the command line, e.g. hasCode:C67. Its constructor receives the
+//arguments after the first colon, and a filter context with the data that filters may need. The built-in filters are
+//registered the same way, cf. registerPatientFilters and registerTrajectoryFilters.
+
+// FilterContext is the data that filter constructors can use.
+type FilterContext struct {
+	Experiment     *trajectory.Experiment   // the experiment, nil for patient filters, which are created before it
+	TumorInfo      map[string][]*TumorInfo  // the tumor information of --tumorInfo
+	TreatmentInfo  map[string]TreatmentInfo // the treatments of --treatmentInfo, cf. TreatmentData
+	StageSelection StageSelection           // the tumor information entry the cancer stage filters check
+	AnalysisMaps   AnalysisMaps             // for resolving ICD10 codes
+	RegionIDs      map[string]int           // the region IDs by region name, cf. RegionData and ParseTriNetXRegions
+	CohortLists    *[]*CohortList           // if not nil, collects the cohort lists of the cohort file filters
+}
+
+// FilterData is a set of flags for the input data that a patient filter needs, so that the data is only parsed if a
+// filter uses it, cf. PatientFilterNeeds.
+type FilterData int
+
+const (
+	TreatmentData FilterData = 1 << iota // the treatments of --treatmentInfo in FilterContext.TreatmentInfo
+	RegionData                           // the regions of the patient file in FilterContext.RegionIDs
+)
+
+// PatientFilterConstructor creates a patient filter from the arguments of a filter name, i.e. the text after the first
+// colon, or "" if there is none. It returns an error if the arguments are invalid.
+type PatientFilterConstructor func(args string, ctx FilterContext) (trajectory.PatientFilter, error)
+
+// TrajectoryFilterConstructor creates a trajectory filter from the arguments of a filter name, cf.
+// PatientFilterConstructor.
+type TrajectoryFilterConstructor func(args string, ctx FilterContext) (trajectory.TrajectoryFilter, error)
+
+// PatientFilterSpec describes a patient filter for the registry, cf. RegisterPatientFilter.
+type PatientFilterSpec struct {
+	Name   string // the name of the filter, which must not contain a colon
+	Usage  string // the usage of the filter for --listFilters, e.g. hasCode:ICD10Code, or "" for the name
+	Prefix bool   // the name is a prefix, e.g. age for age80+, and the arguments are the text that follows it
+	Needs  FilterData
+	New    PatientFilterConstructor
+}
+
+// TrajectoryFilterSpec describes a trajectory filter for the registry, cf. RegisterTrajectoryFilter.
+type TrajectoryFilterSpec struct {
+	Name     string // the name of the filter, which must not contain a colon
+	Usage    string // the usage of the filter for --listFilters, e.g. contains:codes, or "" for the name
+	ListArgs bool   // the arguments are a comma-separated list that runs up to the next filter, e.g. contains:J44,J45
+	// Check checks the arguments before the RR scores are computed, so that invalid arguments are reported early. It
+	// may be nil. The constructor is only called after the RR scores are computed.
+	Check func(args string) error
+	New   TrajectoryFilterConstructor
+}
+
+// usage returns the usage of a patient filter spec for --listFilters.
+func (spec *PatientFilterSpec) usage() string {
+	if spec.Usage == "" {
+		return spec.Name
+	}
+	return spec.Usage
+}
+
+// usage returns the usage of a trajectory filter spec for --listFilters.
+func (spec *TrajectoryFilterSpec) usage() string {
+	if spec.Usage == "" {
+		return spec.Name
+	}
+	return spec.Usage
+}
+
+var (
+	patientFilterRegistry    = []*PatientFilterSpec{}
+	trajectoryFilterRegistry = []*TrajectoryFilterSpec{}
+)
+
+// splitFilterName splits a filter of the form name or name:args into its name and arguments.
+func splitFilterName(s string) (string, string) {
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// checkFilterName panics if a filter name is invalid or already registered.
+func checkFilterName(kind, name string, registered func(name string) bool) {
+	if name == "" || strings.Contains(name, ":") {
+		panic(fmt.Sprintf("invalid %s filter name %q", kind, name))
+	}
+	if registered(name) {
+		panic(fmt.Sprintf("%s filter %q registered twice", kind, name))
+	}
+}
+
+// RegisterPatientFilter registers a patient filter. It is meant to be called from init functions. It panics if the
+// name is already registered, so that a custom filter cannot silently replace a built-in filter. The filters are
+// listed in the order in which they are registered, cf. PatientFilterUsages.
+func RegisterPatientFilter(spec PatientFilterSpec) {
+	checkFilterName("patient", spec.Name, func(name string) bool {
+		for _, s := range patientFilterRegistry {
+			if s.Name == name {
+				return true
+			}
+		}
+		return false
+	})
+	patientFilterRegistry = append(patientFilterRegistry, &spec)
+}
+
+// RegisterTrajectoryFilter registers a trajectory filter, cf. RegisterPatientFilter.
+func RegisterTrajectoryFilter(spec TrajectoryFilterSpec) {
+	checkFilterName("trajectory", spec.Name, func(name string) bool {
+		return lookupTrajectoryFilter(name) != nil
+	})
+	trajectoryFilterRegistry = append(trajectoryFilterRegistry, &spec)
+}
+
+// lookupPatientFilter returns the registered patient filter of a filter of the form name or name:args, and its
+// arguments. The filters with a fixed name are looked up before the filters with a prefix. It returns nil if the name
+// is not registered.
+func lookupPatientFilter(s string) (*PatientFilterSpec, string) {
+	name, args := splitFilterName(s)
+	for _, spec := range patientFilterRegistry {
+		if !spec.Prefix && spec.Name == name {
+			return spec, args
+		}
+	}
+	for _, spec := range patientFilterRegistry {
+		if spec.Prefix && strings.HasPrefix(s, spec.Name) {
+			return spec, strings.TrimPrefix(s, spec.Name)
+		}
+	}
+	return nil, ""
+}
+
+// lookupTrajectoryFilter returns the registered trajectory filter of a filter of the form name or name:args, or nil
+// if the name is not registered.
+func lookupTrajectoryFilter(s string) *TrajectoryFilterSpec {
+	name, _ := splitFilterName(s)
+	for _, spec := range trajectoryFilterRegistry {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// PatientFilterUsages returns the usages of the registered patient filters in the order in which they are registered,
+// cf. --listFilters.
+func PatientFilterUsages() []string {
+	usages := []string{}
+	for _, spec := range patientFilterRegistry {
+		usages = append(usages, spec.usage())
+	}
+	return usages
+}
+
+// TrajectoryFilterUsages returns the usages of the registered trajectory filters in the order in which they are
+// registered, cf. --listFilters.
+func TrajectoryFilterUsages() []string {
+	usages := []string{}
+	for _, spec := range trajectoryFilterRegistry {
+		usages = append(usages, spec.usage())
+	}
+	return usages
+}
+
+// NewPatientFilter creates the registered patient filter of a filter of the form name or name:args. It returns an
+// error for an unknown name, or if the constructor rejects the arguments.
+func NewPatientFilter(s string, ctx FilterContext) (trajectory.PatientFilter, error) {
+	spec, args := lookupPatientFilter(s)
+	if spec == nil {
+		return nil, fmt.Errorf("unknown patient filter %q, valid patient filters: %s", s,
+			strings.Join(PatientFilterUsages(), ", "))
+	}
+	return spec.New(args, ctx)
+}
+
+// patientFilterNames returns the filter names of a patient filter expression, cf.
+// trajectory.ParsePatientFilterExpression.
+func patientFilterNames(expression string) []string {
+	names := []string{}
+	for _, name := range strings.FieldsFunc(expression, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == '(' || r == ')'
+	}) {
+		switch strings.ToUpper(name) {
+		case "AND", "OR", "NOT":
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// PatientFilterNeeds returns the input data that the filters of a patient filter expression need, cf. FilterData.
+// Unknown filter names are ignored, they are reported by NewPatientFilterExpression.
+func PatientFilterNeeds(expression string) FilterData {
+	var needs FilterData
+	for _, name := range patientFilterNames(expression) {
+		if spec, _ := lookupPatientFilter(name); spec != nil {
+			needs |= spec.Needs
+		}
+	}
+	return needs
+}
+
+// NewPatientFilterExpression compiles a patient filter expression, cf. trajectory.ParsePatientFilterExpression, into
+// a patient filter, with the registered patient filters, cf. NewPatientFilter. It returns an error if the expression
+// is invalid or contains an unknown filter.
+func NewPatientFilterExpression(expression string, ctx FilterContext) (trajectory.PatientFilter, error) {
+	return trajectory.ParsePatientFilterExpression(expression, func(name string) (trajectory.PatientFilter, error) {
+		return NewPatientFilter(name, ctx)
+	})
+}
+
+// splitTrajectoryFilters splits a comma-separated list of trajectory filters into the filters, cf.
+// NewTrajectoryFilters. The startsWith: and endsWith: spellings are normalized to startswith: and endswith:.
+func splitTrajectoryFilters(f string) []string {
+	fs := []string{}
+	list := -1 // index of the last filter with a list of arguments in fs
+	for _, f := range strings.Split(f, ",") {
+		if strings.HasPrefix(f, "startsWith:") || strings.HasPrefix(f, "endsWith:") {
+			f = strings.Replace(f, "With:", "with:", 1)
+		}
+		spec := lookupTrajectoryFilter(f)
+		switch {
+		case spec != nil && spec.ListArgs && strings.Contains(f, ":"):
+			list = len(fs)
+			fs = append(fs, f)
+		case list >= 0 && !strings.Contains(f, ":") && spec == nil:
+			fs[list] = fs[list] + "," + f
+		default:
+			list = -1
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// CheckTrajectoryFilters checks if the filters of a comma-separated list of trajectory filters are known and if their
+// arguments are valid, cf. TrajectoryFilterSpec.Check, so that errors are reported before the RR scores are computed.
+// The ICD10 codes of the filters are only checked by NewTrajectoryFilters.
+func CheckTrajectoryFilters(f string) error {
+	for _, f := range splitTrajectoryFilters(f) {
+		spec := lookupTrajectoryFilter(f)
+		if spec == nil {
+			return fmt.Errorf("unknown trajectory filter %q, valid trajectory filters: %s", f,
+				strings.Join(TrajectoryFilterUsages(), ", "))
+		}
+		if spec.Check != nil {
+			_, args := splitFilterName(f)
+			if err := spec.Check(args); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NewTrajectoryFilters creates the registered trajectory filters of a comma-separated list of trajectory filters. The
+// arguments of a filter with a list of arguments, e.g. the ICD10 codes of contains, are also comma-separated, e.g.
+// contains:C67.0,C67.1,neoplasm: all entries following contains: up to the next filter name are codes of the contains
+// filter. It returns an error if a filter is unknown, cf. CheckTrajectoryFilters, or if a constructor rejects its
+// arguments, e.g. an unknown ICD10 code.
+func NewTrajectoryFilters(f string, ctx FilterContext) ([]trajectory.TrajectoryFilter, error) {
+	if err := CheckTrajectoryFilters(f); err != nil {
+		return nil, err
+	}
+	result := []trajectory.TrajectoryFilter{}
+	for _, f := range splitTrajectoryFilters(f) {
+		_, args := splitFilterName(f)
+		filter, err := lookupTrajectoryFilter(f).New(args, ctx)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, filter)
+	}
+	return result, nil
+}
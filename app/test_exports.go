@@ -24,6 +24,11 @@ var IntializeIcd10AnalysisMaps = intializeIcd10AnalysisMaps
 var InitializeIcd10NameMap = initializeIcd10NameMap
 var InitializeIcd10AnalysisMapsFromXML = initializeIcd10AnalysisMapsFromXML
 var ParseTrinetXPatientDiagnoses = parseTrinetXPatientDiagnoses
+var ParseTrinetXPatientDiagnosisFile = parseTrinetXPatientDiagnosisFile
 var ParseIcd10HierarchyFromXml = parseIcd10HierarchyFromXml
 var PrintIcd10Hierarchy = printIcd10Hierarchy
 var PrintIcd10NameMap = printIcd10NameMap
+var InitializeIcd10AnalysisMapsFromCCSR = initializeIcd10AnalysisMapsFromCCSR
+var GetIcd10DescToExcludeFromAnalysis = getIcd10DescToExcludeFromAnalysis
+var LoadExclusionConfig = loadExclusionConfig
+var ParseSNOMEDToICD10Mapping = parseSNOMEDToICD10Mapping
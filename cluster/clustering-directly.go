@@ -99,8 +99,12 @@ func convertTrajectoriesToAbcFormat(exp *trajectory.Experiment, name string) {
 
 // ClusterTrajectoriesDirectly performs clustering of the trajectories that have been calculated for a given experiment.
 // It does a pairwise comparison of all trajectories by calculating the jaccard similarity coefficients. Subsequently,
-// MCL clustering is used to group the trajectories by jaccard similarity into clusters.
-func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int, path, pathToMcl string) {
+// MCL clustering is used to group the trajectories by jaccard similarity into clusters. It also writes the
+// co-occurrence network of the diagnoses in the trajectories to a file name.cooccurrence.abc for the mcl tool, cf.
+// BuildTrajectoryCoOccurrenceNetwork. It returns the quality of the clustering for each granularity, cf.
+// ClusterQuality.
+func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int, path,
+	pathToMcl string) []ClusterQuality {
 	fmt.Println("Clustering trajectories directly with MCL")
 	// convert trajectories to abc format for the mcl tool
 	dirName := fmt.Sprintf("%s-clusters-directly/", exp.Name)
@@ -114,6 +118,8 @@ func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int
 	os.Chdir(workingDir)
 	abcFileName := fmt.Sprintf("%s%s.abc", workingDir, exp.Name)
 	convertTrajectoriesToAbcFormat(exp, abcFileName)
+	// also export the co-occurrence network of the diagnoses in the trajectories, for clustering the diagnoses with mcl
+	convertCoOccurrenceNetworkToAbcFormat(exp, fmt.Sprintf("%s%s.cooccurrence.abc", workingDir, exp.Name))
 	tabFileName := fmt.Sprintf("%s%s.tab", workingDir, exp.Name)
 	mciFileName := fmt.Sprintf("%s%s.mci", workingDir, exp.Name)
 	mcxloadCmd := fmt.Sprintf("%smcxload", pathToMcl)
@@ -158,7 +164,10 @@ func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int
 			panic(err)
 		}
 	}
-	// convert the clusterings generated by mcl tool to gml format
+	// convert the clusterings generated by mcl tool to gml format, the quality is computed one row of jaccard
+	// similarity coefficients at a time, because the mcl path does not need the dense matrix of all trajectory pairs
+	jaccardRows := jaccardRowsForTrajectories(exp)
+	qualities := []ClusterQuality{}
 	for _, gran := range granularities {
 		dumpFileName := fmt.Sprintf("%s.I%d", outFileName, gran)
 		convertToDirectTrajectoryClusterGraphs(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
@@ -166,7 +175,9 @@ func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int
 		trajectory.PrintClusteredTrajectoriesToFile(exp, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
 		trajectory.PrintClustersToCSVFiles(exp, fmt.Sprintf("%s.clustered.patients.csv", dumpFileName),
 			fmt.Sprintf("%s.clustered.clusters.csv", dumpFileName))
+		qualities = append(qualities, computeClusterQuality(exp, jaccardRows, fmt.Sprintf("I%d", gran)))
 	}
+	return qualities
 }
 
 // collectTrajectoriesFromClusterData looks up trajectories associated with a given list of trajectory ids and assigns
@@ -327,7 +338,9 @@ func transitionInformation(exp *trajectory.Experiment, t *trajectory.Trajectory,
 // convertToDirectTrajectoryClusterGraphsRR converts MCL cluster output - a file with for each cluster id a list of
 // trajectory ids - to a GML output file that plots the trajectories as graphs. Each cluster is plotted as a separate
 // subgraph, with diagnosis codes used as nodes and trajectory transitions used as edges. The edges are annotated with
-// the relatitive risk score (RR) associated with the diagnosis pair that the edge represents.
+// the relatitive risk score (RR) associated with the diagnosis pair that the edge represents, and carry its absolute
+// risk difference and, if known, its p-value as RD and pvalue attributes. With odds ratios, the graphs have an
+// effectMeasure "OR" attribute, cf. trajectory.GMLEffectMeasure.
 func convertToDirectTrajectoryClusterGraphsRR(exp *trajectory.Experiment, input, output string) {
 	file, err := os.Open(input)
 	if err != nil {
@@ -377,7 +390,7 @@ func convertToDirectTrajectoryClusterGraphsRR(exp *trajectory.Experiment, input,
 		// print header
 		fmt.Fprintf(ofile,
 			fmt.Sprintf("graph [ \n comment \"cluster %d\" \n directed 1 \n label \"cluster %d\" \n "+
-				"multigraph 1\n", nofClusters-1, nofClusters-1))
+				"multigraph 1\n%s", nofClusters-1, nofClusters-1, trajectory.GMLEffectMeasure(exp)))
 		nodePrinted := map[int]bool{}
 		// print nodes
 		for _, t := range collected {
@@ -401,7 +414,9 @@ func convertToDirectTrajectoryClusterGraphsRR(exp *trajectory.Experiment, input,
 				if !edgePrinted[d1][d2] {
 					edgePrinted[d1][d2] = true
 					RR := strconv.FormatFloat(exp.DxDRR[d1][d2], 'f', 2, 64)
-					fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %s\n]\n", d1, d2, RR))
+					RD := strconv.FormatFloat(trajectory.RiskDifference(exp, d1, d2), 'f', 4, 64)
+					fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %s\nRD %s\n%s]\n", d1, d2, RR, RD,
+						trajectory.GMLPValue(exp, d1, d2)))
 					//rr, mfratio, eoi := transitionInformation(exp, t, tctr, d1, d2)
 					//fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel \"RR:%s,M/F:%s,EOI:%s\"\n]\n", d1, d2, rr, mfratio, eoi))
 				}
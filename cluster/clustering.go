@@ -22,14 +22,18 @@ import (
 	"bytes"
 	"encoding/csv"
 	"fmt"
+	"github.com/exascience/pargo/parallel"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"ptra/trajectory"
 	"ptra/utils"
+	"sort"
 	"strconv"
+	"sync/atomic"
 )
 
 // Clustering as in Brunak paper
@@ -111,6 +115,51 @@ func convertTrajectoryPairsToAbcFormat(exp *trajectory.Experiment, name string)
 	}
 }
 
+// BuildTrajectoryCoOccurrenceNetwork counts for each pair of diagnosis codes how many trajectories of an experiment
+// contain both, regardless of their order in the trajectories. The resulting matrix is symmetric, and its diagonal is
+// 0. Unlike the jaccard index for pairs, which only links diagnoses that follow each other in a trajectory, this groups
+// diagnoses that tend to appear together in the same trajectories.
+func BuildTrajectoryCoOccurrenceNetwork(exp *trajectory.Experiment) [][]int {
+	network := make([][]int, exp.NofDiagnosisCodes)
+	for i := range network {
+		network[i] = make([]int, exp.NofDiagnosisCodes)
+	}
+	for _, t := range exp.Trajectories {
+		codes := trajectoryCodes(t)
+		for i, d1 := range codes {
+			for _, d2 := range codes[i+1:] {
+				network[d1][d2]++
+				network[d2][d1]++
+			}
+		}
+	}
+	return network
+}
+
+// convertCoOccurrenceNetworkToAbcFormat writes the trajectory co-occurrence network of an experiment to file in abc
+// format for the mcl tool, cf. BuildTrajectoryCoOccurrenceNetwork. Each pair of diagnosis codes that co-occur is
+// written once, with the nr of trajectories that contain both as weight, as mcxload mirrors the edges.
+func convertCoOccurrenceNetworkToAbcFormat(exp *trajectory.Experiment, name string) {
+	//create output file
+	file, err := os.Create(name)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Panic(err)
+		}
+	}()
+	network := BuildTrajectoryCoOccurrenceNetwork(exp)
+	for d1, d2s := range network {
+		for d2 := d1 + 1; d2 < len(d2s); d2++ {
+			if d2s[d2] > 0 {
+				fmt.Fprintf(file, "%d\t%d\t%d\n", d1, d2, d2s[d2])
+			}
+		}
+	}
+}
+
 func ClusterTrajectories(exp *trajectory.Experiment, granularities []int, path, pathToMcl string) {
 	fmt.Println("Clustering trajectories with MCL")
 	// convert trajectories to abc format for the mcl tool
@@ -382,3 +431,596 @@ func convertToTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output
 	fmt.Println("Collected ", nofClusters, " clusters and ", len(trajectories), " not clustered trajectories.")
 	fmt.Println("Clustered ", len(exp.Trajectories)-len(trajectories), " out of ", len(exp.Trajectories), " trajectories.")
 }
+
+// Hierarchical clustering
+// Agglomerative clustering of the trajectories in pure Go, as an alternative to the MCL clustering that requires the
+// mcl binaries. Each trajectory starts in its own cluster, and the two most similar clusters are merged until no two
+// clusters are at least threshold similar. The similarity between two trajectories is their jaccard similarity
+// coefficient, as for ClusterTrajectoriesDirectly. The similarity between two clusters depends on the linkage:
+// single linkage takes the maximum similarity between their trajectories, complete linkage the minimum, and average
+// linkage the mean.
+
+// Linkage criteria for ClusterTrajectoriesHierarchical.
+const (
+	SingleLinkage   = "single"
+	CompleteLinkage = "complete"
+	AverageLinkage  = "average"
+)
+
+// mergeLinkage computes the similarity between a cluster k and the merge of clusters i and j, given the similarities
+// si and sj between k and i, and k and j, and the sizes ni and nj of i and j (Lance-Williams).
+func mergeLinkage(linkage string, si, sj float64, ni, nj int) float64 {
+	switch linkage {
+	case SingleLinkage:
+		return math.Max(si, sj)
+	case CompleteLinkage:
+		return math.Min(si, sj)
+	case AverageLinkage:
+		return (float64(ni)*si + float64(nj)*sj) / float64(ni+nj)
+	default:
+		panic(fmt.Sprintf("unknown linkage %q", linkage))
+	}
+}
+
+// agglomerativeClusters clusters the items of a symmetric similarity matrix with the given linkage, merging clusters
+// until no two clusters are at least threshold similar. The similarity matrix is overwritten. It returns the clusters
+// as sorted lists of item indices, ordered by their first item.
+func agglomerativeClusters(similarity [][]float64, linkage string, threshold float64) [][]int {
+	n := len(similarity)
+	members := make([][]int, n)
+	active := make([]bool, n)
+	// best[i] is the most similar active cluster to cluster i
+	best := make([]int, n)
+	for i := range members {
+		members[i] = []int{i}
+		active[i] = true
+	}
+	updateBest := func(i int) {
+		best[i] = -1
+		for j := 0; j < n; j++ {
+			if j != i && active[j] && (best[i] == -1 || similarity[i][j] > similarity[i][best[i]]) {
+				best[i] = j
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		updateBest(i)
+	}
+	for {
+		// find the most similar pair of clusters
+		i := -1
+		for k := 0; k < n; k++ {
+			if active[k] && best[k] != -1 && (i == -1 || similarity[k][best[k]] > similarity[i][best[i]]) {
+				i = k
+			}
+		}
+		if i == -1 || similarity[i][best[i]] < threshold {
+			break
+		}
+		j := best[i]
+		if j < i {
+			i, j = j, i
+		}
+		// merge cluster j into cluster i
+		for k := 0; k < n; k++ {
+			if active[k] && k != i && k != j {
+				s := mergeLinkage(linkage, similarity[i][k], similarity[j][k], len(members[i]), len(members[j]))
+				similarity[i][k] = s
+				similarity[k][i] = s
+			}
+		}
+		members[i] = append(members[i], members[j]...)
+		members[j] = nil
+		active[j] = false
+		// the merged similarities never exceed the previous best ones, so only the clusters that had i or j as their
+		// most similar cluster need to be updated
+		for k := 0; k < n; k++ {
+			if active[k] && (k == i || best[k] == i || best[k] == j) {
+				updateBest(k)
+			}
+		}
+	}
+	clusters := [][]int{}
+	for i, ms := range members {
+		if active[i] {
+			sort.Ints(ms)
+			clusters = append(clusters, ms)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters
+}
+
+// writeClusterData writes clusters of trajectory ids to a file in the format of the MCL cluster output, i.e. a line per
+// cluster that lists the ids of its trajectories separated by tabs.
+func writeClusterData(clusters [][]int, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, c := range clusters {
+		for i, id := range c {
+			if i > 0 {
+				fmt.Fprint(file, "\t")
+			}
+			fmt.Fprint(file, id)
+		}
+		fmt.Fprintln(file)
+	}
+}
+
+// ClusterTrajectoriesHierarchical performs agglomerative clustering of the trajectories that have been calculated for
+// a given experiment, without the need for the mcl binaries. The linkage is SingleLinkage, CompleteLinkage, or
+// AverageLinkage, and clusters are merged as long as their similarity is at least threshold, a jaccard similarity
+// coefficient between 0 and 1. The output files are the same as for ClusterTrajectoriesDirectly, in a folder
+// name-clusters-hierarchical in the output path. It returns the quality of the clustering, cf. ClusterQuality.
+func ClusterTrajectoriesHierarchical(exp *trajectory.Experiment, linkage string, threshold float64,
+	outputPath string) []ClusterQuality {
+	fmt.Println("Clustering trajectories with ", linkage, " linkage hierarchical clustering")
+	switch linkage {
+	case SingleLinkage, CompleteLinkage, AverageLinkage:
+	default:
+		panic(fmt.Sprintf("unknown linkage %q", linkage))
+	}
+	dirName := fmt.Sprintf("%s-clusters-hierarchical/", exp.Name)
+	workingDir := filepath.Join(outputPath, dirName) + string(filepath.Separator)
+	fmt.Println("Working path becomes: ", workingDir)
+	derr := os.MkdirAll(workingDir, 0777)
+	if derr != nil {
+		panic(derr)
+	}
+	jaccardIndex := computeJaccardIndexForTrajectories(exp)
+	similarity := make([][]float64, len(jaccardIndex))
+	for i, row := range jaccardIndex {
+		similarity[i] = append([]float64{}, row...)
+	}
+	clusters := agglomerativeClusters(similarity, linkage, threshold)
+	fmt.Println("Collected ", len(clusters), " clusters for ", len(exp.Trajectories), " trajectories")
+	dumpFileName := fmt.Sprintf("%sdump.%s.%s.T%s", workingDir, exp.Name, linkage,
+		strconv.FormatFloat(threshold, 'f', -1, 64))
+	writeClusterData(clusters, dumpFileName)
+	convertToDirectTrajectoryClusterGraphs(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
+	convertToDirectTrajectoryClusterGraphsRR(exp, dumpFileName, fmt.Sprintf("%s.trajectories.RR.gml", dumpFileName))
+	trajectory.PrintClusteredTrajectoriesToFile(exp, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
+	trajectory.PrintClustersToCSVFiles(exp, fmt.Sprintf("%s.clustered.patients.csv", dumpFileName),
+		fmt.Sprintf("%s.clustered.clusters.csv", dumpFileName))
+	return []ClusterQuality{computeClusterQuality(exp, DenseSimilarityRows(jaccardIndex),
+		fmt.Sprintf("%s:%s", linkage, strconv.FormatFloat(threshold, 'f', -1, 64)))}
+}
+
+// Cluster quality
+// The quality of a clustering of the trajectories is measured with the jaccard distance between trajectories, i.e. 1
+// minus their jaccard similarity coefficient, so that different clusterings of the same trajectories, e.g. with
+// different granularities, can be compared.
+
+// computeJaccardIndexForTrajectories computes the jaccard similarity coefficient for each pair of trajectories of an
+// experiment, indexed by the positions of the trajectories in the experiment, which are also assigned as their IDs.
+func computeJaccardIndexForTrajectories(exp *trajectory.Experiment) [][]float64 {
+	index := make([][]float64, len(exp.Trajectories))
+	for i := range index {
+		index[i] = make([]float64, len(exp.Trajectories))
+	}
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for i := low; i < high; i++ {
+			exp.Trajectories[i].ID = i
+			for j := 0; j < len(exp.Trajectories); j++ {
+				if j == i {
+					index[i][j] = 1
+				} else {
+					index[i][j] = jaccardTrajectory(exp.Trajectories[i], exp.Trajectories[j])
+				}
+			}
+		}
+	})
+	return index
+}
+
+// SimilarityRows computes the similarity coefficients of trajectory i to all trajectories of an experiment into row,
+// indexed by the positions of the trajectories in the experiment, so that the cluster quality can be computed one row
+// at a time, without a dense matrix of all pairs of trajectories. It must be safe to call from multiple goroutines.
+type SimilarityRows func(i int, row []float64)
+
+// DenseSimilarityRows returns the rows of a dense matrix of similarity coefficients.
+func DenseSimilarityRows(matrix [][]float64) SimilarityRows {
+	return func(i int, row []float64) {
+		copy(row, matrix[i])
+	}
+}
+
+// jaccardRowsForTrajectories returns the rows of the jaccard similarity coefficients of the trajectories of an
+// experiment, cf. computeJaccardIndexForTrajectories, computed on demand.
+func jaccardRowsForTrajectories(exp *trajectory.Experiment) SimilarityRows {
+	return func(i int, row []float64) {
+		for j, t := range exp.Trajectories {
+			if j == i {
+				row[j] = 1
+			} else {
+				row[j] = jaccardTrajectory(exp.Trajectories[i], t)
+			}
+		}
+	}
+}
+
+// clusterIndices maps the cluster IDs of the trajectories of an experiment to consecutive indices. It returns the index
+// of each trajectory's cluster, and the number of clusters.
+func clusterIndices(exp *trajectory.Experiment) ([]int, int) {
+	indices := map[int]int{}
+	clusters := make([]int, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		index, ok := indices[t.Cluster]
+		if !ok {
+			index = len(indices)
+			indices[t.Cluster] = index
+		}
+		clusters[i] = index
+	}
+	return clusters, len(indices)
+}
+
+// meanClusterDistances computes the mean jaccard distance between the trajectories of each pair of clusters, given the
+// cluster index of each trajectory. The mean distance of a cluster to itself is over the pairs of different
+// trajectories, and 0 for a cluster with a single trajectory.
+func meanClusterDistances(jaccardRows SimilarityRows, clusters []int, nofClusters int) [][]float64 {
+	newMatrix := func() [][]float64 {
+		matrix := make([][]float64, nofClusters)
+		for c := range matrix {
+			matrix[c] = make([]float64, nofClusters)
+		}
+		return matrix
+	}
+	counts := newMatrix()
+	for i := range clusters {
+		for j := range clusters {
+			if i != j {
+				counts[clusters[i]][clusters[j]]++
+			}
+		}
+	}
+	sums := parallel.RangeReduce(0, len(clusters), 0, func(low, high int) interface{} {
+		sums := newMatrix()
+		row := make([]float64, len(clusters))
+		for i := low; i < high; i++ {
+			jaccardRows(i, row)
+			for j, coeff := range row {
+				if i != j {
+					sums[clusters[i]][clusters[j]] += 1 - coeff
+				}
+			}
+		}
+		return sums
+	}, func(x, y interface{}) interface{} {
+		sums := x.([][]float64)
+		for c1, row := range y.([][]float64) {
+			for c2, sum := range row {
+				sums[c1][c2] += sum
+			}
+		}
+		return sums
+	}).([][]float64)
+	for c1, row := range sums {
+		for c2 := range row {
+			if counts[c1][c2] > 0 {
+				row[c2] /= float64(counts[c1][c2])
+			}
+		}
+	}
+	return sums
+}
+
+// ComputeClusterSilhouette computes the mean silhouette score of the clustered trajectories of an experiment, given the
+// rows of the jaccard similarity coefficients of the trajectories, cf. SimilarityRows. The silhouette of a trajectory
+// is (b - a) / max(a, b), where a is its mean jaccard distance to the other trajectories in its cluster, and b its mean
+// jaccard distance to the trajectories in the nearest other cluster. It is 0 for a trajectory that is alone in its
+// cluster. The score ranges from -1 to 1, and higher is better. It is 0 if there are fewer than 2 clusters.
+func ComputeClusterSilhouette(exp *trajectory.Experiment, jaccardRows SimilarityRows) float64 {
+	clusters, nofClusters := clusterIndices(exp)
+	if nofClusters < 2 {
+		return 0
+	}
+	sizes := make([]int, nofClusters)
+	for _, c := range clusters {
+		sizes[c]++
+	}
+	silhouettes := make([]float64, len(clusters))
+	parallel.Range(0, len(clusters), 0, func(low, high int) {
+		sums := make([]float64, nofClusters)
+		row := make([]float64, len(clusters))
+		for i := low; i < high; i++ {
+			if sizes[clusters[i]] == 1 {
+				continue
+			}
+			for c := range sums {
+				sums[c] = 0
+			}
+			jaccardRows(i, row)
+			for j, coeff := range row {
+				if j != i {
+					sums[clusters[j]] += 1 - coeff
+				}
+			}
+			a := sums[clusters[i]] / float64(sizes[clusters[i]]-1)
+			b := math.Inf(1)
+			for c, sum := range sums {
+				if c != clusters[i] {
+					b = math.Min(b, sum/float64(sizes[c]))
+				}
+			}
+			if max := math.Max(a, b); max > 0 {
+				silhouettes[i] = (b - a) / max
+			}
+		}
+	})
+	sum := 0.0
+	for _, s := range silhouettes {
+		sum += s
+	}
+	return sum / float64(len(silhouettes))
+}
+
+// ComputeDaviesBouldin computes the Davies-Bouldin index of the clustered trajectories of an experiment, given the rows
+// of the jaccard similarity coefficients of the trajectories, cf. SimilarityRows. As there are no centroids for
+// trajectories, the scatter of a cluster is the mean jaccard distance between its trajectories, and the separation of
+// two clusters is the mean jaccard distance between their trajectories. The index is the mean over the clusters of the
+// maximum ratio of the summed scatters to the separation for any other cluster. Lower is better. It is 0 if there are
+// fewer than 2 clusters.
+func ComputeDaviesBouldin(exp *trajectory.Experiment, jaccardRows SimilarityRows) float64 {
+	clusters, nofClusters := clusterIndices(exp)
+	if nofClusters < 2 {
+		return 0
+	}
+	distances := meanClusterDistances(jaccardRows, clusters, nofClusters)
+	sum := 0.0
+	for c1 := 0; c1 < nofClusters; c1++ {
+		max := 0.0
+		for c2 := 0; c2 < nofClusters; c2++ {
+			if c2 != c1 && distances[c1][c2] > 0 {
+				max = math.Max(max, (distances[c1][c1]+distances[c2][c2])/distances[c1][c2])
+			}
+		}
+		sum += max
+	}
+	return sum / float64(nofClusters)
+}
+
+// ClusterQuality is the quality of a clustering of the trajectories of an experiment, e.g. for selecting the best MCL
+// granularity.
+type ClusterQuality struct {
+	Clustering    string  `json:"clustering"`    // the clustering, e.g. I40 for MCL granularity 40
+	Clusters      int     `json:"clusters"`      // the number of clusters
+	Silhouette    float64 `json:"silhouette"`    // cf. ComputeClusterSilhouette
+	DaviesBouldin float64 `json:"daviesBouldin"` // cf. ComputeDaviesBouldin
+	Entropy       float64 `json:"entropy"`       // the mean entropy of the clusters, cf. trajectory.ClusterEntropy
+}
+
+// meanClusterEntropy computes the mean entropy of the diagnoses in the clusters of the current clustering of the
+// trajectories of an experiment, cf. trajectory.ClusterEntropy. It is 0 if there are no clusters.
+func meanClusterEntropy(exp *trajectory.Experiment) float64 {
+	clusters := map[int][]*trajectory.Trajectory{}
+	for _, t := range exp.Trajectories {
+		clusters[t.Cluster] = append(clusters[t.Cluster], t)
+	}
+	if len(clusters) == 0 {
+		return 0
+	}
+	// sum in order of cluster ID, so that the mean is reproducible
+	cids := []int{}
+	for cid := range clusters {
+		cids = append(cids, cid)
+	}
+	sort.Ints(cids)
+	sum := 0.0
+	for _, cid := range cids {
+		sum += trajectory.ClusterEntropy(clusters[cid], exp)
+	}
+	return sum / float64(len(clusters))
+}
+
+// computeClusterQuality computes and prints the quality of the current clustering of the trajectories of an
+// experiment, given the rows of the jaccard similarity coefficients of the trajectories, cf. SimilarityRows.
+func computeClusterQuality(exp *trajectory.Experiment, jaccardRows SimilarityRows, clustering string) ClusterQuality {
+	_, nofClusters := clusterIndices(exp)
+	quality := ClusterQuality{
+		Clustering:    clustering,
+		Clusters:      nofClusters,
+		Silhouette:    ComputeClusterSilhouette(exp, jaccardRows),
+		DaviesBouldin: ComputeDaviesBouldin(exp, jaccardRows),
+		Entropy:       meanClusterEntropy(exp),
+	}
+	fmt.Println("Clustering ", clustering, ": ", nofClusters, " clusters, silhouette score ",
+		strconv.FormatFloat(quality.Silhouette, 'f', 4, 64), ", Davies-Bouldin index ",
+		strconv.FormatFloat(quality.DaviesBouldin, 'f', 4, 64), ", mean entropy ",
+		strconv.FormatFloat(quality.Entropy, 'f', 4, 64))
+	return quality
+}
+
+// K-means clustering
+// K-means clustering of the trajectories in pure Go, as an alternative to the MCL and hierarchical clustering when the
+// number of clusters is known upfront. Each trajectory is represented as a sparse binary vector over the diagnosis
+// codes, and Lloyd's algorithm alternates between assigning each trajectory to its nearest centroid and recomputing
+// each centroid as the mean vector of its trajectories. The distance between a trajectory and a centroid is the
+// weighted jaccard distance, which equals the jaccard distance between trajectories for binary centroids.
+
+// DefaultKMeansIter is the default maximum number of iterations of Lloyd's algorithm.
+const DefaultKMeansIter = 100
+
+// trajectoryCodes returns the set of diagnosis codes of a trajectory, i.e. its sparse binary vector.
+func trajectoryCodes(t *trajectory.Trajectory) []int {
+	codes := []int{}
+	for _, d := range t.Diagnoses {
+		if !utils.MemberInt(d, codes) {
+			codes = append(codes, d)
+		}
+	}
+	return codes
+}
+
+// centroidDistance computes the weighted jaccard distance between a trajectory, given by its set of diagnosis codes,
+// and a centroid with the given sum of its weights: 1 - sum(min(x, c)) / sum(max(x, c)).
+func centroidDistance(codes []int, centroid map[int]float64, total float64) float64 {
+	shared := 0.0
+	for _, d := range codes {
+		shared += centroid[d]
+	}
+	return 1 - shared/(total-shared+float64(len(codes)))
+}
+
+// initialKMeansCentroids selects k trajectories as initial centroids with farthest-first traversal over the jaccard
+// distances: the first is the trajectory with the smallest total distance to the others, and each next one is the
+// trajectory with the largest distance to its nearest selected one. This is deterministic. It returns nil if k is 0 or
+// there are no trajectories.
+func initialKMeansCentroids(jaccardIndex [][]float64, k int) []int {
+	if k <= 0 || len(jaccardIndex) == 0 {
+		return nil
+	}
+	first, minTotal := 0, math.Inf(1)
+	for i, row := range jaccardIndex {
+		total := 0.0
+		for _, coeff := range row {
+			total += 1 - coeff
+		}
+		if total < minTotal {
+			first, minTotal = i, total
+		}
+	}
+	selected := []int{first}
+	nearest := make([]float64, len(jaccardIndex))
+	for i := range nearest {
+		nearest[i] = 1 - jaccardIndex[i][first]
+	}
+	for len(selected) < k {
+		next := -1
+		for i, d := range nearest {
+			if next == -1 || d > nearest[next] {
+				next = i
+			}
+		}
+		selected = append(selected, next)
+		for i := range nearest {
+			nearest[i] = math.Min(nearest[i], 1-jaccardIndex[i][next])
+		}
+	}
+	return selected
+}
+
+// kMeansClusters clusters the trajectories of an experiment into k clusters with Lloyd's algorithm, for at most
+// maxIter iterations, given the jaccard similarity coefficient for each pair of trajectories. It returns the clusters
+// as sorted lists of trajectory positions, ordered by their first trajectory. Clusters that become empty are left out.
+// It returns nil if k is 0 or there are no trajectories.
+func kMeansClusters(exp *trajectory.Experiment, jaccardIndex [][]float64, k, maxIter int) [][]int {
+	if k <= 0 || len(exp.Trajectories) == 0 {
+		return nil
+	}
+	codes := make([][]int, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		codes[i] = trajectoryCodes(t)
+	}
+	centroids := make([]map[int]float64, k)
+	totals := make([]float64, k)
+	for c, i := range initialKMeansCentroids(jaccardIndex, k) {
+		centroids[c] = map[int]float64{}
+		for _, d := range codes[i] {
+			centroids[c][d] = 1
+		}
+		totals[c] = float64(len(codes[i]))
+	}
+	assignment := make([]int, len(codes))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for iter := 0; iter < maxIter; iter++ {
+		// assign each trajectory to its nearest centroid
+		var changed int64
+		parallel.Range(0, len(codes), 0, func(low, high int) {
+			for i := low; i < high; i++ {
+				nearest, minDistance := 0, math.Inf(1)
+				for c, centroid := range centroids {
+					if d := centroidDistance(codes[i], centroid, totals[c]); d < minDistance {
+						nearest, minDistance = c, d
+					}
+				}
+				if assignment[i] != nearest {
+					assignment[i] = nearest
+					atomic.AddInt64(&changed, 1)
+				}
+			}
+		})
+		if changed == 0 {
+			fmt.Println("K-means converged after ", iter, " iterations")
+			break
+		}
+		// recompute the centroids as the mean vectors of their trajectories
+		sizes := make([]int, k)
+		for c := range centroids {
+			centroids[c] = map[int]float64{}
+		}
+		for i, c := range assignment {
+			sizes[c]++
+			for _, d := range codes[i] {
+				centroids[c][d]++
+			}
+		}
+		for c, centroid := range centroids {
+			totals[c] = 0
+			for d, w := range centroid {
+				centroid[d] = w / float64(sizes[c])
+				totals[c] += centroid[d]
+			}
+		}
+	}
+	members := make([][]int, k)
+	for i, c := range assignment {
+		members[c] = append(members[c], i)
+	}
+	clusters := [][]int{}
+	for _, ms := range members {
+		if len(ms) > 0 {
+			clusters = append(clusters, ms)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters
+}
+
+// ClusterTrajectoriesKMeans performs k-means clustering of the trajectories that have been calculated for a given
+// experiment into k clusters, with at most maxIter iterations of Lloyd's algorithm, without the need for the mcl
+// binaries. If there are fewer than k trajectories, each trajectory forms its own cluster. The output files are the
+// same as for ClusterTrajectoriesDirectly, in a folder name-clusters-kmeans in the output path. It returns the quality
+// of the clustering, cf. ClusterQuality. If there are no trajectories, e.g. because the trajectory filters removed all
+// of them, no output files are written and nil is returned.
+func ClusterTrajectoriesKMeans(exp *trajectory.Experiment, k int, maxIter int, outputPath string) []ClusterQuality {
+	fmt.Println("Clustering trajectories with k-means clustering, k = ", k)
+	if k < 1 {
+		panic(fmt.Sprintf("invalid number of clusters %d", k))
+	}
+	if len(exp.Trajectories) == 0 {
+		fmt.Println("No trajectories to cluster.")
+		return nil
+	}
+	dirName := fmt.Sprintf("%s-clusters-kmeans/", exp.Name)
+	workingDir := filepath.Join(outputPath, dirName) + string(filepath.Separator)
+	fmt.Println("Working path becomes: ", workingDir)
+	derr := os.MkdirAll(workingDir, 0777)
+	if derr != nil {
+		panic(derr)
+	}
+	jaccardIndex := computeJaccardIndexForTrajectories(exp)
+	clusters := kMeansClusters(exp, jaccardIndex, utils.MinInt(k, len(exp.Trajectories)), maxIter)
+	fmt.Println("Collected ", len(clusters), " clusters for ", len(exp.Trajectories), " trajectories")
+	dumpFileName := fmt.Sprintf("%sdump.%s.K%d", workingDir, exp.Name, k)
+	writeClusterData(clusters, dumpFileName)
+	convertToDirectTrajectoryClusterGraphs(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
+	convertToDirectTrajectoryClusterGraphsRR(exp, dumpFileName, fmt.Sprintf("%s.trajectories.RR.gml", dumpFileName))
+	trajectory.PrintClusteredTrajectoriesToFile(exp, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
+	trajectory.PrintClustersToCSVFiles(exp, fmt.Sprintf("%s.clustered.patients.csv", dumpFileName),
+		fmt.Sprintf("%s.clustered.clusters.csv", dumpFileName))
+	return []ClusterQuality{computeClusterQuality(exp, DenseSimilarityRows(jaccardIndex), fmt.Sprintf("K%d", k))}
+}
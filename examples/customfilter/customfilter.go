@@ -0,0 +1,74 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+// Package customfilter is an example of a package with use-case specific filters that lives outside of ptra's main
+// package. It registers the patient filter repeatedCode:ICD10Code:n, which keeps the patients who are diagnosed with
+// an ICD10 code on at least n different dates, e.g. repeatedCode:G35:2 for a multiple sclerosis cohort that requires a
+// confirmed diagnosis. To make the filter available in --pfilters, add a blank import of this package to main.go:
+//
+//	import _ "ptra/examples/customfilter"
+package customfilter
+
+import (
+	"fmt"
+	"ptra/app"
+	"ptra/trajectory"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	app.RegisterPatientFilter(app.PatientFilterSpec{Name: "repeatedCode", Usage: "repeatedCode:ICD10Code:n",
+		New: newRepeatedCodeFilter})
+}
+
+// newRepeatedCodeFilter creates a repeated code filter from the arguments ICD10Code:n of repeatedCode:ICD10Code:n. The
+// ICD10 code is resolved with the analysis maps of the filter context.
+func newRepeatedCodeFilter(args string, ctx app.FilterContext) (trajectory.PatientFilter, error) {
+	fields := strings.Split(args, ":")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid repeated code filter, expected repeatedCode:ICD10Code:n: repeatedCode:%s", args)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid repeated code filter, expected a number of dates >= 1: repeatedCode:%s", args)
+	}
+	analysisMaps := ctx.AnalysisMaps
+	if analysisMaps == nil || len(analysisMaps.GetDIDs(fields[0])) == 0 {
+		return nil, fmt.Errorf("unknown ICD10 code in repeated code filter: repeatedCode:%s", args)
+	}
+	return RepeatedCodeFilter(analysisMaps, fields[0], n), nil
+}
+
+// RepeatedCodeFilter keeps the patients who are diagnosed with an ICD10 code on at least n different dates. The code
+// may be a prefix, and is resolved to analysis DIDs with the analysis maps, cf. app.HasCodeFilter.
+func RepeatedCodeFilter(analysisMaps app.AnalysisMaps, icd10Code string, n int) trajectory.PatientFilter {
+	dids := map[int]bool{}
+	for _, did := range analysisMaps.GetDIDs(icd10Code) {
+		dids[did] = true
+	}
+	return func(p *trajectory.Patient) bool {
+		dates := map[trajectory.DiagnosisDate]bool{}
+		for _, d := range p.Diagnoses {
+			if dids[d.DID] {
+				dates[d.Date] = true
+			}
+		}
+		return len(dates) >= n
+	}
+}
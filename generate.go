@@ -0,0 +1,99 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"ptra/app"
+	"ptra/generator"
+)
+
+const generateHelp = "\nptra generate parameters:\n" +
+	"ptra generate diagnosisInfoFile outputPath \n" +
+	"[--nofPatients nr]\n" +
+	"[--minDiagnoses nr]\n" +
+	"[--maxDiagnoses nr]\n" +
+	"[--associations from>to:RR[:prevalence[:baseRate]],...]\n" +
+	"[--minYOB year]\n" +
+	"[--maxYOB year]\n" +
+	"[--firstYear year]\n" +
+	"[--lastYear year]\n" +
+	"[--minDelay years]\n" +
+	"[--maxDelay years]\n" +
+	"[--tumors]\n" +
+	"[--treatments]\n" +
+	"[--seed nr]\n" +
+	"[--icdFlavor auto | cm | who]\n"
+
+// generate runs the generate command: ptra generate diagnosisInfoFile outputPath [flags]. It writes a synthetic cohort
+// in TriNetX format, with noise diagnoses drawn from the ICD10 codes of the diagnosis info file, cf.
+// generator.Generate.
+func generate() {
+	config := generator.DefaultConfig()
+	var (
+		associations string
+		icdFlavor    string
+	)
+	var flags flag.FlagSet
+	flags.IntVar(&config.NofPatients, "nofPatients", config.NofPatients, "The number of patients to generate.")
+	flags.IntVar(&config.MinDiagnoses, "minDiagnoses", config.MinDiagnoses, "The minimum number of noise "+
+		"diagnoses per patient.")
+	flags.IntVar(&config.MaxDiagnoses, "maxDiagnoses", config.MaxDiagnoses, "The maximum number of noise "+
+		"diagnoses per patient.")
+	flags.StringVar(&associations, "associations", "", "A comma-separated list of associations to plant, "+
+		"e.g. I10>I25.10:3 to plant I25.10 after I10 with RR 3.")
+	flags.IntVar(&config.MinYOB, "minYOB", config.MinYOB, "The earliest year of birth.")
+	flags.IntVar(&config.MaxYOB, "maxYOB", config.MaxYOB, "The latest year of birth.")
+	flags.IntVar(&config.FirstYear, "firstYear", config.FirstYear, "The first year in which diagnoses are dated.")
+	flags.IntVar(&config.LastYear, "lastYear", config.LastYear, "The last year in which diagnoses are dated.")
+	flags.Float64Var(&config.MinDelay, "minDelay", config.MinDelay, "The minimum number of years between "+
+		"the diagnoses of a planted association.")
+	flags.Float64Var(&config.MaxDelay, "maxDelay", config.MaxDelay, "The maximum number of years between "+
+		"the diagnoses of a planted association.")
+	flags.BoolVar(&config.Tumors, "tumors", false, "Also generate a tumor file for the bladder cancer patients.")
+	flags.BoolVar(&config.Treatments, "treatments", false, "Also generate a treatment file for the bladder "+
+		"cancer patients.")
+	flags.Int64Var(&config.Seed, "seed", config.Seed, "The seed of the random generator.")
+	flags.StringVar(&icdFlavor, "icdFlavor", app.IcdFlavorAuto, "The flavor of the ICD10 xml hierarchy: "+
+		"ICD10-CM (cm), WHO ICD10 ClaML (who), or detected from the file (auto).")
+	// parse optional arguments
+	parseFlags(flags, 4, generateHelp)
+	// parse required arguments
+	diagnosisInfo := getFileName(os.Args[2], generateHelp)
+	outputPath := getFileName(os.Args[3], generateHelp)
+	var err error
+	if config.Associations, err = generator.ParseAssociations(associations); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if icdFlavor != app.IcdFlavorAuto && icdFlavor != app.IcdFlavorCM && icdFlavor != app.IcdFlavorWHO {
+		fmt.Fprintln(os.Stderr, "Unknown ICD10 flavor:", icdFlavor)
+		os.Exit(1)
+	}
+	log.Println(programMessage())
+	config.NoiseCodes = app.ICD10Codes(app.DefaultParseConfig(), diagnosisInfo, icdFlavor)
+	generator.Generate(config, outputPath)
+}
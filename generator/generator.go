@@ -0,0 +1,309 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package generator
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Synthetic cohort generation.
+//The generator creates synthetic patient and diagnosis files in TriNetX format, so that ptra can be run end to end
+//without real patient data, e.g. for reproducing bugs, testing, and benchmarking. Known D1->D2 associations are planted
+//in the diagnosis histories on top of noise diagnoses, so that it can be checked that the trajectories are recovered.
+
+// Association is a D1->D2 association that is planted in the synthetic cohort. Patients that are not diagnosed with
+// From yet are diagnosed with it with probability Prevalence. Patients that are diagnosed with From are diagnosed with
+// To after From with probability RR * BaseRate, the other patients are diagnosed with To with probability BaseRate.
+// Associations are planted in order, so that chains, e.g. A->B and B->C, plant trajectories A->B->C. A prevalence of 0
+// for B->C keeps the RR of A->B as planted, since B is then only diagnosed by A->B.
+type Association struct {
+	From, To   string  // ICD10 codes
+	RR         float64 // relative risk of To for patients diagnosed with From
+	Prevalence float64 // probability of being diagnosed with From
+	BaseRate   float64 // probability of being diagnosed with To without From
+}
+
+// Default parameters of planted associations.
+const (
+	DefaultPrevalence = 0.2
+	DefaultBaseRate   = 0.05
+)
+
+// ParseAssociations parses a comma-separated list of associations of the form from>to:RR[:prevalence[:baseRate]],
+// e.g. I10>I25.10:3 or I10>I25.10:3:0.3:0.02. The prevalence and base rate default to DefaultPrevalence and
+// DefaultBaseRate.
+func ParseAssociations(s string) ([]Association, error) {
+	associations := []Association{}
+	if s == "" {
+		return associations, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		fields := strings.Split(spec, ":")
+		codes := strings.Split(fields[0], ">")
+		if len(codes) != 2 || codes[0] == "" || codes[1] == "" || len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid association %q, expected from>to:RR[:prevalence[:baseRate]]", spec)
+		}
+		association := Association{From: codes[0], To: codes[1], Prevalence: DefaultPrevalence,
+			BaseRate: DefaultBaseRate}
+		values := []*float64{&association.RR, &association.Prevalence, &association.BaseRate}
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid association %q: %q is not a positive number", spec, field)
+			}
+			*values[i] = value
+		}
+		if association.Prevalence > 1 || association.BaseRate > 1 {
+			return nil, fmt.Errorf("invalid association %q: probabilities must be at most 1", spec)
+		}
+		associations = append(associations, association)
+	}
+	return associations, nil
+}
+
+// Config defines a synthetic cohort.
+type Config struct {
+	NofPatients                int
+	MinDiagnoses, MaxDiagnoses int      // the nr of noise diagnoses per patient is drawn uniformly from this range
+	NoiseCodes                 []string // the ICD10 codes from which the noise diagnoses are drawn
+	Associations               []Association
+	MinYOB, MaxYOB             int     // the years of birth are drawn uniformly from this range
+	FirstYear, LastYear        int     // diagnoses are dated in this range of years, but not before the year of birth
+	MinDelay, MaxDelay         float64 // the nr of years between the diagnoses of a planted association
+	Tumors                     bool    // also generate a tumor file
+	Treatments                 bool    // also generate a treatment file
+	Seed                       int64
+}
+
+// Validate checks if a configuration defines a valid cohort.
+func (config Config) Validate() error {
+	switch {
+	case config.NofPatients <= 0:
+		return fmt.Errorf("invalid number of patients: %d", config.NofPatients)
+	case config.MinDiagnoses < 0 || config.MaxDiagnoses < config.MinDiagnoses:
+		return fmt.Errorf("invalid range of noise diagnoses: %d-%d", config.MinDiagnoses, config.MaxDiagnoses)
+	case config.MaxYOB < config.MinYOB:
+		return fmt.Errorf("invalid range of years of birth: %d-%d", config.MinYOB, config.MaxYOB)
+	case config.LastYear < config.FirstYear || config.MaxYOB > config.LastYear:
+		return fmt.Errorf("invalid range of diagnosis years: %d-%d, for years of birth up to %d", config.FirstYear,
+			config.LastYear, config.MaxYOB)
+	case config.MinDelay < 0 || config.MaxDelay < config.MinDelay:
+		return fmt.Errorf("invalid range of delays: %v-%v", config.MinDelay, config.MaxDelay)
+	}
+	return nil
+}
+
+// DefaultConfig returns a configuration for a cohort of 10000 patients born between 1930 and 2000, with 5 to 20 noise
+// diagnoses between 2000 and 2020 each, and planted associations with delays between 0.5 and 3 years.
+func DefaultConfig() Config {
+	return Config{NofPatients: 10000, MinDiagnoses: 5, MaxDiagnoses: 20, MinYOB: 1930, MaxYOB: 2000,
+		FirstYear: 2000, LastYear: 2020, MinDelay: 0.5, MaxDelay: 3, Seed: 1}
+}
+
+// bladderCancerPrefix is the ICD10 code prefix of the diagnoses for which tumors and treatments are generated.
+const bladderCancerPrefix = "C67"
+
+const tnmT, tnmN, tnmM = "Ta,Tis,T1,T2,T3,T4", "N0,N1,N2,N3", "M0,M1"
+
+// nullField is the TriNetX representation of a missing value.
+const nullField = "\\\\000"
+
+// dateFormat is the TriNetX date format.
+const dateFormat = "2006-01-02"
+
+// patientHistory is the diagnosis history of a synthetic patient.
+type patientHistory struct {
+	pid       string
+	yob       int
+	sex       string
+	diagnoses map[string]time.Time // ICD10 code -> date
+	codes     []string             // the ICD10 codes in the order of diagnosis generation
+}
+
+func (h *patientHistory) add(code string, date time.Time) {
+	if _, ok := h.diagnoses[code]; ok {
+		return
+	}
+	h.diagnoses[code] = date
+	h.codes = append(h.codes, code)
+}
+
+// randomDate returns a uniformly drawn date between January 1st of the first year and December 31st of the last year.
+func randomDate(r *rand.Rand, firstYear, lastYear int) time.Time {
+	start := time.Date(firstYear, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(lastYear+1, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := int(end.Sub(start).Hours() / 24)
+	return start.AddDate(0, 0, r.Intn(days))
+}
+
+// addYears adds a fractional number of years to a date, with a precision of days.
+func addYears(date time.Time, years float64) time.Time {
+	return date.AddDate(0, 0, int(math.Round(years*365.25)))
+}
+
+// generatePatient generates the diagnosis history of a patient.
+func generatePatient(r *rand.Rand, config Config, planted map[string]bool, i int) *patientHistory {
+	h := &patientHistory{pid: strconv.Itoa(i + 1), diagnoses: map[string]time.Time{}}
+	h.yob = config.MinYOB + r.Intn(config.MaxYOB-config.MinYOB+1)
+	h.sex = "F"
+	if r.Intn(2) == 0 {
+		h.sex = "M"
+	}
+	firstYear := config.FirstYear
+	if h.yob > firstYear {
+		firstYear = h.yob
+	}
+	for _, a := range config.Associations {
+		if _, ok := h.diagnoses[a.From]; !ok && r.Float64() < a.Prevalence {
+			h.add(a.From, randomDate(r, firstYear, config.LastYear))
+		}
+		if date, ok := h.diagnoses[a.From]; ok {
+			if r.Float64() < a.RR*a.BaseRate {
+				delay := config.MinDelay + r.Float64()*(config.MaxDelay-config.MinDelay)
+				h.add(a.To, addYears(date, delay))
+			}
+		} else if r.Float64() < a.BaseRate {
+			h.add(a.To, randomDate(r, firstYear, config.LastYear))
+		}
+	}
+	if len(config.NoiseCodes) > 0 {
+		n := config.MinDiagnoses + r.Intn(config.MaxDiagnoses-config.MinDiagnoses+1)
+		for j := 0; j < n; j++ {
+			code := config.NoiseCodes[r.Intn(len(config.NoiseCodes))]
+			if planted[code] {
+				continue // keep the planted associations free of noise
+			}
+			h.add(code, randomDate(r, firstYear, config.LastYear))
+		}
+	}
+	return h
+}
+
+// writeCSVFile writes the records to a csv file.
+func writeCSVFile(name string, records [][]string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	if err := writer.WriteAll(records); err != nil {
+		panic(err)
+	}
+}
+
+// nullRecord returns a record of n missing values.
+func nullRecord(n int) []string {
+	record := make([]string, n)
+	for i := range record {
+		record[i] = nullField
+	}
+	return record
+}
+
+// pick returns a uniformly drawn element of a comma-separated list.
+func pick(r *rand.Rand, list string) string {
+	elements := strings.Split(list, ",")
+	return elements[r.Intn(len(elements))]
+}
+
+// Generate generates a synthetic cohort in TriNetX format in the given directory: a patient file patient.csv and a
+// diagnosis file diagnosis.csv, and optionally a tumor file tumor.csv and a treatment file treatment.csv. Tumors and
+// treatments are generated for the patients diagnosed with bladder cancer (C67). The generator is seeded with
+// config.Seed, so that the same configuration always generates the same cohort.
+func Generate(config Config, path string) {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		panic(err)
+	}
+	r := rand.New(rand.NewSource(config.Seed))
+	planted := map[string]bool{}
+	for _, a := range config.Associations {
+		planted[a.From] = true
+		planted[a.To] = true
+	}
+	patients, diagnoses, tumors, treatments := [][]string{}, [][]string{}, [][]string{}, [][]string{}
+	nofDiagnoses := 0
+	for i := 0; i < config.NofPatients; i++ {
+		h := generatePatient(r, config, planted, i)
+		//patient_id, sex, race, ethnicity, year_of_birth, age_at_death, patient_regional_location, postal_code,
+		//marital_status, reason_yob_missing, month_year_death, source_id
+		patient := nullRecord(12)
+		patient[0], patient[1], patient[4] = h.pid, h.sex, strconv.Itoa(h.yob)
+		patients = append(patients, patient)
+		var bladderCancer *time.Time
+		for _, code := range h.codes {
+			date := h.diagnoses[code]
+			//patient_id, encounter_id, code_system, code, principal_diagnosis_indicator, admitting_diagnosis,
+			//reason_for_visit, date, derived_by_TriNetX, source_id
+			diagnosis := nullRecord(10)
+			diagnosis[0], diagnosis[2], diagnosis[3], diagnosis[7] = h.pid, "ICD-10-CM", code, date.Format(dateFormat)
+			diagnoses = append(diagnoses, diagnosis)
+			nofDiagnoses++
+			if strings.HasPrefix(code, bladderCancerPrefix) && (bladderCancer == nil || date.Before(*bladderCancer)) {
+				bladderCancer = &date
+			}
+		}
+		if bladderCancer == nil {
+			continue
+		}
+		if config.Tumors {
+			//patient_id, date, ..., site, ..., tumor size, lymph nodes, metastasis
+			tumor := make([]string, 13)
+			tumor[0], tumor[1], tumor[4] = h.pid, bladderCancer.Format(dateFormat), bladderCancerPrefix+".9"
+			tumor[10], tumor[11], tumor[12] = "AJCC_"+pick(r, tnmT), "AJCC_"+pick(r, tnmN), "AJCC_"+pick(r, tnmM)
+			tumors = append(tumors, tumor)
+		}
+		if config.Treatments {
+			// the treatment columns of the default extra codes: radical cystectomy, MVAC chemotherapy, and
+			// intravesical therapy
+			treatment := nullRecord(15)
+			treatment[0] = h.pid
+			for _, column := range []int{10, 11, 13} {
+				if r.Intn(3) == 0 {
+					treatment[column] = addYears(*bladderCancer, r.Float64()).Format(dateFormat)
+				}
+			}
+			treatments = append(treatments, treatment)
+		}
+	}
+	writeCSVFile(filepath.Join(path, "patient.csv"), patients)
+	writeCSVFile(filepath.Join(path, "diagnosis.csv"), diagnoses)
+	if config.Tumors {
+		writeCSVFile(filepath.Join(path, "tumor.csv"), tumors)
+	}
+	if config.Treatments {
+		writeCSVFile(filepath.Join(path, "treatment.csv"), treatments)
+	}
+	fmt.Println("Generated ", config.NofPatients, " synthetic patients with ", nofDiagnoses, " diagnoses in ", path)
+}
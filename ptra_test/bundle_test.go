@@ -0,0 +1,144 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package ptra_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"ptra/app"
+	"ptra/trajectory"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// makeBundleExperiment creates a small experiment with one trajectory A -> B -> C followed by 20 and 5 patients.
+func makeBundleExperiment() *trajectory.Experiment {
+	patients := func(n int) []*trajectory.Patient {
+		ps := []*trajectory.Patient{}
+		for i := 0; i < n; i++ {
+			p := &trajectory.Patient{PID: i, PIDString: "secret" + strconv.Itoa(i), YOB: 1950, Sex: i % 2}
+			for did := 0; did < 3; did++ {
+				trajectory.AddDiagnosis(p, &trajectory.Diagnosis{PID: i, DID: did,
+					Date: trajectory.DiagnosisDate{Year: 2010 + did, Month: 1, Day: 1}})
+			}
+			ps = append(ps, p)
+		}
+		return ps
+	}
+	exp := &trajectory.Experiment{
+		NofDiagnosisCodes: 3,
+		Name:              "bundle",
+		NameMap:           map[int]string{0: "A", 1: "B", 2: "C"},
+		IdMap:             map[int]string{0: "A00", 1: "B00", 2: "C00"},
+		DxDRR:             trajectory.MakeDxDRR(3),
+		DxDPatients:       trajectory.MakeDxDPatients(3),
+		Pairs:             []*trajectory.Pair{{First: 0, Second: 1}, {First: 1, Second: 2}},
+	}
+	exp.DxDRR[0][1] = 2.5
+	exp.DxDRR[1][2] = 1.5
+	exp.DxDPatients[0][1] = patients(20)
+	exp.DxDPatients[1][2] = patients(5)
+	exp.Trajectories = []*trajectory.Trajectory{{
+		Diagnoses:      []int{0, 1, 2},
+		PatientNumbers: []int{20, 5},
+		Patients:       [][]*trajectory.Patient{patients(20), patients(5)},
+		ID:             0,
+		Cluster:        1,
+	}}
+	return exp
+}
+
+func TestExportBundle(t *testing.T) {
+	dir := t.TempDir()
+	bundleFile := filepath.Join(dir, "bundle.tar.gz")
+	if err := app.ExportBundle(makeBundleExperiment(), bundleFile, "ptra test", "test", 11); err != nil {
+		t.Fatal(err)
+	}
+	// unpack the bundle
+	file, err := os.Open(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	contents := map[string][]byte{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = data
+	}
+	// validate the index against the contents
+	index, ok := contents[app.BundleIndexFile]
+	if !ok {
+		t.Fatal("Bundle has no index.")
+	}
+	lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+	if len(lines) != len(contents)-1 {
+		t.Error("Index lists ", len(lines), " files, but the bundle contains ", len(contents)-1, " other files.")
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		data, ok := contents[fields[0]]
+		if !ok {
+			t.Error("Bundle is missing ", fields[0])
+			continue
+		}
+		if fields[1] != strconv.Itoa(len(data)) {
+			t.Error("Size of ", fields[0], " does not match the index.")
+		}
+		checksum := sha256.Sum256(data)
+		if fields[2] != hex.EncodeToString(checksum[:]) {
+			t.Error("Checksum of ", fields[0], " does not match the index.")
+		}
+	}
+	// validate the pseudonymization and minimum cell size policies
+	for name, data := range contents {
+		if strings.Contains(string(data), "secret") {
+			t.Error("Bundle file ", name, " contains patient identifiers.")
+		}
+	}
+	var trajectories []struct{ PatientNumbers []int }
+	if err := json.Unmarshal(contents["trajectories.json"], &trajectories); err != nil {
+		t.Fatal(err)
+	}
+	if len(trajectories) != 1 || trajectories[0].PatientNumbers[0] != 20 || trajectories[0].PatientNumbers[1] != -1 {
+		t.Error("Patient numbers below the minimum cell size should be suppressed, got ", trajectories)
+	}
+}
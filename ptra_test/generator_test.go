@@ -0,0 +1,654 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package ptra_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"ptra/app"
+	"ptra/cluster"
+	"ptra/generator"
+	"ptra/trajectory"
+	"strings"
+	"testing"
+)
+
+// syntheticConfig returns a small synthetic cohort with the planted trajectory E11.9 -> I10 -> N18.9.
+func syntheticConfig(t *testing.T) generator.Config {
+	associations, err := generator.ParseAssociations("E11.9>I10:5:0.3:0.05,I10>N18.9:5:0:0.05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := generator.DefaultConfig()
+	config.NofPatients = 2000
+	config.MinDiagnoses, config.MaxDiagnoses = 2, 5
+	config.NoiseCodes = app.ICD10Codes(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", app.IcdFlavorAuto)
+	config.Associations = associations
+	return config
+}
+
+func TestParseAssociations(t *testing.T) {
+	associations, err := generator.ParseAssociations("A01>B02:3,C03>D04:2:0.5:0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(associations) != 2 || associations[0].RR != 3 || associations[0].Prevalence != generator.DefaultPrevalence ||
+		associations[1].To != "D04" || associations[1].Prevalence != 0.5 || associations[1].BaseRate != 0.1 {
+		t.Error("Unexpected associations: ", associations)
+	}
+	for _, s := range []string{"A01:3", "A01>B02", "A01>B02:x", "A01>B02:3:2"} {
+		if _, err := generator.ParseAssociations(s); err == nil {
+			t.Error("Expected an error for association ", s)
+		}
+	}
+}
+
+func TestGeneratorIsReproducible(t *testing.T) {
+	config := syntheticConfig(t)
+	config.NofPatients = 100
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	generator.Generate(config, dir1)
+	generator.Generate(config, dir2)
+	for _, name := range []string{"patient.csv", "diagnosis.csv"} {
+		data1, err := ioutil.ReadFile(filepath.Join(dir1, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data2, err := ioutil.ReadFile(filepath.Join(dir2, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data1, data2) {
+			t.Error("Expected the same ", name, " for the same seed")
+		}
+	}
+}
+
+func TestGeneratorPlantedTrajectory(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	planted := []int{analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0],
+		analysisMaps.GetDIDs("N18.9")[0]}
+	if RR := exp.DxDRR[planted[0]][planted[1]]; RR < 2 {
+		t.Error("Expected a planted RR well above 1 for E11.9 -> I10, got ", RR)
+	}
+	trajectories := trajectory.BuildTrajectories(exp, 10, 3, 3, 0.5, 5, 1.5, nil)
+	for _, tr := range trajectories {
+		if len(tr.Diagnoses) == 3 && tr.Diagnoses[0] == planted[0] && tr.Diagnoses[1] == planted[1] &&
+			tr.Diagnoses[2] == planted[2] {
+			return
+		}
+	}
+	t.Error("Expected the planted trajectory E11.9 -> I10 -> N18.9 among ", len(trajectories), " trajectories")
+}
+
+func TestAdaptiveRRSampling(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	// the planted pair converges to a p-value of 0 long before the maximum number of iterations
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.AdaptiveRRSampling(1000, 50, 0.01), nil,
+		"")
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if RR := exp.DxDRR[e11][i10]; RR < 2 {
+		t.Error("Expected a planted RR well above 1 for E11.9 -> I10 with adaptive sampling, got ", RR)
+	}
+	if exp.NofSampledPairs == 0 {
+		t.Fatal("Expected sampled diagnosis pairs.")
+	}
+	if exp.NofSamples < 50*exp.NofSampledPairs || exp.NofSamples >= 1000*exp.NofSampledPairs {
+		t.Error("Expected adaptive sampling to stop between 50 and 1000 iterations per pair, got ", exp.NofSamples,
+			" samples for ", exp.NofSampledPairs, " pairs")
+	}
+}
+
+func TestZeroCellRRSampling(t *testing.T) {
+	// 20 patients are diagnosed with E11.9 and then I10, and none of the 20 comparison patients ever has I10, so that
+	// every sampled comparison group has a zero cell
+	dir := t.TempDir()
+	patients, diagnoses := []string{}, []string{}
+	for pid := 0; pid < 40; pid++ {
+		patients = append(patients, fmt.Sprintf("%d,M,1950", pid))
+		if pid < 20 {
+			diagnoses = append(diagnoses, fmt.Sprintf("%d,E11.9,2010-01-01", pid),
+				fmt.Sprintf("%d,I10,2011-01-01", pid))
+		} else {
+			diagnoses = append(diagnoses, fmt.Sprintf("%d,J45.909,2010-01-01", pid))
+		}
+	}
+	writeTriNetXFiles(t, dir, patients, diagnoses)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 3,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "zeroCell", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, nil, 1, 3, nil, false, 0, 0.5, 5, "", "", nil, nil)
+	exp.DxDOR = trajectory.MakeDxDOR(exp.NofDiagnosisCodes)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	// with the Haldane-Anscombe correction, RR = (20.5/21)/(0.5/21) = 41
+	if RR := exp.DxDRR[e11][i10]; math.Abs(RR-41) > 1e-9 {
+		t.Error("Expected a finite RR of 41 for a pair without cases in the comparison groups, got ", RR)
+	}
+	if OR := exp.DxDOR[e11][i10]; math.IsInf(OR, 0) || math.IsNaN(OR) || OR <= 1 {
+		t.Error("Expected a finite OR above 1 for a pair without cases in the comparison groups, got ", OR)
+	}
+	if RD := exp.DxDRD[e11][i10]; math.Abs(RD-1) > 1e-9 {
+		t.Error("Expected RD 1, got ", RD)
+	}
+}
+
+func TestSeededRRSampling(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	computeRR := func(seed int64, name string) []byte {
+		exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+			filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil,
+			false, 0, 0.5, 5, "", "", nil, nil)
+		sampling := trajectory.FixedRRSampling(100)
+		sampling.Seed = seed
+		trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, sampling, nil, "")
+		path := filepath.Join(dir, name)
+		trajectory.SaveRRMatrix(exp, path)
+		rr, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	rr1, rr2, rr3 := computeRR(7, "RR1.csv"), computeRR(7, "RR2.csv"), computeRR(8, "RR3.csv")
+	if !bytes.Equal(rr1, rr2) {
+		t.Error("Expected the same RR matrix for the same seed")
+	}
+	if bytes.Equal(rr1, rr3) {
+		t.Error("Expected a different RR matrix for a different seed")
+	}
+}
+
+func TestEffectMeasureOR(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	compute := func(measure string) *trajectory.Experiment {
+		exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+			filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil,
+			false, 0, 0.5, 5, "", "", nil, nil)
+		exp.EffectMeasure = measure
+		sampling := trajectory.FixedRRSampling(100)
+		sampling.Seed = 7
+		trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, sampling, nil, "")
+		return exp
+	}
+	expRR, expOR := compute(trajectory.EffectMeasureRR), compute(trajectory.EffectMeasureOR)
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if RR, OR := expRR.DxDRR[e11][i10], expOR.DxDRR[e11][i10]; RR <= 1 || OR <= RR {
+		t.Error("Expected an OR above the RR above 1 for the planted pair E11.9 -> I10, got RR ", RR, " and OR ", OR)
+	}
+	// the effect measure is recorded in the RR matrix file, and verified when loading it
+	path := filepath.Join(dir, "OR.csv")
+	trajectory.SaveRRMatrix(expOR, path)
+	loaded := &trajectory.Experiment{NofDiagnosisCodes: expOR.NofDiagnosisCodes, NameMap: expOR.NameMap,
+		DxDRR: trajectory.MakeDxDRR(expOR.NofDiagnosisCodes), EffectMeasure: trajectory.EffectMeasureOR}
+	trajectory.LoadRRMatrix(loaded, path)
+	if loaded.DxDRR[e11][i10] != expOR.DxDRR[e11][i10] {
+		t.Error("Expected the OR to survive a round trip through the RR matrix file")
+	}
+	// the outputs built from the ORs name the effect measure
+	trajectory.BuildTrajectories(expOR, 10, 3, 2, 0.5, 5, 1.5, nil)
+	out := t.TempDir()
+	trajectory.PrintTrajectoriesToFile(expOR, out)
+	trajectory.SaveMarkovModel(expOR, trajectory.BuildMarkovModel(expOR), filepath.Join(out, "markov.json"))
+	for file, label := range map[string]string{"synthetic-trajectories.tab": "#effectMeasure\tOR\n",
+		"synthetic-trajectories-d3.json": `"effectMeasure": "OR"`, "markov.json": `"effectMeasure": "OR"`} {
+		data, err := ioutil.ReadFile(filepath.Join(out, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), label) {
+			t.Error("Expected ", file, " to name the effect measure OR")
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected population attributable risks of ORs to fail")
+			}
+		}()
+		trajectory.PopulationAttributableRisk(expOR, e11, i10)
+	}()
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected loading an OR matrix for RR scores to fail")
+		}
+	}()
+	loaded.EffectMeasure = trajectory.EffectMeasureRR
+	trajectory.LoadRRMatrix(loaded, path)
+}
+
+func TestCorrectedPairSelection(t *testing.T) {
+	dir := t.TempDir()
+	// the sampling p-values are at least 1/(n+1) for n samples, so the pairs can only be significant after the
+	// correction with enough samples for few tested pairs, i.e. few noise codes at the chapter level
+	config := syntheticConfig(t)
+	config.NoiseCodes = []string{"J45.909", "K21.9", "M54.5", "F41.1", "L40.0", "H52.4", "G43.909"}
+	generator.Generate(config, dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	exp.DxDPval = trajectory.MakeDxDPval(exp.NofDiagnosisCodes)
+	exp.PValueCorrection, exp.Alpha = trajectory.PValueCorrectionBH, 0.05
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(10000), nil, "")
+	for d1, row := range exp.DxDPval {
+		for d2, pval := range row {
+			if adj := exp.DxDPadj[d1][d2]; math.IsNaN(pval) != math.IsNaN(adj) || adj < pval {
+				t.Fatal("Expected a corrected p-value of at least ", pval, ", got ", adj)
+			}
+			if pval <= 0 {
+				t.Fatal("Expected a positive sampling p-value, got ", pval)
+			}
+		}
+	}
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if adj := exp.DxDPadj[e11][i10]; adj > 0.05 {
+		t.Error("Expected a significant corrected p-value for the planted pair E11.9 -> I10, got ", adj)
+	}
+	trajectory.BuildTrajectories(exp, 10, 3, 2, 0.5, 5, 1.5, nil)
+	for _, pair := range exp.Pairs {
+		if adj := exp.DxDPadj[pair.First][pair.Second]; adj > 0.05 {
+			t.Error("Expected only pairs with a corrected p-value of at most 0.05, got ", adj)
+		}
+	}
+}
+
+func TestMappedRRMatrix(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	var rr *trajectory.MappedMatrix
+	config := app.DefaultParseConfig()
+	config.MakeDxDRR = func(size int) [][]float64 {
+		var err error
+		if rr, err = trajectory.NewMappedRRMatrix(size, filepath.Join(dir, "RR.mmap")); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Rows()
+	}
+	exp, _ := app.ParseTriNetXData(config, "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	if rr == nil {
+		t.Fatal("Expected the RR matrix of the experiment to be allocated with the MakeDxDRR of the parse config")
+	}
+	defer func() {
+		if err := rr.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if v := rr.Get(0, exp.NofDiagnosisCodes-1); v != 1.0 {
+		t.Error("Expected the RR scores of a new mapped matrix to be 1.0, got ", v)
+	}
+	rr.Set(1, 0, 3.5)
+	if v := exp.DxDRR[1][0]; v != 3.5 {
+		t.Error("Expected the RR matrix of the experiment to share the RR scores of the mapped matrix, got ", v)
+	}
+	rr.Set(1, 0, 1.0)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if RR := rr.Get(e11, i10); RR < 2 {
+		t.Error("Expected a planted RR well above 1 for E11.9 -> I10 in the mapped matrix, got ", RR)
+	}
+	pval, err := trajectory.NewMappedMatrix(exp.NofDiagnosisCodes, filepath.Join(dir, "RR.mmap.pval"), math.NaN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := pval.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if v := pval.Get(exp.NofDiagnosisCodes-1, 0); !math.IsNaN(v) {
+		t.Error("Expected the values of a new mapped matrix to be the given NaN, got ", v)
+	}
+}
+
+func TestAgglomerativeClusters(t *testing.T) {
+	// two tight pairs {0, 1} and {2, 3} that are only linked by the similarity between 1 and 2
+	similarity := func() [][]float64 {
+		return [][]float64{
+			{0, 0.9, 0.1, 0.1},
+			{0.9, 0, 0.6, 0.1},
+			{0.1, 0.6, 0, 0.8},
+			{0.1, 0.1, 0.8, 0},
+		}
+	}
+	for _, test := range []struct {
+		linkage  string
+		expected string
+	}{
+		{cluster.SingleLinkage, "[[0 1 2 3]]"},
+		{cluster.CompleteLinkage, "[[0 1] [2 3]]"},
+		{cluster.AverageLinkage, "[[0 1] [2 3]]"},
+	} {
+		if clusters := fmt.Sprint(cluster.AgglomerativeClusters(similarity(), test.linkage, 0.5)); clusters != test.expected {
+			t.Error("Expected clusters ", test.expected, " with ", test.linkage, " linkage, got ", clusters)
+		}
+	}
+	if clusters := cluster.AgglomerativeClusters(similarity(), cluster.SingleLinkage, 0.95); len(clusters) != 4 {
+		t.Error("Expected no merged clusters above the highest similarity, got ", clusters)
+	}
+}
+
+func TestTrajectoryCoOccurrenceNetwork(t *testing.T) {
+	exp := &trajectory.Experiment{NofDiagnosisCodes: 4, Trajectories: []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1, 2}},
+		{Diagnoses: []int{2, 1}},
+		{Diagnoses: []int{3, 0}},
+	}}
+	network := cluster.BuildTrajectoryCoOccurrenceNetwork(exp)
+	if fmt.Sprint(network) != "[[0 1 1 1] [1 0 2 0] [1 2 0 0] [1 0 0 0]]" {
+		t.Error("Unexpected co-occurrence network: ", network)
+	}
+}
+
+func TestClusterQuality(t *testing.T) {
+	// the jaccard similarity coefficients of two tight pairs of trajectories {0, 1} and {2, 3}
+	jaccardIndex := [][]float64{
+		{1, 0.9, 0.1, 0.1},
+		{0.9, 1, 0.2, 0.1},
+		{0.1, 0.2, 1, 0.8},
+		{0.1, 0.1, 0.8, 1},
+	}
+	clustered := func(clusters ...int) *trajectory.Experiment {
+		exp := &trajectory.Experiment{}
+		for _, c := range clusters {
+			exp.Trajectories = append(exp.Trajectories, &trajectory.Trajectory{Cluster: c})
+		}
+		return exp
+	}
+	good, bad := clustered(0, 0, 1, 1), clustered(0, 1, 0, 1)
+	rows := cluster.DenseSimilarityRows(jaccardIndex)
+	if s1, s2 := cluster.ComputeClusterSilhouette(good, rows),
+		cluster.ComputeClusterSilhouette(bad, rows); s1 <= 0.5 || s2 >= 0 {
+		t.Error("Expected a high silhouette score for the tight pairs and a negative one otherwise, got ", s1, " and ",
+			s2)
+	}
+	if db1, db2 := cluster.ComputeDaviesBouldin(good, rows),
+		cluster.ComputeDaviesBouldin(bad, rows); db1 >= db2 {
+		t.Error("Expected a lower Davies-Bouldin index for the tight pairs, got ", db1, " and ", db2)
+	}
+	if s := cluster.ComputeClusterSilhouette(clustered(0, 0, 0, 0), rows); s != 0 {
+		t.Error("Expected a silhouette score of 0 for a single cluster, got ", s)
+	}
+	// the rows computed on demand give the same quality as the dense matrix of the trajectories
+	exp := clustered(0, 0, 1, 1, 2)
+	for i, diagnoses := range [][]int{{1, 2, 3}, {1, 2, 4}, {5, 6}, {5, 6, 7}, {1, 7}} {
+		exp.Trajectories[i].Diagnoses = diagnoses
+	}
+	dense := cluster.DenseSimilarityRows(cluster.ComputeJaccardIndexForTrajectories(exp))
+	onDemand := cluster.JaccardRowsForTrajectories(exp)
+	if s1, s2 := cluster.ComputeClusterSilhouette(exp, dense),
+		cluster.ComputeClusterSilhouette(exp, onDemand); s1 != s2 {
+		t.Error("Expected the same silhouette score for the dense and on demand rows, got ", s1, " and ", s2)
+	}
+	if db1, db2 := cluster.ComputeDaviesBouldin(exp, dense), cluster.ComputeDaviesBouldin(exp, onDemand); db1 != db2 {
+		t.Error("Expected the same Davies-Bouldin index for the dense and on demand rows, got ", db1, " and ", db2)
+	}
+}
+
+func TestClusterTrajectoriesHierarchical(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	trajectory.BuildTrajectories(exp, 10, 3, 2, 0.5, 5, 1.5, nil)
+	if len(exp.Trajectories) == 0 {
+		t.Fatal("Expected trajectories to cluster")
+	}
+	quality := cluster.ClusterTrajectoriesHierarchical(exp, cluster.AverageLinkage, 0.5, dir)
+	if len(quality) != 1 || quality[0].Clusters == 0 || quality[0].Silhouette < -1 || quality[0].Silhouette > 1 {
+		t.Error("Unexpected cluster quality: ", quality)
+	}
+	gml := filepath.Join(dir, "synthetic-clusters-hierarchical", "dump.synthetic.average.T0.5.trajectories.gml")
+	if info, err := os.Stat(gml); err != nil || info.Size() == 0 {
+		t.Error("Expected the clustered trajectories in ", gml, ": ", err)
+	}
+}
+
+func TestKMeansClusters(t *testing.T) {
+	// two groups of trajectories that share no diagnoses
+	exp := &trajectory.Experiment{Trajectories: []*trajectory.Trajectory{
+		{Diagnoses: []int{1, 2, 3}},
+		{Diagnoses: []int{1, 2, 4}},
+		{Diagnoses: []int{5, 6, 7}},
+		{Diagnoses: []int{1, 3, 4}},
+		{Diagnoses: []int{5, 6, 8}},
+	}}
+	jaccardIndex := cluster.ComputeJaccardIndexForTrajectories(exp)
+	if clusters := fmt.Sprint(cluster.KMeansClusters(exp, jaccardIndex, 2, 100)); clusters != "[[0 1 3] [2 4]]" {
+		t.Error("Expected clusters [[0 1 3] [2 4]], got ", clusters)
+	}
+	if clusters := cluster.KMeansClusters(exp, jaccardIndex, 5, 100); len(clusters) != 5 {
+		t.Error("Expected a cluster for each trajectory, got ", clusters)
+	}
+	empty := &trajectory.Experiment{Name: "empty"}
+	emptyIndex := cluster.ComputeJaccardIndexForTrajectories(empty)
+	if clusters := cluster.KMeansClusters(empty, emptyIndex, 0, 100); clusters != nil {
+		t.Error("Expected no clusters without trajectories, got ", clusters)
+	}
+	if quality := cluster.ClusterTrajectoriesKMeans(empty, 2, 100, t.TempDir()); quality != nil {
+		t.Error("Expected no cluster quality without trajectories, got ", quality)
+	}
+}
+
+func TestClusterTrajectoriesKMeans(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	trajectory.BuildTrajectories(exp, 10, 3, 2, 0.5, 5, 1.5, nil)
+	if len(exp.Trajectories) == 0 {
+		t.Fatal("Expected trajectories to cluster")
+	}
+	quality := cluster.ClusterTrajectoriesKMeans(exp, 2, cluster.DefaultKMeansIter, dir)
+	if len(quality) != 1 || quality[0].Clusters == 0 || quality[0].Clusters > 2 || quality[0].Entropy <= 0 {
+		t.Error("Unexpected cluster quality: ", quality)
+	}
+	gml := filepath.Join(dir, "synthetic-clusters-kmeans", "dump.synthetic.K2.trajectories.gml")
+	if info, err := os.Stat(gml); err != nil || info.Size() == 0 {
+		t.Error("Expected the clustered trajectories in ", gml, ": ", err)
+	}
+}
+
+func TestMarkovModel(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	trajectory.BuildTrajectories(exp, 10, 3, 2, 0.5, 5, 1.5, nil)
+	model := trajectory.BuildMarkovModel(exp)
+	for d1, transitions := range model {
+		total := 0.0
+		for _, p := range transitions {
+			total += p
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Error("Expected the transition probabilities of ", d1, " to sum to 1, got ", total)
+		}
+	}
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if model[e11][i10] == 0 {
+		t.Fatal("Expected a transition for the planted pair E11.9 -> I10")
+	}
+	samples := trajectory.SampleTrajectories(model, e11, 3, 50, rand.New(rand.NewSource(7)))
+	if len(samples) != 50 {
+		t.Fatal("Expected 50 sampled trajectories, got ", len(samples))
+	}
+	for i, sample := range trajectory.SampleTrajectories(model, e11, 3, 50, rand.New(rand.NewSource(7))) {
+		if fmt.Sprint(sample.Diagnoses) != fmt.Sprint(samples[i].Diagnoses) {
+			t.Fatal("Expected the same sampled trajectories for the same seed")
+		}
+	}
+	for _, sample := range samples {
+		if sample.Diagnoses[0] != e11 || len(sample.Diagnoses) < 2 || len(sample.Diagnoses) > 3 {
+			t.Error("Unexpected sampled trajectory ", sample.Diagnoses)
+		}
+		for i := 1; i < len(sample.Diagnoses); i++ {
+			if model[sample.Diagnoses[i-1]][sample.Diagnoses[i]] == 0 {
+				t.Error("Sampled a transition that is not in the model: ", sample.Diagnoses)
+			}
+		}
+	}
+	path := filepath.Join(dir, "markov.json")
+	trajectory.SaveMarkovModel(exp, model, path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved struct {
+		Names       map[int]string
+		Transitions map[int]map[int]float64
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Names[e11] != exp.NameMap[e11] || saved.Transitions[e11][i10] != model[e11][i10] {
+		t.Error("Expected the model to survive a round trip through JSON")
+	}
+}
+
+func TestPermutationTestTrajectory(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	e11, i10, n18 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0], analysisMaps.GetDIDs("N18.9")[0]
+	planted := &trajectory.Trajectory{Diagnoses: []int{e11, i10, n18}}
+	if p := trajectory.PermutationTestTrajectory(planted, exp, 100, 7); p > 0.05 {
+		t.Error("Expected a significant permutation p-value for the planted trajectory, got ", p)
+	}
+	reversed := &trajectory.Trajectory{Diagnoses: []int{n18, i10, e11}}
+	p := trajectory.PermutationTestTrajectory(reversed, exp, 100, 7)
+	if p < 0.5 {
+		t.Error("Expected no significant permutation p-value for the reversed trajectory, got ", p)
+	}
+	if p2 := trajectory.PermutationTestTrajectory(reversed, exp, 100, 7); p2 != p {
+		t.Error("Expected the same permutation p-value for the same seed, got ", p, " and ", p2)
+	}
+	// the random stream depends on the diagnoses of a trajectory, not on its ID
+	reversed.ID = 5
+	if p2 := trajectory.PermutationTestTrajectory(reversed, exp, 100, 7); p2 != p {
+		t.Error("Expected the same permutation p-value for another trajectory ID, got ", p, " and ", p2)
+	}
+	exp.Trajectories = []*trajectory.Trajectory{planted, reversed}
+	trajectory.PermutationTestTrajectories(exp, 100, trajectory.DefaultAlpha, 7)
+	if !planted.Significant || reversed.Significant || planted.Permutations != 100 {
+		t.Error("Expected only the planted trajectory to be marked as significant")
+	}
+}
+
+func TestTrajectoryIDs(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, _ := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false,
+		0, 0.5, 5, "", "", nil, nil)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5, trajectory.FixedRRSampling(100), nil, "")
+	trajectory.BuildTrajectories(exp, 10, 3, 2, 0.5, 5, 1.5, nil)
+	if len(exp.Trajectories) < 2 {
+		t.Fatal("Expected several trajectories, got ", len(exp.Trajectories))
+	}
+	// without ranking or clustering, the assignments still tell the trajectories apart
+	trajectory.PrintPatientTrajectoryAssignments(exp, dir)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "synthetic-patient-trajectories.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequences := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		fields := strings.Split(line, ",")
+		if sequence, ok := sequences[fields[1]]; ok && sequence != fields[2] {
+			t.Fatal("Expected a distinct TID per trajectory, got TID ", fields[1], " for ", sequence, " and ",
+				fields[2])
+		}
+		sequences[fields[1]] = fields[2]
+	}
+	if len(sequences) != len(exp.Trajectories) {
+		t.Error("Expected ", len(exp.Trajectories), " distinct TIDs, got ", len(sequences))
+	}
+}
+
+func TestStratifiedRRBySex(t *testing.T) {
+	dir := t.TempDir()
+	generator.Generate(syntheticConfig(t), dir)
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 2,
+		app.CCSRModeAll, app.IcdFlavorAuto, nil)
+	exp, patients := app.ParseTriNetXData(app.DefaultParseConfig(), "synthetic", filepath.Join(dir, "patient.csv"),
+		filepath.Join(dir, "diagnosis.csv"), analysisMaps, bladderCancerProcessors(analysisMaps, ""), 1, 2, nil, false, 0,
+		0.5, 5, "", "", nil, nil)
+	e11, i10 := analysisMaps.GetDIDs("E11.9")[0], analysisMaps.GetDIDs("I10")[0]
+	if rrMale, rrFemale := trajectory.StratifiedRRBySex(exp, e11, i10); rrMale != 0 || rrFemale != 0 {
+		t.Error("Expected no sex-stratified RR scores before initializing them")
+	}
+	expMale, expFemale := trajectory.InitializeSexStratifiedRelativeRiskRatios(exp, patients, 0.5, 5,
+		trajectory.FixedRRSampling(100))
+	rrMale, rrFemale := trajectory.StratifiedRRBySex(exp, e11, i10)
+	if rrMale < 2 || rrFemale < 2 {
+		t.Error("Expected a planted RR well above 1 for E11.9 -> I10 in both sexes, got ", rrMale, " and ", rrFemale)
+	}
+	if rrMale != expMale.DxDRR[e11][i10] || rrFemale != expFemale.DxDRR[e11][i10] {
+		t.Error("Expected the sex-stratified RR scores of the sub-experiments")
+	}
+}
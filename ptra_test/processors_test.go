@@ -0,0 +1,925 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package ptra_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"ptra/app"
+	"ptra/trajectory"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// bladderCancerProcessors returns the diagnosis processors of the default bladder cancer configuration.
+func bladderCancerProcessors(analysisMaps app.AnalysisMaps, treatmentInfoFile string) []app.DiagnosisProcessor {
+	processors := []app.DiagnosisProcessor{app.NewEOIMarker(app.NewEventOfInterest(app.DefaultEventOfInterestCodes))}
+	if treatmentInfoFile != "" {
+		processors = append(processors, app.NewTreatmentInjector(app.DefaultParseConfig(), app.DefaultExtraCodes,
+			treatmentInfoFile, analysisMaps))
+	}
+	return processors
+}
+
+// makePatientMap creates a patient map for the given patients.
+func makePatientMap(patients ...*trajectory.Patient) *trajectory.PatientMap {
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*trajectory.Patient{}}
+	for _, p := range patients {
+		pMap.PIDStringMap[p.PIDString] = p.PID
+		pMap.PIDMap[p.PID] = p
+		pMap.Ctr++
+	}
+	return pMap
+}
+
+// writeTriNetXFiles writes a TriNetX patient.csv and diagnosis.csv file to a directory. The patients are given as
+// PID, sex, and year of birth, separated by commas, and the diagnoses as PID, ICD10 code, and date (yyyy-mm-dd).
+func writeTriNetXFiles(t *testing.T, dir string, patients, diagnoses []string) {
+	null := `\\000`
+	row := func(fields ...string) string {
+		return "\"" + strings.Join(fields, "\",\"") + "\"\n"
+	}
+	var patientFile, diagnosisFile bytes.Buffer
+	for _, patient := range patients {
+		f := strings.Split(patient, ",")
+		patientFile.WriteString(row(f[0], f[1], null, null, f[2], null, null, null, null, null, null, null))
+	}
+	for _, diagnosis := range diagnoses {
+		f := strings.Split(diagnosis, ",")
+		diagnosisFile.WriteString(row(f[0], null, "ICD-10-CM", f[1], null, null, null, f[2], null, null))
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "patient.csv"), patientFile.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), diagnosisFile.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEOIMarker(t *testing.T) {
+	p := &trajectory.Patient{PID: 0, PIDString: "0"}
+	marker := app.NewEOIMarker(app.NewEventOfInterest([]string{"C50"}))
+	marker.ProcessDiagnosis(p, "I10", trajectory.DiagnosisDate{Year: 2018, Month: 1, Day: 1})
+	if p.EOIDate != nil {
+		t.Error("I10 should not be marked as event of interest.")
+	}
+	marker.ProcessDiagnosis(p, "C50.1", trajectory.DiagnosisDate{Year: 2019, Month: 1, Day: 1})
+	marker.ProcessDiagnosis(p, "C50.2", trajectory.DiagnosisDate{Year: 2020, Month: 1, Day: 1})
+	marker.Finish(makePatientMap(p))
+	if p.EOIDate == nil || p.EOIDate.Year != 2019 {
+		t.Error("The first C50 diagnosis should be marked as event of interest, got ", p.EOIDate)
+	}
+	if marker.Ctr != 2 || len(p.EOIDates) != 2 || p.EOIDates[1].Year != 2020 {
+		t.Error("Expected 2 events of interest, got ", p.EOIDates)
+	}
+}
+
+func TestNamedEOIMarker(t *testing.T) {
+	for _, definitions := range [][]string{{"C67"}, {":C67"}, {"cancer:"}, {"cancer:C67:C50"}} {
+		if _, err := app.NewNamedEOIMarker(definitions); err == nil {
+			t.Error("Expected an error for the event of interest definitions ", definitions)
+		}
+	}
+	marker, err := app.NewNamedEOIMarker([]string{"cancer:C67", "treatment:Z51.1", "treatment:Z51.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &trajectory.Patient{PID: 0, PIDString: "0", YOB: 1950}
+	marker.ProcessDiagnosis(p, "Z51.1", trajectory.DiagnosisDate{Year: 2021, Month: 1, Day: 1})
+	marker.ProcessDiagnosis(p, "C67.2", trajectory.DiagnosisDate{Year: 2019, Month: 1, Day: 1})
+	marker.ProcessDiagnosis(p, "Z51.0", trajectory.DiagnosisDate{Year: 2020, Month: 1, Day: 1})
+	marker.ProcessDiagnosis(p, "I10", trajectory.DiagnosisDate{Year: 2018, Month: 1, Day: 1})
+	other := &trajectory.Patient{PID: 1, PIDString: "1", YOB: 1960}
+	marker.Finish(makePatientMap(p, other))
+	if len(p.NamedEOIs) != 2 || p.NamedEOIs["cancer"].Year != 2019 || p.NamedEOIs["treatment"].Year != 2020 ||
+		p.NamedEOICodes["treatment"] != "Z51.0" {
+		t.Error("Expected the first cancer and treatment events of interest, got ", p.NamedEOIs, p.NamedEOICodes)
+	}
+	if marker.Ctr["cancer"] != 1 || marker.Ctr["treatment"] != 1 {
+		t.Error("Expected 1 patient per named event of interest, got ", marker.Ctr)
+	}
+	if trajectory.AgeAtEOI(p, "treatment") != 70 || trajectory.AgeAtEOI(p, "") != -1 ||
+		trajectory.AgeAtEOI(other, "cancer") != -1 {
+		t.Error("Expected age 70 at treatment, and no age at the other events of interest")
+	}
+}
+
+func TestTreatmentInjector(t *testing.T) {
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+		app.CCSRModeAll, app.IcdFlavorAuto, app.DefaultExtraCodes)
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	injector := app.NewTreatmentInjector(app.DefaultParseConfig(), app.DefaultExtraCodes, "./treatments.csv",
+		analysisMaps)
+	injector.Finish(patients)
+	p, ok := trajectory.GetPatient("70", patients)
+	if !ok {
+		t.Fatal("Patient 70 is missing from the fixture.")
+	}
+	found := false
+	for _, d := range p.Diagnoses {
+		if d.Date == (trajectory.DiagnosisDate{Year: 2049, Month: 1, Day: 19}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("The MVAC chemotherapy of patient 70 should be added as a diagnosis.")
+	}
+}
+
+func TestIntravesicalTherapyEvents(t *testing.T) {
+	dir := t.TempDir()
+	treatments := "\"70\",\"\\\\000\",\"M\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"1908\",\"\\\\000\",\"193205\"," +
+		"\"\\\\000\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2048-03-01\",\"\\\\000\"\n"
+	treatmentFile := filepath.Join(dir, "treatments.csv")
+	if err := ioutil.WriteFile(treatmentFile, []byte(treatments), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ivtDate := trajectory.DiagnosisDate{Year: 2048, Month: 3, Day: 1}
+	// the intravesical therapies are only added as diagnoses with IntravesicalTherapyEvents
+	for _, test := range []struct {
+		extraCodes []app.ExtraCode
+		nofIVT     int
+	}{
+		{app.DefaultExtraCodes, 0},
+		{app.IntravesicalTherapyEvents(app.DefaultExtraCodes), 1},
+	} {
+		analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+			app.CCSRModeAll, app.IcdFlavorAuto, test.extraCodes)
+		ivt := analysisMaps.GetDIDs(app.IntravesicalTherapyCode)
+		if len(ivt) != 1 {
+			t.Fatal("Intravesical therapy should be registered in the analysis maps")
+		}
+		patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+		app.NewTreatmentInjector(app.DefaultParseConfig(), test.extraCodes, treatmentFile,
+			analysisMaps).Finish(patients)
+		p, _ := trajectory.GetPatient("70", patients)
+		nofIVT := 0
+		for _, d := range p.Diagnoses {
+			if d.DID == ivt[0] && d.Date == ivtDate {
+				nofIVT++
+			}
+		}
+		if nofIVT != test.nofIVT {
+			t.Error("Expected ", test.nofIVT, " intravesical therapy diagnoses for patient 70, got ", nofIVT)
+		}
+	}
+	if app.DefaultExtraCodes[2].Column != -1 {
+		t.Error("IntravesicalTherapyEvents should not modify the default extra codes")
+	}
+	// the ivt patient filter uses the intravesical therapies regardless
+	if info := app.ParseTriNetXTreatmentFile(app.DefaultParseConfig(),
+		treatmentFile)["70"]; len(info[app.IntravesicalTherapyCode]) != 1 {
+		t.Error("Expected the intravesical therapy of patient 70 for the treatment filters, got ", info)
+	}
+}
+
+func TestBurstCollapser(t *testing.T) {
+	d := func(did, year, month, day int) *trajectory.Diagnosis {
+		return &trajectory.Diagnosis{PID: 0, DID: did, Date: trajectory.DiagnosisDate{Year: year, Month: month, Day: day}}
+	}
+	newPatient := func() *trajectory.Patient {
+		return &trajectory.Patient{PID: 0, PIDString: "0", Diagnoses: []*trajectory.Diagnosis{
+			d(1, 2020, 3, 1), d(1, 2020, 1, 1), d(1, 2020, 1, 1), d(2, 2020, 2, 1), d(1, 2021, 6, 1)}}
+	}
+	p := newPatient()
+	app.NewBurstCollapser(0).Finish(makePatientMap(p))
+	if len(p.Diagnoses) != 5 {
+		t.Error("Without a window, the diagnoses should be left to the parser, got ", len(p.Diagnoses), " diagnoses.")
+	}
+	p = newPatient()
+	app.NewBurstCollapser(0.5).Finish(makePatientMap(p))
+	if len(p.Diagnoses) != 3 || p.Diagnoses[0].Date.Month != 1 || p.Diagnoses[2].Date.Year != 2021 {
+		t.Error("Diagnoses within half a year should be collapsed into the first one, got ", len(p.Diagnoses),
+			" diagnoses.")
+	}
+	for i := 1; i < len(p.Diagnoses); i++ {
+		if trajectory.DiagnosisDateSmallerThan(p.Diagnoses[i].Date, p.Diagnoses[i-1].Date) {
+			t.Error("Diagnoses should be sorted by date.")
+		}
+	}
+}
+
+// diagnosesFingerprint summarizes the parsed diagnoses and events of interest of all patients. Diagnoses are identified
+// by name, since analysis DIDs are not assigned deterministically.
+func diagnosesFingerprint(patients *trajectory.PatientMap, nameMap map[int]string) string {
+	pids := []int{}
+	for pid := range patients.PIDMap {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	h := fnv.New64a()
+	nofDiagnoses, nofEOI := 0, 0
+	for _, pid := range pids {
+		p := patients.PIDMap[pid]
+		fmt.Fprint(h, p.PIDString, p.EOIDate != nil)
+		if p.EOIDate != nil {
+			nofEOI++
+			fmt.Fprint(h, *p.EOIDate)
+		}
+		diagnoses := []string{}
+		for _, d := range p.Diagnoses {
+			nofDiagnoses++
+			diagnoses = append(diagnoses, fmt.Sprint(d.Date, nameMap[d.DID]))
+		}
+		sort.Strings(diagnoses) // diagnoses on the same day are not ordered
+		fmt.Fprint(h, diagnoses)
+	}
+	return fmt.Sprintf("%d %d %x", nofDiagnoses, nofEOI, h.Sum64())
+}
+
+func TestDeathCensor(t *testing.T) {
+	death := trajectory.DiagnosisDate{Year: 2019, Month: 6, Day: 15}
+	p := &trajectory.Patient{PID: 0, PIDString: "0", DeathDate: &death}
+	alive := &trajectory.Patient{PID: 1, PIDString: "1"}
+	dates := []trajectory.DiagnosisDate{{Year: 2018, Month: 1, Day: 1}, {Year: 2019, Month: 6, Day: 15},
+		{Year: 2019, Month: 6, Day: 16}, {Year: 2020, Month: 1, Day: 1}}
+	for did, date := range dates {
+		trajectory.AddDiagnosis(p, &trajectory.Diagnosis{PID: 0, DID: did, Date: date})
+		trajectory.AddDiagnosis(alive, &trajectory.Diagnosis{PID: 1, DID: did, Date: date})
+	}
+	censor := app.NewDeathCensor()
+	censor.Finish(makePatientMap(p, alive))
+	if censor.Ctr != 2 {
+		t.Error("Expected 2 censored diagnoses, got ", censor.Ctr)
+	}
+	if len(p.Diagnoses) != 2 || p.Diagnoses[1].Date != death {
+		t.Error("Expected the diagnoses up to and including the death date, got ", p.Diagnoses)
+	}
+	if len(alive.Diagnoses) != 4 {
+		t.Error("Patients without death date should keep all diagnoses, got ", alive.Diagnoses)
+	}
+}
+
+func TestBirthCensor(t *testing.T) {
+	makePatient := func() *trajectory.Patient {
+		p := &trajectory.Patient{PID: 0, PIDString: "0", YOB: 1960}
+		for did, year := range []int{1950, 1958, 1960, 1970} {
+			trajectory.AddDiagnosis(p, &trajectory.Diagnosis{PID: 0, DID: did,
+				Date: trajectory.DiagnosisDate{Year: year, Month: 6, Day: 1}})
+		}
+		return p
+	}
+	p := makePatient()
+	censor := app.NewBirthCensor(app.BeforeYOBDrop)
+	censor.Finish(makePatientMap(p))
+	if censor.Ctr != 2 || len(p.Diagnoses) != 2 || p.Diagnoses[0].Date.Year != 1960 {
+		t.Error("Expected the diagnoses before 1960 to be dropped, got ", censor.Ctr, " ", p.Diagnoses)
+	}
+	p = makePatient()
+	censor = app.NewBirthCensor(app.BeforeYOBClamp)
+	censor.Finish(makePatientMap(p))
+	if censor.Ctr != 2 || len(p.Diagnoses) != 4 ||
+		p.Diagnoses[1].Date != (trajectory.DiagnosisDate{Year: 1960, Month: 1, Day: 1}) {
+		t.Error("Expected the diagnoses before 1960 to be clamped, got ", censor.Ctr, " ", p.Diagnoses)
+	}
+}
+
+func TestDeathNode(t *testing.T) {
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, append(app.DefaultExtraCodes, app.DeathExtraCode))
+	deathDID := analysisMaps.GetDIDs(app.DeathCode)[0]
+	death := trajectory.DiagnosisDate{Year: 2019, Month: 6, Day: 15}
+	p := &trajectory.Patient{PID: 0, PIDString: "0", DeathDate: &death}
+	alive := &trajectory.Patient{PID: 1, PIDString: "1"}
+	injector := app.NewDeathInjector(analysisMaps)
+	injector.Finish(makePatientMap(p, alive))
+	if injector.Ctr != 1 || len(p.Diagnoses) != 1 || p.Diagnoses[0].DID != deathDID || p.Diagnoses[0].Date != death ||
+		len(alive.Diagnoses) != 0 {
+		t.Error("Expected a death diagnosis for the deceased patient only, got ", p.Diagnoses, alive.Diagnoses)
+	}
+	exp := &trajectory.Experiment{}
+	app.MarkDeathTerminal(exp, analysisMaps)
+	if len(exp.TerminalDiagnoses) != 1 || !exp.TerminalDiagnoses[deathDID] {
+		t.Error("Expected death to be a terminal diagnosis, got ", exp.TerminalDiagnoses)
+	}
+	// A -> B -> Death -> C, where C is recorded after death
+	const deathNode = 2
+	exp = &trajectory.Experiment{NofDiagnosisCodes: 4, DxDRR: trajectory.MakeDxDRR(4),
+		DxDPatients: trajectory.MakeDxDPatients(4), TerminalDiagnoses: map[int]bool{deathNode: true},
+		NameMap: map[int]string{0: "A", 1: "B", deathNode: "Death", 3: "C"}}
+	for pid := 0; pid < 20; pid++ {
+		p := &trajectory.Patient{PID: pid, PIDString: fmt.Sprint(pid)}
+		for did, year := range []int{2000, 2002, 2004, 2006} {
+			trajectory.AddDiagnosis(p, &trajectory.Diagnosis{PID: pid, DID: did,
+				Date: trajectory.DiagnosisDate{Year: year, Month: 1, Day: 1}})
+		}
+		for did := 0; did < 3; did++ {
+			exp.DxDPatients[did][did+1] = append(exp.DxDPatients[did][did+1], p)
+			exp.DxDRR[did][did+1] = 2
+		}
+	}
+	trajectories := trajectory.BuildTrajectories(exp, 5, 4, 2, 0.5, 5, 1.0, nil)
+	if len(trajectories) == 0 {
+		t.Fatal("Expected trajectories that end in death")
+	}
+	for _, tr := range trajectories {
+		for i, did := range tr.Diagnoses {
+			if did == deathNode && i != len(tr.Diagnoses)-1 {
+				t.Error("Death should be the last diagnosis of a trajectory, got ", tr.Diagnoses)
+			}
+		}
+	}
+}
+
+func TestParseTrinetXPatientDiagnosesFixture(t *testing.T) {
+	// fingerprints of the fixture parsed with the bladder cancer configuration before the diagnosis processors were
+	// split from the parser
+	expected := map[int]string{0: "7295 1000 47264256e96180af", 2: "7295 1000 2fb851bbe0efe0e5"}
+	for level, fingerprint := range expected {
+		patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+		analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+			app.IcdFlavorAuto, level, app.DefaultExtraCodes)
+		app.ParseTrinetXPatientDiagnoses(app.DefaultParseConfig(), "./diagnosis.csv", patients, analysisMaps,
+			app.ICD9Mapping{}, bladderCancerProcessors(analysisMaps, "./treatments.csv"), nil)
+		if result := diagnosesFingerprint(patients, analysisMaps.NameMap); result != fingerprint {
+			t.Error("Parsed diagnoses for level ", level, " changed: expected ", fingerprint, ", got ", result)
+		}
+	}
+}
+
+func TestParseTrinetXPatientDiagnosesInParallel(t *testing.T) {
+	// the diagnoses parsed with several workers must be in exactly the same order as when parsed sequentially
+	parse := func(nofWorkers int) (map[string]string, *app.UnmappedICD9Report) {
+		patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+		analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+			app.IcdFlavorAuto, 2, app.DefaultExtraCodes)
+		report := app.NewUnmappedICD9Report()
+		app.ParseTrinetXPatientDiagnosisFile(app.DefaultParseConfig(), "./diagnosis.csv", patients, analysisMaps,
+			app.ICD9Mapping{}, bladderCancerProcessors(analysisMaps, "./treatments.csv"), report, nofWorkers)
+		result := map[string]string{}
+		for _, p := range patients.PIDMap {
+			diagnoses := fmt.Sprint(p.EOIDates)
+			for _, d := range p.Diagnoses {
+				diagnoses = fmt.Sprint(diagnoses, analysisMaps.NameMap[d.DID], d.Date)
+			}
+			result[p.PIDString] = diagnoses
+		}
+		return result, report
+	}
+	sequential, sequentialReport := parse(1)
+	for _, nofWorkers := range []int{2, 7} {
+		parallel, parallelReport := parse(nofWorkers)
+		if len(parallel) != len(sequential) {
+			t.Fatal("Expected ", len(sequential), " patients with ", nofWorkers, " workers, got ", len(parallel))
+		}
+		for pid, diagnoses := range sequential {
+			if parallel[pid] != diagnoses {
+				t.Error("Patient ", pid, " has different diagnoses with ", nofWorkers, " workers")
+			}
+		}
+		if parallelReport.Rows != sequentialReport.Rows || parallelReport.Dropped != sequentialReport.Dropped ||
+			len(parallelReport.Unmapped) != len(sequentialReport.Unmapped) {
+			t.Error("Expected the same report with ", nofWorkers, " workers, got ", parallelReport)
+		}
+	}
+}
+
+func TestCSVDelimiter(t *testing.T) {
+	parse := func(config *app.ParseConfig, dir string) string {
+		patients, _ := app.ParseTriNetXPatientData(config, filepath.Join(dir, "patient.csv"), 10, nil)
+		analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(config, "./icd10cm_tabular_2022.xml",
+			app.IcdFlavorAuto, 2, app.DefaultExtraCodes)
+		app.ParseTrinetXPatientDiagnoses(config, filepath.Join(dir, "diagnosis.csv"), patients, analysisMaps,
+			app.ICD9Mapping{}, bladderCancerProcessors(analysisMaps, ""), nil)
+		return diagnosesFingerprint(patients, analysisMaps.NameMap)
+	}
+	expected := parse(app.DefaultParseConfig(), ".")
+	// convert the fixtures to semicolon-delimited files, with a quoted free-text field that contains the delimiter
+	dir := t.TempDir()
+	convert := func(name string, freeText int) {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		writer.Comma = ';'
+		for _, record := range records {
+			record[freeText] = "free; text"
+			writer.Write(record)
+		}
+		writer.Flush()
+		if !bytes.Contains(buf.Bytes(), []byte("\"free; text\"")) {
+			t.Fatal("Expected the free-text field to be quoted")
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	convert("patient.csv", 11)
+	convert("diagnosis.csv", 1)
+	config := app.DefaultParseConfig()
+	if err := config.SetCSVFormat(';', false); err != nil {
+		t.Fatal(err)
+	}
+	if result := parse(config, dir); result != expected {
+		t.Error("Expected the same diagnoses from the semicolon-delimited files: ", expected, ", got ", result)
+	}
+	if result := parse(app.DefaultParseConfig(), "."); result != expected {
+		t.Error("Expected the default config to be unaffected by the semicolon-delimited config: ", expected,
+			", got ", result)
+	}
+	if err := config.SetCSVFormat('"', false); err == nil {
+		t.Error("Expected an error for a quote as delimiter")
+	}
+}
+
+func TestCSVLazyQuotes(t *testing.T) {
+	dir := t.TempDir()
+	tumors := "\"70\";\"2040-05-01\";free \"text\";\"\\\\000\";\"X00\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "tumor.csv"), []byte(tumors), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := app.DefaultParseConfig()
+	if err := config.SetCSVFormat(';', false); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetMaxParseWarnings(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a parse error for a quote in an unquoted field without lazy quotes")
+			}
+		}()
+		app.ParsetTriNetXTumorData(config, filepath.Join(dir, "tumor.csv"), app.DefaultTumorSites)
+	}()
+	if err := config.SetCSVFormat(';', true); err != nil {
+		t.Fatal(err)
+	}
+	app.ParsetTriNetXTumorData(config, filepath.Join(dir, "tumor.csv"), app.DefaultTumorSites)
+}
+
+func TestParseWarnings(t *testing.T) {
+	dir := t.TempDir()
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	diagnoses := "70,e,ICD-10-CM,I10,,,,2010-01-01\n70,e,ICD-10-CM,E11.9,,,,2010-13\n70,e\n" +
+		"70,e,ICD-10-CM,\"N18\"9,,,,2012-01-01\n70,e,ICD-10-CM,N18.9,,,,2012-01-01\n"
+	diagnosisFile := filepath.Join(dir, "diagnosis.csv")
+	if err := ioutil.WriteFile(diagnosisFile, []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, app.DefaultExtraCodes)
+	config := app.DefaultParseConfig()
+	parse := func() {
+		app.ParseTrinetXPatientDiagnoses(config, diagnosisFile, patients, analysisMaps, app.ICD9Mapping{}, nil, nil)
+	}
+	if err := config.SetMaxParseWarnings(2, ""); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the parse to abort with 3 malformed rows")
+			}
+		}()
+		parse()
+	}()
+	log := filepath.Join(dir, "parse-warnings.csv")
+	if err := config.SetMaxParseWarnings(3, log); err != nil {
+		t.Fatal(err)
+	}
+	parse()
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[1][0] != "2" || records[1][2] != "date" || records[1][3] != "2010-13" ||
+		records[2][0] != "3" || records[3][0] != "4" {
+		t.Error("Unexpected parse warnings: ", records)
+	}
+}
+
+func TestValidateInputData(t *testing.T) {
+	dir := t.TempDir()
+	patients := "p1,F,W,N,1950,,,,,,,s\np2,M,W,N,1960,,,,,,,s\np3,M,W,N,,,,,,,,s\np4,M\np5,\"M\"x,W,N,1970,,,,,,,s\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "patient.csv"), []byte(patients), 0600); err != nil {
+		t.Fatal(err)
+	}
+	diagnoses := "p1,e,ICD-10-CM,I10,,,,2010-01-01\np1,e,ICD-10-CM,XYZ,,,,2011-01-01\np1,e,ICD-9-CM,401.9,,,,2012-01-01\n" +
+		"p9,e,ICD-10-CM,E11.9,,,,2012-01-01\np1,e,ICD-10-CM,E11.9,,,,2012-13\np1,e\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	report := app.ValidateInputData(app.DefaultParseConfig(), filepath.Join(dir, "patient.csv"), filepath.Join(dir,
+		"diagnosis.csv"))
+	if report.PatientRows != 5 || report.SkippedPatientRows["missing year of birth"] != 1 ||
+		report.SkippedPatientRows["too few fields"] != 1 || report.SkippedPatientRows["malformed csv"] != 1 {
+		t.Error("Unexpected patient rows: ", report.PatientRows, report.SkippedPatientRows)
+	}
+	if report.DiagnosisRows != 6 || report.SkippedDiagnosisRows["unknown patient"] != 1 ||
+		report.SkippedDiagnosisRows["invalid date"] != 1 || report.SkippedDiagnosisRows["too few fields"] != 1 {
+		t.Error("Unexpected diagnosis rows: ", report.DiagnosisRows, report.SkippedDiagnosisRows)
+	}
+	if report.PatientsWithoutDiagnoses != 50 || report.UnrecognisedCodes != 100.0/6 || report.DateParseFailures != 1 {
+		t.Error("Unexpected data quality: ", report)
+	}
+	if err := report.WriteJSON(filepath.Join(dir, "exp1-data-quality.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtraCodes(t *testing.T) {
+	dir := t.TempDir()
+	definitions := "code,description,source\nX01,Radiotherapy,radiotherapy.csv\nX02,Chemotherapy,11\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "extra.csv"), []byte(definitions), 0600); err != nil {
+		t.Fatal(err)
+	}
+	events := "70,2040-05-01\n70,2041-05-01\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "radiotherapy.csv"), []byte(events), 0600); err != nil {
+		t.Fatal(err)
+	}
+	extraCodes := app.ParseExtraCodesFile(app.DefaultParseConfig(), filepath.Join(dir, "extra.csv"))
+	if len(extraCodes) != 2 || extraCodes[0].Column != -1 || extraCodes[1].Column != 11 {
+		t.Fatal("Unexpected extra codes: ", extraCodes)
+	}
+	for _, diagnosisInfo := range []string{"./icd10cm_tabular_2022.xml", "./DXCCSR_v2022-1.CSV"} {
+		analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), diagnosisInfo, 0, app.CCSRModeAll,
+			app.IcdFlavorAuto, extraCodes)
+		radiotherapy := analysisMaps.GetDIDs("X01")
+		chemotherapy := analysisMaps.GetDIDs("X02")
+		if len(radiotherapy) != 1 || len(chemotherapy) != 1 {
+			t.Fatal("Extra codes should be registered in the analysis maps for ", diagnosisInfo)
+		}
+		patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+		app.NewTreatmentInjector(app.DefaultParseConfig(), extraCodes, "./treatments.csv",
+			analysisMaps).Finish(patients)
+		p, _ := trajectory.GetPatient("70", patients)
+		ctr := map[int]int{}
+		for _, d := range p.Diagnoses {
+			ctr[d.DID]++
+		}
+		if ctr[radiotherapy[0]] != 2 || ctr[chemotherapy[0]] != 1 {
+			t.Error("Expected 2 radiotherapy and 1 chemotherapy diagnoses for patient 70, got ", ctr)
+		}
+	}
+}
+
+func TestProcedureInjector(t *testing.T) {
+	dir := t.TempDir()
+	mapping := "cpt,code,description\n51590-51597,PROC01,Radical cystectomy\nJ90*,PROC02,Chemotherapy\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "procedure-codes.csv"), []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	procedures := "\"70\",\"\\\\000\",\"CPT\",\"51595\",\"\\\\000\",\"2040-05-01\"\n" +
+		"\"70\",\"\\\\000\",\"CPT\",\"51600\",\"\\\\000\",\"2040-06-01\"\n" +
+		"\"70\",\"\\\\000\",\"HCPCS\",\"J9045\",\"\\\\000\",\"2041-05-01\"\n" +
+		"\"70\",\"\\\\000\",\"HCPCS\",\"J9060\",\"\\\\000\",\"2041-06-01\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-10-PCS\",\"J9045\",\"\\\\000\",\"2042-05-01\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "procedure.csv"), []byte(procedures), 0600); err != nil {
+		t.Fatal(err)
+	}
+	procedureCodes, err := app.ParseProcedureCodesFile(app.DefaultParseConfig(), filepath.Join(dir,
+		"procedure-codes.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procedureCodes) != 2 || !procedureCodes[0].Match("51597") || procedureCodes[0].Match("515901") ||
+		!procedureCodes[1].Match("J9099") {
+		t.Fatal("Unexpected procedure codes: ", procedureCodes)
+	}
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+		app.CCSRModeAll, app.IcdFlavorAuto, app.ProcedureExtraCodes(procedureCodes))
+	cystectomy := analysisMaps.GetDIDs("PROC01")
+	chemotherapy := analysisMaps.GetDIDs("PROC02")
+	if len(cystectomy) != 1 || len(chemotherapy) != 1 {
+		t.Fatal("Procedure codes should be registered in the analysis maps")
+	}
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	injector := app.NewProcedureInjector(app.DefaultParseConfig(), procedureCodes, filepath.Join(dir, "procedure.csv"),
+		analysisMaps)
+	injector.Finish(patients)
+	if injector.Ctr["PROC01"] != 1 || injector.Ctr["PROC02"] != 2 {
+		t.Error("Expected 1 cystectomy and 2 chemotherapy events, got ", injector.Ctr)
+	}
+	p, _ := trajectory.GetPatient("70", patients)
+	ctr := map[int]int{}
+	for _, d := range p.Diagnoses {
+		ctr[d.DID]++
+	}
+	if ctr[cystectomy[0]] != 1 || ctr[chemotherapy[0]] != 2 {
+		t.Error("Expected 1 cystectomy and 2 chemotherapy diagnoses for patient 70, got ", ctr)
+	}
+}
+
+func TestProcedureCodesFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		mapping, expected string
+	}{
+		{"cpt,code,description\n51590-51597,P01,Radical cystectomy\n", "must start with PROC"},
+		{"cpt,code,description\n51597-51590,PROC01,Radical cystectomy\n", "invalid procedure code range"},
+		{"cpt,code,description\nJ90*,PROC02\n", "line 2"},
+	} {
+		fileName := filepath.Join(dir, "procedure-codes.csv")
+		if err := ioutil.WriteFile(fileName, []byte(test.mapping), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := app.ParseProcedureCodesFile(app.DefaultParseConfig(), fileName)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Error("Expected an error containing ", test.expected, " for ", test.mapping, ", got ", err)
+		}
+	}
+}
+
+func TestLabInjector(t *testing.T) {
+	dir := t.TempDir()
+	mapping := "loinc,code,description\n4548-4,LAB01,Hemoglobin A1c\n17856-6,LAB01,Hemoglobin A1c\n" +
+		"2160-0,LAB02,Creatinine\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "loinc.csv"), []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	labs := "\"70\",\"\\\\000\",\"LOINC\",\"4548-4\",\"2040-05-01\",\"7.1\",\"\\\\000\",\"%\"\n" +
+		"\"70\",\"\\\\000\",\"LOINC\",\"17856-6\",\"2040-05-01\",\"7.2\",\"\\\\000\",\"%\"\n" +
+		"\"70\",\"\\\\000\",\"LOINC\",\"2160-0\",\"2041-05-01\",\"1.4\",\"\\\\000\",\"mg/dL\"\n" +
+		"\"70\",\"\\\\000\",\"LOINC\",\"2345-7\",\"2041-06-01\",\"95\",\"\\\\000\",\"mg/dL\"\n" +
+		"\"70\",\"\\\\000\",\"TNX\",\"4548-4\",\"2042-05-01\",\"6.5\",\"\\\\000\",\"%\"\n" +
+		"\"unknown\",\"\\\\000\",\"LOINC\",\"4548-4\",\"2042-05-01\",\"6.5\",\"\\\\000\",\"%\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "lab_result.csv"), []byte(labs), 0600); err != nil {
+		t.Fatal(err)
+	}
+	labCodes, err := app.LabResultTable.ParseCodeMapFile(app.DefaultParseConfig(), filepath.Join(dir, "loinc.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labCodes) != 3 || labCodes[1].Source != "17856-6" || labCodes[1].Code != "LAB01" {
+		t.Fatal("Unexpected LOINC codes: ", labCodes)
+	}
+	if extraCodes := app.CodeMappingExtraCodes(labCodes); len(extraCodes) != 2 {
+		t.Fatal("Expected 2 pseudo codes for the lab tests, got ", extraCodes)
+	}
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+		app.CCSRModeAll, app.IcdFlavorAuto, app.CodeMappingExtraCodes(labCodes))
+	hba1c, creatinine := analysisMaps.GetDIDs("LAB01"), analysisMaps.GetDIDs("LAB02")
+	if len(hba1c) != 1 || len(creatinine) != 1 {
+		t.Fatal("Lab codes should be registered in the analysis maps")
+	}
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	injector := app.NewCodedEventInjector(app.DefaultParseConfig(), app.LabResultTable, labCodes, filepath.Join(dir,
+		"lab_result.csv"), analysisMaps)
+	injector.Finish(patients)
+	if injector.Ctr != 2 {
+		t.Error("Expected 2 lab result events, the HbA1c tests on the same date added once, got ", injector.Ctr)
+	}
+	p, _ := trajectory.GetPatient("70", patients)
+	ctr := map[int]int{}
+	for _, d := range p.Diagnoses {
+		ctr[d.DID]++
+	}
+	if ctr[hba1c[0]] != 1 || ctr[creatinine[0]] != 1 {
+		t.Error("Expected 1 HbA1c and 1 creatinine diagnosis for patient 70, got ", ctr)
+	}
+}
+
+func TestMedicationInjector(t *testing.T) {
+	dir := t.TempDir()
+	mapping := "rxnorm,code,description\n6809,RX01,Metformin\n860975,RX01,Metformin\n29046,RX02,Lisinopril\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "rxnorm.csv"), []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	medications := "\"70\",\"\\\\000\",\"1\",\"RxNorm\",\"6809\",\"2040-05-01\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"2\",\"RxNorm\",\"860975\",\"2040-05-01\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"3\",\"RxNorm\",\"29046\",\"2041-05-01\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"4\",\"RxNorm\",\"161\",\"2041-06-01\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"5\",\"NDC\",\"6809\",\"2042-05-01\",\"\\\\000\"\n" +
+		"\"unknown\",\"\\\\000\",\"6\",\"RxNorm\",\"6809\",\"2042-05-01\",\"\\\\000\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "medication_ingredient.csv"), []byte(medications), 0600); err != nil {
+		t.Fatal(err)
+	}
+	medicationCodes, err := app.MedicationTable.ParseCodeMapFile(app.DefaultParseConfig(), filepath.Join(dir,
+		"rxnorm.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(medicationCodes) != 3 || medicationCodes[1].Source != "860975" || medicationCodes[1].Code != "RX01" {
+		t.Fatal("Unexpected RxNorm codes: ", medicationCodes)
+	}
+	analysisMaps := app.InitializeAnalysisMaps(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml", 0,
+		app.CCSRModeAll, app.IcdFlavorAuto, app.CodeMappingExtraCodes(medicationCodes))
+	metformin, lisinopril := analysisMaps.GetDIDs("RX01"), analysisMaps.GetDIDs("RX02")
+	if len(metformin) != 1 || len(lisinopril) != 1 {
+		t.Fatal("Medication codes should be registered in the analysis maps")
+	}
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	injector := app.NewCodedEventInjector(app.DefaultParseConfig(), app.MedicationTable, medicationCodes,
+		filepath.Join(dir, "medication_ingredient.csv"), analysisMaps)
+	injector.Finish(patients)
+	if injector.Ctr != 2 {
+		t.Error("Expected 2 medication events, the metformin exposures on the same date added once, got ", injector.Ctr)
+	}
+	p, _ := trajectory.GetPatient("70", patients)
+	ctr := map[int]int{}
+	for _, d := range p.Diagnoses {
+		ctr[d.DID]++
+	}
+	if ctr[metformin[0]] != 1 || ctr[lisinopril[0]] != 1 {
+		t.Error("Expected 1 metformin and 1 lisinopril diagnosis for patient 70, got ", ctr)
+	}
+}
+
+func TestCodeMapFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	mapping := "loinc,code,description\n4548-4,LAB01,Hemoglobin A1c\n2160-0,LAB02\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "loinc.csv"), []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.LabResultTable.ParseCodeMapFile(app.DefaultParseConfig(), filepath.Join(dir,
+		"loinc.csv")); err == nil ||
+		!strings.Contains(err.Error(), "line 3") {
+		t.Error("Expected an error for the short line 3, got ", err)
+	}
+	if _, err := app.MedicationTable.ParseCodeMapFile(app.DefaultParseConfig(), filepath.Join(dir,
+		"missing.csv")); err == nil {
+		t.Error("Expected an error for a missing mapping file")
+	}
+}
+
+func TestUnmappedICD9Report(t *testing.T) {
+	dir := t.TempDir()
+	diagnoses := "\"70\",\"\\\\000\",\"ICD-9-CM\",\"250.00\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2010-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-9-CM\",\"401.9\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2011-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-9-CM\",\"401.9\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2012-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-9-CM\",\"530.81\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2013-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-10-CM\",\"I10\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2014-01-01\",\"\\\\000\",\"\\\\000\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	patients, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), "./patient.csv", 10, nil)
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, nil)
+	report := app.NewUnmappedICD9Report()
+	app.ParseTrinetXPatientDiagnoses(app.DefaultParseConfig(), filepath.Join(dir, "diagnosis.csv"), patients,
+		analysisMaps, app.ICD9Mapping{Codes: map[string][]string{"530.81": {"K21.9"}}}, nil, report)
+	if report.Rows != 5 || report.Dropped != 3 || report.Percentage() != 60 {
+		t.Error("Expected 3 of 5 diagnoses dropped, got ", report.Dropped, " of ", report.Rows)
+	}
+	if len(report.Unmapped) != 2 || report.Unmapped["401.9"] != 2 || report.Unmapped["250.00"] != 1 {
+		t.Error("Unexpected unmapped ICD9 codes: ", report.Unmapped)
+	}
+	fileName := filepath.Join(dir, "exp1-unmapped-icd9.csv")
+	if err := report.WriteCSV(fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "code,occurrences\n401.9,2\n250.00,1\n"; string(data) != expected {
+		t.Error("Expected unmapped ICD9 csv ", expected, ", got ", string(data))
+	}
+}
+
+func TestIcd9ToIcd10GEM(t *testing.T) {
+	dir := t.TempDir()
+	gem := "25000     E119      00000\n" +
+		"25001     E109      10000\n" +
+		"25001     E108      10000\n" +
+		"4019      I10       00000\n" +
+		"V0481     Z23       10000\n" +
+		"E8800     W10XXXA   00000\n" +
+		"7999      NoDx      11000\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "2018_I9gem.txt"), []byte(gem), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mapping := app.ParseIcd9ToIcd10Mapping(filepath.Join(dir, "2018_I9gem.txt"))
+	if len(mapping.Codes) != 5 || len(mapping.Codes["250.01"]) != 2 || mapping.Codes["250.00"][0] != "E11.9" ||
+		mapping.Codes["E880.0"][0] != "W10.XXXA" || mapping.Codes["401.9"][0] != "I10" {
+		t.Fatal("Unexpected ICD9 to ICD10 mapping: ", mapping.Codes)
+	}
+	if len(mapping.Approximate) != 2 || !mapping.Approximate["250.01"] || !mapping.Approximate["V04.81"] {
+		t.Error("Expected 2 ICD9 codes with approximate mappings only, got ", mapping.Approximate)
+	}
+	diagnoses := "\"70\",\"\\\\000\",\"ICD-9-CM\",\"250.01\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2010-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-9-CM\",\"799.9\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2011-01-01\",\"\\\\000\",\"\\\\000\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &trajectory.Patient{PID: 1, PIDString: "70", YOB: 1950}
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, nil)
+	report := app.NewUnmappedICD9Report()
+	app.ParseTrinetXPatientDiagnoses(app.DefaultParseConfig(), filepath.Join(dir, "diagnosis.csv"), makePatientMap(p),
+		analysisMaps, mapping, nil, report)
+	// E10.9 and E10.8 share the level 2 diagnosis on the same date and are compacted into one
+	if len(p.Diagnoses) != 1 || report.Dropped != 1 || report.Unmapped["799.9"] != 1 {
+		t.Error("Expected the ICD10 codes of 250.01 compacted and 799.9 dropped, got ", len(p.Diagnoses),
+			" diagnoses and ", report.Unmapped)
+	}
+}
+
+func TestSNOMEDToICD10Mapping(t *testing.T) {
+	dir := t.TempDir()
+	// 44054006 has an age-dependent rule that is skipped, 59621000 an inactive row, and 73211009 a second map group
+	nlm := "id\teffectiveTime\tactive\tmoduleId\trefsetId\treferencedComponentId\tmapGroup\tmapPriority\tmapRule\t" +
+		"mapAdvice\tmapTarget\tcorrelationId\tmapCategoryId\n" +
+		"1\t20220301\t1\t5991000124107\t6011000124106\t44054006\t1\t1\tIFA 445518008 | Age at onset |\t\tE11.8\t0\t0\n" +
+		"2\t20220301\t1\t5991000124107\t6011000124106\t44054006\t1\t2\tOTHERWISE TRUE\t\tE11.9\t0\t0\n" +
+		"3\t20220301\t0\t5991000124107\t6011000124106\t59621000\t1\t1\tTRUE\t\tI15.9\t0\t0\n" +
+		"4\t20220301\t1\t5991000124107\t6011000124106\t59621000\t1\t2\tTRUE\t\tI10\t0\t0\n" +
+		"5\t20220301\t1\t5991000124107\t6011000124106\t73211009\t1\t1\tTRUE\t\tE14.9\t0\t0\n" +
+		"6\t20220301\t1\t5991000124107\t6011000124106\t73211009\t2\t1\tTRUE\t\tZ79.4\t0\t0\n" +
+		"7\t20220301\t1\t5991000124107\t6011000124106\t22298006\t1\t1\tTRUE\t\t\t0\t0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "snomed.tsv"), []byte(nlm), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mapping := app.ParseSNOMEDToICD10Mapping(app.DefaultParseConfig(), filepath.Join(dir, "snomed.tsv"))
+	if len(mapping) != 3 || mapping["44054006"] != "E11.9" || mapping["59621000"] != "I10" ||
+		mapping["73211009"] != "E14.9" {
+		t.Error("Unexpected SNOMED CT to ICD10 mapping from the NLM map: ", mapping)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "snomed.csv"), []byte("44054006,E11.9\n38341003,I10\n"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	mapping = app.ParseSNOMEDToICD10Mapping(app.DefaultParseConfig(), filepath.Join(dir, "snomed.csv"))
+	if len(mapping) != 2 || mapping["38341003"] != "I10" {
+		t.Error("Unexpected SNOMED CT to ICD10 mapping from the csv file: ", mapping)
+	}
+	diagnoses := "\"70\",\"\\\\000\",\"SNOMEDCT\",\"44054006\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2010-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"SNOMEDCT\",\"22298006\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2011-01-01\",\"\\\\000\",\"\\\\000\"\n" +
+		"\"70\",\"\\\\000\",\"ICD-10-CM\",\"I10\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"2012-01-01\",\"\\\\000\",\"\\\\000\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &trajectory.Patient{PID: 1, PIDString: "70", YOB: 1950}
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, nil)
+	report := app.NewUnmappedICD9Report()
+	app.ParseTrinetXPatientDiagnoses(app.DefaultParseConfig(), filepath.Join(dir, "diagnosis.csv"), makePatientMap(p),
+		analysisMaps, app.ICD9Mapping{SNOMED: mapping}, nil, report)
+	if len(p.Diagnoses) != 2 || p.Diagnoses[0].DID != analysisMaps.GetDIDs("E11.9")[0] || report.Dropped != 0 {
+		t.Error("Expected the SNOMED CT diagnosis mapped onto E11.9 and the unmapped one dropped, got ",
+			len(p.Diagnoses), " diagnoses")
+	}
+}
+
+func TestDuplicatePatients(t *testing.T) {
+	dir := t.TempDir()
+	patientRow := func(pid, sex, yob, death string) string {
+		return "\"" + pid + "\",\"" + sex + "\",\"\\\\000\",\"\\\\000\",\"" + yob + "\",\"\\\\000\",\"\\\\000\"," +
+			"\"\\\\000\",\"\\\\000\",\"\\\\000\",\"" + death + "\",\"\\\\000\"\n"
+	}
+	diagnosisRow := func(pid, code, date string) string {
+		return "\"" + pid + "\",\"\\\\000\",\"ICD-10-CM\",\"" + code + "\",\"\\\\000\",\"\\\\000\",\"\\\\000\",\"" + date +
+			"\",\"\\\\000\",\"\\\\000\"\n"
+	}
+	// patient 1 occurs in the extracts of two networks, the second one with a conflicting year of birth
+	patients := patientRow("1", "M", "1950", "\\\\000") + patientRow("2", "F", "1960", "\\\\000") +
+		patientRow("1", "M", "1951", "202001")
+	diagnoses := diagnosisRow("1", "I10", "2010-01-01") + diagnosisRow("2", "I10", "2011-01-01") +
+		diagnosisRow("1", "I10", "2010-01-01") + diagnosisRow("1", "E11.9", "2012-01-01")
+	if err := ioutil.WriteFile(filepath.Join(dir, "patient.csv"), []byte(patients), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "diagnosis.csv"), []byte(diagnoses), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pMap, _ := app.ParseTriNetXPatientData(app.DefaultParseConfig(), filepath.Join(dir, "patient.csv"), 1, nil)
+	if len(pMap.PIDMap) != 2 || pMap.Ctr != 2 || pMap.MaleCtr != 1 || pMap.FemaleCtr != 1 {
+		t.Fatal("Expected 2 patients, 1 male and 1 female, got ", len(pMap.PIDMap))
+	}
+	p, _ := trajectory.GetPatient("1", pMap)
+	if p.YOB != 1950 || p.DeathDate == nil || p.DeathDate.Year != 2020 {
+		t.Error("Expected the year of birth of the first row and the death date of the second row, got ", p.YOB,
+			" and ", p.DeathDate)
+	}
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(app.DefaultParseConfig(), "./icd10cm_tabular_2022.xml",
+		app.IcdFlavorAuto, 2, nil)
+	app.ParseTrinetXPatientDiagnoses(app.DefaultParseConfig(), filepath.Join(dir, "diagnosis.csv"), pMap, analysisMaps,
+		app.ICD9Mapping{}, nil, nil)
+	// the parser compacts the diagnoses without a burst collapser
+	if len(p.Diagnoses) != 2 || p.Diagnoses[0].Date.Year != 2010 || p.Diagnoses[1].Date.Year != 2012 {
+		t.Error("Expected the diagnoses of both rows unioned and compacted, got ", len(p.Diagnoses), " diagnoses.")
+	}
+}
@@ -0,0 +1,91 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package ptra_test
+
+import (
+	"ptra/trajectory"
+	"testing"
+)
+
+// makeWindowExperiment creates a small experiment where 10 patients follow A -> B -> C in 2010-2012 and 20 patients
+// follow A -> B -> C in 2016-2018.
+func makeWindowExperiment() *trajectory.Experiment {
+	exp := &trajectory.Experiment{
+		NofDiagnosisCodes: 3,
+		Name:              "windows",
+		NameMap:           map[int]string{0: "A", 1: "B", 2: "C"},
+		DxDRR:             trajectory.MakeDxDRR(3),
+		DxDPatients:       trajectory.MakeDxDPatients(3),
+	}
+	pid := 0
+	for _, group := range []struct{ year, n int }{{2010, 10}, {2016, 20}} {
+		for i := 0; i < group.n; i++ {
+			p := &trajectory.Patient{PID: pid, YOB: 1950}
+			for did := 0; did < 3; did++ {
+				trajectory.AddDiagnosis(p, &trajectory.Diagnosis{PID: pid, DID: did,
+					Date: trajectory.DiagnosisDate{Year: group.year + did, Month: 6, Day: 1}})
+			}
+			exp.DxDPatients[0][1] = append(exp.DxDPatients[0][1], p)
+			exp.DxDPatients[0][2] = append(exp.DxDPatients[0][2], p)
+			exp.DxDPatients[1][2] = append(exp.DxDPatients[1][2], p)
+			pid++
+		}
+	}
+	exp.DxDRR[0][1] = 2
+	exp.DxDRR[0][2] = 2
+	exp.DxDRR[1][2] = 2
+	return exp
+}
+
+func TestSlidingWindowAnalysis(t *testing.T) {
+	exp := makeWindowExperiment()
+	results := trajectory.SlidingWindowAnalysis(exp, 5, 5, 2010, 2018, 5, 3, 3, 0.5, 5, 1.0,
+		[]trajectory.TrajectoryFilter{})
+	if len(results) != 2 {
+		t.Fatal("Expected 2 windows, got ", len(results))
+	}
+	if results[0].Start != 2010 || results[0].End != 2015 || results[1].Start != 2015 || results[1].End != 2019 {
+		t.Error("Unexpected window boundaries: ", results[0].Start, "-", results[0].End, ", ", results[1].Start, "-",
+			results[1].End)
+	}
+	for i, expected := range []int{10, 20} {
+		result := results[i]
+		if len(result.Trajectories) != 1 {
+			t.Fatal("Expected 1 trajectory in window ", i, ", got ", len(result.Trajectories))
+		}
+		traj := result.Trajectories[0]
+		if len(traj.Diagnoses) != 3 || traj.PatientNumbers[len(traj.PatientNumbers)-1] != expected {
+			t.Error("Expected A -> B -> C with ", expected, " patients in window ", i, ", got ", traj.Diagnoses, " ",
+				traj.PatientNumbers)
+		}
+	}
+	if results[0].Dominant[0] || !results[1].Dominant[0] {
+		t.Error("A -> B -> C should only be dominant in the second window.")
+	}
+	// overlapping windows
+	results = trajectory.SlidingWindowAnalysis(exp, 4, 2, 2010, 2018, 5, 3, 3, 0.5, 5, 1.0,
+		[]trajectory.TrajectoryFilter{})
+	if len(results) != 4 || results[3].Start != 2016 || results[3].End != 2019 {
+		t.Error("Expected 4 overlapping windows, the last one from 2016 to 2019, got ", len(results))
+	}
+	// the experiment itself is not modified
+	if exp.Pairs != nil || exp.Trajectories != nil || len(exp.DxDPatients[0][1]) != 30 {
+		t.Error("Sliding window analysis should not modify the experiment.")
+	}
+}
@@ -0,0 +1,213 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	_ "embed"
+	"fmt"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// Charlson comorbidity index
+
+//go:embed charlson.tsv
+var charlsonTable string
+
+// CharlsonCondition is a condition of the Charlson comorbidity index. Of the conditions with the same Hierarchy, e.g.
+// diabetes with and without chronic complications, only the one with the highest weight counts for a patient. An empty
+// Hierarchy means the condition always counts.
+type CharlsonCondition struct {
+	Name      string
+	Weight    int
+	Hierarchy string
+	Codes     []string //ICD10 codes, matched as prefixes
+}
+
+// CharlsonConditions are the conditions of the Charlson comorbidity index, read from the embedded charlson.tsv table.
+var CharlsonConditions = parseCharlsonTable(charlsonTable)
+
+// parseCharlsonTable parses a table of Charlson conditions. Each line has 4 tab-separated fields: the name of the
+// condition, its weight, its hierarchy or - for none, and a comma-separated list of ICD10 codes. Lines starting with #
+// are comments.
+func parseCharlsonTable(table string) []*CharlsonCondition {
+	conditions := []*CharlsonCondition{}
+	for _, line := range strings.Split(table, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			panic(fmt.Sprintf("Invalid Charlson condition: %s", line))
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil {
+			panic(err)
+		}
+		hierarchy := fields[2]
+		if hierarchy == "-" {
+			hierarchy = ""
+		}
+		conditions = append(conditions, &CharlsonCondition{Name: fields[0], Weight: weight, Hierarchy: hierarchy,
+			Codes: strings.Split(fields[3], ",")})
+	}
+	return conditions
+}
+
+// Comorbidity is an ICD10 code of a patient that codes for a condition of the Charlson or Elixhauser comorbidity
+// indices, with the date it is first diagnosed. The comorbidity indices are computed from these raw codes rather than
+// from the analysis DIDs, which may combine the codes of different conditions, e.g. at a coarse ICD10 level or under
+// CCSR maps, and which are not available for the codes that are excluded from the analysis.
+type Comorbidity struct {
+	Code string
+	Date DiagnosisDate
+}
+
+// comorbidityPrefixes are the ICD10 codes of the conditions of the Charlson and Elixhauser comorbidity indices.
+var comorbidityPrefixes = comorbidityCodes()
+
+// comorbidityCodes returns the set of ICD10 codes of the Charlson and Elixhauser conditions.
+func comorbidityCodes() map[string]bool {
+	codes := map[string]bool{}
+	for _, condition := range CharlsonConditions {
+		for _, code := range condition.Codes {
+			codes[code] = true
+		}
+	}
+	for _, category := range ElixhauserCategories {
+		for _, code := range category.Codes {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+// matchesCode checks if an ICD10 code starts with one of the given codes.
+func matchesCode(code string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordComorbidity records an ICD10 code of a patient in Patient.Comorbidities if it codes for a condition of the
+// Charlson or Elixhauser comorbidity indices. Of the same code, only the first date is kept. The parsers record all
+// ICD10 codes of the patients, including the codes excluded from the analysis.
+func RecordComorbidity(p *Patient, code string, date DiagnosisDate) {
+	matched := false
+	for i := 1; i <= len(code); i++ {
+		if comorbidityPrefixes[code[:i]] {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+	for _, c := range p.Comorbidities {
+		if c.Code == code {
+			if DiagnosisDateSmallerThan(date, c.Date) {
+				c.Date = date
+			}
+			return
+		}
+	}
+	p.Comorbidities = append(p.Comorbidities, &Comorbidity{Code: string([]byte(code)), Date: date})
+}
+
+// charlsonReferenceDate returns the date up to which the diagnoses of a patient count for the Charlson index: the date
+// of the event of interest, or else the date of the first diagnosis.
+func charlsonReferenceDate(p *Patient) (DiagnosisDate, bool) {
+	if p.EOIDate != nil {
+		return *p.EOIDate, true
+	}
+	if len(p.Diagnoses) > 0 {
+		return p.Diagnoses[0].Date, true
+	}
+	return DiagnosisDate{}, false
+}
+
+// CharlsonIndex computes the Charlson comorbidity index of a patient from the comorbidity codes, cf.
+// RecordComorbidity, that are diagnosed on or before the reference date, i.e. the date of the event of interest, or
+// else the date of the first diagnosis. The index is the sum of the weights of the conditions the patient is diagnosed
+// with, where of the conditions of the same hierarchy only the one with the highest weight counts.
+func CharlsonIndex(p *Patient) int {
+	referenceDate, ok := charlsonReferenceDate(p)
+	if !ok {
+		return 0
+	}
+	weights := map[string]int{} // hierarchy, or name for conditions without a hierarchy -> highest weight
+	for _, c := range p.Comorbidities {
+		if DiagnosisDateSmallerThan(referenceDate, c.Date) {
+			continue
+		}
+		for _, condition := range CharlsonConditions {
+			if !matchesCode(c.Code, condition.Codes) {
+				continue
+			}
+			key := condition.Hierarchy
+			if key == "" {
+				key = condition.Name
+			}
+			if condition.Weight > weights[key] {
+				weights[key] = condition.Weight
+			}
+		}
+	}
+	index := 0
+	for _, weight := range weights {
+		index += weight
+	}
+	return index
+}
+
+// InitializeCharlsonIndices computes the Charlson comorbidity index of all patients, cf. CharlsonIndex, and stores it
+// in Patient.Charlson.
+func InitializeCharlsonIndices(patients *PatientMap) {
+	for _, p := range patients.PIDMap {
+		p.Charlson = CharlsonIndex(p)
+	}
+}
+
+// NofCharlsonGroups is the nr of Charlson groups when cohorts are stratified by Charlson index, cf. CharlsonGroup.
+const NofCharlsonGroups = 4
+
+// CharlsonGroups are the names of the Charlson groups, indexed by CharlsonGroup.
+var CharlsonGroups = []string{"0", "1-2", "3-4", "5+"}
+
+// CharlsonGroup returns the Charlson group for a Charlson index: 0 for index 0, 1 for 1-2, 2 for 3-4, and 3 for 5 or
+// more.
+func CharlsonGroup(index int) int {
+	if index <= 0 {
+		return 0
+	}
+	return utils.MinInt((index+1)/2, NofCharlsonGroups-1)
+}
+
+// StratifyCohortsByCharlson replaces the cohorts of an experiment by cohorts that are also stratified by Charlson
+// group, cf. CharlsonGroup, so that comparison patients are sampled from the patients with a similar comorbidity
+// burden. The Charlson indices of the patients must be initialized, cf. InitializeCharlsonIndices.
+func StratifyCohortsByCharlson(exp *Experiment, patients *PatientMap) {
+	exp.NofCharlsonGroups = NofCharlsonGroups
+	exp.Cohorts = initializeCohorts(patients, exp.NofAgeGroups, exp.NofRegions, exp.NofRaces, exp.NofCharlsonGroups,
+		exp.NofDiagnosisCodes)
+}
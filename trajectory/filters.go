@@ -18,6 +18,14 @@
 
 package trajectory
 
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
 // PatientFilter prescribes a function type for implementing filters on TriNetX patients, to be able to calculate
 // trajectories for specific cohorts. E.g. male patients, patients <70 years, patients with specific cancer stage, etc.
 type PatientFilter func(patient *Patient) bool
@@ -27,7 +35,8 @@ type PatientFilter func(patient *Patient) bool
 type TrajectoryFilter func(t *Trajectory) bool
 
 func ApplyPatientFilter(filter PatientFilter, pMap *PatientMap) *PatientMap {
-	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr}
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		AgeGroups: pMap.AgeGroups, Regions: pMap.Regions, Races: pMap.Races, Ethnicities: pMap.Ethnicities}
 	for pid, p := range pMap.PIDMap {
 		if filter(p) {
 			newPMap.PIDStringMap[p.PIDString] = pid
@@ -43,7 +52,8 @@ func ApplyPatientFilter(filter PatientFilter, pMap *PatientMap) *PatientMap {
 }
 
 func ApplyPatientFilters(filters []PatientFilter, pMap *PatientMap) *PatientMap {
-	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr}
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		AgeGroups: pMap.AgeGroups, Regions: pMap.Regions, Races: pMap.Races, Ethnicities: pMap.Ethnicities}
 	for pid, p := range pMap.PIDMap {
 		res := true
 		for _, filter := range filters {
@@ -82,6 +92,224 @@ func FemaleFilter() PatientFilter {
 	return SexFilter(Female)
 }
 
+// RaceFilter keeps the patients of the given race, an index in PatientMap.Races.
+func RaceFilter(race int) PatientFilter {
+	return func(p *Patient) bool {
+		return p.Race == race
+	}
+}
+
+// RegionFilter keeps the patients of the given region, an index in PatientMap.Regions.
+func RegionFilter(regionID int) PatientFilter {
+	return func(p *Patient) bool {
+		return p.Region == regionID
+	}
+}
+
+//Composing patient filters.
+//Several patient filters have the side effect of removing diagnoses from the patients they keep, e.g. the EOI and age
+//filters. Such filters must replace p.Diagnoses by a new slice rather than modify it in place. The combinators below
+//restore the diagnoses of a patient whenever a filter that was tried rejects the patient, so that only the filters
+//that accept a patient leave their side effects behind.
+
+// AndFilter keeps the patients that pass all filters. The filters are applied in order, so that each filter sees the
+// diagnoses left by the previous ones. If a filter rejects the patient, the remaining filters are not applied and the
+// diagnoses of the patient are restored.
+func AndFilter(filters ...PatientFilter) PatientFilter {
+	return func(p *Patient) bool {
+		diagnoses := p.Diagnoses
+		for _, filter := range filters {
+			if !filter(p) {
+				p.Diagnoses = diagnoses
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// OrFilter keeps the patients that pass any of the filters. The filters are tried in order on the original diagnoses of
+// the patient, and the first filter that accepts the patient determines its diagnoses: the side effects of the
+// filters that reject the patient are undone, and the remaining filters are not applied.
+func OrFilter(filters ...PatientFilter) PatientFilter {
+	return func(p *Patient) bool {
+		diagnoses := p.Diagnoses
+		for _, filter := range filters {
+			if filter(p) {
+				return true
+			}
+			p.Diagnoses = diagnoses
+		}
+		return false
+	}
+}
+
+// NotFilter keeps the patients that a filter rejects. The side effects of the filter are always undone, so the kept
+// patients have their original diagnoses.
+func NotFilter(filter PatientFilter) PatientFilter {
+	return func(p *Patient) bool {
+		diagnoses := p.Diagnoses
+		result := filter(p)
+		p.Diagnoses = diagnoses
+		return !result
+	}
+}
+
+// ParsePatientFilterExpression compiles a patient filter expression into a single patient filter. The expression
+// combines filter names with AND, OR, NOT, and parentheses, e.g. "female AND NOT age70+". NOT binds stronger than AND,
+// which binds stronger than OR. A comma is an AND that binds weaker than OR, so that a comma-separated list of filters
+// keeps the patients that pass all of them, e.g. "MIBC OR mUC,female" keeps the female MIBC or mUC patients. The
+// keywords are case-insensitive. The names are resolved to filters with the resolve function. See AndFilter, OrFilter,
+// and NotFilter for how the side effects of the filters are combined.
+func ParsePatientFilterExpression(expression string, resolve func(name string) (PatientFilter, error)) (PatientFilter,
+	error) {
+	parser := &patientFilterParser{tokens: tokenizePatientFilterExpression(expression), resolve: resolve}
+	if len(parser.tokens) == 0 {
+		return nil, fmt.Errorf("empty patient filter expression")
+	}
+	filter, err := parser.parseList()
+	if err != nil {
+		return nil, fmt.Errorf("invalid patient filter expression %q: %v", expression, err)
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("invalid patient filter expression %q: unexpected %s", expression,
+			parser.tokens[parser.pos])
+	}
+	return filter, nil
+}
+
+// tokenizePatientFilterExpression splits a patient filter expression into parentheses, commas, and words.
+func tokenizePatientFilterExpression(expression string) []string {
+	tokens := []string{}
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range expression {
+		switch {
+		case r == '(' || r == ')' || r == ',':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// patientFilterParser is a recursive descent parser for patient filter expressions, cf. ParsePatientFilterExpression.
+type patientFilterParser struct {
+	tokens  []string
+	pos     int
+	resolve func(name string) (PatientFilter, error)
+}
+
+// peek returns the next token in upper case, or "" at the end of the expression.
+func (parser *patientFilterParser) peek() string {
+	if parser.pos < len(parser.tokens) {
+		return strings.ToUpper(parser.tokens[parser.pos])
+	}
+	return ""
+}
+
+// parseList parses: or (, or)*
+func (parser *patientFilterParser) parseList() (PatientFilter, error) {
+	filters := []PatientFilter{}
+	for {
+		filter, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if parser.peek() != "," {
+			break
+		}
+		parser.pos++
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AndFilter(filters...), nil
+}
+
+// parseOr parses: and (OR and)*
+func (parser *patientFilterParser) parseOr() (PatientFilter, error) {
+	filters := []PatientFilter{}
+	for {
+		filter, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if parser.peek() != "OR" {
+			break
+		}
+		parser.pos++
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return OrFilter(filters...), nil
+}
+
+// parseAnd parses: not (AND not)*
+func (parser *patientFilterParser) parseAnd() (PatientFilter, error) {
+	filters := []PatientFilter{}
+	for {
+		filter, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if parser.peek() != "AND" {
+			break
+		}
+		parser.pos++
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AndFilter(filters...), nil
+}
+
+// parseNot parses: NOT not | ( list ) | name
+func (parser *patientFilterParser) parseNot() (PatientFilter, error) {
+	switch token := parser.peek(); token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "NOT":
+		parser.pos++
+		filter, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotFilter(filter), nil
+	case "(":
+		parser.pos++
+		filter, err := parser.parseList()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		parser.pos++
+		return filter, nil
+	case ")", ",", "AND", "OR":
+		return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+	default:
+		name := parser.tokens[parser.pos]
+		parser.pos++
+		return parser.resolve(name)
+	}
+}
+
 // EOIFilter removes all diagnoses for patients that satisfy a given predicate
 func EOIFilter(test func(d1, d2 DiagnosisDate) bool) PatientFilter {
 	return func(p *Patient) bool {
@@ -113,6 +341,177 @@ func EOIAfterFilter() PatientFilter {
 	return EOIFilter(func(d1, d2 DiagnosisDate) bool { return DiagnosisDateSmallerThan(d2, d1) })
 }
 
+// addYears adds a possibly negative and fractional number of years to a date with calendar arithmetic, e.g. 5 years
+// before 2020-03-15 is 2015-03-15. The fraction of a year is added as a number of days, rounded to the nearest day.
+func addYears(date DiagnosisDate, years float64) DiagnosisDate {
+	whole := math.Trunc(years)
+	days := math.Round((years - whole) * 365.25)
+	t := time.Date(date.Year, time.Month(date.Month), date.Day, 0, 0, 0, 0, time.UTC).AddDate(int(whole), 0, int(days))
+	return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}
+}
+
+// EOIPeriodFilter removes all diagnoses outside a period around the event of interest date, from yearsBefore years
+// before up to yearsAfter years after it. The diagnoses on the edges of the period are kept. The edges are computed
+// with calendar arithmetic, cf. addYears. Patients without an event of interest, or without diagnoses in the period,
+// are removed. E.g. EOIPeriodFilter(5, 2) keeps the diagnoses from 5 years before through 2 years after the event of
+// interest.
+func EOIPeriodFilter(yearsBefore, yearsAfter float64) PatientFilter {
+	return func(p *Patient) bool {
+		if p.EOIDate == nil {
+			return false
+		}
+		start, end := addYears(*p.EOIDate, -yearsBefore), addYears(*p.EOIDate, yearsAfter)
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if DiagnosisDateSmallerThan(d.Date, start) || DiagnosisDateSmallerThan(end, d.Date) {
+				continue
+			}
+			newD = append(newD, d)
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
+// DiedWithinYearsOfEOI keeps the patients who died less than a number of years after their event of interest, e.g. the
+// patients who died within 2 years of their bladder cancer diagnosis. The end of the period is computed with calendar
+// arithmetic, cf. addYears, and a patient who died exactly that number of years after the event of interest is not
+// kept, cf. SurvivedAtLeastYearsAfterEOI. Patients without an event of interest or without a date of death are removed.
+func DiedWithinYearsOfEOI(years float64) PatientFilter {
+	return func(p *Patient) bool {
+		if p.EOIDate == nil || p.DeathDate == nil {
+			return false
+		}
+		return DiagnosisDateSmallerThan(*p.DeathDate, addYears(*p.EOIDate, years))
+	}
+}
+
+// SurvivedAtLeastYearsAfterEOI keeps the patients who survived at least a number of years after their event of interest,
+// i.e. the patients that DiedWithinYearsOfEOI removes. Patients without a date of death are treated as survivors, cf.
+// ObservedSurvivalAfterEOI. Patients without an event of interest are removed.
+func SurvivedAtLeastYearsAfterEOI(years float64) PatientFilter {
+	return func(p *Patient) bool {
+		if p.EOIDate == nil {
+			return false
+		}
+		return p.DeathDate == nil || !DiagnosisDateSmallerThan(*p.DeathDate, addYears(*p.EOIDate, years))
+	}
+}
+
+// ObservedSurvivalAfterEOI is a SurvivedAtLeastYearsAfterEOI filter that only treats patients without a date of death
+// as survivors if they are observed long enough, i.e. if their last diagnosis is at least the number of years after
+// their event of interest.
+func ObservedSurvivalAfterEOI(years float64) PatientFilter {
+	return func(p *Patient) bool {
+		if p.EOIDate == nil {
+			return false
+		}
+		end := addYears(*p.EOIDate, years)
+		if p.DeathDate != nil {
+			return !DiagnosisDateSmallerThan(*p.DeathDate, end)
+		}
+		return len(p.Diagnoses) > 0 && !DiagnosisDateSmallerThan(p.Diagnoses[len(p.Diagnoses)-1].Date, end)
+	}
+}
+
+// EOIWindowFilter removes all diagnoses outside the window from the n-th to the m-th event of interest, counting from
+// 1. The diagnoses on the event of interest dates themselves are kept. If n is 0, the window starts at the first
+// diagnosis. If m is 0, or the patient has fewer than m events of interest, the window ends at the last diagnosis.
+// Patients with fewer than n events of interest, or without diagnoses in the window, are removed. E.g.
+// EOIWindowFilter(1, 2) keeps the diagnoses between the first and second event of interest.
+func EOIWindowFilter(n, m int) PatientFilter {
+	return func(p *Patient) bool {
+		if len(p.EOIDates) < n {
+			return false
+		}
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if n > 0 && DiagnosisDateSmallerThan(d.Date, p.EOIDates[n-1]) {
+				continue
+			}
+			if m > 0 && m <= len(p.EOIDates) && DiagnosisDateSmallerThan(p.EOIDates[m-1], d.Date) {
+				break
+			}
+			newD = append(newD, d)
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
+// BeforeNthEOIFilter removes all diagnoses after the n-th event of interest.
+func BeforeNthEOIFilter(n int) PatientFilter {
+	return EOIWindowFilter(0, n)
+}
+
+// AfterNthEOIFilter removes all diagnoses before the n-th event of interest.
+func AfterNthEOIFilter(n int) PatientFilter {
+	return EOIWindowFilter(n, 0)
+}
+
+// WashoutFilter removes all patients that are diagnosed with a given diagnosis (excludeDID) during a washout period of
+// washoutYears that starts at their earliest recorded diagnosis. This keeps only patients that are naive to that
+// diagnosis at the start of their follow-up.
+func WashoutFilter(excludeDID int, washoutYears float64) PatientFilter {
+	return func(p *Patient) bool {
+		if len(p.Diagnoses) == 0 {
+			return true
+		}
+		start := DiagnosisDateToFloat(p.Diagnoses[0].Date)
+		for _, d := range p.Diagnoses {
+			if DiagnosisDateToFloat(d.Date)-start > washoutYears {
+				break
+			}
+			if d.DID == excludeDID {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MinObservationPeriodFilter removes all patients whose recorded history is shorter than minYears, i.e. where the time
+// between their earliest and latest diagnosis is less than minYears.
+func MinObservationPeriodFilter(minYears float64) PatientFilter {
+	return func(p *Patient) bool {
+		if len(p.Diagnoses) == 0 {
+			return minYears <= 0
+		}
+		first := DiagnosisDateToFloat(p.Diagnoses[0].Date)
+		last := DiagnosisDateToFloat(p.Diagnoses[len(p.Diagnoses)-1].Date)
+		return last-first >= minYears
+	}
+}
+
+// MinDiagnosesFilter removes all patients with fewer than minDiagnoses different diagnoses. Such patients can never
+// contribute to a diagnosis pair, but they inflate the cohorts that RR scores are computed from. Diagnoses that occur
+// multiple times for a patient are counted once.
+func MinDiagnosesFilter(minDiagnoses int) PatientFilter {
+	return func(p *Patient) bool {
+		dids := map[int]bool{}
+		for _, d := range p.Diagnoses {
+			dids[d.DID] = true
+		}
+		return len(dids) >= minDiagnoses
+	}
+}
+
+// DateRangeFilter trims the diagnoses of all patients down to the ones recorded from start up to and including end, and
+// removes the patients without diagnoses in that period.
+func DateRangeFilter(start, end DiagnosisDate) PatientFilter {
+	return func(p *Patient) bool {
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if DiagnosisDateSmallerThan(d.Date, start) || DiagnosisDateSmallerThan(end, d.Date) {
+				continue
+			}
+			newD = append(newD, d)
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
 // ageLessAggregator collects all patients younger than a specific age or trims down their data up until that age.
 func ageLessAggregator(age int) PatientFilter {
 	return func(p *Patient) bool {
@@ -162,3 +561,129 @@ func LessThanSeventyAggregator() PatientFilter {
 func AboveSeventyAggregator() PatientFilter {
 	return ageAboveAggregator(70)
 }
+
+// LessThanAgeAggregator collects all patients below a given age, and trims their diagnoses down to the ones recorded
+// before that age. Ages are derived from calendar years: the diagnoses recorded up to the year of birth + age - 1 are
+// kept.
+func LessThanAgeAggregator(age int) PatientFilter {
+	return ageLessAggregator(age)
+}
+
+// AboveAgeAggregator collects all patients above a given age, and removes their diagnoses recorded before that age.
+// Ages are derived from calendar years: the diagnoses recorded after the year of birth + age are kept.
+func AboveAgeAggregator(age int) PatientFilter {
+	return ageAboveAggregator(age)
+}
+
+// AgeBandAggregator collects all patients with diagnoses recorded between two ages, and removes their other
+// diagnoses. Ages are derived from calendar years: the diagnoses recorded from the year of birth + minAge up to and
+// including the year of birth + maxAge are kept.
+func AgeBandAggregator(minAge, maxAge int) PatientFilter {
+	return func(p *Patient) bool {
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if age := d.Date.Year - p.YOB; age >= minAge && age <= maxAge {
+				newD = append(newD, d)
+			}
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
+// MinMeanRRTrajectoryFilter keeps the trajectories for which the geometric mean of the RR scores of their transitions,
+// cf. MeanRR, is at least minMeanRR.
+func MinMeanRRTrajectoryFilter(minMeanRR float64, exp *Experiment) TrajectoryFilter {
+	return func(t *Trajectory) bool {
+		return MeanRR(exp, t) >= minMeanRR
+	}
+}
+
+// MinTransitionRRFilter keeps the trajectories for which the RR score of every transition, i.e. of every pair of
+// consecutive diagnoses, is at least rr. Unlike MinMeanRRTrajectoryFilter, a single weak transition removes the
+// trajectory, even if the other transitions are strong.
+func MinTransitionRRFilter(exp *Experiment, rr float64) TrajectoryFilter {
+	return func(t *Trajectory) bool {
+		for i := 1; i < len(t.Diagnoses); i++ {
+			if exp.DxDRR[t.Diagnoses[i-1]][t.Diagnoses[i]] < rr {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MinFinalPatientsFilter keeps the trajectories whose last transition has at least n patients, according to the last
+// element of PatientNumbers. Unlike the minimum number of patients of BuildTrajectories, which is applied to each
+// transition while the trajectories are built and determines which trajectories are extended, this filter only
+// removes trajectories from the output: a trajectory whose last transition has fewer patients is removed as a whole,
+// rather than shortened.
+func MinFinalPatientsFilter(n int) TrajectoryFilter {
+	return func(t *Trajectory) bool {
+		return len(t.PatientNumbers) > 0 && t.PatientNumbers[len(t.PatientNumbers)-1] >= n
+	}
+}
+
+// MinTotalUniquePatientsFilter keeps the trajectories that are followed by at least n unique patients, i.e. the
+// patients of the last transition, counted by PID. Unlike MinFinalPatientsFilter, it counts the patients themselves
+// rather than relying on the recorded patient numbers, so that a patient listed more than once is only counted once.
+func MinTotalUniquePatientsFilter(n int) TrajectoryFilter {
+	return func(t *Trajectory) bool {
+		if len(t.Patients) == 0 {
+			return n <= 0
+		}
+		pids := map[int]bool{}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			pids[p.PID] = true
+		}
+		return len(pids) >= n
+	}
+}
+
+// MaxTrajectorySpanFilter keeps the trajectories that span at most maxYears from the first to the last diagnosis. The
+// span is the time between the median date of the first diagnosis and the median date of the last diagnosis, over the
+// patients who follow the whole trajectory. Trajectories without such patients are kept.
+func MaxTrajectorySpanFilter(maxYears float64) TrajectoryFilter {
+	return func(t *Trajectory) bool {
+		if len(t.Diagnoses) < 2 || len(t.Patients) == 0 {
+			return true
+		}
+		firstDates, lastDates := []float64{}, []float64{}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			if first, last, ok := trajectorySpan(p, t.Diagnoses); ok {
+				firstDates = append(firstDates, first)
+				lastDates = append(lastDates, last)
+			}
+		}
+		if len(firstDates) == 0 {
+			return true
+		}
+		sort.Float64s(firstDates)
+		sort.Float64s(lastDates)
+		return percentile(lastDates, 0.5)-percentile(firstDates, 0.5) <= maxYears
+	}
+}
+
+// trajectorySpan returns the dates of the first and last diagnosis of a trajectory for a patient. The patient's
+// diagnoses are followed from the first occurrence of the first diagnosis on, taking the next occurrence of each next
+// diagnosis of the trajectory. It returns false if the patient does not follow the whole trajectory.
+func trajectorySpan(p *Patient, diagnoses []int) (float64, float64, bool) {
+	idx := -1
+	for i, d := range p.Diagnoses {
+		if d.DID == diagnoses[0] {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return 0, 0, false
+	}
+	first := idx
+	for _, did := range diagnoses[1:] {
+		idx = countPatientTrajectory(p, idx, did, 0, math.Inf(1))
+		if idx == -1 {
+			return 0, 0, false
+		}
+	}
+	return DiagnosisDateToFloat(p.Diagnoses[first].Date), DiagnosisDateToFloat(p.Diagnoses[idx].Date), true
+}
@@ -0,0 +1,138 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Markov-chain trajectory model
+// The diagnosis pairs of an experiment can be seen as the transitions of a Markov chain over the diagnosis codes. The
+// probability of a transition d1->d2 is the RR of the pair, normalised over all selected pairs that start with d1.
+// Following the chain from a start diagnosis generates synthetic trajectories, e.g. to compare with the observed
+// trajectories.
+
+// BuildMarkovModel builds a Markov chain from the RR scores of the selected diagnosis pairs of an experiment, cf.
+// BuildTrajectories. For each first diagnosis d1, the RRs of the pairs d1->d2 in exp.Pairs, or the ORs with
+// EffectMeasureOR, are normalised to sum to 1.0, so that the model maps d1 onto the transition probabilities to each
+// d2. Diagnoses without outgoing pairs have no entry in the model.
+func BuildMarkovModel(exp *Experiment) map[int]map[int]float64 {
+	model := map[int]map[int]float64{}
+	totals := map[int]float64{}
+	for _, pair := range exp.Pairs {
+		RR := exp.DxDRR[pair.First][pair.Second]
+		if RR <= 0 {
+			continue
+		}
+		if model[pair.First] == nil {
+			model[pair.First] = map[int]float64{}
+		}
+		model[pair.First][pair.Second] = RR
+		totals[pair.First] += RR
+	}
+	for d1, transitions := range model {
+		for d2, RR := range transitions {
+			transitions[d2] = RR / totals[d1]
+		}
+	}
+	return model
+}
+
+// sampleTransition selects the next diagnosis from the transition probabilities of a diagnosis. It returns false if
+// the diagnosis has no transitions. The transitions are visited in order of their diagnosis, so that the sampling is
+// reproducible for a given random number generator.
+func sampleTransition(transitions map[int]float64, rng *rand.Rand) (int, bool) {
+	if len(transitions) == 0 {
+		return 0, false
+	}
+	dids := make([]int, 0, len(transitions))
+	for d2 := range transitions {
+		dids = append(dids, d2)
+	}
+	sort.Ints(dids)
+	x := rng.Float64()
+	for _, d2 := range dids {
+		x -= transitions[d2]
+		if x < 0 {
+			return d2, true
+		}
+	}
+	return dids[len(dids)-1], true
+}
+
+// SampleTrajectories generates nSamples synthetic trajectories by following the Markov chain of a model, cf.
+// BuildMarkovModel. Each trajectory starts with the diagnosis startDID, and ends after maxLen diagnoses or at a
+// diagnosis without transitions. The trajectories only have diagnoses, and no patients. The random numbers are drawn
+// from rng, so that the sampled trajectories are reproducible for a given seed, e.g. rand.New(rand.NewSource(seed)).
+func SampleTrajectories(model map[int]map[int]float64, startDID, maxLen int, nSamples int,
+	rng *rand.Rand) []*Trajectory {
+	trajectories := make([]*Trajectory, nSamples)
+	for i := range trajectories {
+		diagnoses := []int{startDID}
+		for d := startDID; len(diagnoses) < maxLen; {
+			next, ok := sampleTransition(model[d], rng)
+			if !ok {
+				break
+			}
+			diagnoses = append(diagnoses, next)
+			d = next
+		}
+		trajectories[i] = &Trajectory{Diagnoses: diagnoses, ID: i}
+	}
+	return trajectories
+}
+
+// markovModelJSON is the JSON representation of a Markov model, cf. SaveMarkovModel.
+type markovModelJSON struct {
+	EffectMeasure string                  `json:"effectMeasure"`
+	Names         map[int]string          `json:"names"`
+	Transitions   map[int]map[int]float64 `json:"transitions"`
+}
+
+// SaveMarkovModel saves a Markov model of an experiment to a JSON file, cf. BuildMarkovModel. The file has the
+// transition probabilities under "transitions", keyed by the analysis IDs of the diagnoses, and the medical names of
+// these diagnoses under "names". The effect measure from which the transition probabilities are normalised, cf.
+// EffectMeasureName, is recorded under "effectMeasure".
+func SaveMarkovModel(exp *Experiment, model map[int]map[int]float64, path string) {
+	names := map[int]string{}
+	for d1, transitions := range model {
+		names[d1] = exp.NameMap[d1]
+		for d2 := range transitions {
+			names[d2] = exp.NameMap[d2]
+		}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	modelJSON := markovModelJSON{EffectMeasure: EffectMeasureName(exp), Names: names, Transitions: model}
+	if err := encoder.Encode(modelJSON); err != nil {
+		panic(err)
+	}
+}
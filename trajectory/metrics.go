@@ -18,7 +18,11 @@
 
 package trajectory
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"sort"
+)
 
 // Collecting metrics for clusters of trajectories
 
@@ -36,11 +40,17 @@ func AgeAtDiagnosis(p *Patient, DID int) int {
 	return date.Year - yob
 }
 
-// AgeAtEOI calculates the age of a patient at the event of interest (e.g. cancer diagnosis)
-func AgeAtEOI(p *Patient) int {
+// AgeAtEOI calculates the age of a patient at an event of interest (e.g. cancer diagnosis). The name selects a named
+// event of interest, cf. RegisterEOI, or the default event of interest if it is empty. It returns -1 if the patient has
+// no such event of interest, or if the event of interest is dated before the patient's year of birth.
+func AgeAtEOI(p *Patient, name string) int {
 	yob := p.YOB
-	if p.EOIDate != nil {
-		return p.EOIDate.Year - yob
+	eoiDate := p.EOIDate
+	if name != "" {
+		eoiDate = p.NamedEOIs[name]
+	}
+	if eoiDate != nil && eoiDate.Year >= yob {
+		return eoiDate.Year - yob
 	}
 	return -1
 }
@@ -51,27 +61,40 @@ func AgeAtEOI(p *Patient) int {
 // * #patients per age category (normalized in percentages, not absolute numbers). Patients that occr in different
 // trajectories will be counted as separate instances for these age categories.
 // * #males, #females
-// * mean survival time after event of interest
-func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, float64, float64, int, int) {
+// The mean survival time after the event of interest is computed by MeanSurvivalAfterEOI.
+// * median age + interquartile range, at the last diagnosis and at the event of interest, which are more robust than
+// the mean and standard deviation for skewed age distributions. The median and IQR are NaN if there are no ages.
+// Ages that are negative because of diagnoses dated before the year of birth are left out of the mean ages and standard
+// deviations, and of the medians and IQRs.
+// The results are: mean age, stdev, mean age EOI, stdev EOI, #males, #females, median age, IQR age, median age EOI,
+// IQR age EOI.
+func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, float64, float64, int, int, float64, float64,
+	float64, float64) {
 	meanAge := 0
 	ctr := 0
 	mCtr := 0
 	fCtr := 0
 	meanAgeOfEOI := 0
 	ctr2 := 0
+	ages := []float64{}
+	agesEOI := []float64{}
 	for _, t := range trajectories {
 		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
-			ctr++
-			meanAge = meanAge + AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1])
+			if age := AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1]); age >= 0 {
+				ctr++
+				meanAge = meanAge + age
+				ages = append(ages, float64(age))
+			}
 			if p.Sex == Male {
 				mCtr++
 			} else {
 				fCtr++
 			}
-			ageEOI := AgeAtEOI(p)
+			ageEOI := AgeAtEOI(p, "")
 			if ageEOI != -1 {
 				meanAgeOfEOI = meanAgeOfEOI + ageEOI
 				ctr2++
+				agesEOI = append(agesEOI, float64(ageEOI))
 			}
 		}
 	}
@@ -82,8 +105,10 @@ func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, floa
 	for _, t := range trajectories {
 		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
 			age := float64(AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1]))
-			stdDev = stdDev + ((meanAgeF - age) * (meanAgeF - age))
-			ageEOI := float64(AgeAtEOI(p))
+			if age >= 0 {
+				stdDev = stdDev + ((meanAgeF - age) * (meanAgeF - age))
+			}
+			ageEOI := float64(AgeAtEOI(p, ""))
 			if ageEOI != -1 {
 				stdDevEOI = stdDevEOI + ((meanAgeOfEOIF - ageEOI) * (meanAgeOfEOIF - ageEOI))
 			}
@@ -91,5 +116,325 @@ func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, floa
 	}
 	stdDev = math.Sqrt(stdDev / float64(ctr))
 	stdDevEOI = math.Sqrt(stdDevEOI / float64(ctr2))
-	return meanAgeF, stdDev, meanAgeOfEOIF, stdDevEOI, mCtr, fCtr
+	medianAge, iqrAge := medianAndIQR(ages)
+	medianAgeEOI, iqrAgeEOI := medianAndIQR(agesEOI)
+	return meanAgeF, stdDev, meanAgeOfEOIF, stdDevEOI, mCtr, fCtr, medianAge, iqrAge, medianAgeEOI, iqrAgeEOI
+}
+
+// medianAndIQR computes the median and interquartile range of a list of values. The values are sorted in place. It
+// returns NaN for both if the list is empty.
+func medianAndIQR(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sort.Float64s(values)
+	return percentile(values, 0.5), percentile(values, 0.75) - percentile(values, 0.25)
+}
+
+// MeanSurvivalAfterEOI computes the mean and standard deviation of the survival time in years after the event of
+// interest, for the patients in the trajectories that have both an event of interest and a date of death. As in
+// MetricsFromTrajectories, patients that occur in different trajectories are counted as separate instances. It also
+// returns the number of instances. The mean and standard deviation are NaN if there are no such patients.
+func MeanSurvivalAfterEOI(trajectories []*Trajectory) (float64, float64, int) {
+	survivals := []float64{}
+	for _, t := range trajectories {
+		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
+			if p.EOIDate != nil && p.DeathDate != nil {
+				survivals = append(survivals, DiagnosisDateToFloat(*p.DeathDate)-DiagnosisDateToFloat(*p.EOIDate))
+			}
+		}
+	}
+	if len(survivals) == 0 {
+		return math.NaN(), math.NaN(), 0
+	}
+	mean := 0.0
+	for _, survival := range survivals {
+		mean = mean + survival
+	}
+	mean = mean / float64(len(survivals))
+	stdDev := 0.0
+	for _, survival := range survivals {
+		stdDev = stdDev + ((mean - survival) * (mean - survival))
+	}
+	stdDev = math.Sqrt(stdDev / float64(len(survivals)))
+	return mean, stdDev, len(survivals)
+}
+
+// DominantAgeGroup returns the age group (CohortAge) of the majority of the patients that complete a trajectory. If
+// several age groups have the same number of patients, the lowest one is returned.
+func DominantAgeGroup(t *Trajectory) int {
+	ctr := map[int]int{}
+	for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
+		ctr[p.CohortAge]++
+	}
+	dominant := 0
+	for ageGroup, n := range ctr {
+		if n > ctr[dominant] || (n == ctr[dominant] && ageGroup < dominant) {
+			dominant = ageGroup
+		}
+	}
+	return dominant
+}
+
+// TransitionTimeStats contains statistics of the times between the diagnoses of a transition in a trajectory, in years.
+type TransitionTimeStats struct {
+	Mean, Median, P25, P75, Min, Max float64
+}
+
+// percentile computes the p-th percentile (0 <= p <= 1) of a sorted list of values, interpolating linearly between the
+// closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	low := int(math.Floor(rank))
+	high := int(math.Ceil(rank))
+	return sorted[low] + (rank-float64(low))*(sorted[high]-sorted[low])
+}
+
+// transitionTimes returns for a patient the times between the diagnoses of each transition in a trajectory, following
+// the patient's diagnoses as when the trajectory is built: starting from the first occurrence of the first diagnosis,
+// each next diagnosis must occur within minTime and maxTime of the previous one. It returns the times for as many
+// transitions as the patient follows.
+func transitionTimes(p *Patient, t *Trajectory, minTime, maxTime float64) []float64 {
+	times := []float64{}
+	idx := -1
+	for i, d := range p.Diagnoses {
+		if d.DID == t.Diagnoses[0] {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return times
+	}
+	for _, did := range t.Diagnoses[1:] {
+		next := countPatientTrajectory(p, idx, did, minTime, maxTime)
+		if next == -1 {
+			break
+		}
+		times = append(times, DiagnosisDateToFloat(p.Diagnoses[next].Date)-DiagnosisDateToFloat(p.Diagnoses[idx].Date))
+		idx = next
+	}
+	return times
+}
+
+// ComputeTransitionTimeStats computes for each transition in a trajectory the statistics of the times between the
+// diagnoses of the transition, over the patients of the transition. The minimum and maximum time between diagnoses
+// must be the ones used for building the trajectory. The statistics of a transition without patients are 0.
+func ComputeTransitionTimeStats(t *Trajectory, minTime, maxTime float64) []TransitionTimeStats {
+	stats := make([]TransitionTimeStats, len(t.Diagnoses)-1)
+	for i := range stats {
+		if i >= len(t.Patients) {
+			break
+		}
+		times := []float64{}
+		for _, p := range t.Patients[i] {
+			if pTimes := transitionTimes(p, t, minTime, maxTime); i < len(pTimes) {
+				times = append(times, pTimes[i])
+			}
+		}
+		if len(times) == 0 {
+			continue
+		}
+		sort.Float64s(times)
+		sum := 0.0
+		for _, time := range times {
+			sum = sum + time
+		}
+		stats[i] = TransitionTimeStats{
+			Mean:   sum / float64(len(times)),
+			Median: percentile(times, 0.5),
+			P25:    percentile(times, 0.25),
+			P75:    percentile(times, 0.75),
+			Min:    times[0],
+			Max:    times[len(times)-1],
+		}
+	}
+	return stats
+}
+
+// icd10Categories returns the ICD10 categories from letter+from to letter+to, e.g. icd10Categories("I", 47, 49) returns
+// I47, I48, and I49.
+func icd10Categories(letter string, from, to int) []string {
+	codes := []string{}
+	for i := from; i <= to; i++ {
+		codes = append(codes, fmt.Sprintf("%s%02d", letter, i))
+	}
+	return codes
+}
+
+// icd10Subcategories returns the ICD10 subcategories of a category from category.from to category.to, e.g.
+// icd10Subcategories("I42", 5, 9) returns I42.5, I42.6, I42.7, I42.8, and I42.9.
+func icd10Subcategories(category string, from, to int) []string {
+	codes := []string{}
+	for i := from; i <= to; i++ {
+		codes = append(codes, fmt.Sprintf("%s.%d", category, i))
+	}
+	return codes
+}
+
+// icd10Codes concatenates lists of ICD10 codes.
+func icd10Codes(lists ...[]string) []string {
+	result := []string{}
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+	return result
+}
+
+// ElixhauserCategory is a comorbidity category of the Elixhauser Comorbidity Index. The ICD10 codes of a category are
+// prefixes, and its weight is the van Walraven weight of the category.
+type ElixhauserCategory struct {
+	Name   string
+	Codes  []string
+	Weight int
+}
+
+// ElixhauserCategories are the 31 categories of the Elixhauser Comorbidity Index, with the ICD10 codes of the coding
+// algorithm of Quan et al. (Med Care 2005;43:1130-1139), and the weights of van Walraven et al. (Med Care
+// 2009;47:626-633). Van Walraven et al. combine the uncomplicated and complicated hypertension categories, which both
+// have weight 0.
+var ElixhauserCategories = []ElixhauserCategory{
+	{"Congestive heart failure", icd10Codes([]string{"I09.9", "I11.0", "I13.0", "I13.2", "I25.5", "I42.0", "I43", "I50",
+		"P29.0"}, icd10Subcategories("I42", 5, 9)), 7},
+	{"Cardiac arrhythmias", icd10Codes(icd10Subcategories("I44", 1, 3), []string{"I45.6", "I45.9", "I47", "I48", "I49",
+		"R00.0", "R00.1", "R00.8", "T82.1", "Z45.0", "Z95.0"}), 5},
+	{"Valvular disease", icd10Codes([]string{"A52.0", "I05", "I06", "I07", "I08", "I09.1", "I09.8"},
+		icd10Categories("I", 34, 39), icd10Subcategories("Q23", 0, 3), icd10Subcategories("Z95", 2, 4)), -1},
+	{"Pulmonary circulation disorders", []string{"I26", "I27", "I28.0", "I28.8", "I28.9"}, 4},
+	{"Peripheral vascular disorders", []string{"I70", "I71", "I73.1", "I73.8", "I73.9", "I77.1", "I79.0", "I79.2",
+		"K55.1", "K55.8", "K55.9", "Z95.8", "Z95.9"}, 2},
+	{"Hypertension, uncomplicated", []string{"I10"}, 0},
+	{"Hypertension, complicated", []string{"I11", "I12", "I13", "I15"}, 0},
+	{"Paralysis", icd10Codes([]string{"G04.1", "G11.4", "G80.1", "G80.2", "G81", "G82", "G83.9"},
+		icd10Subcategories("G83", 0, 4)), 7},
+	{"Other neurological disorders", icd10Codes(icd10Categories("G", 10, 13), icd10Categories("G", 20, 22),
+		[]string{"G25.4", "G25.5", "G31.2", "G31.8", "G31.9", "G32", "G35", "G36", "G37", "G40", "G41", "G93.1",
+			"G93.4", "R47.0", "R56"}), 6},
+	{"Chronic pulmonary disease", icd10Codes([]string{"I27.8", "I27.9"}, icd10Categories("J", 40, 47),
+		icd10Categories("J", 60, 67), []string{"J68.4", "J70.1", "J70.3"}), 3},
+	{"Diabetes, uncomplicated", []string{"E10.0", "E10.1", "E10.9", "E11.0", "E11.1", "E11.9", "E12.0", "E12.1",
+		"E12.9", "E13.0", "E13.1", "E13.9", "E14.0", "E14.1", "E14.9"}, 0},
+	{"Diabetes, complicated", icd10Codes(icd10Subcategories("E10", 2, 8), icd10Subcategories("E11", 2, 8),
+		icd10Subcategories("E12", 2, 8), icd10Subcategories("E13", 2, 8), icd10Subcategories("E14", 2, 8)), 0},
+	{"Hypothyroidism", icd10Codes(icd10Categories("E", 0, 3), []string{"E89.0"}), 0},
+	{"Renal failure", icd10Codes([]string{"I12.0", "I13.1", "N18", "N19", "N25.0", "Z94.0", "Z99.2"},
+		icd10Subcategories("Z49", 0, 2)), 5},
+	{"Liver disease", icd10Codes([]string{"B18", "I85", "I86.4", "I98.2", "K70", "K71.1", "K71.7", "K72", "K73", "K74",
+		"K76.0", "Z94.4"}, icd10Subcategories("K71", 3, 5), icd10Subcategories("K76", 2, 9)), 11},
+	{"Peptic ulcer disease excluding bleeding", []string{"K25.7", "K25.9", "K26.7", "K26.9", "K27.7", "K27.9", "K28.7",
+		"K28.9"}, 0},
+	{"AIDS/HIV", []string{"B20", "B21", "B22", "B24"}, 0},
+	{"Lymphoma", icd10Codes(icd10Categories("C", 81, 85), []string{"C88", "C96", "C90.0", "C90.2"}), 9},
+	{"Metastatic cancer", icd10Categories("C", 77, 80), 12},
+	{"Solid tumor without metastasis", icd10Codes(icd10Categories("C", 0, 26), icd10Categories("C", 30, 34),
+		icd10Categories("C", 37, 41), []string{"C43"}, icd10Categories("C", 45, 58), icd10Categories("C", 60, 76),
+		[]string{"C97"}), 4},
+	{"Rheumatoid arthritis/collagen vascular diseases", icd10Codes([]string{"L94.0", "L94.1", "L94.3", "M05", "M06", "M08",
+		"M12.0", "M12.3", "M30"}, icd10Subcategories("M31", 0, 3), icd10Categories("M", 32, 35), []string{"M45",
+		"M46.1", "M46.8", "M46.9"}), 0},
+	{"Coagulopathy", icd10Codes(icd10Categories("D", 65, 68), []string{"D69.1"}, icd10Subcategories("D69", 3, 6)), 3},
+	{"Obesity", []string{"E66"}, -4},
+	{"Weight loss", icd10Codes(icd10Categories("E", 40, 46), []string{"R63.4", "R64"}), 6},
+	{"Fluid and electrolyte disorders", []string{"E22.2", "E86", "E87"}, 5},
+	{"Blood loss anemia", []string{"D50.0"}, -2},
+	{"Deficiency anemia", icd10Codes([]string{"D50.8", "D50.9"}, icd10Categories("D", 51, 53)), -2},
+	{"Alcohol abuse", []string{"F10", "E52", "G62.1", "I42.6", "K29.2", "K70.0", "K70.3", "K70.9", "T51", "Z50.2",
+		"Z71.4", "Z72.1"}, 0},
+	{"Drug abuse", icd10Codes(icd10Categories("F", 11, 16), []string{"F18", "F19", "Z71.5", "Z72.2"}), -7},
+	{"Psychoses", []string{"F20", "F22", "F23", "F24", "F25", "F28", "F29", "F30.2", "F31.2", "F31.5"}, 0},
+	{"Depression", []string{"F20.4", "F31.3", "F31.4", "F31.5", "F32", "F33", "F34.1", "F41.2", "F43.2"}, -3},
+}
+
+// ElixhauserScore contains for each Elixhauser category, cf. ElixhauserCategories, the number of distinct ICD10 codes
+// of a patient in that category.
+type ElixhauserScore [31]int
+
+// VanWalraven converts an Elixhauser score into a single score, by summing the van Walraven weights of the categories
+// the patient has at least one diagnosis in.
+func (score ElixhauserScore) VanWalraven() int {
+	sum := 0
+	for i, ctr := range score {
+		if ctr > 0 {
+			sum = sum + ElixhauserCategories[i].Weight
+		}
+	}
+	return sum
+}
+
+// ElixhauserComorbidityIndex computes the Elixhauser score of a patient from the comorbidity codes of the patient, cf.
+// RecordComorbidity. A code may belong to several categories, e.g. I11.0 to congestive heart failure and complicated
+// hypertension.
+func ElixhauserComorbidityIndex(p *Patient) ElixhauserScore {
+	var score ElixhauserScore
+	for _, c := range p.Comorbidities {
+		for i, category := range ElixhauserCategories {
+			if matchesCode(c.Code, category.Codes) {
+				score[i]++
+			}
+		}
+	}
+	return score
+}
+
+// MeanElixhauserVanWalravenScore computes the mean van Walraven score of the Elixhauser scores of the patients in the
+// trajectories, cf. ElixhauserComorbidityIndex. As in MetricsFromTrajectories, patients that occur in different
+// trajectories are counted as separate instances. The mean is NaN if there are no patients.
+func MeanElixhauserVanWalravenScore(trajectories []*Trajectory) float64 {
+	sum, ctr := 0, 0
+	for _, t := range trajectories {
+		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
+			sum = sum + ElixhauserComorbidityIndex(p).VanWalraven()
+			ctr++
+		}
+	}
+	if ctr == 0 {
+		return math.NaN()
+	}
+	return float64(sum) / float64(ctr)
+}
+
+// ClusterEntropy computes the Shannon entropy, in bits, of the distribution of the diagnosis codes of an experiment
+// over the trajectories of a cluster, as a measure of the diversity of the diseases in the cluster. Each diagnosis code
+// is counted once per trajectory it occurs in. Higher entropies mean a more diverse disease coverage. The entropy is 0
+// if there are no trajectories.
+func ClusterEntropy(trajectories []*Trajectory, exp *Experiment) float64 {
+	counts := make([]int, exp.NofDiagnosisCodes)
+	total := 0
+	for _, t := range trajectories {
+		seen := map[int]bool{}
+		for _, d := range t.Diagnoses {
+			if !seen[d] {
+				seen[d] = true
+				counts[d]++
+				total++
+			}
+		}
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// PopulationAttributableRisk computes the population attributable risk (PAR) of a diagnosis pair d1 -> d2, i.e. the
+// fraction of the d2 diagnoses in the population that is attributable to d1:
+// PAR = (RR-1) * prevalence(d1) / (1 + (RR-1) * prevalence(d1)),
+// with RR the relative risk of the pair and prevalence(d1) the fraction of the patients of the experiment diagnosed
+// with d1, cf. exp.DPatients. It returns 0 if the experiment has no patients. The formula does not hold for odds
+// ratios, so it panics if the experiment's effect measure is the OR, cf. EffectMeasureOR.
+func PopulationAttributableRisk(exp *Experiment, d1, d2 int) float64 {
+	if exp.EffectMeasure == EffectMeasureOR {
+		panic("population attributable risks require relative risks, not odds ratios")
+	}
+	nofPatients := exp.MCtr + exp.FCtr
+	if nofPatients == 0 {
+		return 0
+	}
+	prevalence := float64(len(exp.DPatients[d1])) / float64(nofPatients)
+	excess := (exp.DxDRR[d1][d2] - 1) * prevalence
+	return excess / (1 + excess)
 }
@@ -0,0 +1,35 @@
+//go:build !unix
+
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import "os"
+
+// mapFile allocates the first length bytes of a file in memory on platforms without memory-mapped files, cf.
+// NewMappedMatrix. The file is only written when the data is unmapped, cf. unmapFile.
+func mapFile(file *os.File, length int) ([]byte, error) {
+	return make([]byte, length), nil
+}
+
+// unmapFile writes the data of a file allocated with mapFile to the file.
+func unmapFile(file *os.File, data []byte) error {
+	_, err := file.WriteAt(data, 0)
+	return err
+}
@@ -19,11 +19,19 @@
 package trajectory
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"ptra/utils"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Plotting of trajectories
@@ -45,8 +53,12 @@ func PrintTrajectory(t *Trajectory, exp *Experiment) {
 // printTrajectoriesToTabFile prints a human-readable representation of trajectories to a tab file. Per trajectory, it
 // prints two lines. A first line is a list of medical terms for diagnoses in the trajectory (in order of occurrence):
 // term1 tab term2 tab ... termn. The second line lists the number of patients for each transition in the trajectory:
-// nr1->2 tab nr2->3 tab ... nrn-1->n.
-func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]string, name string) {
+// nr1->2 tab nr2->3 tab ... nrn-1->n. If the transition time statistics of a trajectory are computed, a third line lists
+// them for each transition as mean,median,p25,p75,min,max in years: stats1->2 tab stats2->3 tab ... statsn-1->n. If the
+// trajectory is tested with a permutation test, a last line lists its p-value, followed by tab * if it is significant.
+// If the trajectories are built from ORs instead of RRs, cf. EffectMeasureOR, the first line records the effect
+// measure: #effectMeasure, OR.
+func printTrajectoriesToTabFile(trajectories []*Trajectory, exp *Experiment, name string) {
 	file, err := os.Create(name)
 	if err != nil {
 		panic(err)
@@ -56,15 +68,16 @@ func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]stri
 			panic(err)
 		}
 	}()
+	writeEffectMeasureHeader(file, exp)
 	for _, trajectory := range trajectories {
 		nodes := trajectory.Diagnoses
 		labels := trajectory.PatientNumbers
 		var line string
 		for i, node := range nodes {
 			if i < len(nodes)-1 {
-				line = fmt.Sprintf("%s%s\t", line, nameMap[node])
+				line = fmt.Sprintf("%s%s\t", line, exp.NameMap[node])
 			} else {
-				line = fmt.Sprintf("%s%s\n", line, nameMap[node])
+				line = fmt.Sprintf("%s%s\n", line, exp.NameMap[node])
 			}
 		}
 		fmt.Fprintf(file, line)
@@ -77,12 +90,30 @@ func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]stri
 			}
 		}
 		fmt.Fprintf(file, line)
+		if trajectory.TransitionTimes != nil {
+			stats := []string{}
+			for _, s := range trajectory.TransitionTimes {
+				stats = append(stats, fmt.Sprintf("%.2f,%.2f,%.2f,%.2f,%.2f,%.2f", s.Mean, s.Median, s.P25, s.P75,
+					s.Min, s.Max))
+			}
+			fmt.Fprintln(file, strings.Join(stats, "\t"))
+		}
+		if trajectory.Permutations > 0 {
+			if trajectory.Significant {
+				fmt.Fprintf(file, "p=%g\t*\n", trajectory.PermutationPValue)
+			} else {
+				fmt.Fprintf(file, "p=%g\n", trajectory.PermutationPValue)
+			}
+		}
 	}
 }
 
-// printPairsToTableFile prints the diagnosis pairs and the associated relative risks scores in a human-readable format
+// printPairsToTableFile prints the diagnosis pairs and the associated relative risks scores and risk differences in a human-readable format
 // to a tab file. For each diagnosis pair, it prints one line that lists the medical terms for the diagnoses and the
-// relative risk score: term1 tab term2 tab RR.
+// relative risk score and absolute risk difference: term1 tab term2 tab RR tab RD. If the experiment has an OR matrix,
+// the odds ratio is printed in an extra column. If the experiment has p-values, the sampling p-value is printed in an
+// extra column, followed by the corrected p-value if the p-values are corrected, cf. AdjustPValues. If the experiment
+// has ORs instead of RRs, cf. EffectMeasureOR, the first line records the effect measure: #effectMeasure tab OR.
 func printPairsToTabFile(exp *Experiment, name string) {
 	pairs := exp.Pairs
 	file, err := os.Create(name)
@@ -94,9 +125,51 @@ func printPairsToTabFile(exp *Experiment, name string) {
 			panic(err)
 		}
 	}()
+	writeEffectMeasureHeader(file, exp)
 	for _, pair := range pairs {
-		fmt.Fprintf(file, "%s\t%s\t%s\n", exp.NameMap[pair.First], exp.NameMap[pair.Second],
-			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64))
+		fmt.Fprintf(file, "%s\t%s\t%s\t%s", exp.NameMap[pair.First], exp.NameMap[pair.Second],
+			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64),
+			strconv.FormatFloat(RiskDifference(exp, pair.First, pair.Second), 'E', -1, 64))
+		if exp.DxDOR != nil {
+			fmt.Fprintf(file, "\t%s", strconv.FormatFloat(exp.DxDOR[pair.First][pair.Second], 'E', -1, 64))
+		}
+		if exp.DxDPval != nil {
+			fmt.Fprintf(file, "\t%s", strconv.FormatFloat(exp.DxDPval[pair.First][pair.Second], 'E', -1, 64))
+		}
+		if exp.DxDPadj != nil {
+			fmt.Fprintf(file, "\t%s", strconv.FormatFloat(exp.DxDPadj[pair.First][pair.Second], 'E', -1, 64))
+		}
+		fmt.Fprintln(file)
+	}
+}
+
+// PrintPARToTabFile prints the selected diagnosis pairs of an experiment, i.e. the pairs above the RR threshold, with
+// their population attributable risks to a tab file, cf. PopulationAttributableRisk. The pairs are sorted by PAR,
+// from highest to lowest. For each pair, it prints one line: term1 tab term2 tab RR tab PAR. The experiment's
+// DPatients must still be initialized. The PARs are only defined for RRs, so PrintPARToTabFile panics if the
+// experiment's effect measure is the OR, cf. PopulationAttributableRisk.
+func PrintPARToTabFile(exp *Experiment, name string) {
+	pairs := append([]*Pair{}, exp.Pairs...)
+	pars := map[*Pair]float64{}
+	for _, pair := range pairs {
+		pars[pair] = PopulationAttributableRisk(exp, pair.First, pair.Second)
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pars[pairs[i]] > pars[pairs[j]]
+	})
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, pair := range pairs {
+		fmt.Fprintf(file, "%s\t%s\t%s\t%s\n", exp.NameMap[pair.First], exp.NameMap[pair.Second],
+			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64),
+			strconv.FormatFloat(pars[pair], 'E', -1, 64))
 	}
 }
 
@@ -136,9 +209,29 @@ func convertTrajectoriesToGraph(exp *Experiment) ([]int, [][][]int) {
 	return nodes, am
 }
 
+// GMLEffectMeasure returns a GML effectMeasure attribute line with the name of the effect measure of an experiment,
+// cf. EffectMeasureName, for the headers of GML graphs whose edges carry the RR scores, or "" for RRs, so that the
+// graphs of older versions of ptra remain unchanged.
+func GMLEffectMeasure(exp *Experiment) string {
+	if exp.EffectMeasure != EffectMeasureOR {
+		return ""
+	}
+	return fmt.Sprintf("effectMeasure \"%s\"\n", EffectMeasureName(exp))
+}
+
+// GMLPValue returns a GML pvalue attribute line with the sampling p-value of a diagnosis pair, for the edges of GML
+// graphs, or "" if the p-value is not known.
+func GMLPValue(exp *Experiment, d1, d2 int) string {
+	if exp.DxDPval == nil || math.IsNaN(exp.DxDPval[d1][d2]) {
+		return ""
+	}
+	return fmt.Sprintf("pvalue %s\n", strconv.FormatFloat(exp.DxDPval[d1][d2], 'E', -1, 64))
+}
+
 // printTrajectoriesToOneGraphFile plots all of an experiment's trajectories as a single graph to a GML file. The nodes
 // in the graph are the medical terms for the diagnoses that make up the trajectories. The edges are derived from the
-// transitions between diagnoses in the trajectories.
+// transitions between diagnoses in the trajectories. If the p-value of a transition's diagnosis pair is known, the
+// edge carries it as a pvalue attribute.
 func printTrajectoriesToOneGraphFile(exp *Experiment, name string) {
 	file, err := os.Create(name)
 	if err != nil {
@@ -164,13 +257,252 @@ func printTrajectoriesToOneGraphFile(exp *Experiment, name string) {
 				for _, n := range ns {
 					nsstring = nsstring + strconv.Itoa(n) + ","
 				}
-				fmt.Fprintf(file, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel \"%s\"\n]\n", i, j, nsstring))
+				fmt.Fprintf(file, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel \"%s\"\n%s]\n", i, j, nsstring,
+					GMLPValue(exp, i, j)))
 			}
 		}
 	}
 	fmt.Fprintf(file, "]\n")
 }
 
+// xmlEscape escapes a string for use as XML text.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// printTrajectoriesToGraphML plots all of an experiment's trajectories as a single graph to a GraphML file, which can be
+// imported in tools such as Gephi and yEd. The nodes are the diagnoses that make up the trajectories, with their medical
+// term as label and their original diagnostic ID. The edges are the transitions between diagnoses in the trajectories,
+// with the number of patients diagnosed with the diagnosis pair and the pair's RR, whose attribute name is the name of
+// the effect measure, cf. EffectMeasureName.
+func printTrajectoriesToGraphML(exp *Experiment, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	nodes, edges := convertTrajectoriesToGraph(exp)
+	// print header
+	fmt.Fprintf(file, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n"+
+		"<key id=\"label\" for=\"node\" attr.name=\"label\" attr.type=\"string\"/>\n"+
+		"<key id=\"diagnosisID\" for=\"node\" attr.name=\"diagnosisID\" attr.type=\"string\"/>\n"+
+		"<key id=\"patientCount\" for=\"edge\" attr.name=\"patientCount\" attr.type=\"int\"/>\n"+
+		"<key id=\"RR\" for=\"edge\" attr.name=\"%s\" attr.type=\"double\"/>\n"+
+		"<graph id=\"%s\" edgedefault=\"directed\">\n", EffectMeasureName(exp), xmlEscape(exp.Name))
+	// print nodes
+	for _, node := range nodes {
+		fmt.Fprintf(file, "<node id=\"n%d\">\n<data key=\"label\">%s</data>\n<data key=\"diagnosisID\">%s</data>\n"+
+			"</node>\n", node, xmlEscape(exp.NameMap[node]), xmlEscape(exp.IdMap[node]))
+	}
+	// print edges
+	for i, v := range edges {
+		for j, ns := range v {
+			if ns != nil {
+				fmt.Fprintf(file, "<edge source=\"n%d\" target=\"n%d\">\n<data key=\"patientCount\">%d</data>\n"+
+					"<data key=\"RR\">%s</data>\n</edge>\n", i, j, len(exp.DxDPatients[i][j]),
+					strconv.FormatFloat(exp.DxDRR[i][j], 'f', -1, 64))
+			}
+		}
+	}
+	fmt.Fprintf(file, "</graph>\n</graphml>\n")
+}
+
+// d3Node is a node in a D3.js force graph.
+type d3Node struct {
+	ID            int    `json:"id"`
+	Label         string `json:"label"`
+	DiagnosisCode string `json:"diagnosisCode"`
+	Degree        int    `json:"degree"`
+}
+
+// d3Link is a link in a D3.js force graph.
+type d3Link struct {
+	Source int     `json:"source"`
+	Target int     `json:"target"`
+	Value  int     `json:"value"`
+	RR     float64 `json:"rr"`
+}
+
+// d3Graph is a D3.js force graph. The rr of its links is the effect measure of the graph, cf. EffectMeasureName.
+type d3Graph struct {
+	EffectMeasure string   `json:"effectMeasure"`
+	Nodes         []d3Node `json:"nodes"`
+	Links         []d3Link `json:"links"`
+}
+
+// d3HTMLTemplate is a minimal web page that draws a D3.js force graph. The graph data is filled in for the %s verb.
+const d3HTMLTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Patient trajectories</title>
+<style>
+body { margin: 0; font-family: sans-serif; }
+.links line { stroke: #999; stroke-opacity: 0.6; }
+.nodes circle { stroke: #fff; stroke-width: 1.5px; fill: #1f77b4; }
+.labels text { font-size: 10px; pointer-events: none; }
+</style>
+</head>
+<body>
+<svg width="1200" height="900"></svg>
+<script src="https://d3js.org/d3.v7.min.js"></script>
+<script>
+const graph = %s;
+const svg = d3.select("svg"), width = +svg.attr("width"), height = +svg.attr("height");
+svg.append("defs").append("marker").attr("id", "arrow").attr("viewBox", "0 -5 10 10").attr("refX", 18)
+  .attr("markerWidth", 6).attr("markerHeight", 6).attr("orient", "auto")
+  .append("path").attr("d", "M0,-5L10,0L0,5").attr("fill", "#999");
+const simulation = d3.forceSimulation(graph.nodes)
+  .force("link", d3.forceLink(graph.links).id(d => d.id).distance(100))
+  .force("charge", d3.forceManyBody().strength(-300))
+  .force("center", d3.forceCenter(width / 2, height / 2));
+const link = svg.append("g").attr("class", "links").selectAll("line").data(graph.links).join("line")
+  .attr("stroke-width", d => Math.sqrt(d.value)).attr("marker-end", "url(#arrow)");
+link.append("title").text(d => "patients: " + d.value + ", " + graph.effectMeasure + ": " + d.rr);
+const node = svg.append("g").attr("class", "nodes").selectAll("circle").data(graph.nodes).join("circle")
+  .attr("r", d => 4 + Math.sqrt(d.degree) * 2)
+  .call(d3.drag()
+    .on("start", (event, d) => { if (!event.active) simulation.alphaTarget(0.3).restart(); d.fx = d.x; d.fy = d.y; })
+    .on("drag", (event, d) => { d.fx = event.x; d.fy = event.y; })
+    .on("end", (event, d) => { if (!event.active) simulation.alphaTarget(0); d.fx = null; d.fy = null; }));
+node.append("title").text(d => d.diagnosisCode + ": " + d.label);
+const label = svg.append("g").attr("class", "labels").selectAll("text").data(graph.nodes).join("text")
+  .attr("dx", 10).attr("dy", 4).text(d => d.label);
+simulation.on("tick", () => {
+  link.attr("x1", d => d.source.x).attr("y1", d => d.source.y).attr("x2", d => d.target.x).attr("y2", d => d.target.y);
+  node.attr("cx", d => d.x).attr("cy", d => d.y);
+  label.attr("x", d => d.x).attr("y", d => d.y);
+});
+</script>
+</body>
+</html>
+`
+
+// printTrajectoriesToD3JSON plots all of an experiment's trajectories as a single graph to a JSON file that can be
+// loaded directly by D3.js force-directed graphs. The nodes are the diagnoses that make up the trajectories, with their
+// medical term as label, their original diagnostic ID, and their number of incoming and outgoing links. The links are
+// the transitions between diagnoses in the trajectories, with the number of patients diagnosed with the diagnosis pair
+// as value and the pair's RR, whose name is the graph's effectMeasure, cf. EffectMeasureName. Alongside the JSON file,
+// an index.html file is written that visualizes the graph in a browser. The graph data is embedded in the web page, so
+// that it can be opened without a web server.
+func printTrajectoriesToD3JSON(exp *Experiment, name string) {
+	nodes, edges := convertTrajectoriesToGraph(exp)
+	degrees := map[int]int{}
+	graph := d3Graph{EffectMeasure: EffectMeasureName(exp), Nodes: []d3Node{}, Links: []d3Link{}}
+	for i, v := range edges {
+		for j, ns := range v {
+			if ns != nil {
+				degrees[i]++
+				degrees[j]++
+				graph.Links = append(graph.Links, d3Link{Source: i, Target: j, Value: len(exp.DxDPatients[i][j]),
+					RR: exp.DxDRR[i][j]})
+			}
+		}
+	}
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, d3Node{ID: node, Label: exp.NameMap[node], DiagnosisCode: exp.IdMap[node],
+			Degree: degrees[node]})
+	}
+	data, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		panic(err)
+	}
+	html := fmt.Sprintf(d3HTMLTemplate, data)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(name), "index.html"), []byte(html), 0644); err != nil {
+		panic(err)
+	}
+}
+
+// sankeyNode is a node in a Sankey diagram: a diagnosis at a position in the trajectories.
+type sankeyNode struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	DiagnosisCode string `json:"diagnosisCode"`
+	Column        int    `json:"column"`
+}
+
+// sankeyLink is a flow between two columns of a Sankey diagram.
+type sankeyLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Value  int    `json:"value"`
+}
+
+// sankeyDiagram is the data for a Sankey diagram.
+type sankeyDiagram struct {
+	Nodes []sankeyNode `json:"nodes"`
+	Links []sankeyLink `json:"links"`
+}
+
+// sankeyNodeID returns the ID of the Sankey node for a diagnosis at a position in the trajectories.
+func sankeyNodeID(position, did int) string {
+	return fmt.Sprintf("%d-%d", position, did)
+}
+
+// printTrajectoriesToSankeyJSON prints the flow of patients through an experiment's trajectories as Sankey diagram data
+// to a JSON file. The diagnoses are organised in columns by their position in the trajectories, so that the same
+// diagnosis at different positions is a different node. The node IDs are the position and the diagnosis ID, e.g. 1-42
+// is diagnosis 42 at position 1. The links are the flows between diagnoses in subsequent columns, with as value the
+// number of patients. Trajectories with a common prefix share the transitions of that prefix, so these are counted
+// once.
+func printTrajectoriesToSankeyJSON(exp *Experiment, name string) {
+	diagram := sankeyDiagram{Nodes: []sankeyNode{}, Links: []sankeyLink{}}
+	nodes := map[string]bool{}
+	links := map[string]int{}     // link key -> index in diagram.Links
+	prefixes := map[string]bool{} // trajectory prefixes whose last transition is counted
+	addNode := func(position, did int) string {
+		id := sankeyNodeID(position, did)
+		if !nodes[id] {
+			nodes[id] = true
+			diagram.Nodes = append(diagram.Nodes, sankeyNode{ID: id, Name: exp.NameMap[did],
+				DiagnosisCode: exp.IdMap[did], Column: position})
+		}
+		return id
+	}
+	for _, t := range exp.Trajectories {
+		for i := 0; i < len(t.Diagnoses)-1; i++ {
+			source := addNode(i, t.Diagnoses[i])
+			target := addNode(i+1, t.Diagnoses[i+1])
+			prefix := fmt.Sprint(t.Diagnoses[:i+2])
+			if prefixes[prefix] {
+				continue
+			}
+			prefixes[prefix] = true
+			key := source + " " + target
+			if index, ok := links[key]; ok {
+				diagram.Links[index].Value = diagram.Links[index].Value + t.PatientNumbers[i]
+			} else {
+				links[key] = len(diagram.Links)
+				diagram.Links = append(diagram.Links, sankeyLink{Source: source, Target: target, Value: t.PatientNumbers[i]})
+			}
+		}
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(diagram); err != nil {
+		panic(err)
+	}
+}
+
 // printTrajectoriesToIndividualGraphsFile prints each trajectory as a separate subgraph to the same GML output file.
 func printTrajectoriesToIndividualGraphsFile(exp *Experiment, name string) {
 	file, err := os.Create(name)
@@ -210,19 +542,201 @@ func printTrajectoriesToIndividualGraphsFile(exp *Experiment, name string) {
 // - A tab file containing all disease pairs and their relative risk scores (medical terms + float for RR)
 // - A GML file with one graph reprsenting all trajectories
 // - A GML file where each trajectory is represented as an individula subgraph
+// - A GraphML file with one graph representing all trajectories
+// - A D3.js JSON file with one graph representing all trajectories, and an index.html file to visualize it
+// - A JSON file with the flows between the positions in the trajectories for a Sankey diagram
 func PrintTrajectoriesToFile(exp *Experiment, path string) {
 	// print the trajectories to file
 	// create a file where all trajectories are seperate graphs
 	// create a file where all trajectories are combined into 1 graph
 	// create a file that just has each trajectory as a tab seperated list of disease codes
 	tabFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories.tab", exp.Name))
-	printTrajectoriesToTabFile(exp.Trajectories, exp.NameMap, tabFileName)
+	printTrajectoriesToTabFile(exp.Trajectories, exp, tabFileName)
 	tabFileName2 := filepath.Join(path, fmt.Sprintf("%s-pairs.tab", exp.Name))
 	printPairsToTabFile(exp, tabFileName2)
 	graphFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.gml", exp.Name))
 	printTrajectoriesToOneGraphFile(exp, graphFileName)
 	graphsFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-individual-graphs.gml", exp.Name))
 	printTrajectoriesToIndividualGraphsFile(exp, graphsFileName)
+	graphMLFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.graphml", exp.Name))
+	printTrajectoriesToGraphML(exp, graphMLFileName)
+	d3FileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-d3.json", exp.Name))
+	printTrajectoriesToD3JSON(exp, d3FileName)
+	sankeyFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-sankey.json", exp.Name))
+	printTrajectoriesToSankeyJSON(exp, sankeyFileName)
+}
+
+// PrintTrajectoriesByAgeGroup annotates the trajectories of an experiment with their dominant age group, cf.
+// DominantAgeGroup, and prints the trajectories of each age group to a tab file {exp.Name}-trajectories-age-{group}.tab
+// in the given path, in the format of the tab file written by PrintTrajectoriesToFile. The age groups are named after
+// the patients' age group labels, e.g. 1930-1942, or numbered if the patients have no labels. No file is written for
+// age groups without trajectories.
+func PrintTrajectoriesByAgeGroup(exp *Experiment, patients *PatientMap, path string) {
+	ageGroups := map[int][]*Trajectory{}
+	for _, t := range exp.Trajectories {
+		t.AgeGroup = DominantAgeGroup(t)
+		ageGroups[t.AgeGroup] = append(ageGroups[t.AgeGroup], t)
+	}
+	for ageGroup, trajectories := range ageGroups {
+		label := strconv.Itoa(ageGroup)
+		if ageGroup < len(patients.AgeGroups) {
+			label = patients.AgeGroups[ageGroup]
+		}
+		fileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-age-%s.tab", exp.Name, label))
+		printTrajectoriesToTabFile(trajectories, exp, fileName)
+		fmt.Println("Printed ", len(trajectories), " trajectories for age group ", label)
+	}
+}
+
+// PrintSexStratifiedTrajectories compares the trajectories of a sex-stratified analysis, cf. SexExperiment, and prints
+// them to a tab file {expMale.Name}-sex-stratified.tab in the given path. Trajectories are the same if they have the
+// same diagnoses. The trajectories found in both the male and female cohort are printed first, followed by those
+// unique to the male cohort and those unique to the female cohort. For each trajectory it prints 2 lines:
+// - A line with the sexes in which the trajectory is found and the number of patients that complete the trajectory in
+// each cohort: Sex: \tab shared/male/female \tab Males: \tab nr \tab Females: \tab nr.
+// - A list of medical terms for the diagnoses: term1 \tab term2 ...\tab termn.
+func PrintSexStratifiedTrajectories(expMale, expFemale *Experiment, path string) {
+	file, err := os.Create(filepath.Join(path, fmt.Sprintf("%s-sex-stratified.tab", expMale.Name)))
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	patientNumber := func(t *Trajectory) int {
+		if t == nil {
+			return 0
+		}
+		return t.PatientNumbers[len(t.PatientNumbers)-1]
+	}
+	femaleTrajectories := map[string]*Trajectory{}
+	for _, t := range expFemale.Trajectories {
+		femaleTrajectories[trajectoryKey(t)] = t
+	}
+	maleTrajectories := map[string]*Trajectory{}
+	for _, t := range expMale.Trajectories {
+		maleTrajectories[trajectoryKey(t)] = t
+	}
+	type comparison struct {
+		sex          string
+		male, female *Trajectory
+	}
+	shared, maleOnly, femaleOnly := []comparison{}, []comparison{}, []comparison{}
+	for _, t := range expMale.Trajectories {
+		if female, ok := femaleTrajectories[trajectoryKey(t)]; ok {
+			shared = append(shared, comparison{sex: "shared", male: t, female: female})
+		} else {
+			maleOnly = append(maleOnly, comparison{sex: "male", male: t})
+		}
+	}
+	for _, t := range expFemale.Trajectories {
+		if _, ok := maleTrajectories[trajectoryKey(t)]; !ok {
+			femaleOnly = append(femaleOnly, comparison{sex: "female", female: t})
+		}
+	}
+	comparisons := append(append(shared, maleOnly...), femaleOnly...)
+	for _, c := range comparisons {
+		fmt.Fprintf(file, "Sex:\t%s\tMales:\t%d\tFemales:\t%d\n", c.sex, patientNumber(c.male),
+			patientNumber(c.female))
+		t := c.male
+		if t == nil {
+			t = c.female
+		}
+		line := ""
+		for j, node := range t.Diagnoses {
+			if j < len(t.Diagnoses)-1 {
+				line = fmt.Sprintf("%s%s\t", line, expMale.NameMap[node])
+			} else {
+				line = fmt.Sprintf("%s%s\n", line, expMale.NameMap[node])
+			}
+		}
+		fmt.Fprint(file, line)
+	}
+	fmt.Println("Compared sex-stratified trajectories: ", len(shared), " shared, ", len(maleOnly), " male only, ",
+		len(femaleOnly), " female only.")
+}
+
+// PrintCohortPairComparison compares the diagnosis pairs of two experiments, cf. CompareCohortPairs, and prints the
+// result to a tab file {exp1.Name}-{exp2.Name}-pair-comparison.tab in the given path. The file has three sections:
+// the shared pairs, the pairs only in exp1, and the pairs only in exp2. Each section starts with a line that names it
+// and gives its number of pairs, e.g. Only in MIBC: tab 12, followed by one line per pair that lists the medical terms
+// for the diagnoses and the relative risk scores: term1 tab term2 tab RR. For shared pairs, the relative risk scores of
+// both experiments are listed: term1 tab term2 tab RR1 tab RR2.
+func PrintCohortPairComparison(exp1, exp2 *Experiment, path string) {
+	file, err := os.Create(filepath.Join(path, fmt.Sprintf("%s-%s-pair-comparison.tab", exp1.Name, exp2.Name)))
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	shared, onlyIn1, onlyIn2 := CompareCohortPairs(exp1, exp2)
+	pairs2 := map[string]*Pair{}
+	for _, pair := range exp2.Pairs {
+		pairs2[pairKey(exp2, pair)] = pair
+	}
+	formatRR := func(exp *Experiment, pair *Pair) string {
+		return strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64)
+	}
+	fmt.Fprintf(file, "Shared:\t%d\n", len(shared))
+	for _, pair := range shared {
+		fmt.Fprintf(file, "%s\t%s\t%s\n", pairKey(exp1, pair), formatRR(exp1, pair),
+			formatRR(exp2, pairs2[pairKey(exp1, pair)]))
+	}
+	fmt.Fprintf(file, "Only in %s:\t%d\n", exp1.Name, len(onlyIn1))
+	for _, pair := range onlyIn1 {
+		fmt.Fprintf(file, "%s\t%s\n", pairKey(exp1, pair), formatRR(exp1, pair))
+	}
+	fmt.Fprintf(file, "Only in %s:\t%d\n", exp2.Name, len(onlyIn2))
+	for _, pair := range onlyIn2 {
+		fmt.Fprintf(file, "%s\t%s\n", pairKey(exp2, pair), formatRR(exp2, pair))
+	}
+	fmt.Println("Compared diagnosis pairs: ", len(shared), " shared, ", len(onlyIn1), " only in ", exp1.Name, ", ",
+		len(onlyIn2), " only in ", exp2.Name, ".")
+}
+
+// SaveExperimentMetadata writes a JSON file {exp.Name}-metadata.json to the given path, with the parameters of a run
+// (params), e.g. the command line and flags, and a summary of the experiment: a timestamp, the number of patients,
+// males, and females, the number of diagnosis codes, diagnosis pairs, and trajectories. This makes runs reproducible
+// and auditable.
+func SaveExperimentMetadata(exp *Experiment, params map[string]interface{}, path string) {
+	metadata := map[string]interface{}{}
+	for key, value := range params {
+		metadata[key] = value
+	}
+	metadata["name"] = exp.Name
+	metadata["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	metadata["patients"] = exp.MCtr + exp.FCtr
+	metadata["males"] = exp.MCtr
+	metadata["females"] = exp.FCtr
+	metadata["diagnosisCodes"] = exp.NofDiagnosisCodes
+	metadata["pairs"] = len(exp.Pairs)
+	metadata["trajectories"] = len(exp.Trajectories)
+	if exp.AgeGroupBounds != nil {
+		metadata["ageGroupBounds"] = exp.AgeGroupBounds
+	}
+	if exp.CohortMode == CohortModeAgeAtDiagnosis {
+		metadata["cohortMode"] = exp.CohortMode
+		metadata["ageGroupWidth"] = exp.AgeGroupWidth
+	}
+	file, err := os.Create(filepath.Join(path, fmt.Sprintf("%s-metadata.json", exp.Name)))
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(metadata); err != nil {
+		panic(err)
+	}
 }
 
 // collectClusters returns a map from cluster ID to a set of trajectories that belong to that cluster
@@ -239,7 +753,12 @@ func collectClusters(exp *Experiment) map[int][]*Trajectory {
 }
 
 // PrintClusteredTrajectoriesToFile plots the trajectories of an experiment to a tab file, including for each trajectory
-// information about the cluster a trajectory belongs to. For each trajectory it prints 3 lines:
+// information about the cluster a trajectory belongs to. Each cluster starts with a line with the cluster metrics: the
+// mean age, standard deviation, median age and IQR at the last diagnosis and at the event of interest, the number of
+// males and females, the number of trajectories, and the mean survival time after the event of interest with its
+// standard deviation and the number of deceased patients it is computed for, cf. MeanSurvivalAfterEOI, and the mean van
+// Walraven score of the Elixhauser Comorbidity Index, cf. MeanElixhauserVanWalravenScore, and the entropy of the
+// diagnoses in the cluster, cf. ClusterEntropy. For each trajectory it prints 3 lines:
 // - A line with the cluster ID and the trajectory ID: CID: \tab nr \tab TID: \tab nr.
 // - A list of medical terms for the diagnoses: term1 \tab term2 ...\tab termn.
 // - A list of patient numbers for the transitions between diagnosis pairs: nr1->2 \tab nr2->3 ...\tab nrn-1->n.
@@ -260,13 +779,23 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 	for i := 0; i < len(clusters); i++ {
 		c := clusters[i]
 		// print out metrics of the c
-		ageMean, stdev, ageEOIMean, stdev2, mCtr, fCtr := MetricsFromTrajectories(c)
-		line := fmt.Sprintf("CID:\t%d\tMean Age:\t%s\tStdev:\t%s\tMean Age EOI:\t%s\tStdev:\t%s\tMales:\t%d\tFemales:\t%d\tTrajectories:\t%d\n",
+		ageMean, stdev, ageEOIMean, stdev2, mCtr, fCtr, ageMedian, iqr, ageEOIMedian, iqr2 := MetricsFromTrajectories(c)
+		survivalMean, stdev3, survivalCtr := MeanSurvivalAfterEOI(c)
+		elixhauser := MeanElixhauserVanWalravenScore(c)
+		line := fmt.Sprintf("CID:\t%d\tMean Age:\t%s\tStdev:\t%s\tMean Age EOI:\t%s\tStdev:\t%s\tMales:\t%d\tFemales:\t%d\tTrajectories:\t%d\tMedian Age:\t%s\tIQR:\t%s\tMedian Age EOI:\t%s\tIQR:\t%s\tMean Survival EOI:\t%s\tStdev:\t%s\tDeceased:\t%d\tMean Elixhauser:\t%s\tEntropy:\t%s\n",
 			i,
 			strconv.FormatFloat(ageMean, 'f', 2, 64),
 			strconv.FormatFloat(stdev, 'f', 2, 64),
 			strconv.FormatFloat(ageEOIMean, 'f', 2, 64),
-			strconv.FormatFloat(stdev2, 'f', 2, 64), mCtr, fCtr, len(c))
+			strconv.FormatFloat(stdev2, 'f', 2, 64), mCtr, fCtr, len(c),
+			strconv.FormatFloat(ageMedian, 'f', 2, 64),
+			strconv.FormatFloat(iqr, 'f', 2, 64),
+			strconv.FormatFloat(ageEOIMedian, 'f', 2, 64),
+			strconv.FormatFloat(iqr2, 'f', 2, 64),
+			strconv.FormatFloat(survivalMean, 'f', 2, 64),
+			strconv.FormatFloat(stdev3, 'f', 2, 64), survivalCtr,
+			strconv.FormatFloat(elixhauser, 'f', 2, 64),
+			strconv.FormatFloat(ClusterEntropy(c, exp), 'f', 2, 64))
 		fmt.Fprintf(file, line)
 		line = ""
 		// print the trajectories to tab file
@@ -300,34 +829,47 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 	}
 }
 
+// sortPatientsByPID returns a copy of a list of patients sorted by PID, so that the patients are printed in a
+// reproducible order.
+func sortPatientsByPID(patients []*Patient) []*Patient {
+	sorted := append([]*Patient{}, patients...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PID < sorted[j].PID })
+	return sorted
+}
+
 // PrintClustersToCSVFiles prints the experiment clusters to a CSV file. It creates two output files:
-// - A CSV file with patient information. The header is: PID,AgeEOI,Sex,PIDString. This represents: patient analysis id,
-// age at which the event of interest occurred, sex, and the TriNetX patient id.
-// - A CSV file with cluster information. The header is: PID,CID,TID,Age. This represents: patient id, cluster id,
-// trajectory id, and age of the patient when matching the trajectory.
+// - A CSV file with patient information. The header is: PID,AgeEOI,Sex,PIDString,Charlson. This represents: patient
+// analysis id, age at which the event of interest occurred, sex, the TriNetX patient id, and the Charlson comorbidity
+// index, cf. CharlsonIndex.
+// - A CSV file with cluster information. The header is: PID,CID,TID,Age,ClusterMedianAge,ClusterIQRAge,
+// ClusterMedianAgeEOI,ClusterIQRAgeEOI. This represents: patient id, cluster id, trajectory id, age of the patient when
+// matching the trajectory, and the median age and IQR of the cluster at the last diagnosis and at the event of
+// interest, cf. MetricsFromTrajectories.
+// Unknown ages, e.g. for patients without an event of interest or for diagnoses dated before the year of birth, are -1.
+// The patients of each trajectory are printed in the order of their PIDs.
 func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 	// print the patients information for this cluster to a CSV file containing:
-	// PID, Age, AgeEOI, Sex, PIDString
+	// PID, Age, AgeEOI, Sex, PIDString, Charlson
 	pFile, err := os.Create(pName)
 	if err != nil {
 		panic(err)
 	}
 	// print header
-	fmt.Fprintf(pFile, "PID,AgeEOI,Sex,PIDString\n")
+	fmt.Fprintf(pFile, "PID,AgeEOI,Sex,PIDString,Charlson\n")
 	pSeen := map[int]bool{}
 	for _, t := range exp.Trajectories {
 		ps := t.Patients
-		for _, p := range ps[len(ps)-1] {
+		for _, p := range sortPatientsByPID(ps[len(ps)-1]) {
 			if _, ok := pSeen[p.PID]; !ok {
 				pSeen[p.PID] = true
-				ageEOI := AgeAtEOI(p)
+				ageEOI := AgeAtEOI(p, "")
 				var sex string
 				if p.Sex == Male {
 					sex = "M"
 				} else {
 					sex = "F"
 				}
-				fmt.Fprintf(pFile, "%d,%d,%s,%s\n", p.PID, ageEOI, sex, p.PIDString)
+				fmt.Fprintf(pFile, "%d,%d,%s,%s,%d\n", p.PID, ageEOI, sex, p.PIDString, p.Charlson)
 			}
 		}
 	}
@@ -347,12 +889,89 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 		}
 	}()
 	// print header
-	fmt.Fprintf(cFile, "PID,CID,TID,Age\n")
+	fmt.Fprintf(cFile, "PID,CID,TID,Age,ClusterMedianAge,ClusterIQRAge,ClusterMedianAgeEOI,ClusterIQRAgeEOI\n")
+	clusterMetrics := map[int]string{}
+	for cid, c := range collectClusters(exp) {
+		_, _, _, _, _, _, ageMedian, iqr, ageEOIMedian, iqr2 := MetricsFromTrajectories(c)
+		clusterMetrics[cid] = fmt.Sprintf("%s,%s,%s,%s", strconv.FormatFloat(ageMedian, 'f', 2, 64),
+			strconv.FormatFloat(iqr, 'f', 2, 64), strconv.FormatFloat(ageEOIMedian, 'f', 2, 64),
+			strconv.FormatFloat(iqr2, 'f', 2, 64))
+	}
 	for _, t := range exp.Trajectories {
 		ps := t.Patients
-		for _, p := range ps[len(ps)-1] {
+		for _, p := range sortPatientsByPID(ps[len(ps)-1]) {
+			age := AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1])
+			if age < 0 { // diagnosis dated before the year of birth
+				age = -1
+			}
+			fmt.Fprintf(cFile, "%d,%d,%d,%d,%s\n", p.PID, t.Cluster, t.ID, age, clusterMetrics[t.Cluster])
+		}
+	}
+}
+
+// namedEOIs returns the sorted names of the named events of interest of the patients of trajectories.
+func namedEOIs(trajectories []*Trajectory) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, t := range trajectories {
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			for name := range p.NamedEOIs {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrintPatientTrajectoryAssignments prints for each trajectory the patients that match it to a CSV file
+// name-patient-trajectories.csv in the given path. The header is: PIDString,TID,diagnosisSequence,ageAtLastDiagnosis,
+// ageAtEOI. This represents: the TriNetX patient id, the trajectory id, the diagnosis codes of the trajectory separated
+// by >, the age of the patient at the last diagnosis of the trajectory, and the age at which the event of interest
+// occurred. If the patients have named events of interest, cf. RegisterEOI, a column ageAtEOI:name with the age at each
+// named event of interest is added. A patient that matches multiple trajectories occurs in multiple rows. Unknown ages
+// are -1.
+func PrintPatientTrajectoryAssignments(exp *Experiment, path string) {
+	file, err := os.Create(filepath.Join(path, fmt.Sprintf("%s-patient-trajectories.csv", exp.Name)))
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	eoiNames := namedEOIs(exp.Trajectories)
+	header := []string{"PIDString", "TID", "diagnosisSequence", "ageAtLastDiagnosis", "ageAtEOI"}
+	for _, name := range eoiNames {
+		header = append(header, "ageAtEOI:"+name)
+	}
+	writer.Write(header)
+	for _, t := range exp.Trajectories {
+		codes := []string{}
+		for _, did := range t.Diagnoses {
+			codes = append(codes, exp.IdMap[did])
+		}
+		sequence := strings.Join(codes, ">")
+		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
 			age := AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1])
-			fmt.Fprintf(cFile, "%d,%d,%d,%d\n", p.PID, t.Cluster, t.ID, age)
+			if age < 0 { // diagnosis dated before the year of birth
+				age = -1
+			}
+			record := []string{p.PIDString, strconv.Itoa(t.ID), sequence, strconv.Itoa(age),
+				strconv.Itoa(AgeAtEOI(p, ""))}
+			for _, name := range eoiNames {
+				record = append(record, strconv.Itoa(AgeAtEOI(p, name)))
+			}
+			writer.Write(record)
 		}
 	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
 }
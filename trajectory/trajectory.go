@@ -19,19 +19,23 @@
 package trajectory
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"github.com/exascience/pargo/parallel"
-	"github.com/valyala/fastrand"
+	"hash/fnv"
 	"io"
 	"math"
-	"math/rand"
 	"os"
 	"ptra/utils"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -41,15 +45,22 @@ const (
 
 // Patient represents patient information.
 type Patient struct {
-	PID       int            //analysis ID
-	PIDString string         //ID from TriNetX
-	YOB       int            //year of birth
-	CohortAge int            //age range a patient belongs to
-	Sex       int            //0 = male, 1 = female
-	Diagnoses []*Diagnosis   //list of patient's diagnoses, sorted by date <, unique diagnosis per date
-	EOIDate   *DiagnosisDate //Event of interest date, e.g. day of cancer diagnosis
-	DeathDate *DiagnosisDate //Date of death
-	Region    int            //Region where the patient lives
+	PID           int                       //analysis ID
+	PIDString     string                    //ID from TriNetX
+	YOB           int                       //year of birth
+	CohortAge     int                       //age range a patient belongs to
+	Sex           int                       //0 = male, 1 = female
+	Diagnoses     []*Diagnosis              //list of patient's diagnoses, sorted by date <, unique diagnosis per date
+	EOIDate       *DiagnosisDate            //Event of interest date, e.g. day of cancer diagnosis
+	EOIDates      []DiagnosisDate           //All event of interest dates, sorted by date <, EOIDate is the first
+	NamedEOIs     map[string]*DiagnosisDate //First date per named event of interest, cf. RegisterEOI
+	NamedEOICodes map[string]string         //ICD10 code of the first date per named event of interest
+	DeathDate     *DiagnosisDate            //Date of death
+	Region        int                       //Region where the patient lives
+	Race          int                       //Race of the patient, index in PatientMap.Races
+	Ethnicity     int                       //Ethnicity of the patient, index in PatientMap.Ethnicities
+	Charlson      int                       //Charlson comorbidity index, cf. CharlsonIndex
+	Comorbidities []*Comorbidity            //ICD10 codes of the comorbidity indices, cf. RecordComorbidity
 }
 
 // AppendPatient appends a patient to a slice of patients, unless that patient is already a member of that slice.
@@ -129,6 +140,37 @@ func SortDiagnoses(p *Patient) {
 	})
 }
 
+// SortEOIDates modifies a given patient's list of event of interest dates to be ordered by date, with a unique event of
+// interest per date.
+func SortEOIDates(p *Patient) {
+	dates := p.EOIDates
+	sort.Slice(dates, func(i, j int) bool {
+		return DiagnosisDateSmallerThan(dates[i], dates[j])
+	})
+	newDates := []DiagnosisDate{}
+	for i, date := range dates {
+		if i == 0 || !diagnosisDateEqual(date, dates[i-1]) {
+			newDates = append(newDates, date)
+		}
+	}
+	p.EOIDates = newDates
+}
+
+// RegisterEOI registers a diagnosis with an ICD10 code as an occurrence of a named event of interest for a patient, e.g.
+// "treatment" for the start of a treatment next to the bladder cancer diagnosis that is the default event of interest.
+// A patient can have several named events of interest. For each name, the first date and its ICD10 code are kept.
+func RegisterEOI(patient *Patient, name, icdCode string, date DiagnosisDate) {
+	if patient.NamedEOIs == nil {
+		patient.NamedEOIs = map[string]*DiagnosisDate{}
+		patient.NamedEOICodes = map[string]string{}
+	}
+	if first, ok := patient.NamedEOIs[name]; ok && !DiagnosisDateSmallerThan(date, *first) {
+		return
+	}
+	patient.NamedEOIs[name] = &date
+	patient.NamedEOICodes[name] = icdCode
+}
+
 // diagnosisDateEqual compares two diagnosis dates for equality in terms of year, month, and day of occurrence.
 func diagnosisDateEqual(d1, d2 DiagnosisDate) bool {
 	return d1.Year == d2.Year && d1.Month == d2.Month && d1.Day == d2.Day
@@ -164,6 +206,12 @@ type PatientMap struct {
 	// optional info for logging
 	MaleCtr   int
 	FemaleCtr int
+	// names of the age groups, regions, races and ethnicities of the patients, indexed by Patient.CohortAge,
+	// Patient.Region, Patient.Race and Patient.Ethnicity
+	AgeGroups   []string
+	Regions     []string
+	Races       []string
+	Ethnicities []string
 }
 
 // GetPatient retrieves from a patient map the patient object associated with a given patient ID. The patient ID is
@@ -177,13 +225,40 @@ func GetPatient(pidString string, patients *PatientMap) (*Patient, bool) {
 	return patient, ok
 }
 
+// AssignStablePIDs renumbers the patients in a patient map in the order of their PIDString, starting from PID 1. The
+// PIDs are assigned while parsing in the order of the input, so that this makes the PIDs independent of the order of
+// the input rows. The PIDs of the patients' diagnoses are updated as well.
+func AssignStablePIDs(patients *PatientMap) {
+	pidStrings := make([]string, 0, len(patients.PIDStringMap))
+	for pidString := range patients.PIDStringMap {
+		pidStrings = append(pidStrings, pidString)
+	}
+	sort.Strings(pidStrings)
+	pidMap := map[int]*Patient{}
+	for i, pidString := range pidStrings {
+		patient := patients.PIDMap[patients.PIDStringMap[pidString]]
+		patient.PID = i + 1 // avoid using 0 as PID
+		for _, diagnosis := range patient.Diagnoses {
+			diagnosis.PID = patient.PID
+		}
+		patients.PIDStringMap[pidString] = patient.PID
+		pidMap[patient.PID] = patient
+	}
+	patients.PIDMap = pidMap
+}
+
 //Experiment representation
 
 // Cohort represents a specific group of patients from the population stratified by age, sex, and region. The population
 // is divided into male and female cohorts. Those cohorts are in turn split into cohorts depending on an age range, e.g.
-// this could be one for each possible age range apart by 10 years: [0-10], [10-20],[20-30]...[100-120].
+// this could be one for each possible age range apart by 10 years: [0-10], [10-20],[20-30]...[100-120]. Optionally, the
+// population is first divided by Charlson group and race. In the CohortModeAgeAtDiagnosis mode, the age groups are
+// ranges of age at diagnosis instead: DPatients then contains, for each DID, the patients that were diagnosed at an age
+// in the cohort's age range, and Patients contains the patients that were observed at such an age.
 type Cohort struct {
 	AgeGroup, Sex, Region, NofPatients, NofDiagnoses int
+	Race                                             int          //race of the patients, 0 if not stratified by race
+	Charlson                                         int          //Charlson group of the patients, 0 if not stratified
 	DCtr                                             []int        //counts nr of patients per DID
 	DPatients                                        [][]*Patient //contains a list of patients per DID
 	Patients                                         []*Patient   //the patients in this cohort
@@ -203,6 +278,204 @@ func MakeDxDRR(size int) [][]float64 {
 	return DxDRR
 }
 
+// MappedMatrix is a diagnosis by diagnosis-sized matrix for storing a value for each possible diagnosis pair, e.g. the
+// relative risk score as with MakeDxDRR, but backed by a memory-mapped file instead of memory. With thousands of
+// analysis codes, the matrices of an experiment may not fit in RAM, while the operating system pages a mapped file in
+// and out as needed. On platforms without memory-mapped files, the matrix is kept in memory and only written to the
+// file when it is closed, cf. mapFile.
+type MappedMatrix struct {
+	Size   int       // the number of diagnosis codes
+	file   *os.File  // the file that backs the matrix
+	data   []byte    // the mapped file
+	values []float64 // the mapped file as values, row by row
+}
+
+// NewMappedRRMatrix makes a diagnosis by diagnosis-sized RR matrix that is backed by a memory-mapped file at the given
+// path, with all RR scores initialized to 1.0, cf. MakeDxDRR and NewMappedMatrix.
+func NewMappedRRMatrix(size int, path string) (*MappedMatrix, error) {
+	return NewMappedMatrix(size, path, 1.0)
+}
+
+// NewMappedMatrix makes a diagnosis by diagnosis-sized matrix that is backed by a memory-mapped file at the given path.
+// The file is created, or truncated if it exists, and all values are initialized to the given value, e.g. 0 for the
+// RDs as with MakeDxDRD, or NaN for the p-values as with MakeDxDPval.
+func NewMappedMatrix(size int, path string, value float64) (*MappedMatrix, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	length := utils.MaxInt(size*size, 1) * 8 // an empty mapping is invalid
+	if err := file.Truncate(int64(length)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	data, err := mapFile(file, length)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	m := &MappedMatrix{Size: size, file: file, data: data,
+		values: unsafe.Slice((*float64)(unsafe.Pointer(&data[0])), size*size)}
+	for i := range m.values {
+		m.values[i] = value
+	}
+	return m, nil
+}
+
+// Get returns the value of the diagnosis pair (i, j).
+func (m *MappedMatrix) Get(i, j int) float64 {
+	return m.values[i*m.Size+j]
+}
+
+// Set sets the value of the diagnosis pair (i, j).
+func (m *MappedMatrix) Set(i, j int, v float64) {
+	m.values[i*m.Size+j] = v
+}
+
+// Rows returns the rows of the matrix as slices of the mapped file, so that they can be used as a matrix of an
+// experiment, e.g. Experiment.DxDRR. The RR computation then reads and writes the mapped file. The rows must not be
+// used after the matrix is closed.
+func (m *MappedMatrix) Rows() [][]float64 {
+	rows := make([][]float64, m.Size)
+	for i := range rows {
+		rows[i] = m.values[i*m.Size : (i+1)*m.Size : (i+1)*m.Size]
+	}
+	return rows
+}
+
+// Close unmaps the matrix and closes its file. The file itself is not removed.
+func (m *MappedMatrix) Close() error {
+	m.values = nil
+	if err := unmapFile(m.file, m.data); err != nil {
+		m.file.Close()
+		return err
+	}
+	m.data = nil
+	return m.file.Close()
+}
+
+// MakeDxDRD makes a diagnosis by diagnosis-sized matrix for storing the absolute risk difference for each possible
+// diagnosis pair.
+func MakeDxDRD(size int) [][]float64 {
+	DxDRD := make([][]float64, size)
+	for i, _ := range DxDRD {
+		DxDRD[i] = make([]float64, size)
+	}
+	return DxDRD
+}
+
+// MakeDxDOR makes a diagnosis by diagnosis-sized matrix for storing the odds ratio for each possible diagnosis pair.
+// The odds ratios are only computed if an experiment has such a matrix, cf. InitializeExperimentRelativeRiskRatios.
+func MakeDxDOR(size int) [][]float64 {
+	return MakeDxDRR(size)
+}
+
+// MakeDxDPval makes a diagnosis by diagnosis-sized matrix for storing the sampling p-value for each possible diagnosis
+// pair. The p-values are NaN for the pairs that are not tested, cf. InitializeExperimentRelativeRiskRatios.
+func MakeDxDPval(size int) [][]float64 {
+	DxDPval := make([][]float64, size)
+	for i, _ := range DxDPval {
+		row := make([]float64, size)
+		for j, _ := range row {
+			row[j] = math.NaN()
+		}
+		DxDPval[i] = row
+	}
+	return DxDPval
+}
+
+// Effect measures that are stored in the RR matrix of an experiment, cf. InitializeExperimentRelativeRiskRatios.
+const (
+	EffectMeasureRR = "rr" // the relative risk, a/(a+b) / c/(c+d)
+	EffectMeasureOR = "or" // the odds ratio, (a*d)/(b*c)
+)
+
+// EffectMeasureName returns the name of the effect measure in the RR matrix of an experiment for output file headers,
+// i.e. RR or OR.
+func EffectMeasureName(exp *Experiment) string {
+	if exp.EffectMeasure == EffectMeasureOR {
+		return "OR"
+	}
+	return "RR"
+}
+
+// effectMeasureHeader is the first field of the header line that records the effect measure in the files of
+// SaveRRMatrix and printPairsToTabFile, if the effect measure is not the RR.
+const effectMeasureHeader = "#effectMeasure"
+
+// pValueCorrectionHeader is the first field of the header line that records the p-value correction in the files of
+// SaveRRMatrix, if the pairs are selected on corrected p-values.
+const pValueCorrectionHeader = "#pCorrection"
+
+// writeEffectMeasureHeader writes a header line that records the effect measure of an experiment, if it is not the
+// RR. Files without such a line, e.g. from older versions of ptra, have RR scores.
+func writeEffectMeasureHeader(w io.Writer, exp *Experiment) {
+	if exp.EffectMeasure == EffectMeasureOR {
+		fmt.Fprintf(w, "%s\t%s\n", effectMeasureHeader, EffectMeasureName(exp))
+	}
+}
+
+// Corrections of the p-values for multiple testing, cf. AdjustPValues.
+const (
+	PValueCorrectionNone       = "none"       // the raw p-values
+	PValueCorrectionBH         = "bh"         // the Benjamini-Hochberg false discovery rate, cf. utils.BenjaminiHochberg
+	PValueCorrectionBonferroni = "bonferroni" // the Bonferroni family-wise error rate, cf. utils.Bonferroni
+)
+
+// adjustPValues corrects p-values for multiple testing with the given correction.
+func adjustPValues(pvals []float64, correction string) []float64 {
+	switch correction {
+	case PValueCorrectionBH:
+		return utils.BenjaminiHochberg(pvals)
+	case PValueCorrectionBonferroni:
+		return utils.Bonferroni(pvals)
+	case PValueCorrectionNone:
+		return append([]float64{}, pvals...)
+	default:
+		panic(fmt.Sprintf("unknown p-value correction %q", correction))
+	}
+}
+
+// AdjustPValues corrects the sampling p-values of all tested diagnosis pairs of an experiment for multiple testing with
+// the experiment's p-value correction, and stores them in the experiment's DxDPadj. The p-values of the pairs that are
+// not tested remain NaN.
+func AdjustPValues(exp *Experiment) {
+	pvals := []float64{}
+	for _, row := range exp.DxDPval {
+		for _, pval := range row {
+			if !math.IsNaN(pval) {
+				pvals = append(pvals, pval)
+			}
+		}
+	}
+	adjusted := adjustPValues(pvals, exp.PValueCorrection)
+	exp.DxDPadj = MakeDxDPval(exp.NofDiagnosisCodes)
+	i := 0
+	for d1, row := range exp.DxDPval {
+		for d2, pval := range row {
+			if !math.IsNaN(pval) {
+				exp.DxDPadj[d1][d2] = adjusted[i]
+				i++
+			}
+		}
+	}
+	fmt.Println("Corrected the p-values of ", len(pvals), " tested diagnosis pairs with correction ",
+		exp.PValueCorrection)
+}
+
+// HasPValues checks if any diagnosis pair of an experiment has a sampling p-value, e.g. after loading an RR matrix
+// that was saved by an older version of ptra, without p-values.
+func HasPValues(exp *Experiment) bool {
+	for _, row := range exp.DxDPval {
+		for _, pval := range row {
+			if !math.IsNaN(pval) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // MakeDxDPatients makes a diagnosis by diagnosis-sized matrix for storing the list of patients for each possible
 // diagnosis pair.
 func MakeDxDPatients(size int) [][][]*Patient {
@@ -215,8 +488,20 @@ func MakeDxDPatients(size int) [][][]*Patient {
 
 // Experiment contains the inputs and outputs for calculating diagnosis trajectories for a specific patient population.
 type Experiment struct {
-	NofAgeGroups, NofRegions, Level, NofDiagnosisCodes int
-	DxDRR                                              [][]float64    //per disease pair, relative risk score (RR)
+	NofAgeGroups, NofRegions, Level, NofDiagnosisCodes int            //NofRegions is 1 if not stratified by region
+	NofRaces                                           int            //nr of races for stratifying cohorts, 1 if not stratified by race
+	NofCharlsonGroups                                  int            //nr of Charlson groups for stratifying cohorts, 0 or 1 if not stratified
+	AgeGroupBounds                                     []int          //explicit age group boundaries (years of birth), if any
+	CohortMode                                         string         //how patients are assigned to age groups, "" is CohortModeBirthYear
+	AgeGroupWidth                                      int            //years of age per age group in the CohortModeAgeAtDiagnosis mode
+	DxDRR                                              [][]float64    //per disease pair, relative risk score (RR), or the odds ratio with EffectMeasureOR
+	EffectMeasure                                      string         //the effect measure in DxDRR, "" is EffectMeasureRR
+	DxDRD                                              [][]float64    //per disease pair, absolute risk difference (RD)
+	DxDOR                                              [][]float64    //per disease pair, odds ratio (OR), if computed
+	DxDPval, DxDPadj                                   [][]float64    //per disease pair, raw and corrected sampling p-value, NaN if not tested
+	PValueCorrection                                   string         //correction of the p-values for multiple testing, cf. PValueCorrectionBH
+	Alpha                                              float64        //significance level for selecting pairs on the corrected p-values
+	DxDRRMale, DxDRRFemale                             [][]float64    //per disease pair, RR within each sex, if computed
 	DxDPatients                                        [][][]*Patient //per disease pair, all patients diagnosed
 	DPatients                                          [][]*Patient   //per disease, all patients diagnosed
 	Cohorts                                            []*Cohort      //cohorts in the experiment
@@ -225,85 +510,322 @@ type Experiment struct {
 	Trajectories                                       []*Trajectory  // a list of computed trajectories
 	Pairs                                              []*Pair        // a list of all selected pairs that are used to compute trajectories
 	IdMap                                              map[int]string // maps the analysis DID to the original diagnostic ID used in the input data
+	TerminalDiagnoses                                  map[int]bool   // diagnoses that can only end a trajectory, e.g. death
 	MCtr, FCtr                                         int            //counters for counting nr of males,females,patients
+	NofSampledPairs, NofSamples                        int64          //nr of sampled diagnosis pairs, and of comparison groups
 }
 
-// selectCohort returns from a list of cohorts a cohort that matches a specific age group, sex, and region.
-func selectCohort(cohorts []*Cohort, nofAgeGroups, nofRegions, sex, ageGroup, region int) *Cohort {
-	cIndex := cohortIndex(nofAgeGroups, nofRegions, sex, ageGroup, region)
-	return cohorts[cIndex]
-}
+// Modes for assigning patients to the age groups of cohorts.
+const (
+	CohortModeBirthYear      = "birthYear"      // age group derived from the year of birth, i.e. the patient's CohortAge
+	CohortModeAgeAtDiagnosis = "ageAtDiagnosis" // age group derived from the age at diagnosis
+)
 
-// cohortIndex computes the index of a specific cohort in a cohort array. This index is derived from the sex and age
-// group:
-// cohorts: [Males: [age: 10-20] [age: 20-30] ... [age: 100-120] Females: [age: 10-20], [age: 20-30] ... [age: 100-120]]
-func cohortIndex(nofAgegroups, nofRegions, sex, ageGroup, region int) int {
-	return sex*nofAgegroups + ageGroup
+// cohortIndex computes the index of a specific cohort in a cohort array. This index is derived from the Charlson group,
+// race, region, sex and age group:
+// cohorts: [Charlson 0: [Race 0: [Region 0: [Males: [age: 10-20] [age: 20-30] ... [age: 100-120] Females: [age: 10-20],
+// [age: 20-30] ... [age: 100-120]] Region 1: [Males: ...] ...] Race 1: [Region 0: ...] ...] Charlson 1: ...]
+// If the cohorts are not stratified by race, i.e. nofRaces is 1, all patients are of race 0. If the cohorts are not
+// stratified by region, i.e. nofRegions is 1, all patients are of region 0. The same holds for the Charlson groups.
+func cohortIndex(nofAgegroups, nofRegions, nofRaces, nofCharlsonGroups, sex, ageGroup, region, race, charlson int) int {
+	if nofCharlsonGroups <= 1 {
+		charlson = 0
+	}
+	if nofRaces <= 1 {
+		nofRaces = 1
+		race = 0
+	}
+	if nofRegions <= 1 {
+		nofRegions = 1
+		region = 0
+	}
+	return (((charlson*nofRaces+race)*nofRegions+region)*2+sex)*nofAgegroups + ageGroup
 }
 
-// makeCohorts creates cohorts for a requested nr of age groups, nr of regions, and nr of diagnosis codes used in patient
-// records. Creates empty cohorts for both male and females, for every age group, one for each possible age range.
-func makeCohorts(nofAgeGroups, nofRegions, nofDiagnoses int) []*Cohort {
+// makeCohorts creates cohorts for a requested nr of age groups, nr of regions, nr of races, nr of Charlson groups, and
+// nr of diagnosis codes used in patient records. Creates empty cohorts for every Charlson group, for every race, for
+// every region, for both male and females, for every age group, one for each possible age range.
+func makeCohorts(nofAgeGroups, nofRegions, nofRaces, nofCharlsonGroups, nofDiagnoses int) []*Cohort {
 	// Create empty cohorts
-	nofCohorts := nofAgeGroups * 2 //#age groups x #sexes
+	nofCharlsonGroups = utils.MaxInt(nofCharlsonGroups, 1)
+	nofRaces = utils.MaxInt(nofRaces, 1)
+	nofRegions = utils.MaxInt(nofRegions, 1)
+	//#Charlson groups x #races x #regions x #age groups x #sexes
+	nofCohorts := nofCharlsonGroups * nofRaces * nofRegions * nofAgeGroups * 2
 	cohorts := make([]*Cohort, nofCohorts)
-	sex := Male
-	ageGroup := 0
-	region := 0
-	femaleCohortIndex := int(math.Floor(float64(nofCohorts / 2)))
-	for i := 0; i < nofCohorts; i++ {
-		//first fill in male cohorts, then female cohorts
-		//check if need to switch to filling in female cohorts
-		if i >= femaleCohortIndex && sex != Female {
-			sex = Female
-			ageGroup = 0
-			region = 0
-		}
-		cohort := &Cohort{AgeGroup: ageGroup, Sex: sex, NofPatients: 0, NofDiagnoses: 0, Region: region,
-			DCtr: make([]int, nofDiagnoses), DPatients: make([][]*Patient, nofDiagnoses), Patients: []*Patient{}}
-		cohorts[i] = cohort
-		if ageGroup == nofAgeGroups-1 { //switch to next region
-			ageGroup = 0
-			region++
-		} else {
-			ageGroup++ //next age group
+	for charlson := 0; charlson < nofCharlsonGroups; charlson++ {
+		for race := 0; race < nofRaces; race++ {
+			for region := 0; region < nofRegions; region++ {
+				for _, sex := range []int{Male, Female} {
+					for ageGroup := 0; ageGroup < nofAgeGroups; ageGroup++ {
+						cohort := &Cohort{AgeGroup: ageGroup, Sex: sex, NofPatients: 0, NofDiagnoses: 0, Region: region,
+							Race: race, Charlson: charlson, DCtr: make([]int, nofDiagnoses),
+							DPatients: make([][]*Patient, nofDiagnoses), Patients: []*Patient{}}
+						cohorts[cohortIndex(nofAgeGroups, nofRegions, nofRaces, nofCharlsonGroups, sex, ageGroup, region,
+							race, charlson)] = cohort
+					}
+				}
+			}
 		}
 	}
 	return cohorts
 }
 
-// InitializeCohorts creates cohorts + initializes them with the counts for each diagnosis + patients per diagnosis
-func InitializeCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofDiagnosisCodes int) []*Cohort {
+// printStrata prints the number of patients per stratum, e.g. per race, so that sparse strata can be spotted. The
+// stratum of a patient is given by the stratum function, the names of the strata by the names.
+func printStrata(patients *PatientMap, attribute string, nofStrata int, names []string, stratum func(p *Patient) int) {
+	ctrs := make([]int, nofStrata)
+	for _, patient := range patients.PIDMap {
+		ctrs[stratum(patient)]++
+	}
+	fmt.Println("Stratifying cohorts by ", attribute, ": ")
+	for s, ctr := range ctrs {
+		name := strconv.Itoa(s)
+		if s < len(names) {
+			name = names[s]
+		}
+		fmt.Print(name, ": ", ctr, ", ")
+	}
+	fmt.Println("")
+}
+
+// AllRaceGroups can be passed as the number of race groups to GroupRaces to stratify by all races of the patients.
+const AllRaceGroups = -1
+
+// OtherRaceGroup is the name of the race group into which GroupRaces pools the least frequent races.
+const OtherRaceGroup = "Other"
+
+// GroupRaces groups the races of the patients into at most nofRaceGroups race groups, so that sparse races do not
+// lead to sparse cohorts. The nofRaceGroups-1 most frequent races each form a race group, and the other races are
+// pooled into a single race group named OtherRaceGroup. The race of each patient and the names of the races of the patient map
+// are replaced by those of the race groups. If nofRaceGroups is negative, or the patients are of at most nofRaceGroups
+// races, the races are kept as they are. It returns the number of race groups.
+func GroupRaces(patients *PatientMap, nofRaceGroups int) int {
+	if nofRaceGroups < 0 || len(patients.Races) <= nofRaceGroups {
+		return utils.MaxInt(len(patients.Races), 1)
+	}
+	ctrs := make([]int, len(patients.Races))
+	for _, patient := range patients.PIDMap {
+		ctrs[patient.Race]++
+	}
+	races := make([]int, len(patients.Races))
+	for i := range races {
+		races[i] = i
+	}
+	sort.SliceStable(races, func(i, j int) bool {
+		return ctrs[races[i]] > ctrs[races[j]]
+	})
+	other := utils.MaxInt(nofRaceGroups-1, 0)
+	groups := make([]int, len(patients.Races))
+	names := []string{}
+	for i, race := range races {
+		if i < other {
+			groups[race] = i
+			names = append(names, patients.Races[race])
+		} else {
+			groups[race] = other
+		}
+	}
+	names = append(names, OtherRaceGroup)
+	for _, patient := range patients.PIDMap {
+		patient.Race = groups[patient.Race]
+	}
+	patients.Races = names
+	fmt.Println("Grouped ", len(races), " races into ", len(names), " race groups.")
+	return len(names)
+}
+
+// InitializeCohorts creates cohorts + initializes them with the counts for each diagnosis + patients per diagnosis. If
+// nofRegions or nofRaces is larger than 1, the cohorts are stratified by region or race, and the number of patients per
+// region or race is printed.
+func InitializeCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofRaces, nofDiagnosisCodes int) []*Cohort {
+	return initializeCohorts(patients, nofAgegroups, nofRegions, nofRaces, 1, nofDiagnosisCodes)
+}
+
+// initializeCohorts is InitializeCohorts with cohorts that are also stratified by Charlson group, cf. CharlsonGroup, if
+// nofCharlsonGroups is larger than 1.
+func initializeCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofRaces, nofCharlsonGroups,
+	nofDiagnosisCodes int) []*Cohort {
 	fmt.Println("Initializing cohorts: with ", len(patients.PIDMap), " patients (Males: ", patients.MaleCtr, ""+
 		"Females: ", patients.FemaleCtr, ") "+
 		" nr of diagnosis codes: ", nofDiagnosisCodes, "nr of age groups: ", nofAgegroups)
+	if nofAgegroups > 1 {
+		printStrata(patients, "age group", nofAgegroups, patients.AgeGroups, func(p *Patient) int { return p.CohortAge })
+	}
+	if nofRegions > 1 {
+		printStrata(patients, "region", nofRegions, patients.Regions, func(p *Patient) int { return p.Region })
+	}
+	if nofRaces > 1 {
+		printStrata(patients, "race", nofRaces, patients.Races, func(p *Patient) int { return p.Race })
+	}
+	if nofCharlsonGroups > 1 {
+		printStrata(patients, "Charlson index", nofCharlsonGroups, CharlsonGroups,
+			func(p *Patient) int { return CharlsonGroup(p.Charlson) })
+	}
 	fmt.Println("Making cohort vectors...")
-	cohorts := makeCohorts(nofAgegroups, nofRegions, nofDiagnosisCodes)
+	cohorts := makeCohorts(nofAgegroups, nofRegions, nofRaces, nofCharlsonGroups, nofDiagnosisCodes)
 	// count occurence of diagnoses, collect patients in the cohort
 	fmt.Println("Counting diagnosis occurrences...")
+	// group the patients by cohort, so that each cohort is counted by a single goroutine, without locks or partial
+	// copies of the diagnosis counts
+	cohortPatients := make([][]*Patient, len(cohorts))
+	for _, patient := range patients.PIDMap {
+		cIndex := cohortIndex(nofAgegroups, nofRegions, nofRaces, nofCharlsonGroups, patient.Sex, patient.CohortAge,
+			patient.Region, patient.Race, CharlsonGroup(patient.Charlson))
+		cohortPatients[cIndex] = append(cohortPatients[cIndex], patient)
+	}
+	parallel.Range(0, len(cohorts), 0, func(low, high int) {
+		for cIndex := low; cIndex < high; cIndex++ {
+			cohorts[cIndex].Patients = make([]*Patient, 0, len(cohortPatients[cIndex]))
+			for _, patient := range cohortPatients[cIndex] {
+				countCohortPatient(cohorts[cIndex], patient)
+			}
+		}
+	})
+	sortCohortPatients(cohorts)
+	return cohorts
+}
+
+// sortCohortPatients sorts the patients of cohorts by PID, so that the order of the patients does not depend on the
+// order in which the patients are counted, and the comparison groups sampled from the cohorts are reproducible, cf.
+// RRSampling.
+func sortCohortPatients(cohorts []*Cohort) {
+	byPID := func(patients []*Patient) {
+		sort.Slice(patients, func(i, j int) bool { return patients[i].PID < patients[j].PID })
+	}
+	parallel.Range(0, len(cohorts), 0, func(low, high int) {
+		for _, cohort := range cohorts[low:high] {
+			byPID(cohort.Patients)
+			for _, patients := range cohort.DPatients {
+				byPID(patients)
+			}
+		}
+	})
+}
+
+// countCohortPatient adds a patient to a cohort, and counts the patient's exposure to each of its diagnoses once.
+func countCohortPatient(cohort *Cohort, patient *Patient) {
+	cohort.NofPatients++
+	cohort.Patients = append(cohort.Patients, patient)
+	diagnosisCountedForPatient := map[int]bool{} // can count exposure of a disease only once per patient DID->bool
+	for _, d1 := range patient.Diagnoses {
+		// count diagnosis unless already counted (one exposure per patient)
+		if _, ok := diagnosisCountedForPatient[d1.DID]; !ok {
+			cohort.DCtr[d1.DID]++
+			cohort.NofDiagnoses = cohort.NofDiagnoses + 1
+			cohort.DPatients[d1.DID] = append(cohort.DPatients[d1.DID], patient)
+			diagnosisCountedForPatient[d1.DID] = true
+		}
+	}
+}
+
+// InitializeAgeAtDiagnosisCohorts replaces the cohorts of an experiment by cohorts in the CohortModeAgeAtDiagnosis mode,
+// where the age groups are ranges of age at diagnosis instead of ranges of year of birth. The ages at diagnosis are
+// divided into the experiment's nr of age groups of equal width, up to the highest age at diagnosis of the patients.
+// A patient's exposure to a disease is counted in the cohort for the age at the first diagnosis of that disease. A
+// patient is a member of all the cohorts for the ages between the patient's first and last diagnosis, so that
+// comparison patients are sampled from the patients that were observed at the same age as the exposed patients.
+func InitializeAgeAtDiagnosisCohorts(exp *Experiment, patients *PatientMap) {
+	maxAge := 0
 	for _, patient := range patients.PIDMap {
-		diagnoses := patient.Diagnoses
-		cohort := selectCohort(cohorts, nofAgegroups, nofRegions, patient.Sex, patient.CohortAge, patient.Region)
-		cohort.NofPatients++
-		cohort.Patients = append(cohort.Patients, patient)
+		for _, d := range patient.Diagnoses {
+			maxAge = utils.MaxInt(maxAge, d.Date.Year-patient.YOB)
+		}
+	}
+	exp.CohortMode = CohortModeAgeAtDiagnosis
+	exp.AgeGroupWidth = (maxAge + exp.NofAgeGroups) / exp.NofAgeGroups // ceil((maxAge+1)/nofAgeGroups)
+	fmt.Println("Initializing cohorts by age at diagnosis: ", exp.NofAgeGroups, " age groups of ", exp.AgeGroupWidth,
+		" years")
+	cohorts := makeCohorts(exp.NofAgeGroups, exp.NofRegions, exp.NofRaces, exp.NofCharlsonGroups, exp.NofDiagnosisCodes)
+	for _, patient := range patients.PIDMap {
+		if len(patient.Diagnoses) == 0 {
+			continue // never observed
+		}
+		cohortFor := func(ageGroup int) *Cohort {
+			return cohorts[cohortIndex(exp.NofAgeGroups, exp.NofRegions, exp.NofRaces, exp.NofCharlsonGroups,
+				patient.Sex, ageGroup, patient.Region, patient.Race, CharlsonGroup(patient.Charlson))]
+		}
+		firstAge, lastAge := patient.Diagnoses[0].Date.Year-patient.YOB, patient.Diagnoses[0].Date.Year-patient.YOB
 		diagnosisCountedForPatient := map[int]bool{} // can count exposure of a disease only once per patient DID->bool
-		for _, d1 := range diagnoses {
-			// count diagnosis unless already counted (one exposure per patient)
-			if _, ok := diagnosisCountedForPatient[d1.DID]; !ok {
-				cohort.DCtr[d1.DID]++
+		for _, d := range patient.Diagnoses {
+			age := d.Date.Year - patient.YOB
+			firstAge = utils.MinInt(firstAge, age)
+			lastAge = utils.MaxInt(lastAge, age)
+			if _, ok := diagnosisCountedForPatient[d.DID]; !ok {
+				cohort := cohortFor(ageAtDiagnosisGroup(exp, age))
+				cohort.DCtr[d.DID]++
 				cohort.NofDiagnoses = cohort.NofDiagnoses + 1
-				cohort.DPatients[d1.DID] = append(cohort.DPatients[d1.DID], patient)
-				diagnosisCountedForPatient[d1.DID] = true
+				cohort.DPatients[d.DID] = append(cohort.DPatients[d.DID], patient)
+				diagnosisCountedForPatient[d.DID] = true
 			}
 		}
+		lastGroup := ageAtDiagnosisGroup(exp, lastAge)
+		for ageGroup := ageAtDiagnosisGroup(exp, firstAge); ageGroup <= lastGroup; ageGroup++ {
+			cohort := cohortFor(ageGroup)
+			cohort.NofPatients++
+			cohort.Patients = append(cohort.Patients, patient)
+		}
+	}
+	sortCohortPatients(cohorts)
+	exp.Cohorts = cohorts
+}
+
+// sampleRand is a small and fast pseudo random number generator (splitmix64) for sampling comparison groups. Each
+// diagnosis pair gets its own generator, seeded from the sampling seed and the pair, cf. newSampleRand, so that the
+// sampled comparison groups do not depend on how the pairs are scheduled over the goroutines. It is not safe for
+// concurrent use.
+type sampleRand struct {
+	state uint64
+}
+
+// newSampleRand creates the random number generator for sampling the comparison groups of the diagnosis pair (d1, d2).
+func newSampleRand(seed int64, d1, d2 int) *sampleRand {
+	r := &sampleRand{state: uint64(seed)}
+	r.state = r.next() ^ uint64(d1)
+	r.state = r.next() ^ uint64(d2)
+	return r
+}
+
+// newTrajectoryRand creates the random number generator for the permutation test of a trajectory. It is seeded from
+// the trajectory's diagnoses rather than its ID, which is only assigned when the trajectories are ranked or clustered,
+// so that each trajectory gets its own stream. The final -1 keeps the stream apart from those of the diagnosis pairs.
+func newTrajectoryRand(seed int64, t *Trajectory) *sampleRand {
+	r := &sampleRand{state: uint64(seed)}
+	for _, d := range t.Diagnoses {
+		r.state = r.next() ^ uint64(d)
+	}
+	r.state = r.next() ^ ^uint64(0) // -1
+	return r
+}
+
+// next returns the next pseudo random number.
+func (r *sampleRand) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Uint32n returns a pseudo random number in [0, n).
+func (r *sampleRand) Uint32n(n uint32) uint32 {
+	return uint32((uint64(uint32(r.next())) * uint64(n)) >> 32)
+}
+
+// shuffle randomly permutes a list of diagnosis IDs (Fisher-Yates).
+func (r *sampleRand) shuffle(dids []int) {
+	for i := len(dids) - 1; i > 0; i-- {
+		j := int(r.Uint32n(uint32(i + 1)))
+		dids[i], dids[j] = dids[j], dids[i]
 	}
-	return cohorts
 }
 
 // selectRandomPatientsWithoutShuffle randomly selects number of patients (ctr) from a given list of patients (patients),
 // while avoiding patients from a list to be excluded from selection (patientsToExclude). It performs this random selection
-// without shuffling the input patients, which would be computationally too costly.
-func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsToExclude map[int]bool) []*Patient {
+// without shuffling the input patients, which would be computationally too costly. The random
+// choices are drawn from rng.
+func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsToExclude map[int]bool,
+	rng *sampleRand) []*Patient {
 	collectedPatients := []*Patient{}
 	maxRandSkips := utils.MaxInt(0, len(patients)-len(patientsToExclude)-ctr)
 	for _, p := range patients {
@@ -312,7 +834,7 @@ func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsTo
 		}
 		if _, ok := patientsToExclude[p.PID]; !ok { // not a member of patients to exclude
 			if maxRandSkips > 0 {
-				if fastrand.Uint32n(2) > 0 {
+				if rng.Uint32n(2) > 0 {
 					collectedPatients = append(collectedPatients, p)
 				} else {
 					maxRandSkips--
@@ -325,23 +847,46 @@ func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsTo
 	return collectedPatients
 }
 
-// selectRandomPatientsFromSimilarCohorts collects for a given list of patients a random list of patients that is
-// comparable in terms of cohorts. This means, for each patient, randomly select another patient that belongs to the same
-// sex and age groups.
-func selectRandomPatientsFromSimilarCohorts(exp *Experiment, patients []*Patient, pids map[int]bool) []*Patient {
-	// for each cohort, see how many patients you need to select from it
-	cohortSimilar := make([][]*Patient, len(exp.Cohorts))
-	for i, _ := range cohortSimilar {
-		cohortSimilar[i] = []*Patient{}
+// ageAtDiagnosisGroup returns the age group for an age at diagnosis in the CohortModeAgeAtDiagnosis mode.
+func ageAtDiagnosisGroup(exp *Experiment, age int) int {
+	return utils.MinInt(utils.MaxInt(age, 0)/utils.MaxInt(exp.AgeGroupWidth, 1), exp.NofAgeGroups-1)
+}
+
+// exposedCohortIndices computes for a list of patients exposed to a disease d1 the index of the cohort each patient
+// belongs to. In the CohortModeAgeAtDiagnosis mode, the age group is derived from the patient's age at the first d1
+// diagnosis, otherwise it is the patient's CohortAge.
+func exposedCohortIndices(exp *Experiment, patients []*Patient, d1 int) []int {
+	indices := make([]int, len(patients))
+	for i, p := range patients {
+		ageGroup := p.CohortAge
+		if exp.CohortMode == CohortModeAgeAtDiagnosis {
+			ageGroup = ageAtDiagnosisGroup(exp, AgeAtDiagnosis(p, d1))
+		}
+		indices[i] = cohortIndex(exp.NofAgeGroups, exp.NofRegions, exp.NofRaces, exp.NofCharlsonGroups, p.Sex, ageGroup,
+			p.Region, p.Race, CharlsonGroup(p.Charlson))
 	}
-	for _, p := range patients {
-		cohortIndex := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region)
-		cohortSimilar[cohortIndex] = append(cohortSimilar[cohortIndex], p)
+	return indices
+}
+
+// selectRandomPatientsFromSimilarCohorts collects for a list of patients a random list of patients that is comparable in
+// terms of cohorts. The patients are given by the indices of their cohorts, cf. exposedCohortIndices. This means, for
+// each patient, randomly select another patient that belongs to the same sex and age groups, and the same region, race,
+// and Charlson group if the cohorts are stratified by region, race, and Charlson index. The random choices are drawn
+// from rng.
+func selectRandomPatientsFromSimilarCohorts(exp *Experiment, cohortIndices []int, pids map[int]bool,
+	rng *sampleRand) []*Patient {
+	// for each cohort, see how many patients you need to select from it
+	cohortCtrs := make([]int, len(exp.Cohorts))
+	for _, cohortIndex := range cohortIndices {
+		cohortCtrs[cohortIndex]++
 	}
 	// select Random patients from the cohorts
 	collectedPatients := []*Patient{}
-	for i, ps := range cohortSimilar {
-		similarPatients := selectRandomPatientsWithoutShuffle(exp.Cohorts[i].Patients, len(ps), pids)
+	for i, ctr := range cohortCtrs {
+		if ctr == 0 {
+			continue
+		}
+		similarPatients := selectRandomPatientsWithoutShuffle(exp.Cohorts[i].Patients, ctr, pids, rng)
 		for _, p := range similarPatients {
 			collectedPatients = append(collectedPatients, p)
 		}
@@ -349,12 +894,11 @@ func selectRandomPatientsFromSimilarCohorts(exp *Experiment, patients []*Patient
 	return collectedPatients
 }
 
-// probNotExposed calculates for a list of patients exposed to a disease d1, the chance to select a patient exposed to d2
-// that is not exposed to d1.
-func probNotExposed(exp *Experiment, d1Patients []*Patient, d1IDs map[int]bool, d2 int) float64 {
+// probNotExposed calculates for a list of patients exposed to a disease d1, given by the indices of their cohorts (cf.
+// exposedCohortIndices), the chance to select a patient exposed to d2 that is not exposed to d1.
+func probNotExposed(exp *Experiment, cohortIndices []int, d1IDs map[int]bool, d2 int) float64 {
 	d2Ctr := 0.0
-	for _, p := range d1Patients {
-		idx := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region)
+	for _, idx := range cohortIndices {
 		cohort := exp.Cohorts[idx]
 		d2Patients := cohort.DPatients[d2]
 		ctr := 0
@@ -365,7 +909,7 @@ func probNotExposed(exp *Experiment, d1Patients []*Patient, d1IDs map[int]bool,
 		}
 		d2Ctr = d2Ctr + (float64(ctr) / float64(cohort.NofPatients))
 	}
-	return d2Ctr / float64(len(d1Patients))
+	return d2Ctr / float64(len(cohortIndices))
 }
 
 // countPatientDiagnosis returns 1 if a patient has been diagnosed with a disease (did) or 0 when not.
@@ -433,29 +977,179 @@ func patientsToIdMap(patients []*Patient) map[int]bool {
 	return pids
 }
 
+// continuityCorrection applies the Haldane-Anscombe correction to the cells of a 2x2 table: if any cell is 0, 0.5 is
+// added to all four cells, so that the RR and OR are finite.
+func continuityCorrection(a, b, c, d float64) (float64, float64, float64, float64) {
+	if a == 0 || b == 0 || c == 0 || d == 0 {
+		return a + 0.5, b + 0.5, c + 0.5, d + 0.5
+	}
+	return a, b, c, d
+}
+
+// RelativeRiskAndDifference computes the relative risk (RR) and the absolute risk difference (RD) from the cells of a
+// 2x2 table: a and b are the nr of exposed patients with and without the outcome, c and d the nr of unexposed patients
+// with and without the outcome. If any cell is 0, the RR is computed with the Haldane-Anscombe correction, cf.
+// continuityCorrection, e.g. when no unexposed patient has the outcome. The RD is computed from the uncorrected cells.
+func RelativeRiskAndDifference(a, b, c, d float64) (float64, float64) {
+	p1 := a / (a + b)
+	p2 := c / (c + d)
+	ca, cb, cc, cd := continuityCorrection(a, b, c, d)
+	return (ca / (ca + cb)) / (cc / (cc + cd)), p1 - p2
+}
+
+// OddsRatio computes the odds ratio (OR) from the cells of a 2x2 table, cf. RelativeRiskAndDifference: the odds of the
+// outcome in the exposed patients divided by the odds of the outcome in the unexposed patients, (a/b)/(c/d). If any
+// cell is 0, the OR is computed with the Haldane-Anscombe correction, cf. continuityCorrection.
+func OddsRatio(a, b, c, d float64) float64 {
+	a, b, c, d = continuityCorrection(a, b, c, d)
+	return (a / b) / (c / d)
+}
+
+// finiteRR checks if an RR score is finite. Infinite or NaN RR scores cannot be ranked, and are excluded with a
+// warning instead, i.e. they are reset to 0.
+func finiteRR(exp *Experiment, d1, d2 int, RR float64) bool {
+	if math.IsInf(RR, 0) || math.IsNaN(RR) {
+		fmt.Println("Warning: excluding diagnosis pair ", exp.NameMap[d1], " -> ", exp.NameMap[d2], " with RR ", RR)
+		return false
+	}
+	return true
+}
+
+// RiskDifference returns the absolute risk difference (RD) for a diagnosis pair, or 0 if the experiment has no RD matrix.
+func RiskDifference(exp *Experiment, d1, d2 int) float64 {
+	if exp.DxDRD == nil {
+		return 0
+	}
+	return exp.DxDRD[d1][d2]
+}
+
+// Progress reports how many of the diagnosis pairs of an experiment have been processed, cf.
+// InitializeExperimentRelativeRiskRatios.
+type Progress struct {
+	PairsCompleted, PairsTotal int
+}
+
+// sendProgress sends the progress to a channel without blocking, so that a slow reader does not stall the computation.
+// If the channel is not ready, the progress is dropped.
+func sendProgress(progress chan<- Progress, p Progress) {
+	select {
+	case progress <- p:
+	default:
+	}
+}
+
+// RRSampling configures the number of comparison groups that are sampled per diagnosis pair for computing the RR
+// scores, cf. InitializeExperimentRelativeRiskRatios.
+type RRSampling struct {
+	Iter           int     // the maximum number of iterations
+	MinIter        int     // the minimum number of iterations before stopping early, Iter if not adaptive
+	ConvergenceTol float64 // stop early when the running p-value changes less than this for the last iterations
+	Seed           int64   // the seed of the comparison groups, 0 for a different seed for each computation
+}
+
+// rrConvergenceWindow is the number of iterations for which the running p-value must change less than the convergence
+// tolerance to stop sampling early, cf. AdaptiveRRSampling.
+const rrConvergenceWindow = 50
+
+// DefaultConvergenceTol is the default convergence tolerance of adaptive RR sampling.
+const DefaultConvergenceTol = 0.001
+
+// FixedRRSampling samples iter comparison groups for each diagnosis pair.
+func FixedRRSampling(iter int) RRSampling {
+	return RRSampling{Iter: iter, MinIter: iter}
+}
+
+// AdaptiveRRSampling samples at least minIter and at most iter comparison groups for each diagnosis pair. After minIter
+// iterations, the sampling of a pair stops as soon as its running p-value has changed less than convergenceTol for the
+// last rrConvergenceWindow iterations.
+func AdaptiveRRSampling(iter, minIter int, convergenceTol float64) RRSampling {
+	return RRSampling{Iter: iter, MinIter: minIter, ConvergenceTol: convergenceTol}
+}
+
+// converged checks if the sampling of a diagnosis pair can stop after n iterations, given the iteration at which the
+// running p-value last changed by at least the convergence tolerance.
+func (sampling RRSampling) converged(n, lastChange int) bool {
+	return n >= sampling.MinIter && n-lastChange >= rrConvergenceWindow
+}
+
 // InitializeExperimentRelativeRiskRatios computes the relative risk ratios for each possible diagnosis pair in an
 // experiment. It takes into account the minimum and maximum time between diagnoses (minTime and maxTime). It is an
-// iterative algorithm that runs for a given number of iterations (iter). With iter = 400, the calculated p-values are
-// within 0.05 of the true p-values and with iter = 10000 they are within 0.01 of the true p-values.
-// The relative risk ratios are calculated in parallel for all possible diagnosis pairs.
-func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, iter int) {
+// iterative algorithm that runs for a number of iterations given by the sampling configuration. With 400 iterations,
+// the calculated p-values are within 0.05 of the true p-values and with 10000 iterations they are within 0.01 of the
+// true p-values. With adaptive sampling, the iterations for a pair stop early once its p-value converges, cf.
+// AdaptiveRRSampling.
+// The relative risk ratios are calculated in parallel for all possible diagnosis pairs. The absolute risk differences
+// are computed from the same counts and stored in the experiment's DxDRD. If a progress channel is given, the number of
+// processed diagnosis pairs is sent to it each time all pairs for a first diagnosis are processed, and once more when
+// all pairs are processed. The channel is not closed. If a checkpoint file is given, the RR scores for a first diagnosis
+// are saved to it as soon as they are computed, cf. SaveRRMatrixCheckpoint. If the checkpoint file already exists,
+// e.g. after a crash, the RR scores it contains are restored and only the remaining ones are computed. The checkpoint
+// starts with a header that records the input and parameters, cf. SaveRRMatrixCheckpointHeader, and panics if they
+// differ from those of the resumed computation. The checkpoint is removed once all RR scores are computed. The
+// comparison groups are sampled with the seed of the sampling configuration, so that the RR scores are reproducible
+// for the same input, seed, and parameters, regardless of the number of threads. Without a seed, the seed of the
+// resumed checkpoint is used, or else a seed is derived from the time and printed.
+// The sampling p-values of the tested pairs are stored in the experiment's DxDPval. A pair's RR score is only kept if
+// its sampling p-value is at most 0.001. If the experiment has a p-value correction, the RR scores of all tested pairs
+// are kept instead, and the p-values are corrected for multiple testing afterwards, cf. AdjustPValues, so that the
+// pairs can be selected on the corrected p-values. The number of sampled pairs and sampled comparison groups are added
+// to the experiment's NofSampledPairs and NofSamples.
+func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, sampling RRSampling,
+	progress chan<- Progress, checkpoint string) {
 	fmt.Println("Initializing relative risk ratios...")
-	fmt.Println("Sampling ", iter, " comparison groups for each diagnosis pair...")
-	// init random nr generator
-	rand.Seed(time.Now().UnixNano())
+	if exp.DxDRD == nil {
+		exp.DxDRD = MakeDxDRD(exp.NofDiagnosisCodes)
+	}
+	if exp.DxDPval == nil {
+		exp.DxDPval = MakeDxDPval(exp.NofDiagnosisCodes)
+	}
+	if sampling.MinIter < sampling.Iter {
+		fmt.Println("Sampling ", sampling.MinIter, " to ", sampling.Iter, " comparison groups for each diagnosis pair...")
+	} else {
+		fmt.Println("Sampling ", sampling.Iter, " comparison groups for each diagnosis pair...")
+	}
+	completedRows := map[int]bool{}
+	if checkpoint != "" {
+		if _, err := os.Stat(checkpoint); err == nil {
+			sampling.Seed = checkRRMatrixCheckpointHeader(exp, minTime, maxTime, sampling, checkpoint)
+			completedRows = loadRRMatrixCheckpoint(exp, checkpoint)
+			fmt.Println("Restored the RR scores of ", len(completedRows), " diagnoses from checkpoint ", checkpoint)
+		}
+	}
+	// init random nr generators
+	if sampling.Seed == 0 {
+		sampling.Seed = time.Now().UnixNano()
+		fmt.Println("Sampling the comparison groups with seed ", sampling.Seed)
+	}
+	seed := sampling.Seed
+	if checkpoint != "" && len(completedRows) == 0 {
+		SaveRRMatrixCheckpointHeader(exp, minTime, maxTime, sampling, checkpoint)
+	}
 	indexVector := []int{}
 	for i := 0; i < exp.NofDiagnosisCodes; i++ {
 		indexVector = append(indexVector, i)
 	}
+	pairsTotal := len(indexVector) * len(indexVector)
+	var pairsCompleted int64
 	parallel.Range(0, len(indexVector), 0, func(low, high int) {
 		for _, d1 := range indexVector[low:high] {
+			if completedRows[d1] {
+				if progress != nil {
+					completed := atomic.AddInt64(&pairsCompleted, int64(len(indexVector)))
+					sendProgress(progress, Progress{PairsCompleted: int(completed), PairsTotal: pairsTotal})
+				}
+				continue
+			}
 			d1ExposedPatients := exp.DPatients[d1]
 			d1ExposedPatientsIDMap := patientsToIdMap(d1ExposedPatients)
 			if len(d1ExposedPatients) > 0 {
+				d1CohortIndices := exposedCohortIndices(exp, d1ExposedPatients, d1)
 				parallel.Range(0, len(indexVector), 0, func(low, high int) {
 					for _, d2 := range indexVector[low:high] {
+						rng := newSampleRand(seed, d1, d2)
 						// select randomly patients without d1 as a control group of same size as group 1
-						notd1ExposedPatients := selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
+						notd1ExposedPatients := selectRandomPatientsFromSimilarCohorts(exp, d1CohortIndices,
+							d1ExposedPatientsIDMap, rng)
 						if len(d1ExposedPatients) == len(notd1ExposedPatients) {
 							// count nr of patients with d2 in the exposed group, taking into account time constraints
 							// between exposure and diagnosis d1
@@ -472,14 +1166,17 @@ func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime fl
 							// take the average of this of 400 iterations; 400 iterations to get within 0.05 of the
 							// true p-value.
 							// first filter out pairs (d1, d2) with a high chance that #d2 in non exposed >= #d1->d2 in exposed
-							probd2Notd1Exposed := probNotExposed(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d2)
+							probd2Notd1Exposed := probNotExposed(exp, d1CohortIndices, d1ExposedPatientsIDMap, d2)
 							probd2d1Exposed := float64(d2CtrInExposedGroup) / float64(len(d1ExposedPatients))
 							if probd2Notd1Exposed >= probd2d1Exposed {
+								exp.DxDPval[d1][d2] = 1.0
 								continue // skip sampling for testing d1->d2 pair because it is unlikely
 							}
-							var pval float64
+							exceeded := 0               // the nr of sampled comparison groups with at least as many d2s
 							d2CtrInNotExposedGroup := 0 // will be average if N iterations
-							for i := 0; i < iter; i++ {
+							n := 0
+							lastChange, lastPval := 0, 0.0 // the iteration and running p-value of the last change
+							for n < sampling.Iter {
 								d2Ctr := 0
 								for _, p := range notd1ExposedPatients {
 									ctr := countPatientDiagnosis(p, d2)
@@ -487,13 +1184,28 @@ func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime fl
 									d2CtrInNotExposedGroup = d2CtrInNotExposedGroup + ctr
 								}
 								if d2Ctr >= d2CtrInExposedGroup { // if #D2 in comparison group >= #D1->D2 in exposed group, unlikely that D1->D2
-									pval++
+									exceeded++
 								}
-								notd1ExposedPatients = selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
+								n++
+								runningPval := float64(exceeded) / float64(n)
+								if math.Abs(runningPval-lastPval) >= sampling.ConvergenceTol {
+									lastChange, lastPval = n, runningPval
+								}
+								if sampling.MinIter < sampling.Iter && sampling.converged(n, lastChange) {
+									break
+								}
+								notd1ExposedPatients = selectRandomPatientsFromSimilarCohorts(exp, d1CohortIndices,
+									d1ExposedPatientsIDMap, rng)
 							}
-							pval = pval / float64(iter)
-							d2CtrInNotExposedGroup = d2CtrInNotExposedGroup / iter // take the average of d2s counted in all sampled non exposed groups
-							if pval > 0.001 {
+							atomic.AddInt64(&exp.NofSampledPairs, 1)
+							atomic.AddInt64(&exp.NofSamples, int64(n))
+							d2CtrInNotExposedGroup = d2CtrInNotExposedGroup / n // take the average of d2s counted in all sampled non exposed groups
+							// the sampling p-value (k+1)/(n+1) counts the observed group as one of the samples, so
+							// that it is never 0
+							exp.DxDPval[d1][d2] = float64(exceeded+1) / float64(n+1)
+							// with a p-value correction, the pairs are selected on the corrected p-values instead, cf.
+							// selectDiagnosisPairs
+							if exp.PValueCorrection == "" && float64(exceeded)/float64(n) > 0.001 {
 								continue // seems that #D2 in non exposed > #D1->D2 in exposed, so unlikely D1->D2
 							}
 							// compute RR
@@ -501,23 +1213,314 @@ func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime fl
 							b := float64(len(d1ExposedPatients) - d2CtrInExposedGroup)
 							c := float64(d2CtrInNotExposedGroup)
 							d := float64(len(d1ExposedPatients) - d2CtrInNotExposedGroup) //take len(d1ExposedPatients) cause we want same length randomly selected groups
-							p1 := a / (a + b)
-							p2 := c / (c + d)
-							RR := p1 / p2
-							// initialize RR, d1->d2 ctrs etc
+							RR, RD := RelativeRiskAndDifference(a, b, c, d)
+							if exp.EffectMeasure == EffectMeasureOR {
+								RR = OddsRatio(a, b, c, d)
+							}
+							if !finiteRR(exp, d1, d2, RR) {
+								continue
+							}
+							// initialize RR, RD, d1->d2 ctrs etc
 							exp.DxDRR[d1][d2] = RR
+							exp.DxDRD[d1][d2] = RD
+							if exp.DxDOR != nil {
+								exp.DxDOR[d1][d2] = OddsRatio(a, b, c, d)
+							}
 							exp.DxDPatients[d1][d2] = d1FollowedByd2Patients
 						}
 					}
 				})
 			}
+			if checkpoint != "" {
+				SaveRRMatrixCheckpoint(exp, d1, checkpoint)
+			}
+			if progress != nil {
+				completed := atomic.AddInt64(&pairsCompleted, int64(len(indexVector)))
+				sendProgress(progress, Progress{PairsCompleted: int(completed), PairsTotal: pairsTotal})
+			}
 		}
 	})
+	if sampling.MinIter < sampling.Iter && exp.NofSampledPairs > 0 {
+		fmt.Println("Sampled on average ", float64(exp.NofSamples)/float64(exp.NofSampledPairs),
+			" comparison groups for each of ", exp.NofSampledPairs, " sampled diagnosis pairs")
+	}
+	if exp.PValueCorrection != "" {
+		AdjustPValues(exp)
+	}
+	if checkpoint != "" {
+		if err := os.Remove(checkpoint); err != nil {
+			panic(err)
+		}
+	}
+	if progress != nil {
+		progress <- Progress{PairsCompleted: pairsTotal, PairsTotal: pairsTotal}
+	}
+}
+
+// rrMatrixCheckpointHeader returns the header of an RR matrix checkpoint, as pairs of keys and values: the parameters
+// of the computation of the RR scores, and a fingerprint of the input, i.e. of the diagnoses and their patients.
+func rrMatrixCheckpointHeader(exp *Experiment, minTime, maxTime float64, sampling RRSampling) [][2]string {
+	input := fnv.New64a()
+	for did := 0; did < exp.NofDiagnosisCodes; did++ {
+		pids := []string{}
+		if did < len(exp.DPatients) {
+			for _, p := range exp.DPatients[did] {
+				pids = append(pids, p.PIDString)
+			}
+		}
+		sort.Strings(pids)
+		fmt.Fprintf(input, "%s\t%s\n", exp.NameMap[did], strings.Join(pids, ","))
+	}
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'E', -1, 64)
+	}
+	return [][2]string{
+		{"#effectMeasure", EffectMeasureName(exp)},
+		{"#computeOR", strconv.FormatBool(exp.DxDOR != nil)},
+		{"#pCorrection", exp.PValueCorrection},
+		{"#seed", strconv.FormatInt(sampling.Seed, 10)},
+		{"#iter", strconv.Itoa(sampling.Iter)},
+		{"#minIter", strconv.Itoa(sampling.MinIter)},
+		{"#convergenceTol", formatFloat(sampling.ConvergenceTol)},
+		{"#minYears", formatFloat(minTime)},
+		{"#maxYears", formatFloat(maxTime)},
+		{"#input", strconv.FormatUint(input.Sum64(), 16)},
+	}
+}
+
+// SaveRRMatrixCheckpointHeader creates a checkpoint file for the computation of the RR scores of an experiment, cf.
+// InitializeExperimentRelativeRiskRatios, with a header that records the input and parameters of the computation: a
+// line with # followed by the name of the parameter, and its value, for the effect measure, whether the ORs are
+// computed, the p-value correction, the seed, iter, minIter, and convergence tolerance of the sampling, the minimum
+// and maximum years between diagnoses, and a fingerprint of the diagnoses and their patients. The sampling must have
+// a seed.
+func SaveRRMatrixCheckpointHeader(exp *Experiment, minTime, maxTime float64, sampling RRSampling, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, entry := range rrMatrixCheckpointHeader(exp, minTime, maxTime, sampling) {
+		fmt.Fprintf(file, "%s\t%s\n", entry[0], entry[1])
+	}
+}
+
+// checkRRMatrixCheckpointHeader checks that a checkpoint file stems from a computation of the RR scores with the same
+// input and parameters, cf. SaveRRMatrixCheckpointHeader, and panics otherwise. It returns the seed of the sampling,
+// which is the seed of the checkpoint if the sampling has no seed.
+func checkRRMatrixCheckpointHeader(exp *Experiment, minTime, maxTime float64, sampling RRSampling,
+	path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	saved := map[string]string{}
+	for reader := bufio.NewReader(file); ; {
+		line, err := reader.ReadString('\n')
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2); len(fields) == 2 {
+			saved[fields[0]] = fields[1]
+		}
+		if err != nil {
+			break
+		}
+	}
+	if sampling.Seed == 0 {
+		if sampling.Seed, err = strconv.ParseInt(saved["#seed"], 10, 64); err != nil {
+			panic(fmt.Sprintf("the RR checkpoint %s has no seed, it was not created by this version of ptra", path))
+		}
+		fmt.Println("Sampling the comparison groups with the seed of checkpoint ", path, ": ", sampling.Seed)
+	}
+	for _, entry := range rrMatrixCheckpointHeader(exp, minTime, maxTime, sampling) {
+		if value, ok := saved[entry[0]]; !ok || value != entry[1] {
+			panic(fmt.Sprintf("the RR checkpoint %s has %s %q, but the computation has %q; remove the checkpoint to "+
+				"start over", path, entry[0][1:], value, entry[1]))
+		}
+	}
+	return sampling.Seed
+}
+
+// checkpointMutex serializes the writes to RR matrix checkpoints, which are saved from parallel workers.
+var checkpointMutex sync.Mutex
+
+// SaveRRMatrixCheckpoint appends the RR scores computed for a first diagnosis d1 to a checkpoint file, so that the
+// computation can be resumed after a crash, cf. InitializeExperimentRelativeRiskRatios. For each diagnosis pair of d1,
+// it stores a line as follows: medical name 1, medical name 2, RR, RD, OR if the experiment has an OR matrix, and the
+// PIDs of the patients with the pair, separated by commas. If the experiment has p-values, the OR, which is empty if
+// the experiment has no OR matrix, is followed by the p-value before the PIDs. The row is completed with a line:
+// medical name 1, done. It is safe to call concurrently.
+func SaveRRMatrixCheckpoint(exp *Experiment, d1 int, path string) {
+	var row bytes.Buffer
+	for d2, RR := range exp.DxDRR[d1] {
+		pidStrings := make([]string, len(exp.DxDPatients[d1][d2]))
+		for i, p := range exp.DxDPatients[d1][d2] {
+			pidStrings[i] = p.PIDString
+		}
+		fmt.Fprintf(&row, "%s\t%s\t%s\t%s\t", exp.NameMap[d1], exp.NameMap[d2],
+			strconv.FormatFloat(RR, 'E', -1, 64), strconv.FormatFloat(RiskDifference(exp, d1, d2), 'E', -1, 64))
+		if exp.DxDOR != nil {
+			fmt.Fprintf(&row, "%s\t", strconv.FormatFloat(exp.DxDOR[d1][d2], 'E', -1, 64))
+		} else if exp.DxDPval != nil {
+			fmt.Fprint(&row, "\t")
+		}
+		if exp.DxDPval != nil {
+			fmt.Fprintf(&row, "%s\t", strconv.FormatFloat(exp.DxDPval[d1][d2], 'E', -1, 64))
+		}
+		fmt.Fprintf(&row, "%s\n", strings.Join(pidStrings, ","))
+	}
+	fmt.Fprintf(&row, "%s\tdone\n", exp.NameMap[d1])
+	checkpointMutex.Lock()
+	defer checkpointMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if _, err := file.Write(row.Bytes()); err != nil {
+		panic(err)
+	}
+}
+
+// loadRRMatrixCheckpoint restores the RR scores, RDs, ORs, p-values, and patients of the diagnosis pairs from a
+// checkpoint file, cf. SaveRRMatrixCheckpoint, and returns the set of first diagnoses for which all RR scores are
+// restored. Rows that were not completed, e.g. because of a crash while writing them, and lines with unknown diagnoses
+// are ignored. The patients are looked up in the experiment's DPatients.
+func loadRRMatrixCheckpoint(exp *Experiment, path string) map[int]bool {
+	if exp.DxDRD == nil {
+		exp.DxDRD = MakeDxDRD(exp.NofDiagnosisCodes)
+	}
+	//reverse the exp name map
+	nameMapReversed := map[string]int{}
+	for i, name := range exp.NameMap {
+		nameMapReversed[name] = i
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1
+	completed := map[int]bool{}
+	rows := map[int][][]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			break // the last row may be incomplete
+		}
+		d1, ok := nameMapReversed[record[0]]
+		if !ok {
+			continue // a line that was cut off by a crash, and merged with the next line
+		}
+		if len(record) == 2 && record[1] == "done" {
+			completed[d1] = true
+			continue
+		}
+		if len(record) >= 5 && len(record) <= 7 { // with OR and p-value columns if they were computed
+			rows[d1] = append(rows[d1], record)
+		}
+	}
+	for d1 := range completed {
+		d1Patients := map[string]*Patient{}
+		for _, p := range exp.DPatients[d1] {
+			d1Patients[p.PIDString] = p
+		}
+		for _, record := range rows[d1] {
+			d2, ok := nameMapReversed[record[1]]
+			if !ok {
+				continue
+			}
+			RR, err := strconv.ParseFloat(record[2], 64)
+			if err != nil {
+				panic(err)
+			}
+			RD, err := strconv.ParseFloat(record[3], 64)
+			if err != nil {
+				panic(err)
+			}
+			exp.DxDRR[d1][d2] = RR
+			exp.DxDRD[d1][d2] = RD
+			if len(record) >= 6 && record[4] != "" && exp.DxDOR != nil {
+				OR, err := strconv.ParseFloat(record[4], 64)
+				if err != nil {
+					panic(err)
+				}
+				exp.DxDOR[d1][d2] = OR
+			}
+			if len(record) == 7 && exp.DxDPval != nil {
+				pval, err := strconv.ParseFloat(record[5], 64)
+				if err != nil {
+					panic(err)
+				}
+				exp.DxDPval[d1][d2] = pval
+			}
+			patients := []*Patient{}
+			if pids := record[len(record)-1]; pids != "" {
+				for _, pidString := range strings.Split(pids, ",") {
+					p, ok := d1Patients[pidString]
+					if !ok {
+						panic(fmt.Sprint("Unknown patient in RR checkpoint ", path, ": ", pidString))
+					}
+					patients = append(patients, p)
+				}
+			}
+			exp.DxDPatients[d1][d2] = patients
+		}
+	}
+	return completed
+}
+
+// LoadRRMatrixCheckpoint restores the RR scores from a checkpoint file, cf. SaveRRMatrixCheckpoint, and returns the
+// index of the last first diagnosis up to which all RR scores are restored, or -1 if the RR scores of the first
+// diagnosis are missing. Since the rows are computed in parallel, RR scores of later diagnoses may be restored as well.
+func LoadRRMatrixCheckpoint(exp *Experiment, path string) int {
+	completed := loadRRMatrixCheckpoint(exp, path)
+	d1 := 0
+	for completed[d1] {
+		d1++
+	}
+	return d1 - 1
 }
 
 // LoadRRMatrix loads an RR matrix from file and stores it in the given experiment. This file was created from a
-// previous run. This can be used instead of initializeRelativeRiskRatiosParallel
+// previous run. This can be used instead of initializeRelativeRiskRatiosParallel. Files saved by older versions of ptra
+// have no RD column, in which case the RDs are left at 0. Files saved with ORs or p-values have OR and p-value columns,
+// cf. SaveRRMatrix, in which case the ORs and p-values are loaded as well. The p-values of files without p-values are
+// left at NaN. Infinite or NaN RR scores, which older versions of ptra saved for pairs without cases in the comparison
+// groups, are excluded with a warning, cf. finiteRR. The effect measure of the file must be the effect measure of the
+// experiment, cf. SaveRRMatrix, otherwise LoadRRMatrix panics. Likewise, the file must be computed with a p-value
+// correction if and only if the experiment has one, because without a correction the RR scores of the pairs with a
+// sampling p-value above 0.001 are not computed.
 func LoadRRMatrix(exp *Experiment, path string) {
+	if exp.DxDRD == nil {
+		exp.DxDRD = MakeDxDRD(exp.NofDiagnosisCodes)
+	}
+	if exp.DxDPval == nil {
+		exp.DxDPval = MakeDxDPval(exp.NofDiagnosisCodes)
+	}
 	//reverse the exp name map
 	nameMapReversed := map[string]int{}
 	for i, name := range exp.NameMap {
@@ -534,7 +1537,9 @@ func LoadRRMatrix(exp *Experiment, path string) {
 	}()
 	reader := csv.NewReader(file)
 	reader.Comma = '\t'
-	for {
+	reader.FieldsPerRecord = -1
+	measure, correction := "RR", ""
+	for checked := false; ; {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
@@ -542,13 +1547,52 @@ func LoadRRMatrix(exp *Experiment, path string) {
 		if err != nil {
 			panic(err)
 		}
+		if !checked {
+			switch record[0] {
+			case effectMeasureHeader:
+				measure = record[1]
+				continue
+			case pValueCorrectionHeader:
+				correction = record[1]
+				continue
+			}
+			checkRRMatrixHeaders(exp, path, measure, correction)
+			checked = true
+		}
 		d1 := nameMapReversed[record[0]]
 		d2 := nameMapReversed[record[1]]
 		RR, err := strconv.ParseFloat(record[2], 64)
 		if err != nil {
 			panic(err)
 		}
+		if !finiteRR(exp, d1, d2, RR) {
+			RR = 0
+		}
 		exp.DxDRR[d1][d2] = RR
+		if len(record) > 3 {
+			RD, err := strconv.ParseFloat(record[3], 64)
+			if err != nil {
+				panic(err)
+			}
+			exp.DxDRD[d1][d2] = RD
+		}
+		if len(record) > 4 && record[4] != "" {
+			OR, err := strconv.ParseFloat(record[4], 64)
+			if err != nil {
+				panic(err)
+			}
+			if exp.DxDOR == nil {
+				exp.DxDOR = MakeDxDOR(exp.NofDiagnosisCodes)
+			}
+			exp.DxDOR[d1][d2] = OR
+		}
+		if len(record) > 5 {
+			pval, err := strconv.ParseFloat(record[5], 64)
+			if err != nil {
+				panic(err)
+			}
+			exp.DxDPval[d1][d2] = pval
+		}
 	}
 }
 
@@ -598,8 +1642,25 @@ func LoadDxDPatients(exp *Experiment, pMap *PatientMap, path string) {
 	}
 }
 
+// checkRRMatrixHeaders checks the effect measure and p-value correction that are recorded in the headers of an RR
+// matrix file against the experiment, cf. LoadRRMatrix.
+func checkRRMatrixHeaders(exp *Experiment, path, measure, correction string) {
+	if measure != EffectMeasureName(exp) {
+		panic(fmt.Sprintf("the RR matrix %s has %s scores, but the experiment uses %s scores", path, measure,
+			EffectMeasureName(exp)))
+	}
+	if (correction == "") != (exp.PValueCorrection == "") {
+		panic(fmt.Sprintf("the RR matrix %s is computed with p-value correction %q, but the experiment uses %q", path,
+			correction, exp.PValueCorrection))
+	}
+}
+
 // SaveRRMatrix stores the RR matrix calculated for the given experiment. The diagnosis pairs from the matrix are
-// stored line per line as follows: medical name 1, medical name 2, RR.
+// stored line per line as follows: medical name 1, medical name 2, RR, RD, and OR if the experiment has an OR matrix.
+// If the experiment has p-values, the OR, which is empty if the experiment has no OR matrix, is followed by the
+// p-value, which is NaN for the pairs that are not tested. If the matrix has ORs instead of RRs, cf. EffectMeasureOR,
+// the first line records the effect measure: #effectMeasure, OR. If the pairs are selected on corrected p-values, cf.
+// AdjustPValues, a following line records the correction: #pCorrection, the correction.
 func SaveRRMatrix(exp *Experiment, path string) {
 	file, err := os.Create(path)
 	if err != nil {
@@ -610,10 +1671,23 @@ func SaveRRMatrix(exp *Experiment, path string) {
 			panic(err)
 		}
 	}()
+	writeEffectMeasureHeader(file, exp)
+	if exp.PValueCorrection != "" {
+		fmt.Fprintf(file, "%s\t%s\n", pValueCorrectionHeader, exp.PValueCorrection)
+	}
 	for i, js := range exp.DxDRR {
 		for j, RR := range js {
-			fmt.Fprintf(file, "%s\t%s\t%s\n", exp.NameMap[i], exp.NameMap[j],
-				strconv.FormatFloat(RR, 'E', -1, 64))
+			fmt.Fprintf(file, "%s\t%s\t%s\t%s", exp.NameMap[i], exp.NameMap[j],
+				strconv.FormatFloat(RR, 'E', -1, 64), strconv.FormatFloat(RiskDifference(exp, i, j), 'E', -1, 64))
+			if exp.DxDOR != nil {
+				fmt.Fprintf(file, "\t%s", strconv.FormatFloat(exp.DxDOR[i][j], 'E', -1, 64))
+			} else if exp.DxDPval != nil {
+				fmt.Fprint(file, "\t")
+			}
+			if exp.DxDPval != nil {
+				fmt.Fprintf(file, "\t%s", strconv.FormatFloat(exp.DxDPval[i][j], 'E', -1, 64))
+			}
+			fmt.Fprintln(file)
 		}
 	}
 }
@@ -681,16 +1755,141 @@ func PrintCohort(cohort *Cohort, max int) {
 	fmt.Println("...]")
 }
 
+// SexExperiment returns a sub-experiment of an experiment for the patients of one sex, for a sex-stratified analysis.
+// The sub-experiment has the same name, parameters, and diagnosis maps, but new cohorts initialized from the patients
+// of the given sex only. Its RR scores must be initialized, e.g. with InitializeExperimentRelativeRiskRatios, before
+// trajectories can be built. The given experiment is not modified.
+func SexExperiment(exp *Experiment, patients *PatientMap, sex int) *Experiment {
+	sexPatients := ApplyPatientFilter(func(p *Patient) bool { return p.Sex == sex }, patients)
+	sexExp := *exp
+	sexExp.Cohorts = initializeCohorts(sexPatients, exp.NofAgeGroups, exp.NofRegions, exp.NofRaces,
+		exp.NofCharlsonGroups, exp.NofDiagnosisCodes)
+	sexExp.DPatients = MergeCohorts(sexExp.Cohorts).DPatients
+	sexExp.DxDRR = MakeDxDRR(exp.NofDiagnosisCodes)
+	sexExp.DxDRD = MakeDxDRD(exp.NofDiagnosisCodes)
+	if exp.DxDOR != nil {
+		sexExp.DxDOR = MakeDxDOR(exp.NofDiagnosisCodes)
+	}
+	sexExp.DxDPval, sexExp.DxDPadj = nil, nil
+	sexExp.DxDRRMale, sexExp.DxDRRFemale = nil, nil
+	sexExp.DxDPatients = MakeDxDPatients(exp.NofDiagnosisCodes)
+	sexExp.Pairs = nil
+	sexExp.Trajectories = nil
+	sexExp.MCtr, sexExp.FCtr = sexPatients.MaleCtr, sexPatients.FemaleCtr
+	if exp.CohortMode == CohortModeAgeAtDiagnosis {
+		InitializeAgeAtDiagnosisCohorts(&sexExp, sexPatients)
+	}
+	return &sexExp
+}
+
+// InitializeSexStratifiedRelativeRiskRatios computes the RR scores of an experiment separately for the male and the
+// female patients. It creates a sub-experiment for each sex, cf. SexExperiment, and runs
+// InitializeExperimentRelativeRiskRatios on both sub-experiments in parallel. The resulting RR scores are stored in the
+// experiment's DxDRRMale and DxDRRFemale, cf. StratifiedRRBySex. The sub-experiments are returned so that they can be
+// used for building sex-specific trajectories.
+func InitializeSexStratifiedRelativeRiskRatios(exp *Experiment, patients *PatientMap, minTime, maxTime float64,
+	sampling RRSampling) (expMale, expFemale *Experiment) {
+	expMale = SexExperiment(exp, patients, Male)
+	expFemale = SexExperiment(exp, patients, Female)
+	parallel.Do(func() {
+		InitializeExperimentRelativeRiskRatios(expMale, minTime, maxTime, sampling, nil, "")
+	}, func() {
+		InitializeExperimentRelativeRiskRatios(expFemale, minTime, maxTime, sampling, nil, "")
+	})
+	exp.DxDRRMale, exp.DxDRRFemale = expMale.DxDRR, expFemale.DxDRR
+	return expMale, expFemale
+}
+
+// StratifiedRRBySex returns the RR scores of a diagnosis pair d1->d2 computed within the male and the female patients.
+// The sex-stratified RR scores must be initialized with InitializeSexStratifiedRelativeRiskRatios, otherwise 0 is
+// returned for both.
+func StratifiedRRBySex(exp *Experiment, d1, d2 int) (rrMale, rrFemale float64) {
+	if exp.DxDRRMale == nil || exp.DxDRRFemale == nil {
+		return 0, 0
+	}
+	return exp.DxDRRMale[d1][d2], exp.DxDRRFemale[d1][d2]
+}
+
 // Pair is a struct for representing a diagnosis pair. It simply stores two diagnosis codes.
 type Pair struct {
 	First, Second int
 }
 
+// AnalysisSize summarizes the expected size of an analysis before the RR scores are computed, cf. EstimateAnalysisSize.
+type AnalysisSize struct {
+	Patients, Diagnoses, Cohorts int // nr of patients, diagnoses, and cohorts in the experiment
+	DiagnosisCodes               int // nr of distinct diagnosis codes the patients are diagnosed with
+	Pairs                        int // nr of diagnosis pairs with at least minPatients patients
+}
+
+// EstimateAnalysisSize counts the patients, diagnoses, and cohorts of an experiment, and estimates the number of
+// diagnosis pairs that qualify for building trajectories. A pair d1->d2 is counted if at least minPatients patients
+// are diagnosed with d2 within minTime and maxTime years after their first diagnosis of d1, the same time constraints
+// as for computing the RR scores. Pairs that start with a terminal diagnosis are not counted. The estimate is an upper
+// bound for the number of selected pairs, since it does not compute the RR scores.
+func EstimateAnalysisSize(exp *Experiment, patients *PatientMap, minTime, maxTime float64, minPatients int) AnalysisSize {
+	size := AnalysisSize{Patients: len(patients.PIDMap), Cohorts: len(exp.Cohorts)}
+	codes := map[int]bool{}
+	pairCtr := map[Pair]int{}
+	for _, p := range patients.PIDMap {
+		size.Diagnoses += len(p.Diagnoses)
+		pairs := map[Pair]bool{}
+		seen := map[int]bool{}
+		for i, d1 := range p.Diagnoses {
+			codes[d1.DID] = true
+			if seen[d1.DID] || exp.TerminalDiagnoses[d1.DID] {
+				continue
+			}
+			seen[d1.DID] = true
+			for _, d2 := range p.Diagnoses[i+1:] {
+				if d2.DID == d1.DID {
+					continue
+				}
+				timeBetween := DiagnosisDateToFloat(d2.Date) - DiagnosisDateToFloat(d1.Date)
+				if timeBetween <= maxTime && timeBetween >= minTime {
+					pairs[Pair{First: d1.DID, Second: d2.DID}] = true
+				}
+			}
+		}
+		for pair := range pairs {
+			pairCtr[pair]++
+		}
+	}
+	size.DiagnosisCodes = len(codes)
+	for _, ctr := range pairCtr {
+		if ctr >= minPatients {
+			size.Pairs++
+		}
+	}
+	return size
+}
+
+// Print prints the expected size of an analysis to standard output.
+func (size AnalysisSize) Print() {
+	fmt.Println("Patients: ", size.Patients)
+	fmt.Println("Diagnoses: ", size.Diagnoses)
+	fmt.Println("Cohorts: ", size.Cohorts)
+	fmt.Println("Distinct diagnosis codes: ", size.DiagnosisCodes)
+	fmt.Println("Estimated diagnosis pairs: ", size.Pairs)
+}
+
 // selectDiagnosisPairs selects diagnosis pairs from which to calculate trajectories. These pairs are constrained by
-// requiring a minimum number of patients that is diagnosed with the disease pair, and a minimum RR score.
+// requiring a minimum number of patients that is diagnosed with the disease pair, and a minimum RR score. Pairs that
+// start with a terminal diagnosis are never selected, so that trajectories cannot be extended past it. If both
+// directions of a pair qualify, the direction with the most patients is selected if a binomial test shows it is the
+// more likely one, with a p-value below 0.05.
+// If the experiment has corrected p-values, cf. AdjustPValues, a pair is only selected if its corrected sampling
+// p-value is at most the experiment's alpha, and the p-values of the binomial tests are corrected for multiple testing
+// as well, and compared to the experiment's alpha.
 func selectDiagnosisPairs(exp *Experiment, minPatients int, minRR float64) []*Pair {
 	fmt.Println("Selecting diagnosis pairs for building trajectories...")
 	pairs := []*Pair{}
+	significant := func(d1, d2 int) bool {
+		return exp.DxDPadj == nil || exp.DxDPadj[d1][d2] <= exp.Alpha
+	}
+	// the pairs for which both directions qualify, and the p-values of their binomial tests
+	bidirectional := map[*Pair]bool{}
+	binomialPvals := []float64{}
 	nofDiagnosisCodes := len(exp.NameMap)
 	for i := 0; i < nofDiagnosisCodes; i++ {
 		for j := i; j < nofDiagnosisCodes; j++ {
@@ -698,8 +1897,11 @@ func selectDiagnosisPairs(exp *Experiment, minPatients int, minRR float64) []*Pa
 			occursReverse := len(exp.DxDPatients[j][i])
 			RR := exp.DxDRR[i][j]
 			RRReverse := exp.DxDRR[j][i]
+			forward := !exp.TerminalDiagnoses[i] && significant(i, j)
+			backward := !exp.TerminalDiagnoses[j] && significant(j, i)
 			if i != j {
-				if occurs >= minPatients && RR > minRR && occursReverse >= minPatients && RRReverse > minRR {
+				if forward && occurs >= minPatients && RR > minRR && backward && occursReverse >= minPatients &&
+					RRReverse > minRR {
 					var maxOccurs int
 					var maxIndices *Pair
 					if occurs > occursReverse {
@@ -709,26 +1911,75 @@ func selectDiagnosisPairs(exp *Experiment, minPatients int, minRR float64) []*Pa
 						maxOccurs = occursReverse
 						maxIndices = &Pair{First: j, Second: i}
 					}
-					test := utils.BinomialCdf(0.5, occurs+occursReverse, maxOccurs)
-					if test < 0.05 {
-						pairs = append(pairs, maxIndices)
-					}
+					pairs = append(pairs, maxIndices)
+					bidirectional[maxIndices] = true
+					binomialPvals = append(binomialPvals, utils.BinomialCdf(0.5, occurs+occursReverse, maxOccurs))
 					continue
 				}
-				if occurs >= minPatients && RR > minRR {
+				if forward && occurs >= minPatients && RR > minRR {
 					pairs = append(pairs, &Pair{First: i, Second: j})
 					continue
 				}
-				if occursReverse >= minPatients && RRReverse > minRR {
+				if backward && occursReverse >= minPatients && RRReverse > minRR {
 					pairs = append(pairs, &Pair{First: j, Second: i})
 				}
 			}
 		}
 	}
+	if exp.DxDPadj != nil {
+		binomialPvals = adjustPValues(binomialPvals, exp.PValueCorrection)
+	}
+	selected := []*Pair{}
+	i := 0
+	for _, pair := range pairs {
+		if bidirectional[pair] {
+			pval := binomialPvals[i]
+			i++
+			if exp.DxDPadj == nil && pval >= 0.05 || exp.DxDPadj != nil && pval > exp.Alpha {
+				continue
+			}
+		}
+		selected = append(selected, pair)
+	}
+	pairs = selected
 	fmt.Println("Found ", len(pairs), " suitable diagnosis pairs.")
 	return pairs
 }
 
+// pairKey returns a key for a diagnosis pair that consists of the medical names of its diagnoses, so that pairs can be
+// compared across experiments, which may assign different DIDs to the same diagnoses.
+func pairKey(exp *Experiment, pair *Pair) string {
+	return exp.NameMap[pair.First] + "\t" + exp.NameMap[pair.Second]
+}
+
+// CompareCohortPairs compares the diagnosis pairs of two experiments, e.g. of two cohorts with a different stage of the
+// same cancer. The pairs are matched by the medical names of their diagnoses, rather than by their DIDs, which differ
+// between runs. It returns the pairs of exp1 that also occur in exp2, the pairs that only occur in exp1, and the pairs
+// that only occur in exp2, in the order of the experiments' pairs.
+func CompareCohortPairs(exp1, exp2 *Experiment) (shared, onlyIn1, onlyIn2 []*Pair) {
+	pairs1 := map[string]bool{}
+	for _, pair := range exp1.Pairs {
+		pairs1[pairKey(exp1, pair)] = true
+	}
+	pairs2 := map[string]bool{}
+	for _, pair := range exp2.Pairs {
+		pairs2[pairKey(exp2, pair)] = true
+	}
+	for _, pair := range exp1.Pairs {
+		if pairs2[pairKey(exp1, pair)] {
+			shared = append(shared, pair)
+		} else {
+			onlyIn1 = append(onlyIn1, pair)
+		}
+	}
+	for _, pair := range exp2.Pairs {
+		if !pairs1[pairKey(exp2, pair)] {
+			onlyIn2 = append(onlyIn2, pair)
+		}
+	}
+	return shared, onlyIn1, onlyIn2
+}
+
 // Trajectory holds all data relevant to a disease trajectory.
 type Trajectory struct {
 	Diagnoses      []int            // A list of diagnosis codes that represent the trajectory
@@ -737,6 +1988,14 @@ type Trajectory struct {
 	TrajMap        map[*Patient]int //Maps patient IDs onto a diagnosis index for trajectory tracking
 	ID             int              // An analysis id
 	Cluster        int              //A cluster ID to which this trajectory is assigned to
+	// Statistics of the times between the diagnoses for each transition in the trajectory, cf. ComputeTransitionTimeStats
+	TransitionTimes []TransitionTimeStats
+	AgeGroup        int // The age group of the majority of the patients, cf. DominantAgeGroup
+	// The permutation p-value of the trajectory, cf. PermutationTestTrajectory, and the nr of permutations it is based
+	// on, 0 if the trajectory is not tested
+	PermutationPValue float64
+	Permutations      int
+	Significant       bool // Whether the permutation p-value is below alpha, cf. PermutationTestTrajectories
 }
 
 // extendTrajectory tries to extend a given trajectory (currentT) with a diagnosis (d). It returns a map which maps all
@@ -755,7 +2014,8 @@ func extendTrajectory(currentT *Trajectory, d int, minTime, maxTime float64) map
 // BuildTrajectories calculates the trajectories for an experiment. The trajectories are constrained by: a
 // minimum number of patients in the trajectory (minPatients), a maximum number of diagnoses in the trajectory (maxLength),
 // a minumum number of diagnoses in the trajectory (minLength), a minimum RR for each diagnosis transition (minRR), and
-// a list of filters.
+// a list of filters. A terminal diagnosis of the experiment, e.g. death, can only be the last diagnosis of a trajectory.
+// The trajectories are numbered in the order they are returned, cf. Trajectory.ID, and renumbered by RankTrajectories.
 func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, minTime, maxTime, minRR float64,
 	filters []TrajectoryFilter) []*Trajectory {
 	fmt.Println("Building patient trajectories...")
@@ -835,7 +2095,7 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 		}
 		return r1
 	})
-	trajectories = result.([]*Trajectory)
+	trajectories = DeduplicateTrajectories(result.([]*Trajectory))
 	fmt.Println("Found ", len(trajectories), " trajectories.")
 	filteredTrajectories := []*Trajectory{}
 	for _, traj := range trajectories {
@@ -847,6 +2107,8 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 			}
 		}
 		if keep {
+			traj.TransitionTimes = ComputeTransitionTimeStats(traj, minTime, maxTime)
+			traj.ID = len(filteredTrajectories)
 			filteredTrajectories = append(filteredTrajectories, traj)
 		}
 	}
@@ -855,3 +2117,185 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 	exp.Trajectories = filteredTrajectories
 	return filteredTrajectories
 }
+
+// mergePatients returns the union of two lists of patients.
+func mergePatients(ps1, ps2 []*Patient) []*Patient {
+	seen := map[*Patient]bool{}
+	result := []*Patient{}
+	for _, ps := range [][]*Patient{ps1, ps2} {
+		for _, p := range ps {
+			if !seen[p] {
+				seen[p] = true
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// DeduplicateTrajectories merges the trajectories with the same sequence of diagnoses into a single trajectory. For each
+// transition, the patients of the merged trajectory are the union of the patients of the duplicates, and the patient
+// numbers are updated accordingly. The first occurrence of each sequence is the canonical trajectory, and the order of
+// the trajectories is otherwise preserved.
+func DeduplicateTrajectories(trajectories []*Trajectory) []*Trajectory {
+	canonical := map[string]*Trajectory{}
+	result := []*Trajectory{}
+	for _, t := range trajectories {
+		key := trajectoryKey(t)
+		ct, ok := canonical[key]
+		if !ok {
+			canonical[key] = t
+			result = append(result, t)
+			continue
+		}
+		for i := range ct.Patients {
+			if i < len(t.Patients) {
+				ct.Patients[i] = mergePatients(ct.Patients[i], t.Patients[i])
+				ct.PatientNumbers[i] = len(ct.Patients[i])
+			}
+		}
+		for p, idx := range t.TrajMap {
+			if ct.TrajMap == nil {
+				ct.TrajMap = map[*Patient]int{}
+			}
+			if _, ok := ct.TrajMap[p]; !ok {
+				ct.TrajMap[p] = idx
+			}
+		}
+	}
+	if len(result) < len(trajectories) {
+		fmt.Println("Merged ", len(trajectories)-len(result), " duplicate trajectories.")
+	}
+	return result
+}
+
+// followsTrajectoryOrder checks if the given diagnosis IDs contain the diagnoses of a trajectory in order.
+func followsTrajectoryOrder(dids, diagnoses []int) bool {
+	i := 0
+	for _, did := range dids {
+		if did == diagnoses[i] {
+			i++
+			if i == len(diagnoses) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PermutationTestTrajectory assesses the significance of a trajectory as a whole. The candidate patients are the
+// patients of the experiment that have all diagnoses of the trajectory. Per permutation, the order of the diagnoses in
+// each candidate's record is randomly shuffled and the patients that still follow the trajectory are counted. It returns
+// the fraction of the nPerm permutations where this count equals or exceeds the observed count. Both counts only take
+// the order of the diagnoses into account, not the time constraints between them, so that they are comparable. The
+// experiment's DPatients must still be initialized. The permutations are drawn from a random stream derived from the
+// seed and the trajectory's diagnoses, cf. newTrajectoryRand, so that the p-value is reproducible for a given seed.
+func PermutationTestTrajectory(t *Trajectory, exp *Experiment, nPerm int, seed int64) float64 {
+	if nPerm <= 0 || len(t.Diagnoses) == 0 {
+		return 1
+	}
+	records := [][]int{}
+	for _, p := range exp.DPatients[t.Diagnoses[0]] {
+		dids := make([]int, len(p.Diagnoses))
+		has := map[int]bool{}
+		for i, diag := range p.Diagnoses {
+			dids[i] = diag.DID
+			has[diag.DID] = true
+		}
+		complete := true
+		for _, d := range t.Diagnoses {
+			if !has[d] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			records = append(records, dids)
+		}
+	}
+	observed := 0
+	for _, dids := range records {
+		if followsTrajectoryOrder(dids, t.Diagnoses) {
+			observed++
+		}
+	}
+	rng := newTrajectoryRand(seed, t)
+	exceeding := 0
+	for perm := 0; perm < nPerm; perm++ {
+		count := 0
+		for _, dids := range records {
+			rng.shuffle(dids)
+			if followsTrajectoryOrder(dids, t.Diagnoses) {
+				count++
+			}
+		}
+		if count >= observed {
+			exceeding++
+		}
+	}
+	return float64(exceeding) / float64(nPerm)
+}
+
+// DefaultAlpha is the default significance level for the permutation test of trajectories.
+const DefaultAlpha = 0.05
+
+// PermutationTestTrajectories computes the permutation p-values of the trajectories of an experiment in parallel, cf.
+// PermutationTestTrajectory, and marks the trajectories with a p-value below alpha as significant. Without a seed, a
+// seed is derived from the time and printed.
+func PermutationTestTrajectories(exp *Experiment, nPerm int, alpha float64, seed int64) {
+	fmt.Println("Testing the significance of ", len(exp.Trajectories), " trajectories with ", nPerm, " permutations...")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+		fmt.Println("Permuting the diagnoses with seed ", seed)
+	}
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for _, t := range exp.Trajectories[low:high] {
+			t.PermutationPValue = PermutationTestTrajectory(t, exp, nPerm, seed)
+			t.Permutations = nPerm
+			t.Significant = t.PermutationPValue < alpha
+		}
+	})
+	ctr := 0
+	for _, t := range exp.Trajectories {
+		if t.Significant {
+			ctr++
+		}
+	}
+	fmt.Println("Found ", ctr, " significant trajectories at alpha ", alpha)
+}
+
+// MeanRR computes the geometric mean of the RR scores of the transitions of a trajectory.
+func MeanRR(exp *Experiment, t *Trajectory) float64 {
+	logRR := 0.0
+	for i := 0; i < len(t.Diagnoses)-1; i++ {
+		logRR = logRR + math.Log(exp.DxDRR[t.Diagnoses[i]][t.Diagnoses[i+1]])
+	}
+	return math.Exp(logRR / float64(len(t.Diagnoses)-1))
+}
+
+// TrajectoryScore computes a composite score for ranking a trajectory: log(meanRR) * log(minPatients) * length, where
+// meanRR is the geometric mean of the RR scores of the trajectory's transitions, minPatients is the smallest number of
+// patients over its transitions, and length is its number of diagnoses.
+func TrajectoryScore(exp *Experiment, t *Trajectory) float64 {
+	logRR := math.Log(MeanRR(exp, t))
+	minPatients := t.PatientNumbers[0]
+	for _, n := range t.PatientNumbers {
+		minPatients = utils.MinInt(minPatients, n)
+	}
+	return logRR * math.Log(float64(minPatients)) * float64(len(t.Diagnoses))
+}
+
+// RankTrajectories sorts an experiment's trajectories by descending TrajectoryScore, and numbers them in that order.
+func RankTrajectories(exp *Experiment) []*Trajectory {
+	scores := map[*Trajectory]float64{}
+	for _, t := range exp.Trajectories {
+		scores[t] = TrajectoryScore(exp, t)
+	}
+	sort.SliceStable(exp.Trajectories, func(i, j int) bool {
+		return scores[exp.Trajectories[i]] > scores[exp.Trajectories[j]]
+	})
+	for i, t := range exp.Trajectories {
+		t.ID = i
+	}
+	return exp.Trajectories
+}
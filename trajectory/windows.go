@@ -0,0 +1,187 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Sliding time-window analysis
+
+// WindowResult contains the trajectories that are found within a time window. A diagnosis date d falls in the window if
+// Start <= d < End, with dates as calculated by DiagnosisDateToFloat. Dominant marks for each trajectory whether the
+// window is the one where the trajectory has the most patients of all windows.
+type WindowResult struct {
+	Start, End   float64
+	Trajectories []*Trajectory
+	Dominant     []bool
+}
+
+// DiagnosisYearRange returns the first and last year in which the patients are diagnosed.
+func DiagnosisYearRange(patients *PatientMap) (int, int) {
+	minYear, maxYear := 0, 0
+	first := true
+	for _, p := range patients.PIDMap {
+		for _, d := range p.Diagnoses {
+			if first || d.Date.Year < minYear {
+				minYear = d.Date.Year
+			}
+			if first || d.Date.Year > maxYear {
+				maxYear = d.Date.Year
+			}
+			first = false
+		}
+	}
+	return minYear, maxYear
+}
+
+// windowPatient returns a copy of a patient that only has the diagnoses within a time window.
+func windowPatient(p *Patient, start, end float64) *Patient {
+	newP := *p
+	newP.Diagnoses = []*Diagnosis{}
+	for _, d := range p.Diagnoses {
+		date := DiagnosisDateToFloat(d.Date)
+		if date >= start && date < end {
+			newP.Diagnoses = append(newP.Diagnoses, d)
+		}
+	}
+	return &newP
+}
+
+// windowExperiment returns a copy of an experiment for building trajectories within a time window. The RR scores are
+// shared with the given experiment, but the patients for each diagnosis pair are restricted to those that have both
+// diagnoses of the pair within the window. The patients only keep their diagnoses within the window, so that
+// trajectories cannot be extended with diagnoses outside the window.
+func windowExperiment(exp *Experiment, start, end, minTime, maxTime float64) *Experiment {
+	windowExp := *exp
+	windowExp.DxDPatients = MakeDxDPatients(exp.NofDiagnosisCodes)
+	windowExp.Pairs = nil
+	windowExp.Trajectories = nil
+	patients := map[*Patient]*Patient{}
+	for d1, ps := range exp.DxDPatients {
+		for d2, pairPatients := range ps {
+			for _, p := range pairPatients {
+				newP, ok := patients[p]
+				if !ok {
+					newP = windowPatient(p, start, end)
+					patients[p] = newP
+				}
+				if countPatientDiagnosis(newP, d1) == 0 {
+					continue
+				}
+				if ctr, _ := countPatientDiagnosisPair(newP, d1, d2, minTime, maxTime); ctr > 0 {
+					windowExp.DxDPatients[d1][d2] = append(windowExp.DxDPatients[d1][d2], newP)
+				}
+			}
+		}
+	}
+	return &windowExp
+}
+
+// trajectoryKey returns a string that identifies a trajectory by its diagnoses.
+func trajectoryKey(t *Trajectory) string {
+	return fmt.Sprint(t.Diagnoses)
+}
+
+// SlidingWindowAnalysis builds trajectories for overlapping time windows of windowSize years, each window starting
+// stepSize years after the previous one. The windows cover the years from minYear up to and including maxYear. The
+// trajectories are built as with BuildTrajectories, using the RR scores of the given experiment, but only from the
+// diagnoses that fall in each window. The given experiment is not modified.
+func SlidingWindowAnalysis(exp *Experiment, windowSize, stepSize float64, minYear, maxYear int, minPatients, maxLength,
+	minLength int, minTime, maxTime, minRR float64, filters []TrajectoryFilter) []*WindowResult {
+	if windowSize <= 0 || stepSize <= 0 {
+		panic(fmt.Sprint("Invalid sliding window size: ", windowSize, " or step: ", stepSize))
+	}
+	results := []*WindowResult{}
+	rangeEnd := float64(maxYear + 1)
+	for start := float64(minYear); start < rangeEnd; start = start + stepSize {
+		end := start + windowSize
+		if end > rangeEnd {
+			end = rangeEnd
+		}
+		fmt.Println("Building trajectories for window: ", start, " - ", end)
+		windowExp := windowExperiment(exp, start, end, minTime, maxTime)
+		trajectories := BuildTrajectories(windowExp, minPatients, maxLength, minLength, minTime, maxTime, minRR, filters)
+		results = append(results, &WindowResult{Start: start, End: end, Trajectories: trajectories,
+			Dominant: make([]bool, len(trajectories))})
+		if end == rangeEnd {
+			break
+		}
+	}
+	// mark for each trajectory the window with the most patients
+	type dominant struct{ window, index, patients int }
+	dominants := map[string]dominant{}
+	for w, result := range results {
+		for i, t := range result.Trajectories {
+			n := t.PatientNumbers[len(t.PatientNumbers)-1]
+			key := trajectoryKey(t)
+			if d, ok := dominants[key]; !ok || n > d.patients {
+				dominants[key] = dominant{window: w, index: i, patients: n}
+			}
+		}
+	}
+	for _, d := range dominants {
+		results[d.window].Dominant[d.index] = true
+	}
+	return results
+}
+
+// PrintWindowResultsToFile prints the trajectories of a sliding window analysis to a tab file. For each trajectory it
+// prints 3 lines:
+// - A line with the window boundaries and whether the trajectory is dominant in that window: Window: \tab start \tab end
+// \tab Dominant: \tab true/false.
+// - A list of medical terms for the diagnoses: term1 \tab term2 ...\tab termn.
+// - A list of patient numbers for the transitions between diagnosis pairs: nr1->2 \tab nr2->3 ...\tab nrn-1->n.
+func PrintWindowResultsToFile(exp *Experiment, results []*WindowResult, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, result := range results {
+		for i, t := range result.Trajectories {
+			fmt.Fprintf(file, "Window:\t%s\t%s\tDominant:\t%t\n", strconv.FormatFloat(result.Start, 'f', 2, 64),
+				strconv.FormatFloat(result.End, 'f', 2, 64), result.Dominant[i])
+			line := ""
+			for j, node := range t.Diagnoses {
+				if j < len(t.Diagnoses)-1 {
+					line = fmt.Sprintf("%s%s\t", line, exp.NameMap[node])
+				} else {
+					line = fmt.Sprintf("%s%s\n", line, exp.NameMap[node])
+				}
+			}
+			fmt.Fprint(file, line)
+			line = ""
+			for j, label := range t.PatientNumbers {
+				if j < len(t.PatientNumbers)-1 {
+					line = fmt.Sprintf("%s%d\t", line, label)
+				} else {
+					line = fmt.Sprintf("%s%d\n", line, label)
+				}
+			}
+			fmt.Fprint(file, line)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import "sort"
+
+// Multiple testing correction.
+
+// BenjaminiHochberg adjusts p-values for multiple testing with the Benjamini-Hochberg procedure, which controls the
+// false discovery rate. The adjusted p-value of the i-th smallest of m p-values is the minimum of p * m / j over its
+// j >= i, capped at 1. Selecting the hypotheses with an adjusted p-value <= alpha keeps the expected fraction of false
+// positives among them below alpha. The adjusted p-values are returned in the order of the given p-values.
+func BenjaminiHochberg(pvals []float64) []float64 {
+	m := len(pvals)
+	order := make([]int, m)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return pvals[order[i]] < pvals[order[j]]
+	})
+	adjusted := make([]float64, m)
+	min := 1.0
+	for rank := m; rank >= 1; rank-- {
+		i := order[rank-1]
+		if adj := pvals[i] * float64(m) / float64(rank); adj < min {
+			min = adj
+		}
+		adjusted[i] = min
+	}
+	return adjusted
+}
+
+// Bonferroni adjusts p-values for multiple testing with the Bonferroni correction, which controls the family-wise error
+// rate. The adjusted p-value is p * m for m p-values, capped at 1. It is more conservative than BenjaminiHochberg.
+func Bonferroni(pvals []float64) []float64 {
+	adjusted := make([]float64, len(pvals))
+	for i, p := range pvals {
+		adjusted[i] = p * float64(len(pvals))
+		if adjusted[i] > 1 {
+			adjusted[i] = 1
+		}
+	}
+	return adjusted
+}
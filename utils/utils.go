@@ -40,3 +40,12 @@ func MemberInt(x int, y []int) bool {
 	}
 	return false
 }
+
+func MemberString(x string, y []string) bool {
+	for _, el := range y {
+		if el == x {
+			return true
+		}
+	}
+	return false
+}